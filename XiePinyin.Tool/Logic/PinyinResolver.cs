@@ -10,6 +10,8 @@ namespace XiePinyin.Logic
         readonly Pinyin pinyin;
         readonly Dictionary<string, int> ranksSimp = new Dictionary<string, int>();
         readonly Dictionary<string, int> ranksTrad = new Dictionary<string, int>();
+        readonly Dictionary<string, long> countsSimp = new Dictionary<string, long>();
+        readonly Dictionary<string, long> countsTrad = new Dictionary<string, long>();
         readonly CharReadings charReadingsSimp;
         readonly CharReadings charReadingsTrad;
         readonly PolyDict polyDict;
@@ -51,6 +53,23 @@ namespace XiePinyin.Logic
             }
         }
 
+        /// <summary>
+        /// Writes character frequencies for ranking candidates: a character and its count per line, tab-separated.
+        /// </summary>
+        public void WriteFreqs(string fn, bool isSimp)
+        {
+            var counts = isSimp ? countsSimp : countsTrad;
+            var chars = new List<string>(counts.Keys);
+            chars.Sort((a, b) => counts[b].CompareTo(counts[a]));
+            using (StreamWriter sw = new StreamWriter(fn))
+            {
+                sw.NewLine = "\n";
+                sw.WriteLine("# character\tcount");
+                foreach (var chr in chars)
+                    sw.WriteLine(chr + "\t" + counts[chr]);
+            }
+        }
+
         public List<List<string>> Resolve(string pinyinInput, out List<string> pinyinSylls)
         {
             var res = new List<List<string>>();
@@ -97,8 +116,17 @@ namespace XiePinyin.Logic
                 {
                     if (line == "" || line.StartsWith("#")) continue;
                     var parts = line.Split('\t');
-                    if (isSimp) ranksSimp[parts[1]] = i;
-                    else ranksTrad[parts[0]] = i;
+                    // Jun Da's list has the rank first, then the character and its count
+                    int charIx = isSimp ? 1 : 0;
+                    string chr = parts[charIx];
+                    if (isSimp) ranksSimp[chr] = i;
+                    else ranksTrad[chr] = i;
+                    // Where the list has no count, estimate it from the rank
+                    long count;
+                    if (parts.Length <= charIx + 1 || !long.TryParse(parts[charIx + 1], out count))
+                        count = 10000000 / (i + 1);
+                    if (isSimp) countsSimp[chr] = count;
+                    else countsTrad[chr] = count;
                     ++i;
                 }
             }
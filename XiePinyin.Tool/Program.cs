@@ -12,6 +12,9 @@ namespace XiePinyin
             var resolver = new PinyinResolver("_sources");
             resolver.WriteMap("XiePinyin/wwwroot/simp-map.json", true);
             resolver.WriteMap("XiePinyin/wwwroot/trad-map.json", false);
+            // Frequencies for ranking candidates; the server ranks everything equally without them
+            resolver.WriteFreqs("XiePinyin/wwwroot/simp-freq.txt", true);
+            resolver.WriteFreqs("XiePinyin/wwwroot/trad-freq.txt", false);
         }
     }
 }
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+	"xiep/internal/docx"
+	"xiep/internal/logic"
+)
+
+// Folder with the character maps, relative to the working directory, like for the server.
+const composerDataDir = "./static"
+
+// Runs a maintenance command instead of the server. Returns the process's exit code.
+func runCommand(args []string) int {
+	switch args[0] {
+	case "migrate":
+		return cmdMigrate(args[1:])
+	case "backup":
+		return cmdBackup(args[1:])
+	case "restore":
+		return cmdRestore(args[1:])
+	case "export":
+		return cmdExport(args[1:])
+	case "import":
+		return cmdImport(args[1:])
+	case "list":
+		return cmdList(args[1:])
+	case "validate":
+		return cmdValidate(args[1:])
+	case "stats":
+		return cmdStats(args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command: %v\n", args[0])
+		fmt.Fprintf(os.Stderr, "Commands: list, stats, validate, export, import, backup, restore, migrate\n")
+		return 2
+	}
+}
+
+// Opens the configured document store, or prints the error and returns nil.
+func openStore() logic.DocumentStore {
+	store, err := logic.NewDocumentStore(config.DocStore, &config, xlog)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open document store: %v\n", err)
+		return nil
+	}
+	return store
+}
+
+// Copies all documents from one kind of store to another in DocsFolder, e.g.: xiep migrate files bolt
+// The server must not be running.
+func cmdMigrate(args []string) int {
+	if len(args) != 2 || args[0] == args[1] {
+		fmt.Fprintf(os.Stderr, "Usage: xiep migrate <%v|%v> <%v|%v>\n",
+			logic.DocStoreFiles, logic.DocStoreBolt, logic.DocStoreFiles, logic.DocStoreBolt)
+		return 2
+	}
+	from, err := logic.NewDocumentStore(args[0], &config, xlog)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open source store: %v\n", err)
+		return 1
+	}
+	defer from.Close()
+	to, err := logic.NewDocumentStore(args[1], &config, xlog)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open target store: %v\n", err)
+		return 1
+	}
+	defer to.Close()
+	count, err := logic.MigrateDocuments(from, to)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Migration failed after %v documents: %v\n", count, err)
+		return 1
+	}
+	fmt.Printf("Migrated %v documents from %v to %v.\n", count, args[0], args[1])
+	if trashed, err := from.ListTrash(); err == nil && len(trashed) != 0 {
+		fmt.Printf("%v documents in the trash were not migrated; restore them first to keep them.\n", len(trashed))
+	}
+	if args[1] != config.DocStore && !(args[1] == logic.DocStoreFiles && config.DocStore == "") {
+		fmt.Printf("Set \"docStore\": \"%v\" in the config to use the new store.\n", args[1])
+	}
+	return 0
+}
+
+// Takes a snapshot of all documents, e.g.: xiep backup [folder]
+// Snapshot goes into the configured BackupsFolder unless a folder is provided.
+func cmdBackup(args []string) int {
+	folder := config.BackupsFolder
+	if len(args) == 1 {
+		folder = args[0]
+	}
+	if len(args) > 1 || folder == "" {
+		fmt.Fprintf(os.Stderr, "Usage: xiep backup [folder]\nFolder is required if BackupsFolder is not configured.\n")
+		return 2
+	}
+	store := openStore()
+	if store == nil {
+		return 1
+	}
+	defer store.Close()
+	fileName, count, err := logic.SnapshotDocuments(store, folder, time.Now().UTC())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Backup failed: %v\n", err)
+		return 1
+	}
+	fmt.Printf("Saved %v documents to %v.\n", count, fileName)
+	return 0
+}
+
+// Restores all documents, or just one, from a snapshot, e.g.: xiep restore <archive> [docId]
+// The server must not be running.
+func cmdRestore(args []string) int {
+	if len(args) < 1 || len(args) > 2 {
+		fmt.Fprintf(os.Stderr, "Usage: xiep restore <archive> [docId]\n")
+		return 2
+	}
+	docId := ""
+	if len(args) == 2 {
+		docId = args[1]
+	}
+	store := openStore()
+	if store == nil {
+		return 1
+	}
+	defer store.Close()
+	count, err := logic.RestoreSnapshot(store, args[0], docId)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Restore failed after %v documents: %v\n", count, err)
+		return 1
+	}
+	fmt.Printf("Restored %v documents from %v.\n", count, args[0])
+	return 0
+}
+
+// Exports a document as DOCX, HTML or text, depending on the output file's extension, e.g.:
+// xiep export -o story.docx [-roman zhuyin] [-sandhi show] <docId|doc.json>
+func cmdExport(args []string) int {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	outFileName := fs.String("o", "", "output file: .docx, .html or .txt")
+	roman := fs.String("roman", docx.RomanPinyin, "reading shown for Hanzi: pinyin, zhuyin, wadegiles, gwoyeu or ipa")
+	sandhi := fs.String("sandhi", docx.SandhiNone, "tone sandhi: show changed tones, or mark syllables whose tone changes")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 1 || *outFileName == "" ||
+		!docx.IsRomanization(*roman) || !docx.IsSandhiMode(*sandhi) {
+		fmt.Fprintf(os.Stderr, "Usage: xiep export -o <file.docx|file.html|file.txt> [-roman <romanization>] [-sandhi show|mark] <docId|doc.json>\n")
+		return 2
+	}
+	opts := docx.Options{Romanization: *roman, Sandhi: *sandhi}
+	store := openStore()
+	if store == nil {
+		return 1
+	}
+	defer store.Close()
+	content, err := logic.LoadDocContent(store, fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load document: %v\n", err)
+		return 1
+	}
+	composer := logic.LoadComposer(composerDataDir, xlog)
+	switch strings.ToLower(path.Ext(*outFileName)) {
+	case ".docx":
+		err = docx.Export(content.Text, *outFileName, composer, opts)
+	case ".html", ".htm":
+		err = docx.ExportHtml(content.Text, content.Name, *outFileName, composer, opts)
+	case ".txt":
+		err = docx.ExportText(content.Text, *outFileName, composer, opts)
+	default:
+		fmt.Fprintf(os.Stderr, "Unsupported output format: %v\n", *outFileName)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Export failed: %v\n", err)
+		return 1
+	}
+	fmt.Printf("Exported %v (%v) to %v.\n", content.DocId, content.Name, *outFileName)
+	return 0
+}
+
+// Creates a document from a UTF-8 text file, adding pinyin to Hanzi, e.g.:
+// xiep import -name "Story" [-trad] story.txt
+func cmdImport(args []string) int {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	name := fs.String("name", "", "document name; file name if empty")
+	isTrad := fs.Bool("trad", false, "text is in traditional characters")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "Usage: xiep import [-name <name>] [-trad] <file.txt>\n")
+		return 2
+	}
+	data, err := ioutil.ReadFile(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read input: %v\n", err)
+		return 1
+	}
+	if *name == "" {
+		*name = strings.TrimSuffix(path.Base(fs.Arg(0)), path.Ext(fs.Arg(0)))
+	}
+	store := openStore()
+	if store == nil {
+		return 1
+	}
+	defer store.Close()
+	text := logic.LoadComposer(composerDataDir, xlog).Annotate(string(data), !*isTrad)
+	docId, err := logic.ImportDocument(store, *name, text)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Import failed: %v\n", err)
+		return 1
+	}
+	fmt.Printf("Imported %v characters as %v.\n", len(text), docId)
+	return 0
+}
+
+// Gets the IDs of all documents in the store, sorted; prints the error and returns nil on failure.
+func listDocIds(store logic.DocumentStore) []string {
+	docIds, err := store.List()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to list documents: %v\n", err)
+		return nil
+	}
+	sort.Strings(docIds)
+	return docIds
+}
+
+// Lists all documents with their names and sizes, e.g.: xiep list
+func cmdList(args []string) int {
+	if len(args) != 0 {
+		fmt.Fprintf(os.Stderr, "Usage: xiep list\n")
+		return 2
+	}
+	store := openStore()
+	if store == nil {
+		return 1
+	}
+	defer store.Close()
+	docIds := listDocIds(store)
+	if docIds == nil {
+		return 1
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tCHARS\tREVISION\tNAME")
+	for _, docId := range docIds {
+		if stats, err := logic.GetDocStats(store, docId); err != nil {
+			fmt.Fprintf(tw, "%v\t\t\t(%v)\n", docId, err)
+		} else {
+			fmt.Fprintf(tw, "%v\t%v\t%v\t%v\n", docId, stats.Chars, stats.RevisionId, stats.Name)
+		}
+	}
+	tw.Flush()
+	return 0
+}
+
+// Checks that all documents load and their revision logs are valid, e.g.: xiep validate
+// Exits with 1 if any problems are found.
+func cmdValidate(args []string) int {
+	if len(args) != 0 {
+		fmt.Fprintf(os.Stderr, "Usage: xiep validate\n")
+		return 2
+	}
+	store := openStore()
+	if store == nil {
+		return 1
+	}
+	defer store.Close()
+	docIds := listDocIds(store)
+	if docIds == nil {
+		return 1
+	}
+	badDocs := 0
+	for _, docId := range docIds {
+		problems := logic.ValidateDocument(store, docId)
+		if len(problems) != 0 {
+			badDocs++
+		}
+		for _, problem := range problems {
+			fmt.Printf("%v: %v\n", docId, problem)
+		}
+	}
+	fmt.Printf("Checked %v documents, %v with problems.\n", len(docIds), badDocs)
+	if badDocs != 0 {
+		return 1
+	}
+	return 0
+}
+
+// Prints totals for all documents in the store, e.g.: xiep stats
+func cmdStats(args []string) int {
+	if len(args) != 0 {
+		fmt.Fprintf(os.Stderr, "Usage: xiep stats\n")
+		return 2
+	}
+	store := openStore()
+	if store == nil {
+		return 1
+	}
+	defer store.Close()
+	docIds := listDocIds(store)
+	if docIds == nil {
+		return 1
+	}
+	var total logic.DocStats
+	failed := 0
+	for _, docId := range docIds {
+		stats, err := logic.GetDocStats(store, docId)
+		if err != nil {
+			failed++
+			continue
+		}
+		total.Chars += stats.Chars
+		total.Hanzi += stats.Hanzi
+		total.Paragraphs += stats.Paragraphs
+		total.Revisions += stats.Revisions
+	}
+	trashed, err := store.ListTrash()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to list trash: %v\n", err)
+		return 1
+	}
+	fmt.Printf("Documents:        %v\n", len(docIds))
+	fmt.Printf("Failed to load:   %v\n", failed)
+	fmt.Printf("In trash:         %v\n", len(trashed))
+	fmt.Printf("Characters:       %v\n", total.Chars)
+	fmt.Printf("Hanzi:            %v\n", total.Hanzi)
+	fmt.Printf("Paragraphs:       %v\n", total.Paragraphs)
+	fmt.Printf("Logged revisions: %v\n", total.Revisions)
+	return 0
+}
@@ -3,7 +3,9 @@ module xiep
 go 1.16
 
 require (
+	github.com/fxamacker/cbor/v2 v2.4.0
 	github.com/gin-gonic/contrib v0.0.0-20201101042839-6a891bf89f19
 	github.com/gin-gonic/gin v1.7.3
 	github.com/gorilla/websocket v1.4.2
+	go.etcd.io/bbolt v1.3.6
 )
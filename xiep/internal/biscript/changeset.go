@@ -164,6 +164,11 @@ func (cs *ChangeSet) DeserializeJSON(jsonStr string) error {
 	return nil
 }
 
+// Implements json.Unmarshaler, so change sets can be embedded in other JSON-serialized types.
+func (cs *ChangeSet) UnmarshalJSON(data []byte) error {
+	return cs.DeserializeJSON(string(data))
+}
+
 // Applies the change set to a biscriptal text.
 func (cs *ChangeSet) Apply(text []XieChar) []XieChar {
 	if cs.LengthBefore != (uint)(len(text)) {
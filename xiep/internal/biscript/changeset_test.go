@@ -1,6 +1,7 @@
 package biscript
 
 import (
+	"encoding/json"
 	"testing"
 )
 
@@ -88,6 +89,22 @@ func TestChangeSet_UnmarshalJSON(t *testing.T) {
 	}
 }
 
+func TestChangeSet_UnmarshalEmbedded(t *testing.T) {
+	var val struct {
+		Change *ChangeSet `json:"change"`
+	}
+	jsonStr := `{"change":{"lengthBefore":2,"lengthAfter":2,"items":[1,{"hanzi":"Z"}]}}`
+	if err := json.Unmarshal([]byte(jsonStr), &val); err != nil {
+		t.Fatalf("Failed to unmarshal JSON: %v; error: %v", jsonStr, err)
+	}
+	if val.Change == nil || val.Change.ToDiagStr() != "2>1,Z" {
+		t.Errorf("JSON not parsed correctly: %v", jsonStr)
+	}
+	if err := json.Unmarshal([]byte(`{"change":{"lengthBefore":1,"items":[1]}}`), &val); err == nil {
+		t.Errorf("Invalid change set accepted")
+	}
+}
+
 func TestChangeSet_Apply(t *testing.T) {
 	vals := [][]string{
 		{"X", "1>0", "X"},
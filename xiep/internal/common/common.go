@@ -4,28 +4,48 @@ package common
 type Config struct {
 	SourcesFolder           string
 	DocsFolder              string
+	DocStore                string // "files" (default) or "bolt": how documents are kept in DocsFolder
+	DocBackups              int    // Previous versions of each document kept by the "files" store; 3 if zero, none if negative
+	TrashRetentionDays      int    // Deleted documents are purged from the trash after this many days; 30 if zero
+	BackupsFolder           string // Where scheduled snapshots of all documents go; no scheduled backups if empty
+	BackupIntervalMinutes   int    // Time between scheduled snapshots; 60 if zero
+	BackupKeepLatest        int    // Number of newest snapshots always kept; 24 if zero
+	BackupKeepDays          int    // The last snapshot of each day is kept for this many days; 30 if zero
 	ExportsFolder           string
 	SecretsFile             string
 	LogFile                 string
 	ServicePort             uint
 	BaseUrl                 string
-	WebSocketAllowedOrigin  string
+	WebSocketAllowedOrigin  string            // Deprecated: single allowed origin; merged into WebSocketAllowedOrigins
+	WebSocketAllowedOrigins []string          // Hosts (e.g., "localhost:1313") or full origins allowed to open the socket
+	SlowPeerPolicy          string            // "resync" (default) or "disconnect": what to do with peers that can't keep up
+	InstanceId              string            // Identifies this instance when several share the same documents; random if empty
+	ClusterPeers            map[string]string // Instance IDs and base URLs of all instances sharing the documents, this one too; alone if empty
+	ClusterSecret           string            // Key that instances in the cluster present to each other
+	ClusterLeaseHolder      string            // ID of the instance that keeps track of which instance owns each document
 	DebugHacks              bool
 }
 
 const (
-	EnvVarName          = "XIE_ENV"                  // Set to "prod" in production system
-	ConfigVarName       = "CONFIG"                   // If set, will load confi.json from this path and not from DevConfigPath
-	DevConfigPath       = "../config.dev.json"       // Path to config.json in development environment
-	VersionFileName     = "version.txt"              // Name of option file with app's version, next to executable
-	LogSrcApp           = "Xie"                      // Source name for app-level log entries
-	LogSrcOrchestrator  = "Orchestrator"             // Source name for log entries by orchestrator
-	LogSrcSocketHandler = "SocketHandler"            // Source name for log enries by socket handler
-	AuthCookieName      = "xiepauth"                 // Name of authentication (login) cookie sent to client
-	LoginTimeoutMinutes = 60 * 72                    // Expiry of login
-	Iso8601Layout       = "2006-01-02T15:04:05.999Z" // Format string for ISO8601 timestamps (used in auth cookie)
-	SessionIdKey        = "sessionId"                // Key in Gin context for storing session ID
-	ShutdownWaitMsec    = 1000                       // Wait max this long for background threads to finish in graceful shutdown
+	EnvVarName              = "XIE_ENV"                  // Set to "prod" in production system
+	ConfigVarName           = "CONFIG"                   // If set, will load confi.json from this path and not from DevConfigPath
+	DevConfigPath           = "../config.dev.json"       // Path to config.json in development environment
+	VersionFileName         = "version.txt"              // Name of option file with app's version, next to executable
+	LogSrcApp               = "Xie"                      // Source name for app-level log entries
+	LogSrcOrchestrator      = "Orchestrator"             // Source name for log entries by orchestrator
+	LogSrcSocketHandler     = "SocketHandler"            // Source name for log enries by socket handler
+	LogSrcConnectionManager = "ConnectionManager"        // Source name for log entries by connection manager
+	LogSrcCluster           = "Cluster"                  // Source name for log entries about communication between instances
+	LogSrcDocStore          = "DocStore"                 // Source name for log entries by document store
+	LogSrcBackup            = "Backup"                   // Source name for log entries about scheduled backups
+	LogSrcComposer          = "Composer"                 // Source name for log entries by composer
+	AuthCookieName          = "xiepauth"                 // Name of authentication (login) cookie sent to client
+	LoginTimeoutMinutes     = 60 * 72                    // Expiry of login
+	Iso8601Layout           = "2006-01-02T15:04:05.999Z" // Format string for ISO8601 timestamps (used in auth cookie)
+	SessionIdKey            = "sessionId"                // Key in Gin context for storing session ID
+	SocketTicketParam       = "ticket"                   // Query parameter of the socket upgrade with a single-use ticket instead of the cookie
+	SocketTicketSeconds     = 30                         // Socket tickets must be used within this time
+	ShutdownWaitMsec        = 1000                       // Wait max this long for background threads to finish in graceful shutdown
 )
 
 // Defines what a logger looks like for this app.
@@ -21,6 +21,9 @@ var skPara string
 //go:embed skeleton-rubyword.xml
 var skRubyWord string
 
+//go:embed skeleton-rubypinyin.xml
+var skRubyPinyin string
+
 //go:embed skeleton-text.xml
 var skText string
 
@@ -31,13 +34,37 @@ var skStyles string
 var efs embed.FS
 
 type pinyiner interface {
-	PinyinNumsToSurf(pyNums string) string
+	PinyinSyllsToRoman(sylls []string, roman string) []string
+}
+
+// Romanizations in which exports can show the reading of Hanzi
+const (
+	RomanPinyin    = "pinyin"    // Hanyu Pinyin with tone marks; the default
+	RomanZhuyin    = "zhuyin"    // Zhuyin (Bopomofo)
+	RomanWadeGiles = "wadegiles" // Wade-Giles with superscript tone numbers
+	RomanGwoyeu    = "gwoyeu"    // Gwoyeu Romatzyh, with tones spelled in letters
+	RomanIpa       = "ipa"       // IPA with Chao tone letters
+)
+
+// Checks if roman is one of the Roman* constants.
+func IsRomanization(roman string) bool {
+	switch roman {
+	case RomanPinyin, RomanZhuyin, RomanWadeGiles, RomanGwoyeu, RomanIpa:
+		return true
+	}
+	return false
+}
+
+// Settings of an export. The zero value exports with the defaults.
+type Options struct {
+	Romanization string `json:"romanization,omitempty"` // One of the Roman* constants; pinyin if empty
+	Sandhi       string `json:"sandhi,omitempty"`       // One of the Sandhi* constants
 }
 
 // Exports the received text as a DOCX file, saved as fname.
-func Export(text []biscript.XieChar, fname string, pinyiner pinyiner) error {
+func Export(text []biscript.XieChar, fname string, pinyiner pinyiner, opts Options) error {
 	paras := textToParas(text)
-	docXml := makeDocXml(paras, pinyiner)
+	docXml := makeDocXml(paras, pinyiner, opts)
 	return makeZip(fname, docXml)
 }
 
@@ -119,6 +146,11 @@ func readZipFile(zf *zip.File) ([]byte, error) {
 type biWord struct {
 	hanzi  string
 	pinyin string
+	// In biscriptal words: each character's Hanzi and pinyin, as numbered pinyin until makeWords converts it
+	chars []string
+	sylls []string
+	// Whether each syllable's tone changes in sandhi, if syllables are marked
+	sandhi []bool
 }
 
 func (w biWord) isEmpty() bool {
@@ -137,7 +169,7 @@ func isNonEmptyWS(str string) bool {
 	return true
 }
 
-func makeWords(para []biscript.XieChar, pinyiner pinyiner) []biWord {
+func makeWords(para []biscript.XieChar, pinyiner pinyiner, opts Options) []biWord {
 	var res []biWord
 	if len(para) == 0 {
 		return res
@@ -152,6 +184,10 @@ func makeWords(para []biscript.XieChar, pinyiner pinyiner) []biWord {
 				goto wordOver
 			}
 			word.pinyin += " "
+			if !inAlpha {
+				word.chars = append(word.chars, para[ix].Hanzi)
+				word.sylls = append(word.sylls, " ")
+			}
 			ix++
 		}
 		if !word.isEmpty() {
@@ -166,6 +202,8 @@ func makeWords(para []biscript.XieChar, pinyiner pinyiner) []biWord {
 			if !inAlpha {
 				word.hanzi += para[ix].Hanzi
 				word.pinyin += para[ix].Pinyin
+				word.chars = append(word.chars, para[ix].Hanzi)
+				word.sylls = append(word.sylls, para[ix].Pinyin)
 			} else {
 				word.pinyin += para[ix].Hanzi
 			}
@@ -176,6 +214,10 @@ func makeWords(para []biscript.XieChar, pinyiner pinyiner) []biWord {
 				goto wordOver
 			}
 			word.pinyin += " "
+			if !inAlpha {
+				word.chars = append(word.chars, para[ix].Hanzi)
+				word.sylls = append(word.sylls, " ")
+			}
 			ix++
 		}
 		res = append(res, word)
@@ -188,12 +230,18 @@ func makeWords(para []biscript.XieChar, pinyiner pinyiner) []biWord {
 		word = biWord{}
 		inAlpha = !inAlpha
 	}
-	// Convert Pinyin in biscriptal words to pretty accents
+	// Convert Pinyin in biscriptal words to pretty accents, or to the chosen romanization, with sandhi if requested
 	for ix, w := range res {
 		if w.pinyin == "" || w.hanzi == "" {
 			continue
 		}
-		res[ix].pinyin = pinyiner.PinyinNumsToSurf(w.pinyin)
+		if opts.Sandhi == SandhiShow {
+			res[ix].sylls, _ = applySandhi(w.chars, w.sylls)
+		} else if opts.Sandhi == SandhiMark {
+			_, res[ix].sandhi = applySandhi(w.chars, w.sylls)
+		}
+		res[ix].sylls = pinyiner.PinyinSyllsToRoman(res[ix].sylls, opts.Romanization)
+		res[ix].pinyin = strings.Join(res[ix].sylls, "")
 	}
 	// Done
 	return res
@@ -216,25 +264,51 @@ func esc(str string) string {
 	return sb.String()
 }
 
-func makeParaXml(para []biscript.XieChar, pinyiner pinyiner) string {
-	words := makeWords(para, pinyiner)
+func makeParaXml(para []biscript.XieChar, pinyiner pinyiner, opts Options) string {
+	words := makeWords(para, pinyiner, opts)
 	var sb strings.Builder
 	for _, w := range words {
 		if w.hanzi == "" {
 			sb.WriteString(strings.ReplaceAll(skText, "<!-- TEXT -->", esc(w.pinyin)))
 		} else {
 			txt := strings.ReplaceAll(skRubyWord, "<!-- HANZI -->", esc(w.hanzi))
-			txt = strings.ReplaceAll(txt, "<!-- PINYIN -->", esc(w.pinyin))
+			txt = strings.ReplaceAll(txt, "<!-- PINYIN -->", makeRubyPinyinXml(w))
 			sb.WriteString(txt)
 		}
 	}
 	return sb.String()
 }
 
-func makeDocXml(paras [][]biscript.XieChar, pinyiner pinyiner) string {
+// Makes the runs with a biscriptal word's pinyin: one for each stretch of syllables that are all marked for sandhi,
+// or all not marked.
+func makeRubyPinyinXml(w biWord) string {
+	var sb strings.Builder
+	writeRun := func(pinyin string, marked bool) {
+		style := ""
+		if marked {
+			style = `<w:rStyle w:val="Sandhi"/>`
+		}
+		txt := strings.ReplaceAll(skRubyPinyin, "<!-- STYLE -->", style)
+		sb.WriteString(strings.ReplaceAll(txt, "<!-- PINYIN -->", esc(pinyin)))
+	}
+	if w.sandhi == nil {
+		writeRun(w.pinyin, false)
+		return sb.String()
+	}
+	start := 0
+	for i := 1; i <= len(w.sylls); i++ {
+		if i == len(w.sylls) || w.sandhi[i] != w.sandhi[start] {
+			writeRun(strings.Join(w.sylls[start:i], ""), w.sandhi[start])
+			start = i
+		}
+	}
+	return sb.String()
+}
+
+func makeDocXml(paras [][]biscript.XieChar, pinyiner pinyiner, opts Options) string {
 	var sb strings.Builder
 	for _, para := range paras {
-		textStr := makeParaXml(para, pinyiner)
+		textStr := makeParaXml(para, pinyiner, opts)
 		paraStr := skPara
 		paraStr = strings.ReplaceAll(paraStr, "<!-- TEXT -->", textStr)
 		sb.WriteString(paraStr)
@@ -0,0 +1,98 @@
+package docx
+
+import (
+	"archive/zip"
+	"io/ioutil"
+	"path"
+	"strings"
+	"testing"
+	"xiep/internal/biscript"
+)
+
+// Pinyiner that keeps numbered pinyin, and tags syllables with the romanization if it's not pinyin.
+type fakePinyiner struct{}
+
+func (fakePinyiner) PinyinSyllsToRoman(sylls []string, roman string) []string {
+	res := make([]string, len(sylls))
+	for i, syll := range sylls {
+		if roman == RomanPinyin || roman == "" || strings.TrimSpace(syll) == "" {
+			res[i] = syll
+		} else {
+			res[i] = roman + "(" + syll + ")"
+		}
+	}
+	return res
+}
+
+func TestExportRomanization(t *testing.T) {
+	text := []biscript.XieChar{
+		{Hanzi: "北", Pinyin: "Bei3"}, {Hanzi: "京", Pinyin: "jing1"}, {Hanzi: " "},
+		{Hanzi: "你", Pinyin: "ni3"}, {Hanzi: "好", Pinyin: "hao3"}, {Hanzi: "!"},
+	}
+	vals := []struct {
+		fileName string
+		opts     Options
+		contains string
+	}{
+		{"pinyin.txt", Options{}, "Bei3jing1 ni3hao3!"},
+		{"zhuyin.txt", Options{Romanization: RomanZhuyin}, "zhuyin(Bei3)zhuyin(jing1) zhuyin(ni3)zhuyin(hao3)!"},
+		{"sandhi.txt", Options{Romanization: RomanZhuyin, Sandhi: SandhiShow}, "zhuyin(ni2)zhuyin(hao3)"},
+		{"ipa.html", Options{Romanization: RomanIpa}, "<ruby>北京<rt>ipa(Bei3)ipa(jing1)</rt></ruby>"},
+		{"marked.html", Options{Romanization: RomanGwoyeu, Sandhi: SandhiMark},
+			`<span class="sandhi">gwoyeu(ni3)</span>gwoyeu(hao3)`},
+		{"wadegiles.docx", Options{Romanization: RomanWadeGiles}, "wadegiles(Bei3)wadegiles(jing1)"},
+	}
+	for _, val := range vals {
+		fileName := path.Join(t.TempDir(), val.fileName)
+		content := exportAndRead(t, text, fileName, val.opts)
+		if !strings.Contains(content, val.contains) {
+			t.Errorf("Export to %v does not contain %v:\n%v", val.fileName, val.contains, content)
+		}
+	}
+}
+
+// Exports text with fakePinyiner in the format given by fileName's extension, and returns the exported content;
+// for DOCX, the document XML.
+func exportAndRead(t *testing.T, text []biscript.XieChar, fileName string, opts Options) string {
+	var err error
+	switch path.Ext(fileName) {
+	case ".txt":
+		err = ExportText(text, fileName, fakePinyiner{}, opts)
+	case ".html":
+		err = ExportHtml(text, "Test", fileName, fakePinyiner{}, opts)
+	default:
+		err = Export(text, fileName, fakePinyiner{}, opts)
+	}
+	if err != nil {
+		t.Fatalf("Export to %v failed: %v", fileName, err)
+	}
+	if path.Ext(fileName) != ".docx" {
+		data, err := ioutil.ReadFile(fileName)
+		if err != nil {
+			t.Fatalf("Failed to read %v: %v", fileName, err)
+		}
+		return string(data)
+	}
+	zr, err := zip.OpenReader(fileName)
+	if err != nil {
+		t.Fatalf("Failed to open %v: %v", fileName, err)
+	}
+	defer zr.Close()
+	for _, f := range zr.File {
+		if f.Name != "word/document.xml" {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatalf("Failed to open document XML: %v", err)
+		}
+		data, err := ioutil.ReadAll(rc)
+		_ = rc.Close()
+		if err != nil {
+			t.Fatalf("Failed to read document XML: %v", err)
+		}
+		return string(data)
+	}
+	t.Fatalf("No document XML in %v", fileName)
+	return ""
+}
@@ -0,0 +1,71 @@
+package docx
+
+import (
+	"strings"
+)
+
+// How exports show tone sandhi
+const (
+	SandhiNone = ""     // Citation tones, as in the document; the default
+	SandhiShow = "show" // Tones as they are pronounced after sandhi
+	SandhiMark = "mark" // Citation tones, with the syllables whose tone changes in a distinct style
+)
+
+// Checks if sandhi is one of the Sandhi* constants.
+func IsSandhiMode(sandhi string) bool {
+	return sandhi == SandhiNone || sandhi == SandhiShow || sandhi == SandhiMark
+}
+
+// Numerals after which 一 keeps its tone, and before which it does so too, like in 十一 or 一二三
+const sandhiNumerals = "零一二三四五六七八九十"
+
+// Applies standard Mandarin tone sandhi to the numbered pinyin of each character in a word.
+// Returns the pinyin with the changed tones, and whether each syllable's tone changed.
+//   - 一 is read yi2 before a fourth tone and yi4 before other tones, except at the end of the word,
+//     after 第 and next to numerals
+//   - 不 is read bu2 before a fourth tone
+//   - In a run of third tones, all but the last are read in the second tone
+func applySandhi(hanzi []string, sylls []string) (res []string, changed []bool) {
+	res = make([]string, len(sylls))
+	copy(res, sylls)
+	changed = make([]bool, len(sylls))
+	setTone := func(ix int, tone byte) {
+		if getTone(sylls[ix]) != tone {
+			res[ix] = strings.TrimRight(sylls[ix], "12345") + string(tone)
+			changed[ix] = true
+		}
+	}
+	for i := range sylls {
+		toneless := strings.ToLower(strings.TrimRight(sylls[i], "12345"))
+		// Nothing changes before the neutral tone
+		if i == len(sylls)-1 || getTone(sylls[i+1]) == 0 || getTone(sylls[i+1]) == '5' {
+			continue
+		}
+		next := getTone(sylls[i+1])
+		switch {
+		case hanzi[i] == "一" && toneless == "yi":
+			if i > 0 && (hanzi[i-1] == "第" || strings.Contains(sandhiNumerals, hanzi[i-1])) ||
+				strings.Contains(sandhiNumerals, hanzi[i+1]) {
+				continue
+			}
+			if next == '4' {
+				setTone(i, '2')
+			} else {
+				setTone(i, '4')
+			}
+		case hanzi[i] == "不" && toneless == "bu" && next == '4':
+			setTone(i, '2')
+		case getTone(sylls[i]) == '3' && next == '3':
+			setTone(i, '2')
+		}
+	}
+	return
+}
+
+// Gets the tone digit of a numbered pinyin syllable, or 0 if it has none.
+func getTone(syll string) byte {
+	if syll != "" && syll[len(syll)-1] >= '1' && syll[len(syll)-1] <= '5' {
+		return syll[len(syll)-1]
+	}
+	return 0
+}
@@ -0,0 +1,122 @@
+package docx
+
+import (
+	"path"
+	"strings"
+	"testing"
+	"xiep/internal/biscript"
+)
+
+func TestApplySandhi(t *testing.T) {
+	vals := []struct {
+		hanzi   string // One character per syllable
+		sylls   string // Separated by |, so that " " can be a syllable
+		res     string
+		changed string // Changed syllables marked with x
+	}{
+		// Third tones
+		{"你好", "ni3|hao3", "ni2|hao3", "x."},
+		{"我很好", "wo3|hen3|hao3", "wo2|hen2|hao3", "xx."},
+		{"展览馆", "zhan3|lan3|guan3", "zhan2|lan2|guan3", "xx."},
+		{"姐姐", "jie3|jie", "jie3|jie", ".."},
+		{"好的", "hao3|de5", "hao3|de5", ".."},
+		{"有人", "you3|ren2", "you3|ren2", ".."},
+		// 一
+		{"一个", "yi1|ge4", "yi2|ge4", "x."},
+		{"一天", "yi1|tian1", "yi4|tian1", "x."},
+		{"一起", "yi1|qi3", "yi4|qi3", "x."},
+		{"一百", "yi1|bai3", "yi4|bai3", "x."},
+		{"一下", "yi1|xia5", "yi1|xia5", ".."},
+		{"统一", "tong3|yi1", "tong3|yi1", ".."},
+		{"一二三", "yi1|er4|san1", "yi1|er4|san1", "..."},
+		{"十一月", "shi2|yi1|yue4", "shi2|yi1|yue4", "..."},
+		{"一九", "yi1|jiu3", "yi1|jiu3", ".."},
+		{"第一天", "di4|yi1|tian1", "di4|yi1|tian1", "..."},
+		{"一个", "yi2|ge4", "yi2|ge4", ".."},
+		// 不
+		{"不是", "bu4|shi4", "bu2|shi4", "x."},
+		{"不好", "bu4|hao3", "bu4|hao3", ".."},
+		{"不", "bu4", "bu4", "."},
+		// Spaces between words, as makeWords adds them: sandhi stops at the end of the word
+		{"你好 ", "ni3|hao3| ", "ni2|hao3| ", "x.."},
+		{"你 好", "ni3| |hao3", "ni3| |hao3", "..."},
+		{"一 ", "yi1| ", "yi1| ", ".."},
+		{"不 是", "bu4| |shi4", "bu4| |shi4", "..."},
+		// Upper case syllables keep their case
+		{"你好", "Ni3|hao3", "Ni2|hao3", "x."},
+	}
+	for _, val := range vals {
+		hanzi := strings.Split(val.hanzi, "")
+		res, changed := applySandhi(hanzi, strings.Split(val.sylls, "|"))
+		var sbChanged strings.Builder
+		for _, c := range changed {
+			if c {
+				sbChanged.WriteByte('x')
+			} else {
+				sbChanged.WriteByte('.')
+			}
+		}
+		if strings.Join(res, "|") != val.res || sbChanged.String() != val.changed {
+			t.Errorf("Wrong sandhi for %v %v: expected %v %v, got %v %v",
+				val.hanzi, val.sylls, val.res, val.changed, strings.Join(res, "|"), sbChanged.String())
+		}
+	}
+}
+
+func TestMakeWordsSandhi(t *testing.T) {
+	// Spaces typed in Hanzi have pinyin, so they stay in the word before them as " " syllables
+	para := []biscript.XieChar{
+		{Hanzi: "你", Pinyin: "ni3"}, {Hanzi: "好", Pinyin: "hao3"}, {Hanzi: " ", Pinyin: " "},
+		{Hanzi: "好", Pinyin: "hao3"}, {Hanzi: "一", Pinyin: "yi1"}, {Hanzi: " ", Pinyin: " "}, {Hanzi: " ", Pinyin: " "},
+		{Hanzi: "个", Pinyin: "ge4"}, {Hanzi: " "},
+		{Hanzi: "好", Pinyin: "hao3"}, {Hanzi: "好", Pinyin: "hao3"},
+	}
+	vals := []struct {
+		sandhi string
+		words  string
+	}{
+		{SandhiNone, "ni3hao3 |hao3yi1  |ge4| |hao3hao3"},
+		{SandhiShow, "ni2hao3 |hao3yi1  |ge4| |hao2hao3"},
+		{SandhiMark, "ni3hao3 |hao3yi1  |ge4| |hao3hao3"},
+	}
+	for _, val := range vals {
+		words := makeWords(para, fakePinyiner{}, Options{Sandhi: val.sandhi})
+		res := make([]string, len(words))
+		for i, w := range words {
+			res[i] = w.pinyin
+		}
+		if strings.Join(res, "|") != val.words {
+			t.Errorf("Wrong words with sandhi %q: %v", val.sandhi, strings.Join(res, "|"))
+		}
+		if marked := val.sandhi == SandhiMark; marked != (words[0].sandhi != nil) || marked && !words[0].sandhi[0] {
+			t.Errorf("Wrong sandhi marks with sandhi %q: %v", val.sandhi, words[0].sandhi)
+		}
+	}
+}
+
+func TestExportSandhi(t *testing.T) {
+	text := []biscript.XieChar{
+		{Hanzi: "你", Pinyin: "ni3"}, {Hanzi: "好", Pinyin: "hao3"}, {Hanzi: " "},
+		{Hanzi: "一", Pinyin: "yi1"}, {Hanzi: "个", Pinyin: "ge4"}, {Hanzi: " "},
+		{Hanzi: "不", Pinyin: "bu4"}, {Hanzi: "是", Pinyin: "shi4"}, {Hanzi: " "},
+		{Hanzi: "第", Pinyin: "di4"}, {Hanzi: "一", Pinyin: "yi1"}, {Hanzi: "天", Pinyin: "tian1"}, {Hanzi: " "},
+		{Hanzi: "好", Pinyin: "hao3"},
+	}
+	vals := []struct {
+		fileName string
+		opts     Options
+		contains string
+	}{
+		{"citation.txt", Options{}, "ni3hao3 yi1ge4 bu4shi4 di4yi1tian1 hao3"},
+		{"sandhi.txt", Options{Sandhi: SandhiShow}, "ni2hao3 yi2ge4 bu2shi4 di4yi1tian1 hao3"},
+		{"marked.html", Options{Sandhi: SandhiMark}, `<span class="sandhi">ni3</span>hao3`},
+		{"marked.docx", Options{Sandhi: SandhiMark}, `<w:rStyle w:val="Sandhi"/>`},
+	}
+	for _, val := range vals {
+		fileName := path.Join(t.TempDir(), val.fileName)
+		content := exportAndRead(t, text, fileName, val.opts)
+		if !strings.Contains(content, val.contains) {
+			t.Errorf("Export to %v does not contain %v:\n%v", val.fileName, val.contains, content)
+		}
+	}
+}
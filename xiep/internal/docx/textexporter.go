@@ -0,0 +1,85 @@
+package docx
+
+import (
+	"html"
+	"io/ioutil"
+	"strings"
+	"xiep/internal/biscript"
+)
+
+const htmlHead = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title><!-- TITLE --></title>
+<style>
+body { font-size: 20pt; line-height: 2.2; }
+rt { font-size: 50%; }
+.sandhi { color: #c0392b; text-decoration: underline dotted; }
+</style>
+</head>
+<body>
+`
+
+const htmlFoot = `</body>
+</html>
+`
+
+// Exports the received text as an HTML page with pinyin in ruby annotations, saved as fname.
+func ExportHtml(text []biscript.XieChar, title string, fname string, pinyiner pinyiner, opts Options) error {
+	var sb strings.Builder
+	sb.WriteString(strings.ReplaceAll(htmlHead, "<!-- TITLE -->", html.EscapeString(title)))
+	for _, para := range textToParas(text) {
+		sb.WriteString("<p>")
+		for _, w := range makeWords(para, pinyiner, opts) {
+			if w.hanzi == "" {
+				sb.WriteString(html.EscapeString(w.pinyin))
+			} else {
+				sb.WriteString("<ruby>" + html.EscapeString(w.hanzi) + "<rt>" + makeRubyPinyinHtml(w) + "</rt></ruby>")
+			}
+		}
+		sb.WriteString("</p>\n")
+	}
+	sb.WriteString(htmlFoot)
+	return ioutil.WriteFile(fname, []byte(sb.String()), 0644)
+}
+
+// Escapes a biscriptal word's pinyin, with syllables marked for sandhi in spans.
+func makeRubyPinyinHtml(w biWord) string {
+	if w.sandhi == nil {
+		return html.EscapeString(w.pinyin)
+	}
+	var sb strings.Builder
+	for i, syll := range w.sylls {
+		if w.sandhi[i] {
+			sb.WriteString(`<span class="sandhi">` + html.EscapeString(syll) + "</span>")
+		} else {
+			sb.WriteString(html.EscapeString(syll))
+		}
+	}
+	return sb.String()
+}
+
+// Exports the received text as plain text, saved as fname.
+// Each paragraph becomes a line of Hanzi followed by a line of pinyin, and paragraphs are separated by an empty line.
+func ExportText(text []biscript.XieChar, fname string, pinyiner pinyiner, opts Options) error {
+	var sb strings.Builder
+	for i, para := range textToParas(text) {
+		if i != 0 {
+			sb.WriteString("\n")
+		}
+		var hanziLine, pinyinLine strings.Builder
+		for _, w := range makeWords(para, pinyiner, opts) {
+			if w.hanzi == "" {
+				hanziLine.WriteString(w.pinyin)
+				pinyinLine.WriteString(w.pinyin)
+			} else {
+				hanziLine.WriteString(w.hanzi)
+				pinyinLine.WriteString(w.pinyin)
+			}
+		}
+		sb.WriteString(hanziLine.String() + "\n")
+		sb.WriteString(pinyinLine.String() + "\n")
+	}
+	return ioutil.WriteFile(fname, []byte(sb.String()), 0644)
+}
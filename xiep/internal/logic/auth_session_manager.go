@@ -15,12 +15,61 @@ type authSessionManager struct {
 	xlog common.XieLogger
 	mu sync.Mutex
 	sessions map[string]time.Time
+	tickets map[string]socketTicket
+}
+
+// A single-use ticket that authenticates a socket upgrade as an auth session.
+type socketTicket struct {
+	sessionId string
+	expiryUtc time.Time
 }
 
 func (asm *authSessionManager) init(secretsFileName string, xlog common.XieLogger) {
 	asm.secretsFileName = secretsFileName
 	asm.xlog = xlog
 	asm.sessions = make(map[string]time.Time)
+	asm.tickets = make(map[string]socketTicket)
+}
+
+// IssueSocketTicket creates a ticket that can be used once, within common.SocketTicketSeconds,
+// to open a socket as the session identified by the provided ID.
+// Browsers cannot send headers with the socket upgrade, and the ticket keeps the session ID itself out of URLs.
+func (asm *authSessionManager) IssueSocketTicket(sessionId string) string {
+	asm.mu.Lock()
+	defer asm.mu.Unlock()
+	utcNow := time.Now().UTC()
+	for ticket, st := range asm.tickets {
+		if utcNow.After(st.expiryUtc) {
+			delete(asm.tickets, ticket)
+		}
+	}
+	ticket := getShortId()
+	for {
+		if _, ok := asm.tickets[ticket]; ok {
+			ticket = getShortId()
+		} else {
+			break
+		}
+	}
+	asm.tickets[ticket] = socketTicket{sessionId, utcNow.Add(common.SocketTicketSeconds * time.Second)}
+	return ticket
+}
+
+// RedeemSocketTicket returns the session ID that the ticket was issued for, and invalidates the ticket.
+// If the ticket does not exist or has expired, it returns empty string.
+// The session itself must still be verified with Check.
+func (asm *authSessionManager) RedeemSocketTicket(ticket string) string {
+	asm.mu.Lock()
+	defer asm.mu.Unlock()
+	st, ok := asm.tickets[ticket]
+	if !ok {
+		return ""
+	}
+	delete(asm.tickets, ticket)
+	if time.Now().UTC().After(st.expiryUtc) {
+		return ""
+	}
+	return st.sessionId
 }
 
 // Logout removes the session identified by the provided ID.
@@ -0,0 +1,32 @@
+package logic
+
+import (
+	"testing"
+	"time"
+)
+
+func TestASM_SocketTicket(t *testing.T) {
+	var asm authSessionManager
+	asm.init("", testLogger{})
+	ticket := asm.IssueSocketTicket("session1")
+	if ticket == "" {
+		t.Fatalf("Expected a ticket")
+	}
+	if sessionId := asm.RedeemSocketTicket(ticket); sessionId != "session1" {
+		t.Errorf("Expected ticket to redeem for session1, got %q", sessionId)
+	}
+	if sessionId := asm.RedeemSocketTicket(ticket); sessionId != "" {
+		t.Errorf("Expected ticket to be usable only once")
+	}
+	if sessionId := asm.RedeemSocketTicket("nonexistent"); sessionId != "" {
+		t.Errorf("Expected unknown ticket to be rejected")
+	}
+	// Expired ticket
+	ticket = asm.IssueSocketTicket("session2")
+	st := asm.tickets[ticket]
+	st.expiryUtc = time.Now().UTC().Add(-time.Second)
+	asm.tickets[ticket] = st
+	if sessionId := asm.RedeemSocketTicket(ticket); sessionId != "" {
+		t.Errorf("Expected expired ticket to be rejected")
+	}
+}
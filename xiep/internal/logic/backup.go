@@ -0,0 +1,398 @@
+package logic
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+	"xiep/internal/biscript"
+	"xiep/internal/common"
+)
+
+const (
+	backupFilePrefix         = "xiep-backup-"    // Snapshot archives are named this + timestamp + extension
+	backupFileExt            = ".tar.gz"         // Extension of snapshot archives
+	backupTimeLayout         = "20060102-150405" // Timestamp in archive names, UTC
+	backupDocsFolder         = "docs/"           // Folder within archive holding the documents
+	backupDefaultIntervalMin = 60                // Minutes between scheduled snapshots, unless configured
+	backupDefaultKeepLatest  = 24                // Newest snapshots that are always kept, unless configured
+	backupDefaultKeepDays    = 30                // Days for which the last snapshot of the day is kept, unless configured
+)
+
+// Takes snapshots of all documents at regular intervals, and prunes old snapshots.
+type backupScheduler struct {
+	xlog       common.XieLogger
+	store      DocumentStore
+	folder     string
+	interval   time.Duration
+	keepLatest int
+	keepDays   int
+	lastRun    time.Time
+	running    int32
+}
+
+// Creates the scheduler from the config. Returns nil if scheduled backups are not configured.
+func newBackupScheduler(config *common.Config, store DocumentStore, xlog common.XieLogger) *backupScheduler {
+	if config.BackupsFolder == "" {
+		return nil
+	}
+	bs := backupScheduler{
+		xlog:       xlog,
+		store:      store,
+		folder:     config.BackupsFolder,
+		interval:   time.Duration(config.BackupIntervalMinutes) * time.Minute,
+		keepLatest: config.BackupKeepLatest,
+		keepDays:   config.BackupKeepDays,
+	}
+	if bs.interval <= 0 {
+		bs.interval = backupDefaultIntervalMin * time.Minute
+	}
+	if bs.keepLatest <= 0 {
+		bs.keepLatest = backupDefaultKeepLatest
+	}
+	if bs.keepDays <= 0 {
+		bs.keepDays = backupDefaultKeepDays
+	}
+	return &bs
+}
+
+// Takes a snapshot and prunes old ones if it's time. The work is done in a goroutine of its own,
+// so the caller's loop is not held up.
+// Invoked from orchestrator's housekeep goroutine.
+func (bs *backupScheduler) run() {
+	if !bs.lastRun.IsZero() && time.Since(bs.lastRun) < bs.interval {
+		return
+	}
+	// Previous snapshot still in progress
+	if !atomic.CompareAndSwapInt32(&bs.running, 0, 1) {
+		return
+	}
+	bs.lastRun = time.Now()
+	go func() {
+		defer atomic.StoreInt32(&bs.running, 0)
+		fileName, count, err := SnapshotDocuments(bs.store, bs.folder, time.Now().UTC())
+		if err != nil {
+			bs.xlog.Logf(common.LogSrcBackup, "Failed to take snapshot: %v", err)
+			return
+		}
+		bs.xlog.Logf(common.LogSrcBackup, "Saved %v documents to %v", count, fileName)
+		removed, err := PruneSnapshots(bs.folder, bs.keepLatest, bs.keepDays, time.Now().UTC())
+		if err != nil {
+			bs.xlog.Logf(common.LogSrcBackup, "Failed to prune snapshots: %v", err)
+		}
+		for _, name := range removed {
+			bs.xlog.Logf(common.LogSrcBackup, "Removed old snapshot %v", name)
+		}
+	}()
+}
+
+// Writes all documents in the store, with their revision logs, into a timestamped tar.gz archive in folder.
+// Returns the archive's file name and the number of documents in it.
+func SnapshotDocuments(store DocumentStore, folder string, utcNow time.Time) (fileName string, count int, err error) {
+	if err = os.MkdirAll(folder, 0755); err != nil {
+		return
+	}
+	docIds, err := store.List()
+	if err != nil {
+		return
+	}
+	sort.Strings(docIds)
+	fileName = path.Join(folder, backupFilePrefix+utcNow.Format(backupTimeLayout)+backupFileExt)
+	// Write under temp name, so a half-written archive is never mistaken for a snapshot
+	tempFileName := fileName + fsTempExt
+	f, err := os.Create(tempFileName)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(tempFileName)
+		}
+	}()
+	gzw := gzip.NewWriter(f)
+	tw := tar.NewWriter(gzw)
+	for _, docId := range docIds {
+		data, loadErr := store.Load(docId)
+		// Deleted while we were at it
+		if errors.Is(loadErr, errDocNotFound) {
+			continue
+		} else if loadErr != nil {
+			err = fmt.Errorf("loading %v: %v", docId, loadErr)
+			return
+		}
+		revs, loadErr := store.LoadRevisions(docId)
+		if loadErr != nil {
+			err = fmt.Errorf("loading revisions of %v: %v", docId, loadErr)
+			return
+		}
+		if err = writeTarFile(tw, backupDocsFolder+docId+fsDocExt, data, utcNow); err != nil {
+			return
+		}
+		var history bytes.Buffer
+		enc := json.NewEncoder(&history)
+		enc.SetEscapeHTML(false)
+		for i := range revs {
+			if err = enc.Encode(&revs[i]); err != nil {
+				return
+			}
+		}
+		if err = writeTarFile(tw, backupDocsFolder+docId+fsHistoryExt, history.Bytes(), utcNow); err != nil {
+			return
+		}
+		count++
+	}
+	if err = tw.Close(); err != nil {
+		return
+	}
+	if err = gzw.Close(); err != nil {
+		return
+	}
+	if err = f.Sync(); err != nil {
+		return
+	}
+	if err = f.Close(); err != nil {
+		return
+	}
+	err = os.Rename(tempFileName, fileName)
+	return
+}
+
+func writeTarFile(tw *tar.Writer, name string, data []byte, modTime time.Time) error {
+	hdr := tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), ModTime: modTime}
+	if err := tw.WriteHeader(&hdr); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+// Removes snapshots from folder, except the keepLatest newest ones, and the newest one of each of the last keepDays days.
+// Returns the names of the removed files.
+func PruneSnapshots(folder string, keepLatest, keepDays int, utcNow time.Time) (removed []string, err error) {
+	files, err := ioutil.ReadDir(folder)
+	if err != nil {
+		return
+	}
+	type snapshot struct {
+		name    string
+		takenAt time.Time
+	}
+	snapshots := make([]snapshot, 0)
+	for _, f := range files {
+		if takenAt, ok := parseSnapshotName(f.Name()); ok && !f.IsDir() {
+			snapshots = append(snapshots, snapshot{f.Name(), takenAt})
+		}
+	}
+	// Newest first
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].takenAt.After(snapshots[j].takenAt) })
+	keptDays := make(map[string]bool)
+	oldestDay := utcNow.AddDate(0, 0, -keepDays)
+	for i, s := range snapshots {
+		day := s.takenAt.Format("20060102")
+		if i < keepLatest || s.takenAt.After(oldestDay) && !keptDays[day] {
+			keptDays[day] = true
+			continue
+		}
+		if err = os.Remove(path.Join(folder, s.name)); err != nil {
+			return
+		}
+		removed = append(removed, s.name)
+	}
+	return
+}
+
+// Gets the time a snapshot was taken from its file name.
+func parseSnapshotName(name string) (takenAt time.Time, ok bool) {
+	if !strings.HasPrefix(name, backupFilePrefix) || !strings.HasSuffix(name, backupFileExt) {
+		return
+	}
+	stamp := strings.TrimSuffix(strings.TrimPrefix(name, backupFilePrefix), backupFileExt)
+	takenAt, err := time.Parse(backupTimeLayout, stamp)
+	return takenAt, err == nil
+}
+
+// A document read back from a snapshot.
+type snapshotDoc struct {
+	data []byte
+	revs []StoredRevision
+}
+
+// Restores documents from a snapshot archive into the store, replacing the current versions.
+// If docId is not empty, only that document is restored. Every document is validated before any is written.
+// Restored documents continue with revision IDs above any the current version has used, so that clients
+// don't mistake their cached copies of the current version for the restored one.
+// The server must not be running, or it will overwrite restored documents that it has in memory.
+// Returns the number of documents restored.
+func RestoreSnapshot(store DocumentStore, archiveFileName, docId string) (count int, err error) {
+	docs, err := readSnapshot(archiveFileName)
+	if err != nil {
+		return
+	}
+	if docId != "" {
+		doc, ok := docs[docId]
+		if !ok {
+			return 0, fmt.Errorf("document %v is not in the snapshot", docId)
+		}
+		docs = map[string]*snapshotDoc{docId: doc}
+	}
+	docIds := make([]string, 0, len(docs))
+	for id, doc := range docs {
+		if err = validateSnapshotDoc(id, doc); err != nil {
+			return
+		}
+		docIds = append(docIds, id)
+	}
+	sort.Strings(docIds)
+	for _, id := range docIds {
+		doc := docs[id]
+		if err = renumberSnapshotDoc(store, id, doc); err != nil {
+			return count, fmt.Errorf("restoring %v: %v", id, err)
+		}
+		// Saving replaces the current version in one step and keeps it as a backup;
+		// the revision log only goes once the restored document is in place
+		if err = store.Save(id, doc.data); err != nil {
+			return count, fmt.Errorf("restoring %v: %v", id, err)
+		}
+		if err = store.ReplaceRevisions(id, doc.revs); err != nil {
+			return count, fmt.Errorf("restoring revisions of %v: %v", id, err)
+		}
+		count++
+	}
+	return count, nil
+}
+
+// Moves the revision IDs of a document from a snapshot past the last one used by the document's current version
+// in the store, if there is one. Revisions keep their distance from each other and from the saved text.
+func renumberSnapshotDoc(store DocumentStore, docId string, sd *snapshotDoc) error {
+	lastRevId, err := getLastRevisionId(store, docId)
+	if errors.Is(err, errDocNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var doc document
+	if err = doc.deserialize(sd.data); err != nil {
+		return err
+	}
+	firstRevId := doc.BaseRevisionId
+	if len(sd.revs) != 0 && sd.revs[0].RevisionId < firstRevId {
+		firstRevId = sd.revs[0].RevisionId
+	}
+	shift := lastRevId + 1 - firstRevId
+	if shift <= 0 {
+		return nil
+	}
+	doc.BaseRevisionId += shift
+	if sd.data, err = doc.serialize(); err != nil {
+		return err
+	}
+	for i := range sd.revs {
+		sd.revs[i].RevisionId += shift
+	}
+	return nil
+}
+
+// Gets the ID of the last revision of a stored document: that of its saved text, or of the last entry
+// in its revision log if that is newer. If the saved text is damaged, only the log counts.
+// Returns errDocNotFound if the document does not exist.
+func getLastRevisionId(store DocumentStore, docId string) (int, error) {
+	data, err := store.Load(docId)
+	if err != nil {
+		return 0, err
+	}
+	revs, err := store.LoadRevisions(docId)
+	if err != nil {
+		return 0, err
+	}
+	lastRevId := 0
+	var doc document
+	if doc.deserialize(data) == nil {
+		lastRevId = doc.BaseRevisionId
+	}
+	if len(revs) != 0 && revs[len(revs)-1].RevisionId > lastRevId {
+		lastRevId = revs[len(revs)-1].RevisionId
+	}
+	return lastRevId, nil
+}
+
+// Reads all documents from a snapshot archive, by document ID.
+func readSnapshot(archiveFileName string) (map[string]*snapshotDoc, error) {
+	f, err := os.Open(archiveFileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	gzr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(gzr)
+	docs := make(map[string]*snapshotDoc)
+	getDoc := func(docId string) *snapshotDoc {
+		if docs[docId] == nil {
+			docs[docId] = &snapshotDoc{revs: []StoredRevision{}}
+		}
+		return docs[docId]
+	}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		name := strings.TrimPrefix(hdr.Name, backupDocsFolder)
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasSuffix(name, fsHistoryExt) {
+			doc := getDoc(strings.TrimSuffix(name, fsHistoryExt))
+			scanner := bufio.NewScanner(bytes.NewReader(data))
+			scanner.Buffer(make([]byte, 64*1024), len(data)+1)
+			for scanner.Scan() {
+				var rev StoredRevision
+				if err = json.Unmarshal(scanner.Bytes(), &rev); err != nil {
+					return nil, fmt.Errorf("%v: %v", hdr.Name, err)
+				}
+				doc.revs = append(doc.revs, rev)
+			}
+		} else if strings.HasSuffix(name, fsDocExt) {
+			getDoc(strings.TrimSuffix(name, fsDocExt)).data = data
+		}
+	}
+	return docs, nil
+}
+
+// Checks that a document from a snapshot loads, and that its revision log holds valid change sets.
+func validateSnapshotDoc(docId string, sd *snapshotDoc) error {
+	if sd.data == nil {
+		return fmt.Errorf("document %v has a revision log but no content in the snapshot", docId)
+	}
+	var doc document
+	if err := doc.deserialize(sd.data); err != nil {
+		return fmt.Errorf("document %v in snapshot is damaged: %v", docId, err)
+	}
+	if doc.DocId != docId {
+		return fmt.Errorf("document %v in snapshot has wrong ID: %v", docId, doc.DocId)
+	}
+	for _, rev := range sd.revs {
+		var cs biscript.ChangeSet
+		if err := json.Unmarshal(rev.Data, &cs); err != nil {
+			return fmt.Errorf("revision %v of %v in snapshot is damaged: %v", rev.RevisionId, docId, err)
+		}
+	}
+	return nil
+}
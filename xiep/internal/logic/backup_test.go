@@ -0,0 +1,188 @@
+package logic
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestBackup_SnapshotAndRestore(t *testing.T) {
+	stores := openTestStores(t)
+	from, to := stores[DocStoreFiles], stores[DocStoreBolt]
+	_ = from.Save("x", []byte(`{"docId":"x","name":"Momo","startText":[]}`))
+	revData := []byte(makeChange("0>A").SerializeJSON())
+	_ = from.AppendRevision("x", 1, revData)
+	_ = from.Save("y", []byte(`{"docId":"y","name":"Bob","startText":[]}`))
+
+	folder := t.TempDir()
+	fileName, count, err := SnapshotDocuments(from, folder, time.Date(2021, 8, 1, 12, 0, 0, 0, time.UTC))
+	if err != nil || count != 2 {
+		t.Fatalf("Snapshot failed: %v, %v", count, err)
+	}
+	if path.Base(fileName) != "xiep-backup-20210801-120000.tar.gz" {
+		t.Errorf("Wrong snapshot name: %v", fileName)
+	}
+
+	// Single document
+	if count, err = RestoreSnapshot(to, fileName, "y"); err != nil || count != 1 {
+		t.Fatalf("Failed to restore one: %v, %v", count, err)
+	}
+	if docIds, _ := to.List(); len(docIds) != 1 || docIds[0] != "y" {
+		t.Errorf("Wrong documents after restoring one: %v", docIds)
+	}
+	if _, err = RestoreSnapshot(to, fileName, "z"); err == nil {
+		t.Errorf("Restored document not in snapshot")
+	}
+
+	// Everything, replacing what's there; restored document continues after the revision it replaces
+	_ = to.Save("x", []byte(`{"docId":"x","name":"Changed","startText":[]}`))
+	if count, err = RestoreSnapshot(to, fileName, ""); err != nil || count != 2 {
+		t.Fatalf("Failed to restore all: %v, %v", count, err)
+	}
+	if data, _ := to.Load("x"); string(data) != `{"docId":"x","name":"Momo","startText":[],"baseRevisionId":1}` {
+		t.Errorf("Wrong data after restore: %s", data)
+	}
+	if revs, _ := to.LoadRevisions("x"); len(revs) != 1 || revs[0].RevisionId != 2 || string(revs[0].Data) != string(revData) {
+		t.Errorf("Wrong revisions after restore: %+v", revs)
+	}
+}
+
+func TestBackup_DamagedSnapshotNotRestored(t *testing.T) {
+	// Snapshot with one good document and one damaged one
+	fileName := path.Join(t.TempDir(), "damaged.tar.gz")
+	f, _ := os.Create(fileName)
+	gzw := gzip.NewWriter(f)
+	tw := tar.NewWriter(gzw)
+	_ = writeTarFile(tw, "docs/x.json", []byte(`{"docId":"x","startText":[]}`), time.Now())
+	_ = writeTarFile(tw, "docs/y.json", []byte(`{"docId":"y","startT`), time.Now())
+	tw.Close()
+	gzw.Close()
+	f.Close()
+
+	store := &fsDocumentStore{xlog: testLogger{}, folder: t.TempDir()}
+	if _, err := RestoreSnapshot(store, fileName, ""); err == nil {
+		t.Errorf("Damaged snapshot restored")
+	}
+	if _, err := store.Load("x"); !errors.Is(err, errDocNotFound) {
+		t.Errorf("Good document written although snapshot is damaged")
+	}
+	if count, err := RestoreSnapshot(store, fileName, "x"); err != nil || count != 1 {
+		t.Errorf("Failed to restore good document: %v, %v", count, err)
+	}
+}
+
+// Store whose saves fail, like on a full disk.
+type failingSaveStore struct {
+	DocumentStore
+}
+
+func (failingSaveStore) Save(docId string, data []byte) error {
+	return errors.New("disk full")
+}
+
+func TestBackup_FailedRestoreKeepsDocument(t *testing.T) {
+	for kind, store := range openTestStores(t) {
+		_ = store.Save("x", []byte(`{"docId":"x","name":"Momo","startText":[]}`))
+		_ = store.AppendRevision("x", 1, []byte(makeChange("0>A").SerializeJSON()))
+		fileName, _, err := SnapshotDocuments(store, t.TempDir(), time.Now())
+		if err != nil {
+			t.Fatalf("Snapshot failed: %v", err)
+		}
+		changed := `{"docId":"x","name":"Changed","startText":[]}`
+		_ = store.Save("x", []byte(changed))
+		_ = store.AppendRevision("x", 2, []byte(makeChange("0>B").SerializeJSON()))
+
+		// Restored document cannot be written: current one stays, with its revision log
+		if _, err = RestoreSnapshot(failingSaveStore{store}, fileName, "x"); err == nil {
+			t.Errorf("%v: restore succeeded although save failed", kind)
+		}
+		if data, _ := store.Load("x"); string(data) != changed {
+			t.Errorf("%v: document lost in failed restore: %s", kind, data)
+		}
+		if revs, _ := store.LoadRevisions("x"); len(revs) != 2 {
+			t.Errorf("%v: revision log changed in failed restore: %+v", kind, revs)
+		}
+
+		// Successful restore replaces the revision log
+		if _, err = RestoreSnapshot(store, fileName, "x"); err != nil {
+			t.Errorf("%v: restore failed: %v", kind, err)
+		}
+		if revs, _ := store.LoadRevisions("x"); len(revs) != 1 || revs[0].RevisionId <= 2 {
+			t.Errorf("%v: wrong revisions after restore: %+v", kind, revs)
+		}
+	}
+}
+
+func TestBackup_RestoredRevisionsKeepGrowing(t *testing.T) {
+	ork := newTestOrchestrator(t)
+	docId, _ := ork.CreateDocument("Momo")
+	sessionKey := ork.RequestSession(docId, "alice", "Alice")
+	ork.startSession(sessionKey, "alice", -1)
+	typeChar(ork, sessionKey, 0)
+	ork.housekeepDocs()
+	fileName, _, err := SnapshotDocuments(ork.store, t.TempDir(), time.Now())
+	if err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+
+	// Document moves on after the snapshot, and a client caches it at revision 3
+	typeChar(ork, sessionKey, 1)
+	typeChar(ork, sessionKey, 2)
+	ork.housekeepDocs()
+	ork.abandonDocument(docId, true)
+	if _, err = RestoreSnapshot(ork.store, fileName, docId); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	if problems := ValidateDocument(ork.store, docId); len(problems) != 0 {
+		t.Errorf("Restored document has problems: %v", problems)
+	}
+
+	// Client's cache is not taken for the restored document
+	sessionKey = ork.RequestSession(docId, "alice", "")
+	ssm := ork.startSession(sessionKey, "alice", 3)
+	if ssm == nil || ssm.RevisionId <= 3 || ssm.Change != nil || len(ssm.Text) != 1 {
+		t.Errorf("Wrong start after restore: %+v", ssm)
+	}
+}
+
+func TestBackup_Prune(t *testing.T) {
+	folder := t.TempDir()
+	utcNow := time.Date(2021, 8, 10, 12, 0, 0, 0, time.UTC)
+	stamps := []string{
+		"20210810-110000", "20210810-100000", "20210810-090000", // Today: 2 newest kept as latest
+		"20210809-230000", "20210809-220000", // Yesterday: last one kept
+		"20210701-230000", // Too old
+	}
+	for _, stamp := range stamps {
+		_ = ioutil.WriteFile(path.Join(folder, backupFilePrefix+stamp+backupFileExt), []byte{}, 0644)
+	}
+	_ = ioutil.WriteFile(path.Join(folder, "other.txt"), []byte{}, 0644)
+
+	removed, err := PruneSnapshots(folder, 2, 30, utcNow)
+	if err != nil {
+		t.Fatalf("Failed to prune: %v", err)
+	}
+	sort.Strings(removed)
+	expected := []string{
+		backupFilePrefix + "20210701-230000" + backupFileExt,
+		backupFilePrefix + "20210809-220000" + backupFileExt,
+		backupFilePrefix + "20210810-090000" + backupFileExt,
+	}
+	if len(removed) != len(expected) {
+		t.Fatalf("Wrong snapshots removed: %v", removed)
+	}
+	for i := range expected {
+		if removed[i] != expected[i] {
+			t.Errorf("Wrong snapshots removed: %v", removed)
+		}
+	}
+	if _, err = os.Stat(path.Join(folder, "other.txt")); err != nil {
+		t.Errorf("Unrelated file removed")
+	}
+}
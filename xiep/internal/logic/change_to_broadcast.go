@@ -1,10 +1,12 @@
 package logic
 
+import "xiep/internal/biscript"
+
 type changeToBroadcast struct {
 	sourceSessionKey string
 	sourceBaseDocRevisionId int
 	newDocRevisionId int
 	receiverSessionKeys map[string]bool
-	selJson string
-	changeJson string
+	selections []sessionSelection
+	change *biscript.ChangeSet
 }
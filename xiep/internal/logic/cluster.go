@@ -0,0 +1,750 @@
+package logic
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+	"xiep/internal/biscript"
+	"xiep/internal/common"
+	"xiep/internal/docx"
+)
+
+// How several xiep instances share documents:
+// - Every document is owned by one instance, which holds it in memory and sequences all changes to it.
+//   The first instance that needs a document claims it, and keeps it until the document is deleted
+//   or the instance shuts down. Ownership is a lease that the owner keeps renewing; if the owner dies,
+//   the lease runs out, and the next instance that needs the document claims it.
+// - Session keys carry the ID of the instance that owns the session's document.
+// - A socket may connect to any instance. That instance forwards session calls to the owner over the bus,
+//   and the owner relays broadcasts back to the instances that hold the receivers' sockets.
+// - All instances see the same docs and exports folders.
+
+const (
+	clusterCallTimeoutMsec = 5000             // Max wait for a reply from another instance
+	clusterTopicPrefix     = "xiep.instance." // Each instance listens on this prefix + its ID
+	clusterLeaseSeconds    = 30               // Ownership of a document expires unless renewed within this time
+	clusterRenewPeriodSec  = 10               // Owners renew their leases this often
+	// An owner that cannot renew its lease gives up the document this long before the lease expires: leases are
+	// checked once per renewal period, and saving the document must finish before another instance can claim it
+	clusterLeaseMarginSec = clusterRenewPeriodSec + 5
+)
+
+// Kinds of messages between instances.
+const (
+	cmsgRequest   = "request"
+	cmsgReply     = "reply"
+	cmsgBroadcast = "broadcast"
+	cmsgPresence  = "presence"
+	cmsgTerminate = "terminate"
+)
+
+// Calls an instance can make to the owner of a document.
+const (
+	ccallRequestSession  = "requestSession"
+	ccallStartSession    = "startSession"
+	ccallResumeSession   = "resumeSession"
+	ccallIsSessionOpen   = "isSessionOpen"
+	ccallChangeReceived  = "changeReceived"
+	ccallSessionDetached = "sessionDetached"
+	ccallGetDocName      = "getDocumentName"
+	ccallExportDocx      = "exportDocx"
+	ccallDeleteDocument  = "deleteDocument"
+	ccallGetEditors      = "getEditors"
+	ccallCheckReadings   = "checkReadings"
+)
+
+// Transport that lets several xiep instances share documents. HTTPBus connects instances over the network;
+// LoopbackBus connects instances within one process.
+type ClusterBus interface {
+	// Delivers msg to the handler subscribed to topic, if any, without waiting for the handler.
+	// Messages published to the same topic must arrive in the order they were published.
+	Publish(topic string, msg []byte) error
+
+	// Registers the handler that receives messages published to topic.
+	// Handler is invoked from one goroutine at a time.
+	Subscribe(topic string, handler func(msg []byte)) error
+
+	// Makes instanceId the owner of the document for clusterLeaseSeconds, unless another instance holds a lease
+	// on it that has not expired. If instanceId is already the owner, this renews its lease. Returns the owner.
+	ClaimDoc(docId, instanceId string) (ownerId string, err error)
+
+	// Extends the leases instanceId holds on the documents, or grants them again if nobody else holds them.
+	// Returns the documents another instance holds a lease on.
+	RenewDocs(docIds []string, instanceId string) (lost []string, err error)
+
+	// Gives up ownership of the document, if instanceId owns it.
+	ReleaseDoc(docId, instanceId string) error
+}
+
+type clusterMessage struct {
+	Kind    string          `json:"kind"`
+	Id      uint64          `json:"id,omitempty"`
+	From    string          `json:"from"`
+	Method  string          `json:"method,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+type clusterArgs struct {
+	DocId         string              `json:"docId,omitempty"`
+	SessionKey    string              `json:"sessionKey,omitempty"`
+	AuthSessionId string              `json:"authSessionId,omitempty"`
+	DisplayName   string              `json:"displayName,omitempty"`
+	RevisionId    int                 `json:"revisionId"`
+	Selection     *sessionSelection   `json:"selection,omitempty"`
+	Change        *biscript.ChangeSet `json:"change,omitempty"`
+	Export        *docx.Options       `json:"export,omitempty"`
+}
+
+type clusterResult struct {
+	Str      string                `json:"str,omitempty"`
+	Ok       bool                  `json:"ok,omitempty"`
+	Start    *sessionStartMessage  `json:"start,omitempty"`
+	Resume   *sessionResumeMessage `json:"resume,omitempty"`
+	Editors  []sessionPresence     `json:"editors,omitempty"`
+	Readings *ReadingsReport       `json:"readings,omitempty"`
+}
+
+type clusterBroadcast struct {
+	SourceSessionKey        string              `json:"sourceSessionKey"`
+	SourceBaseDocRevisionId int                 `json:"sourceBaseDocRevisionId"`
+	NewDocRevisionId        int                 `json:"newDocRevisionId"`
+	ReceiverSessionKeys     map[string]bool     `json:"receiverSessionKeys"`
+	Selections              []sessionSelection  `json:"selections"`
+	Change                  *biscript.ChangeSet `json:"change,omitempty"`
+}
+
+type clusterPresence struct {
+	Event               string          `json:"event"`
+	Presence            sessionPresence `json:"presence"`
+	ReceiverSessionKeys map[string]bool `json:"receiverSessionKeys"`
+}
+
+type clusterTerminate struct {
+	SessionKeys map[string]bool `json:"sessionKeys"`
+	Error       *protocolError  `json:"error"`
+}
+
+// Sits between the web server, the connection manager and the orchestrator, and sends every
+// document and session operation to the instance that owns the document. When there is no bus,
+// this is the only instance, and everything goes straight to the local orchestrator.
+// Serves as the connection manager's editSessionHandler and the orchestrator's peerMessenger.
+type docRouter struct {
+	xlog       common.XieLogger
+	instanceId string
+	bus        ClusterBus
+	ork        *orchestrator
+	cm         *connectionManager
+
+	// Closed at shutdown to stop renewing leases
+	exit chan struct{}
+
+	mu         sync.Mutex
+	nextCallId uint64
+	// Replies awaited by callers, by call ID
+	pendingCalls map[uint64]chan *clusterMessage
+	// Documents this instance owns, with the time their lease expires, as far as this instance knows
+	ownedDocs map[string]time.Time
+	// For sessions of owned documents: instance holding the session's socket
+	sessionSockets map[string]string
+}
+
+func (r *docRouter) init(xlog common.XieLogger,
+	instanceId string,
+	bus ClusterBus,
+	ork *orchestrator,
+	cm *connectionManager) {
+	r.xlog = xlog
+	r.bus = bus
+	r.ork = ork
+	r.cm = cm
+	r.pendingCalls = make(map[uint64]chan *clusterMessage)
+	r.ownedDocs = make(map[string]time.Time)
+	r.sessionSockets = make(map[string]string)
+	if bus == nil {
+		return
+	}
+	r.instanceId = instanceId
+	if r.instanceId == "" {
+		r.instanceId = getShortId()
+	}
+	if strings.ContainsAny(r.instanceId, ". ") {
+		panic(fmt.Sprintf("Instance ID must not contain dots or spaces: '%v'", r.instanceId))
+	}
+	// Session keys tell which instance owns the session's document
+	ork.sessionKeyPrefix = "S-" + r.instanceId + "."
+	if err := bus.Subscribe(clusterTopicPrefix+r.instanceId, r.messageReceived); err != nil {
+		panic(fmt.Sprintf("Failed to subscribe to cluster bus: %v", err))
+	}
+	r.exit = make(chan struct{})
+	go r.keepLeases()
+	xlog.Logf(common.LogSrcCluster, "Instance %v joined cluster", r.instanceId)
+}
+
+// Gives up ownership of documents when the instance shuts down, so others can claim them.
+func (r *docRouter) shutdown() {
+	if r.bus == nil {
+		return
+	}
+	close(r.exit)
+	r.mu.Lock()
+	ownedDocs := r.ownedDocs
+	r.ownedDocs = make(map[string]time.Time)
+	r.mu.Unlock()
+	for docId := range ownedDocs {
+		if err := r.bus.ReleaseDoc(docId, r.instanceId); err != nil {
+			r.xlog.Logf(common.LogSrcCluster, "Failed to release document %v: %v", docId, err)
+		}
+	}
+}
+
+// Renews the leases on owned documents periodically, until shutdown.
+func (r *docRouter) keepLeases() {
+	ticker := time.NewTicker(clusterRenewPeriodSec * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.renewLeases()
+		case <-r.exit:
+			return
+		}
+	}
+}
+
+// Renews the leases on owned documents. Documents whose lease has been lost may be owned by another
+// instance by now, so this instance drops them from memory without saving them. If leases cannot be renewed,
+// documents whose lease is about to expire are saved and dropped.
+func (r *docRouter) renewLeases() {
+	r.mu.Lock()
+	docIds := make([]string, 0, len(r.ownedDocs))
+	for docId := range r.ownedDocs {
+		docIds = append(docIds, docId)
+	}
+	r.mu.Unlock()
+	if len(docIds) == 0 {
+		return
+	}
+	// Lease runs from before the request, in case the reply takes a while
+	utcRequested := time.Now().UTC()
+	lost, err := r.bus.RenewDocs(docIds, r.instanceId)
+	if err != nil {
+		r.xlog.Logf(common.LogSrcCluster, "Failed to renew leases: %v", err)
+		r.dropExpiringDocs()
+		return
+	}
+	lostDocs := make(map[string]bool, len(lost))
+	r.mu.Lock()
+	for _, docId := range lost {
+		// Released in the meantime, by deleting the document or shutting down
+		if _, owned := r.ownedDocs[docId]; owned {
+			lostDocs[docId] = true
+		}
+		delete(r.ownedDocs, docId)
+	}
+	for _, docId := range docIds {
+		if _, owned := r.ownedDocs[docId]; owned {
+			r.ownedDocs[docId] = utcRequested.Add(clusterLeaseSeconds * time.Second)
+		}
+	}
+	r.mu.Unlock()
+	for docId := range lostDocs {
+		r.xlog.Logf(common.LogSrcCluster, "Lost lease on document %v", docId)
+		r.ork.abandonDocument(docId, false)
+	}
+}
+
+// Saves and drops the owned documents whose lease expires within clusterLeaseMarginSec, because it could not
+// be renewed. Once the lease has run out, another instance may claim the document and write it.
+func (r *docRouter) dropExpiringDocs() {
+	utcLimit := time.Now().UTC().Add(clusterLeaseMarginSec * time.Second)
+	expiring := make([]string, 0)
+	r.mu.Lock()
+	for docId, utcExpiry := range r.ownedDocs {
+		if utcExpiry.Before(utcLimit) {
+			expiring = append(expiring, docId)
+			delete(r.ownedDocs, docId)
+		}
+	}
+	r.mu.Unlock()
+	for _, docId := range expiring {
+		r.xlog.Logf(common.LogSrcCluster, "Lease on document %v is about to expire; giving it up", docId)
+		r.ork.abandonDocument(docId, true)
+	}
+}
+
+// Finds the instance that owns a document, claiming it for this instance if nobody owns it yet.
+func (r *docRouter) getDocOwner(docId string) (ownerId string, err error) {
+	if r.bus == nil {
+		return r.instanceId, nil
+	}
+	utcRequested := time.Now().UTC()
+	if ownerId, err = r.bus.ClaimDoc(docId, r.instanceId); err != nil {
+		return
+	}
+	if ownerId == r.instanceId {
+		r.mu.Lock()
+		r.ownedDocs[docId] = utcRequested.Add(clusterLeaseSeconds * time.Second)
+		r.mu.Unlock()
+	}
+	return
+}
+
+// Finds the instance that owns a session's document, from the session key.
+func (r *docRouter) getSessionOwner(sessionKey string) string {
+	if r.bus == nil {
+		return r.instanceId
+	}
+	key := strings.TrimPrefix(sessionKey, "S-")
+	if ix := strings.Index(key, "."); ix > 0 {
+		return key[:ix]
+	}
+	return r.instanceId
+}
+
+// Performs a call on the instance that owns the document or session, locally if that's us.
+// Returns nil if the call could not be made.
+func (r *docRouter) route(ownerId, method string, args *clusterArgs) *clusterResult {
+	if ownerId == r.instanceId {
+		return r.callReceived(r.instanceId, method, args)
+	}
+	res, err := r.call(ownerId, method, args)
+	if err != nil {
+		r.xlog.Logf(common.LogSrcCluster, "Call %v to instance %v failed: %v", method, ownerId, err)
+		return nil
+	}
+	return res
+}
+
+// Sends a call to another instance and waits for the reply.
+func (r *docRouter) call(instanceId, method string, args *clusterArgs) (*clusterResult, error) {
+	r.mu.Lock()
+	r.nextCallId++
+	callId := r.nextCallId
+	replyChan := make(chan *clusterMessage, 1)
+	r.pendingCalls[callId] = replyChan
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		delete(r.pendingCalls, callId)
+		r.mu.Unlock()
+	}()
+
+	msg := clusterMessage{
+		Kind:    cmsgRequest,
+		Id:      callId,
+		From:    r.instanceId,
+		Method:  method,
+		Payload: mustMarshalJSON("cluster call", args),
+	}
+	if err := r.bus.Publish(clusterTopicPrefix+instanceId, mustMarshalJSON("cluster message", &msg)); err != nil {
+		return nil, err
+	}
+	timer := time.NewTimer(clusterCallTimeoutMsec * time.Millisecond)
+	defer timer.Stop()
+	select {
+	case reply := <-replyChan:
+		var res clusterResult
+		if err := json.Unmarshal(reply.Payload, &res); err != nil {
+			return nil, err
+		}
+		return &res, nil
+	case <-timer.C:
+		return nil, errors.New("timed out waiting for reply")
+	}
+}
+
+// Handles a message from another instance. Invoked from the bus, one message at a time.
+// Requests are handled on goroutines of their own: they may take a while, and replies to this instance's
+// own calls must not wait behind them.
+func (r *docRouter) messageReceived(msgBytes []byte) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			r.xlog.Logf(common.LogSrcCluster, "Panic while processing cluster message: %v", rec)
+		}
+	}()
+	var msg clusterMessage
+	if err := json.Unmarshal(msgBytes, &msg); err != nil {
+		r.xlog.Logf(common.LogSrcCluster, "Invalid cluster message: %v", err)
+		return
+	}
+	switch msg.Kind {
+	case cmsgRequest:
+		go r.requestReceived(&msg)
+	case cmsgReply:
+		r.mu.Lock()
+		replyChan, ok := r.pendingCalls[msg.Id]
+		r.mu.Unlock()
+		// No one waiting if the call has timed out
+		if ok {
+			replyChan <- &msg
+		}
+	case cmsgBroadcast:
+		var cb clusterBroadcast
+		if err := json.Unmarshal(msg.Payload, &cb); err != nil {
+			r.xlog.Logf(common.LogSrcCluster, "Invalid broadcast from %v: %v", msg.From, err)
+			return
+		}
+		r.cm.broadcast(&changeToBroadcast{
+			sourceSessionKey:        cb.SourceSessionKey,
+			sourceBaseDocRevisionId: cb.SourceBaseDocRevisionId,
+			newDocRevisionId:        cb.NewDocRevisionId,
+			receiverSessionKeys:     cb.ReceiverSessionKeys,
+			selections:              cb.Selections,
+			change:                  cb.Change,
+		})
+	case cmsgPresence:
+		var cp clusterPresence
+		if err := json.Unmarshal(msg.Payload, &cp); err != nil {
+			r.xlog.Logf(common.LogSrcCluster, "Invalid presence from %v: %v", msg.From, err)
+			return
+		}
+		r.cm.broadcastPresence(&presenceToBroadcast{
+			event:               cp.Event,
+			presence:            cp.Presence,
+			receiverSessionKeys: cp.ReceiverSessionKeys,
+		})
+	case cmsgTerminate:
+		var ct clusterTerminate
+		if err := json.Unmarshal(msg.Payload, &ct); err != nil || ct.Error == nil {
+			r.xlog.Logf(common.LogSrcCluster, "Invalid termination from %v: %v", msg.From, err)
+			return
+		}
+		r.cm.terminateSessions(ct.SessionKeys, ct.Error)
+	default:
+		r.xlog.Logf(common.LogSrcCluster, "Unknown cluster message kind from %v: %v", msg.From, msg.Kind)
+	}
+}
+
+// Performs a call requested by another instance and publishes the reply.
+func (r *docRouter) requestReceived(msg *clusterMessage) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			r.xlog.Logf(common.LogSrcCluster, "Panic while processing %v from %v: %v", msg.Method, msg.From, rec)
+		}
+	}()
+	var args clusterArgs
+	res := &clusterResult{}
+	if err := json.Unmarshal(msg.Payload, &args); err != nil {
+		r.xlog.Logf(common.LogSrcCluster, "Invalid arguments for %v from %v: %v", msg.Method, msg.From, err)
+	} else {
+		res = r.callReceived(msg.From, msg.Method, &args)
+	}
+	reply := clusterMessage{Kind: cmsgReply, Id: msg.Id, From: r.instanceId, Payload: mustMarshalJSON("cluster reply", res)}
+	r.publish(msg.From, &reply)
+}
+
+func (r *docRouter) publish(instanceId string, msg *clusterMessage) {
+	if err := r.bus.Publish(clusterTopicPrefix+instanceId, mustMarshalJSON("cluster message", msg)); err != nil {
+		r.xlog.Logf(common.LogSrcCluster, "Failed to publish %v to %v: %v", msg.Kind, instanceId, err)
+	}
+}
+
+// Performs a call on this instance, which owns the document involved.
+// from is the calling instance: for session calls coming over a socket, that's where the socket is.
+func (r *docRouter) callReceived(from, method string, args *clusterArgs) *clusterResult {
+	res := clusterResult{}
+	switch method {
+	case ccallRequestSession:
+		res.Str = r.ork.RequestSession(args.DocId, args.AuthSessionId, args.DisplayName)
+	case ccallStartSession:
+		// Remember socket's instance before the start broadcasts presence
+		r.setSessionSocket(args.SessionKey, from)
+		res.Start = r.ork.startSession(args.SessionKey, args.AuthSessionId, args.RevisionId)
+	case ccallResumeSession:
+		r.setSessionSocket(args.SessionKey, from)
+		res.Resume = r.ork.resumeSession(args.SessionKey, args.AuthSessionId, args.RevisionId)
+	case ccallIsSessionOpen:
+		res.Ok = r.ork.isSessionOpen(args.SessionKey)
+	case ccallChangeReceived:
+		if args.Selection != nil {
+			res.Ok = r.ork.changeReceived(args.SessionKey, args.RevisionId, args.Selection, args.Change)
+		}
+	case ccallSessionDetached:
+		r.ork.sessionDetached(args.SessionKey)
+	case ccallGetDocName:
+		res.Str = r.ork.GetDocumentName(args.DocId)
+	case ccallExportDocx:
+		var opts docx.Options
+		if args.Export != nil {
+			opts = *args.Export
+		}
+		res.Str = r.ork.ExportDocx(args.DocId, opts)
+	case ccallDeleteDocument:
+		r.ork.DeleteDocument(args.DocId, args.DisplayName)
+		if r.bus != nil {
+			r.mu.Lock()
+			delete(r.ownedDocs, args.DocId)
+			r.mu.Unlock()
+			if err := r.bus.ReleaseDoc(args.DocId, r.instanceId); err != nil {
+				r.xlog.Logf(common.LogSrcCluster, "Failed to release deleted document %v: %v", args.DocId, err)
+			}
+		}
+	case ccallGetEditors:
+		res.Editors = r.ork.getEditors(args.DocId)
+	case ccallCheckReadings:
+		res.Readings = r.ork.CheckReadings(args.DocId)
+	default:
+		r.xlog.Logf(common.LogSrcCluster, "Unknown call from %v: %v", from, method)
+	}
+	return &res
+}
+
+func (r *docRouter) setSessionSocket(sessionKey, instanceId string) {
+	if r.bus == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sessionSockets[sessionKey] = instanceId
+}
+
+// Gets the instances holding the sockets of the provided sessions; forgets the sessions if requested.
+func (r *docRouter) getSocketInstances(sessionKeys map[string]bool, forget bool) map[string]bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	res := make(map[string]bool)
+	for sessionKey := range sessionKeys {
+		if instanceId, ok := r.sessionSockets[sessionKey]; ok {
+			res[instanceId] = true
+			if forget {
+				delete(r.sessionSockets, sessionKey)
+			}
+		}
+	}
+	return res
+}
+
+// Creates new document. This instance becomes its owner.
+// Thread-safe.
+func (r *docRouter) CreateDocument(name string) (docId string, err error) {
+	if docId, err = r.ork.CreateDocument(name); err != nil {
+		return
+	}
+	_, err = r.getDocOwner(docId)
+	return
+}
+
+// Requests a new editing session on the document's owner. See orchestrator.RequestSession.
+// Thread-safe.
+func (r *docRouter) RequestSession(docId, authSessionId, displayName string) (sessionKey string) {
+	ownerId, err := r.getDocOwner(docId)
+	if err != nil {
+		r.xlog.Logf(common.LogSrcCluster, "Failed to find owner of document %v: %v", docId, err)
+		return ""
+	}
+	args := clusterArgs{DocId: docId, AuthSessionId: authSessionId, DisplayName: displayName}
+	if res := r.route(ownerId, ccallRequestSession, &args); res != nil {
+		sessionKey = res.Str
+	}
+	return
+}
+
+// Unloads document and moves it to the trash on the document's owner. See orchestrator.DeleteDocument.
+// Thread-safe.
+func (r *docRouter) DeleteDocument(docId, deletedBy string) {
+	ownerId, err := r.getDocOwner(docId)
+	if err != nil {
+		r.xlog.Logf(common.LogSrcCluster, "Failed to find owner of document %v: %v", docId, err)
+		return
+	}
+	r.route(ownerId, ccallDeleteDocument, &clusterArgs{DocId: docId, DisplayName: deletedBy})
+}
+
+// Moves a document back from the trash. See orchestrator.RestoreDocument.
+// Nobody owns a document in the trash, so this instance does it directly.
+// Thread-safe.
+func (r *docRouter) RestoreDocument(docId string) bool {
+	return r.ork.RestoreDocument(docId)
+}
+
+// Gets the documents in the trash. See orchestrator.ListTrash.
+// Thread-safe.
+func (r *docRouter) ListTrash() []TrashedDoc {
+	return r.ork.ListTrash()
+}
+
+// Gets the display name of the document from its owner. Returns empty string if document is not found.
+// Thread-safe.
+func (r *docRouter) GetDocumentName(docId string) string {
+	ownerId, err := r.getDocOwner(docId)
+	if err != nil {
+		r.xlog.Logf(common.LogSrcCluster, "Failed to find owner of document %v: %v", docId, err)
+		return ""
+	}
+	if res := r.route(ownerId, ccallGetDocName, &clusterArgs{DocId: docId}); res != nil {
+		return res.Str
+	}
+	return ""
+}
+
+// Exports a document into DOCX on the document's owner. See orchestrator.ExportDocx.
+// Thread-safe.
+func (r *docRouter) ExportDocx(docId string, opts docx.Options) (downloadId string) {
+	ownerId, err := r.getDocOwner(docId)
+	if err != nil {
+		r.xlog.Logf(common.LogSrcCluster, "Failed to find owner of document %v: %v", docId, err)
+		return ""
+	}
+	if res := r.route(ownerId, ccallExportDocx, &clusterArgs{DocId: docId, Export: &opts}); res != nil {
+		return res.Str
+	}
+	return ""
+}
+
+// Checks the pinyin of a document on the document's owner. See orchestrator.CheckReadings.
+// Thread-safe.
+func (r *docRouter) CheckReadings(docId string) *ReadingsReport {
+	ownerId, err := r.getDocOwner(docId)
+	if err != nil {
+		r.xlog.Logf(common.LogSrcCluster, "Failed to find owner of document %v: %v", docId, err)
+		return nil
+	}
+	if res := r.route(ownerId, ccallCheckReadings, &clusterArgs{DocId: docId}); res != nil {
+		return res.Readings
+	}
+	return nil
+}
+
+// Lists everyone currently editing the document, as the document's owner knows them.
+// A session counts from the moment its socket starts it until the socket goes away, wherever that socket is.
+// Thread-safe.
+func (r *docRouter) GetDocEditors(docId string) []sessionPresence {
+	res := make([]sessionPresence, 0)
+	ownerId, err := r.getDocOwner(docId)
+	if err != nil {
+		r.xlog.Logf(common.LogSrcCluster, "Failed to find owner of document %v: %v", docId, err)
+		return res
+	}
+	if cres := r.route(ownerId, ccallGetEditors, &clusterArgs{DocId: docId}); cres != nil && cres.Editors != nil {
+		res = cres.Editors
+	}
+	return res
+}
+
+// editSessionHandler
+
+func (r *docRouter) startSession(sessionKey, authSessionId string, cachedRevisionId int) (startMsg *sessionStartMessage) {
+	args := clusterArgs{SessionKey: sessionKey, AuthSessionId: authSessionId, RevisionId: cachedRevisionId}
+	if res := r.route(r.getSessionOwner(sessionKey), ccallStartSession, &args); res != nil {
+		startMsg = res.Start
+	}
+	return
+}
+
+func (r *docRouter) resumeSession(sessionKey, authSessionId string, lastRevisionId int) (resumeMsg *sessionResumeMessage) {
+	args := clusterArgs{SessionKey: sessionKey, AuthSessionId: authSessionId, RevisionId: lastRevisionId}
+	if res := r.route(r.getSessionOwner(sessionKey), ccallResumeSession, &args); res != nil {
+		resumeMsg = res.Resume
+	}
+	return
+}
+
+func (r *docRouter) isSessionOpen(sessionKey string) bool {
+	res := r.route(r.getSessionOwner(sessionKey), ccallIsSessionOpen, &clusterArgs{SessionKey: sessionKey})
+	return res != nil && res.Ok
+}
+
+func (r *docRouter) changeReceived(sessionKey string, clientRevisionId int, sel *sessionSelection, cs *biscript.ChangeSet) bool {
+	args := clusterArgs{SessionKey: sessionKey, RevisionId: clientRevisionId, Selection: sel, Change: cs}
+	res := r.route(r.getSessionOwner(sessionKey), ccallChangeReceived, &args)
+	return res != nil && res.Ok
+}
+
+func (r *docRouter) sessionDetached(sessionKey string) {
+	r.route(r.getSessionOwner(sessionKey), ccallSessionDetached, &clusterArgs{SessionKey: sessionKey})
+}
+
+// peerMessenger
+
+func (r *docRouter) broadcast(ctb *changeToBroadcast) {
+	if r.bus == nil {
+		r.cm.broadcast(ctb)
+		return
+	}
+	cb := clusterBroadcast{
+		SourceSessionKey:        ctb.sourceSessionKey,
+		SourceBaseDocRevisionId: ctb.sourceBaseDocRevisionId,
+		NewDocRevisionId:        ctb.newDocRevisionId,
+		ReceiverSessionKeys:     ctb.receiverSessionKeys,
+		Selections:              ctb.selections,
+		Change:                  ctb.change,
+	}
+	r.relay(ctb.receiverSessionKeys, false, cmsgBroadcast, &cb, func() { r.cm.broadcast(ctb) })
+}
+
+func (r *docRouter) terminateSessions(sessionKeys map[string]bool, perr *protocolError) {
+	if r.bus == nil {
+		r.cm.terminateSessions(sessionKeys, perr)
+		return
+	}
+	ct := clusterTerminate{SessionKeys: sessionKeys, Error: perr}
+	r.relay(sessionKeys, true, cmsgTerminate, &ct, func() { r.cm.terminateSessions(sessionKeys, perr) })
+}
+
+func (r *docRouter) broadcastPresence(ptb *presenceToBroadcast) {
+	if r.bus == nil {
+		r.cm.broadcastPresence(ptb)
+		return
+	}
+	cp := clusterPresence{
+		Event:               ptb.event,
+		Presence:            ptb.presence,
+		ReceiverSessionKeys: ptb.receiverSessionKeys,
+	}
+	r.relay(ptb.receiverSessionKeys, false, cmsgPresence, &cp, func() { r.cm.broadcastPresence(ptb) })
+}
+
+// Forgets where the sockets of sessions that have ended are.
+func (r *docRouter) sessionsEnded(sessionKeys []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, sessionKey := range sessionKeys {
+		delete(r.sessionSockets, sessionKey)
+	}
+}
+
+// Gives up ownership of a document the orchestrator has unloaded, so another instance can claim it.
+// If a request has loaded the document again in the meantime, claims it back; if another instance
+// has claimed it first, drops it from memory here.
+func (r *docRouter) docUnloaded(docId string) {
+	if r.bus == nil {
+		return
+	}
+	r.mu.Lock()
+	delete(r.ownedDocs, docId)
+	r.mu.Unlock()
+	if err := r.bus.ReleaseDoc(docId, r.instanceId); err != nil {
+		r.xlog.Logf(common.LogSrcCluster, "Failed to release unloaded document %v: %v", docId, err)
+	}
+	if !r.ork.isDocLoaded(docId) {
+		return
+	}
+	ownerId, err := r.getDocOwner(docId)
+	if err != nil {
+		r.xlog.Logf(common.LogSrcCluster, "Failed to claim reloaded document %v: %v", docId, err)
+		return
+	}
+	if ownerId != r.instanceId {
+		r.xlog.Logf(common.LogSrcCluster, "Reloaded document %v is now owned by %v; dropping it", docId, ownerId)
+		r.ork.abandonDocument(docId, false)
+	}
+}
+
+// Sends a message to every instance that holds the socket of one of the sessions.
+// For sockets on this instance, calls deliverLocally instead.
+func (r *docRouter) relay(sessionKeys map[string]bool, forget bool, kind string, payload interface{}, deliverLocally func()) {
+	var msg *clusterMessage
+	for instanceId := range r.getSocketInstances(sessionKeys, forget) {
+		if instanceId == r.instanceId {
+			deliverLocally()
+			continue
+		}
+		if msg == nil {
+			msg = &clusterMessage{Kind: kind, From: r.instanceId, Payload: mustMarshalJSON("cluster "+kind, payload)}
+		}
+		r.publish(instanceId, msg)
+	}
+}
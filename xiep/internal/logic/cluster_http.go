@@ -0,0 +1,262 @@
+package logic
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"xiep/internal/common"
+)
+
+// Paths and headers of the HTTP endpoints instances use to talk to each other.
+const (
+	ClusterPathPrefix   = "/cluster/"            // Web server routes everything under this to HTTPBus
+	clusterPathPublish  = "/cluster/publish/"    // Message for a topic; body is the message
+	clusterPathLease    = "/cluster/lease/"      // Lease operation on the lease holder; body is clusterLeaseRequest
+	clusterSecretHeader = "X-Xiep-Cluster-Key"   // Carries the shared secret
+	clusterTopicHeader  = "X-Xiep-Cluster-Topic" // Topic of a published message
+	clusterMaxBodyBytes = 64 * 1024 * 1024
+)
+
+// Kinds of lease operations.
+const (
+	cleaseClaim   = "claim"
+	cleaseRenew   = "renew"
+	cleaseRelease = "release"
+)
+
+type clusterLeaseRequest struct {
+	Op         string   `json:"op"`
+	InstanceId string   `json:"instanceId"`
+	DocIds     []string `json:"docIds"`
+}
+
+type clusterLeaseReply struct {
+	OwnerId string   `json:"ownerId,omitempty"`
+	Lost    []string `json:"lost,omitempty"`
+}
+
+// Cluster bus connecting instances over HTTP. Every instance knows the base URL of every other one,
+// and messages go straight to the instance whose topic they are published to.
+// One instance, the lease holder, keeps track of document owners; the others ask it over HTTP.
+// If the lease holder restarts, owners get their documents back as they renew their leases,
+// unless someone else claims them first.
+type HTTPBus struct {
+	xlog        common.XieLogger
+	instanceId  string
+	peers       map[string]string // Instance ID to base URL
+	secret      []byte
+	leaseHolder string
+	leases      *leaseTable // Only on the lease holder
+	client      *http.Client
+	done        chan struct{}
+
+	mu       sync.Mutex
+	handlers map[string]*messageQueue // Incoming messages, by topic
+	senders  map[string]*messageQueue // Outgoing messages, by topic
+}
+
+// Creates the bus from the config's cluster settings.
+func NewHTTPBus(config *common.Config, xlog common.XieLogger) (*HTTPBus, error) {
+	if config.InstanceId == "" || config.ClusterPeers[config.InstanceId] == "" {
+		return nil, fmt.Errorf("instance ID '%v' must be one of the cluster's peers", config.InstanceId)
+	}
+	if config.ClusterPeers[config.ClusterLeaseHolder] == "" {
+		return nil, fmt.Errorf("lease holder '%v' must be one of the cluster's peers", config.ClusterLeaseHolder)
+	}
+	if config.ClusterSecret == "" {
+		return nil, errors.New("cluster secret must not be empty")
+	}
+	// Only one process can have a bolt database open
+	if config.DocStore == DocStoreBolt {
+		return nil, errors.New("instances in a cluster cannot share a bolt document store; use files")
+	}
+	hb := HTTPBus{
+		xlog:        xlog,
+		instanceId:  config.InstanceId,
+		peers:       make(map[string]string),
+		secret:      []byte(config.ClusterSecret),
+		leaseHolder: config.ClusterLeaseHolder,
+		client:      &http.Client{Timeout: clusterCallTimeoutMsec * time.Millisecond},
+		done:        make(chan struct{}),
+		handlers:    make(map[string]*messageQueue),
+		senders:     make(map[string]*messageQueue),
+	}
+	for id, url := range config.ClusterPeers {
+		hb.peers[id] = strings.TrimSuffix(url, "/")
+	}
+	if hb.leaseHolder == hb.instanceId {
+		hb.leases = newLeaseTable(clusterLeaseSeconds * time.Second)
+	}
+	return &hb, nil
+}
+
+// Stops sending and delivering messages.
+func (hb *HTTPBus) Close() {
+	close(hb.done)
+}
+
+func (hb *HTTPBus) Publish(topic string, msg []byte) error {
+	url, ok := hb.peers[strings.TrimPrefix(topic, clusterTopicPrefix)]
+	if !ok {
+		return fmt.Errorf("no instance for topic %v", topic)
+	}
+	// One sender per topic posts its messages one after the other, which keeps them in order
+	hb.mu.Lock()
+	sender, ok := hb.senders[topic]
+	if !ok {
+		sender = newMessageQueue(func(msg []byte) { hb.send(url, topic, msg) }, hb.done)
+		hb.senders[topic] = sender
+	}
+	hb.mu.Unlock()
+	sender.push(msg)
+	return nil
+}
+
+// Posts a message to another instance. Like any pub/sub, if it doesn't get there, it's lost.
+func (hb *HTTPBus) send(url, topic string, msg []byte) {
+	req, err := http.NewRequest(http.MethodPost, url+clusterPathPublish, bytes.NewReader(msg))
+	if err != nil {
+		hb.xlog.Logf(common.LogSrcCluster, "Failed to create request for topic %v: %v", topic, err)
+		return
+	}
+	req.Header.Set(clusterSecretHeader, string(hb.secret))
+	req.Header.Set(clusterTopicHeader, topic)
+	resp, err := hb.client.Do(req)
+	if err != nil {
+		hb.xlog.Logf(common.LogSrcCluster, "Failed to send message for topic %v: %v", topic, err)
+		return
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		hb.xlog.Logf(common.LogSrcCluster, "Message for topic %v refused with status %v", topic, resp.StatusCode)
+	}
+}
+
+func (hb *HTTPBus) Subscribe(topic string, handler func(msg []byte)) error {
+	hb.mu.Lock()
+	defer hb.mu.Unlock()
+
+	hb.handlers[topic] = newMessageQueue(handler, hb.done)
+	return nil
+}
+
+func (hb *HTTPBus) ClaimDoc(docId, instanceId string) (ownerId string, err error) {
+	reply, err := hb.lease(&clusterLeaseRequest{Op: cleaseClaim, InstanceId: instanceId, DocIds: []string{docId}})
+	if err != nil {
+		return "", err
+	}
+	return reply.OwnerId, nil
+}
+
+func (hb *HTTPBus) RenewDocs(docIds []string, instanceId string) (lost []string, err error) {
+	reply, err := hb.lease(&clusterLeaseRequest{Op: cleaseRenew, InstanceId: instanceId, DocIds: docIds})
+	if err != nil {
+		return nil, err
+	}
+	return reply.Lost, nil
+}
+
+func (hb *HTTPBus) ReleaseDoc(docId, instanceId string) error {
+	_, err := hb.lease(&clusterLeaseRequest{Op: cleaseRelease, InstanceId: instanceId, DocIds: []string{docId}})
+	return err
+}
+
+// Performs a lease operation on the lease holder, locally if that's us.
+func (hb *HTTPBus) lease(lreq *clusterLeaseRequest) (*clusterLeaseReply, error) {
+	if hb.leases != nil {
+		return hb.doLease(lreq)
+	}
+	req, err := http.NewRequest(http.MethodPost, hb.peers[hb.leaseHolder]+clusterPathLease,
+		bytes.NewReader(mustMarshalJSON("lease request", lreq)))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(clusterSecretHeader, string(hb.secret))
+	resp, err := hb.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("lease holder answered with status %v", resp.StatusCode)
+	}
+	var reply clusterLeaseReply
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		return nil, err
+	}
+	return &reply, nil
+}
+
+// Performs a lease operation on this instance, which is the lease holder.
+func (hb *HTTPBus) doLease(lreq *clusterLeaseRequest) (*clusterLeaseReply, error) {
+	var reply clusterLeaseReply
+	switch lreq.Op {
+	case cleaseClaim:
+		if len(lreq.DocIds) != 1 {
+			return nil, errors.New("claim expects exactly one document")
+		}
+		reply.OwnerId = hb.leases.claim(lreq.DocIds[0], lreq.InstanceId)
+	case cleaseRenew:
+		reply.Lost = hb.leases.renew(lreq.DocIds, lreq.InstanceId)
+	case cleaseRelease:
+		for _, docId := range lreq.DocIds {
+			hb.leases.release(docId, lreq.InstanceId)
+		}
+	default:
+		return nil, fmt.Errorf("unknown lease operation: %v", lreq.Op)
+	}
+	return &reply, nil
+}
+
+// Serves requests from other instances under ClusterPathPrefix.
+func (hb *HTTPBus) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get(clusterSecretHeader)), hb.secret) != 1 {
+		hb.xlog.Logf(common.LogSrcCluster, "Refused cluster request from %v without the right key", r.RemoteAddr)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, clusterMaxBodyBytes))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	switch r.URL.Path {
+	case clusterPathPublish:
+		hb.mu.Lock()
+		handler, ok := hb.handlers[r.Header.Get(clusterTopicHeader)]
+		hb.mu.Unlock()
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		handler.push(body)
+		w.WriteHeader(http.StatusNoContent)
+	case clusterPathLease:
+		var lreq clusterLeaseRequest
+		if hb.leases == nil || json.Unmarshal(body, &lreq) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		reply, err := hb.doLease(&lreq)
+		if err != nil {
+			hb.xlog.Logf(common.LogSrcCluster, "Invalid lease request from %v: %v", lreq.InstanceId, err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(mustMarshalJSON("lease reply", reply))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
@@ -0,0 +1,149 @@
+package logic
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"xiep/internal/common"
+)
+
+// Starts an HTTP bus for each instance ID, each behind a web server of its own; the first instance holds the leases.
+// Replacing a bus in the returned map puts the new one behind the instance's web server.
+func newTestHTTPBuses(t *testing.T, instanceIds ...string) map[string]*HTTPBus {
+	peers := make(map[string]string)
+	buses := make(map[string]*HTTPBus)
+	for _, id := range instanceIds {
+		id := id
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			buses[id].ServeHTTP(w, r)
+		}))
+		t.Cleanup(srv.Close)
+		peers[id] = srv.URL + "/"
+	}
+	for _, id := range instanceIds {
+		buses[id] = newTestHTTPBus(t, id, peers, instanceIds[0])
+	}
+	return buses
+}
+
+func newTestHTTPBus(t *testing.T, instanceId string, peers map[string]string, leaseHolder string) *HTTPBus {
+	cfg := common.Config{InstanceId: instanceId, ClusterPeers: peers, ClusterSecret: "sesame", ClusterLeaseHolder: leaseHolder}
+	hb, err := NewHTTPBus(&cfg, testLogger{})
+	if err != nil {
+		t.Fatalf("Failed to create bus: %v", err)
+	}
+	t.Cleanup(hb.Close)
+	return hb
+}
+
+func TestHTTPBus_MessagesAndLeases(t *testing.T) {
+	buses := newTestHTTPBuses(t, "a", "b")
+
+	// Messages arrive in the order they were published
+	received := make(chan []byte, 16)
+	_ = buses["b"].Subscribe(clusterTopicPrefix+"b", func(msg []byte) { received <- msg })
+	for i := 0; i < 10; i++ {
+		_ = buses["a"].Publish(clusterTopicPrefix+"b", []byte(strconv.Itoa(i)))
+	}
+	for i := 0; i < 10; i++ {
+		if msg := receiveWithTimeout(t, received); msg != strconv.Itoa(i) {
+			t.Fatalf("Expected message %v, got %v", i, msg)
+		}
+	}
+	if err := buses["a"].Publish(clusterTopicPrefix+"c", []byte("x")); err == nil {
+		t.Errorf("Publishing to unknown instance succeeded")
+	}
+
+	// B's claims go to A, which holds the leases
+	if owner, err := buses["b"].ClaimDoc("doc1", "b"); owner != "b" || err != nil {
+		t.Errorf("Claim through B failed: %v, %v", owner, err)
+	}
+	if owner, _ := buses["a"].ClaimDoc("doc1", "a"); owner != "b" {
+		t.Errorf("Claim while B holds lease returned %v", owner)
+	}
+	_, _ = buses["a"].ClaimDoc("doc2", "a")
+	if lost, err := buses["b"].RenewDocs([]string{"doc1", "doc2"}, "b"); err != nil || len(lost) != 1 || lost[0] != "doc2" {
+		t.Errorf("Wrong result renewing leases: %v, %v", lost, err)
+	}
+	_ = buses["b"].ReleaseDoc("doc1", "b")
+	if owner, _ := buses["a"].ClaimDoc("doc1", "a"); owner != "a" {
+		t.Errorf("Claim after release returned %v", owner)
+	}
+}
+
+func TestHTTPBus_LeaseHolderRestarts(t *testing.T) {
+	buses := newTestHTTPBuses(t, "a", "b", "c")
+	_, _ = buses["b"].ClaimDoc("doc1", "b")
+	_, _ = buses["c"].ClaimDoc("doc2", "c")
+
+	// Lease holder comes back with an empty table; C claims B's document before B renews
+	peers := make(map[string]string)
+	for id, hb := range buses {
+		peers[id] = hb.peers[id] + "/"
+	}
+	buses["a"] = newTestHTTPBus(t, "a", peers, "a")
+	if owner, _ := buses["c"].ClaimDoc("doc1", "c"); owner != "c" {
+		t.Fatalf("C failed to claim document after restart")
+	}
+
+	// B gets back what nobody else claimed, and learns which document it lost
+	if lost, err := buses["b"].RenewDocs([]string{"doc1", "doc3"}, "b"); err != nil || len(lost) != 1 || lost[0] != "doc1" {
+		t.Errorf("Wrong result renewing B's leases after restart: %v, %v", lost, err)
+	}
+	if lost, err := buses["c"].RenewDocs([]string{"doc1", "doc2"}, "c"); err != nil || len(lost) != 0 {
+		t.Errorf("Wrong result renewing C's leases after restart: %v, %v", lost, err)
+	}
+	if owner, _ := buses["a"].ClaimDoc("doc3", "a"); owner != "b" {
+		t.Errorf("Renewed lease not held after restart; owner: %v", owner)
+	}
+}
+
+func TestHTTPBus_RefusesWrongKey(t *testing.T) {
+	buses := newTestHTTPBuses(t, "a")
+	for _, key := range []string{"", "open sesame"} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, clusterPathLease, strings.NewReader(`{"op":"release","docIds":["doc1"]}`))
+		if key != "" {
+			r.Header.Set(clusterSecretHeader, key)
+		}
+		buses["a"].ServeHTTP(w, r)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("Expected 403 with key '%v', got %v", key, w.Code)
+		}
+	}
+}
+
+func TestHTTPBus_RefusesBoltStore(t *testing.T) {
+	cfg := common.Config{
+		InstanceId:         "a",
+		ClusterPeers:       map[string]string{"a": "http://localhost/"},
+		ClusterSecret:      "sesame",
+		ClusterLeaseHolder: "a",
+		DocStore:           DocStoreBolt,
+	}
+	if _, err := NewHTTPBus(&cfg, testLogger{}); err == nil {
+		t.Errorf("Cluster created with bolt document store")
+	}
+}
+
+func TestCluster_TwoInstancesOverHTTP(t *testing.T) {
+	buses := newTestHTTPBuses(t, "a", "b")
+	docsFolder, exportsFolder := t.TempDir(), t.TempDir()
+	appA := newClusterTestApp(t, buses["a"], "a", docsFolder, exportsFolder)
+	appB := newClusterTestApp(t, buses["b"], "b", docsFolder, exportsFolder)
+
+	docId, _ := appA.Docs.CreateDocument("Momo")
+	if name := appB.Docs.GetDocumentName(docId); name != "Momo" {
+		t.Errorf("Wrong name through other instance: %v", name)
+	}
+	keyBob := appB.Docs.RequestSession(docId, "bob", "Bob")
+	if !strings.HasPrefix(keyBob, "S-a.") {
+		t.Fatalf("Session key doesn't point to owner: %v", keyBob)
+	}
+	connectClusterTestPeer(t, appB, "bob", keyBob)
+	if editors := appB.Docs.GetDocEditors(docId); len(editors) != 1 || editors[0].SessionKey != keyBob {
+		t.Errorf("Wrong editors through B: %+v", editors)
+	}
+}
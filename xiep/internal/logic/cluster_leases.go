@@ -0,0 +1,69 @@
+package logic
+
+import (
+	"sync"
+	"time"
+)
+
+// Document owners, each with a lease that runs out unless the owner keeps renewing it.
+// Bus implementations that keep ownership in memory use this to decide claims.
+type leaseTable struct {
+	mu       sync.Mutex
+	duration time.Duration
+	leases   map[string]docLease
+}
+
+type docLease struct {
+	ownerId   string
+	expiryUtc time.Time
+}
+
+func newLeaseTable(duration time.Duration) *leaseTable {
+	return &leaseTable{
+		duration: duration,
+		leases:   make(map[string]docLease),
+	}
+}
+
+// Gives instanceId a fresh lease on the document, unless another instance holds one that has not expired.
+// Returns the owner.
+func (lt *leaseTable) claim(docId, instanceId string) (ownerId string) {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+
+	utcNow := time.Now().UTC()
+	if lease, ok := lt.leases[docId]; ok && lease.ownerId != instanceId && lease.expiryUtc.After(utcNow) {
+		return lease.ownerId
+	}
+	lt.leases[docId] = docLease{instanceId, utcNow.Add(lt.duration)}
+	return instanceId
+}
+
+// Extends the leases instanceId holds on the documents. Returns the documents another instance holds a valid
+// lease on. Leases the table doesn't know, e.g. because the lease holder has restarted, or that have expired
+// without anyone else claiming the document, go back to instanceId.
+func (lt *leaseTable) renew(docIds []string, instanceId string) (lost []string) {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+
+	utcNow := time.Now().UTC()
+	lost = make([]string, 0)
+	for _, docId := range docIds {
+		if lease, ok := lt.leases[docId]; ok && lease.ownerId != instanceId && lease.expiryUtc.After(utcNow) {
+			lost = append(lost, docId)
+			continue
+		}
+		lt.leases[docId] = docLease{instanceId, utcNow.Add(lt.duration)}
+	}
+	return
+}
+
+// Ends instanceId's lease on the document, if it holds one.
+func (lt *leaseTable) release(docId, instanceId string) {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+
+	if lt.leases[docId].ownerId == instanceId {
+		delete(lt.leases, docId)
+	}
+}
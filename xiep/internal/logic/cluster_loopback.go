@@ -0,0 +1,106 @@
+package logic
+
+import (
+	"sync"
+	"time"
+)
+
+// Cluster bus connecting instances that run in the same process. Used for tests, and as the reference
+// for what a networked implementation must guarantee.
+type LoopbackBus struct {
+	mu          sync.Mutex
+	subscribers map[string]*messageQueue
+	leases      *leaseTable
+	done        chan struct{}
+}
+
+// Delivers messages to one handler, in order, from a goroutine of its own, so publishers never wait.
+type messageQueue struct {
+	mu      sync.Mutex
+	queue   [][]byte
+	wake    chan struct{}
+	handler func(msg []byte)
+}
+
+func NewLoopbackBus() *LoopbackBus {
+	return &LoopbackBus{
+		subscribers: make(map[string]*messageQueue),
+		leases:      newLeaseTable(clusterLeaseSeconds * time.Second),
+		done:        make(chan struct{}),
+	}
+}
+
+// Stops delivering messages.
+func (lb *LoopbackBus) Close() {
+	close(lb.done)
+}
+
+func (lb *LoopbackBus) Publish(topic string, msg []byte) error {
+	lb.mu.Lock()
+	sub, ok := lb.subscribers[topic]
+	lb.mu.Unlock()
+	// Like any pub/sub, nobody listening means the message is lost
+	if !ok {
+		return nil
+	}
+	sub.push(msg)
+	return nil
+}
+
+func (lb *LoopbackBus) Subscribe(topic string, handler func(msg []byte)) error {
+	lb.mu.Lock()
+	lb.subscribers[topic] = newMessageQueue(handler, lb.done)
+	lb.mu.Unlock()
+	return nil
+}
+
+// Creates a queue, and starts delivering its messages to handler until done is closed.
+func newMessageQueue(handler func(msg []byte), done chan struct{}) *messageQueue {
+	mq := &messageQueue{
+		wake:    make(chan struct{}, 1),
+		handler: handler,
+	}
+	go mq.deliver(done)
+	return mq
+}
+
+// Appends a message to the queue without waiting for the handler.
+func (mq *messageQueue) push(msg []byte) {
+	mq.mu.Lock()
+	mq.queue = append(mq.queue, msg)
+	mq.mu.Unlock()
+	select {
+	case mq.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (mq *messageQueue) deliver(done chan struct{}) {
+	for {
+		select {
+		case <-mq.wake:
+		case <-done:
+			return
+		}
+		mq.mu.Lock()
+		batch := mq.queue
+		mq.queue = nil
+		mq.mu.Unlock()
+		for _, msg := range batch {
+			mq.handler(msg)
+		}
+	}
+}
+
+func (lb *LoopbackBus) ClaimDoc(docId, instanceId string) (ownerId string, err error) {
+	return lb.leases.claim(docId, instanceId), nil
+}
+
+func (lb *LoopbackBus) RenewDocs(docIds []string, instanceId string) (lost []string, err error) {
+	return lb.leases.renew(docIds, instanceId), nil
+}
+
+func (lb *LoopbackBus) ReleaseDoc(docId, instanceId string) error {
+	lb.leases.release(docId, instanceId)
+	return nil
+}
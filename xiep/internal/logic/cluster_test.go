@@ -0,0 +1,321 @@
+package logic
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+	"xiep/internal/common"
+)
+
+// Starts an app instance on the shared bus, using the shared docs and exports folders.
+func newClusterTestApp(t *testing.T, bus ClusterBus, instanceId, docsFolder, exportsFolder string) *xieApp {
+	var app xieApp
+	cfg := common.Config{
+		DocsFolder:    docsFolder,
+		ExportsFolder: exportsFolder,
+		InstanceId:    instanceId,
+	}
+	app.init(&cfg, testLogger{}, nil, bus)
+	t.Cleanup(app.Shutdown)
+	return &app
+}
+
+// Connects a JSON-protocol socket client to an instance and starts its session.
+func connectClusterTestPeer(t *testing.T, app *xieApp, authSessionId, sessionKey string) (receive func([]byte), send <-chan []byte) {
+	receive, send, _ = app.ConnectionManager.NewConnection("1.1.1.1", authSessionId, SubprotocolJSONv1)
+	receive([]byte(`{"type":"sessionKey","payload":{"sessionKey":"` + sessionKey + `"}}`))
+	if msg := receiveWithTimeout(t, send); !strings.HasPrefix(msg, `{"type":"hello"`) {
+		t.Fatalf("Expected hello, got %v", msg)
+	}
+	return
+}
+
+// Waits for the next message of the given type, skipping others.
+func receiveTypeWithTimeout(t *testing.T, send <-chan []byte, msgType string) map[string]interface{} {
+	for {
+		var env struct {
+			Type    string                 `json:"type"`
+			Payload map[string]interface{} `json:"payload"`
+		}
+		msg := receiveWithTimeout(t, send)
+		if err := json.Unmarshal([]byte(msg), &env); err != nil {
+			t.Fatalf("Invalid message: %v", msg)
+		}
+		if env.Type == msgType {
+			return env.Payload
+		}
+	}
+}
+
+func TestCluster_TwoInstancesShareDocument(t *testing.T) {
+	bus := NewLoopbackBus()
+	defer bus.Close()
+	docsFolder, exportsFolder := t.TempDir(), t.TempDir()
+	appA := newClusterTestApp(t, bus, "a", docsFolder, exportsFolder)
+	appB := newClusterTestApp(t, bus, "b", docsFolder, exportsFolder)
+
+	// Document created on A is owned by A
+	docId, err := appA.Docs.CreateDocument("Momo")
+	if err != nil {
+		t.Fatalf("Failed to create document: %v", err)
+	}
+	if name := appB.Docs.GetDocumentName(docId); name != "Momo" {
+		t.Errorf("Wrong name through other instance: %v", name)
+	}
+
+	// Bob opens the doc through B, and his socket connects to B; Alice does everything on A
+	keyBob := appB.Docs.RequestSession(docId, "bob", "Bob")
+	if !strings.HasPrefix(keyBob, "S-a.") {
+		t.Fatalf("Session key doesn't point to owner: %v", keyBob)
+	}
+	receiveBob, sendBob := connectClusterTestPeer(t, appB, "bob", keyBob)
+	keyAlice := appA.Docs.RequestSession(docId, "alice", "Alice")
+	_, sendAlice := connectClusterTestPeer(t, appA, "alice", keyAlice)
+	if len(appB.Orchestrator.getLoadedDocs()) != 0 {
+		t.Errorf("Document loaded on instance that doesn't own it")
+	}
+
+	// Bob hears about Alice joining, relayed from A
+	if pl := receiveTypeWithTimeout(t, sendBob, "presence"); pl["event"] != presenceEventJoin {
+		t.Errorf("Expected join, got %v", pl)
+	}
+	if editors := appB.Docs.GetDocEditors(docId); len(editors) != 2 {
+		t.Errorf("Expected 2 editors through B, got %+v", editors)
+	}
+
+	// Bob types on B: A applies change, Alice gets update on A, Bob's ack is relayed to B
+	receiveBob([]byte(`{"type":"change","payload":{"revisionId":0,"selection":{"start":1,"end":1},` +
+		`"change":{"lengthBefore":0,"lengthAfter":1,"items":[{"hanzi":"狗","pinyin":"gou3"}]}}}`))
+	if pl := receiveTypeWithTimeout(t, sendBob, "ackChange"); pl["revisionId"] != 1.0 {
+		t.Errorf("Wrong ack: %v", pl)
+	}
+	pl := receiveTypeWithTimeout(t, sendAlice, "update")
+	if pl["sourceSessionKey"] != keyBob || pl["change"] == nil {
+		t.Errorf("Wrong update: %v", pl)
+	}
+
+	// Bob's socket on B goes away: Alice sees him leave
+	receiveBob(nil)
+	if pl := receiveTypeWithTimeout(t, sendAlice, "presence"); pl["event"] != presenceEventLeave {
+		t.Errorf("Expected leave, got %v", pl)
+	}
+
+	// Deleting through B releases ownership
+	appB.Docs.DeleteDocument(docId, "Bob")
+	if owner, _ := bus.ClaimDoc(docId, "c"); owner != "c" {
+		t.Errorf("Deleted document still owned by %v", owner)
+	}
+	_ = bus.ReleaseDoc(docId, "c")
+	if appA.Docs.GetDocumentName(docId) != "" {
+		t.Errorf("Deleted document still has a name")
+	}
+}
+
+func TestCluster_SlowRequestDoesNotHoldUpReplies(t *testing.T) {
+	bus := NewLoopbackBus()
+	defer bus.Close()
+	docsFolder, exportsFolder := t.TempDir(), t.TempDir()
+	appA := newClusterTestApp(t, bus, "a", docsFolder, exportsFolder)
+	appB := newClusterTestApp(t, bus, "b", docsFolder, exportsFolder)
+	docA, _ := appA.Docs.CreateDocument("Momo")
+	docB, _ := appB.Docs.CreateDocument("Beppo")
+
+	// B's request to A is stuck while A's orchestrator is locked
+	appA.Orchestrator.mu.Lock()
+	defer appA.Orchestrator.mu.Unlock()
+	go appB.Docs.GetDocumentName(docA)
+	time.Sleep(50 * time.Millisecond)
+
+	// A still gets B's reply to its own call
+	names := make(chan string, 1)
+	go func() { names <- appA.Docs.GetDocumentName(docB) }()
+	select {
+	case name := <-names:
+		if name != "Beppo" {
+			t.Errorf("Wrong name through other instance: %v", name)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Reply held up by request that is still being handled")
+	}
+}
+
+func TestCluster_OwnerReleasedAtShutdown(t *testing.T) {
+	bus := NewLoopbackBus()
+	defer bus.Close()
+	docsFolder, exportsFolder := t.TempDir(), t.TempDir()
+	var appA xieApp
+	appA.init(&common.Config{DocsFolder: docsFolder, ExportsFolder: exportsFolder, InstanceId: "a"}, testLogger{}, nil, bus)
+	docId, _ := appA.Docs.CreateDocument("Momo")
+	appA.Shutdown()
+
+	appB := newClusterTestApp(t, bus, "b", docsFolder, exportsFolder)
+	start := time.Now()
+	if appB.Docs.RequestSession(docId, "bob", "") == "" || time.Since(start) > time.Second {
+		t.Errorf("Document not taken over after owner shut down")
+	}
+}
+
+func TestCluster_EditorsSameWithAndWithoutBus(t *testing.T) {
+	for _, clustered := range []bool{false, true} {
+		var bus ClusterBus
+		if clustered {
+			lb := NewLoopbackBus()
+			defer lb.Close()
+			bus = lb
+		}
+		app := newClusterTestApp(t, bus, "a", t.TempDir(), t.TempDir())
+		docId, _ := app.Docs.CreateDocument("Momo")
+		// Requested but not started yet: not an editor
+		key := app.Docs.RequestSession(docId, "alice", "Alice")
+		if editors := app.Docs.GetDocEditors(docId); len(editors) != 0 {
+			t.Errorf("Clustered %v: session counted before it started: %+v", clustered, editors)
+		}
+		receive, _ := connectClusterTestPeer(t, app, "alice", key)
+		if editors := app.Docs.GetDocEditors(docId); len(editors) != 1 || editors[0].SessionKey != key {
+			t.Errorf("Clustered %v: wrong editors with socket attached: %+v", clustered, editors)
+		}
+		receive(nil)
+		if editors := app.Docs.GetDocEditors(docId); len(editors) != 0 {
+			t.Errorf("Clustered %v: session counted after its socket went away: %+v", clustered, editors)
+		}
+	}
+}
+
+func TestCluster_CrashedOwnerLeaseExpires(t *testing.T) {
+	bus := NewLoopbackBus()
+	defer bus.Close()
+	bus.leases.duration = 50 * time.Millisecond
+	docsFolder, exportsFolder := t.TempDir(), t.TempDir()
+	appB := newClusterTestApp(t, bus, "b", docsFolder, exportsFolder)
+	docId, _ := appB.Docs.CreateDocument("Momo")
+	_ = bus.ReleaseDoc(docId, "b")
+
+	// Owner that claims the document, then dies without releasing it
+	if owner, _ := bus.ClaimDoc(docId, "ghost"); owner != "ghost" {
+		t.Fatalf("Ghost failed to claim document")
+	}
+	if owner, _ := bus.ClaimDoc(docId, "b"); owner != "ghost" {
+		t.Errorf("Document taken over while lease is valid")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if key := appB.Docs.RequestSession(docId, "bob", "Bob"); !strings.HasPrefix(key, "S-b.") {
+		t.Errorf("Document not taken over after lease expired; session key: %v", key)
+	}
+}
+
+func TestCluster_LostLeaseAbandonsDocument(t *testing.T) {
+	bus := NewLoopbackBus()
+	defer bus.Close()
+	docsFolder, exportsFolder := t.TempDir(), t.TempDir()
+	appA := newClusterTestApp(t, bus, "a", docsFolder, exportsFolder)
+	docId, _ := appA.Docs.CreateDocument("Momo")
+	key := appA.Docs.RequestSession(docId, "alice", "Alice")
+	_, send := connectClusterTestPeer(t, appA, "alice", key)
+
+	// Renewal keeps the lease
+	appA.Docs.renewLeases()
+	if len(appA.Orchestrator.getLoadedDocs()) != 1 {
+		t.Fatalf("Document dropped although lease was renewed")
+	}
+
+	// Lease holder restarts and forgets every lease: A keeps its document
+	bus.leases = newLeaseTable(clusterLeaseSeconds * time.Second)
+	appA.Docs.renewLeases()
+	if len(appA.Orchestrator.getLoadedDocs()) != 1 {
+		t.Fatalf("Document dropped after lease holder restarted")
+	}
+	if owner, _ := bus.ClaimDoc(docId, "b"); owner != "a" {
+		t.Fatalf("Lease not granted again after lease holder restarted; owner: %v", owner)
+	}
+
+	// A stalls past its lease, and B takes over in the meantime
+	bus.leases.release(docId, "a")
+	if owner, _ := bus.ClaimDoc(docId, "b"); owner != "b" {
+		t.Fatalf("B failed to claim document")
+	}
+	appA.Docs.renewLeases()
+	if len(appA.Orchestrator.getLoadedDocs()) != 0 {
+		t.Errorf("Document still loaded after lease was lost")
+	}
+	if pl := receiveTypeWithTimeout(t, send, "error"); pl["code"] != errDocMoved {
+		t.Errorf("Expected doc moved error, got %v", pl)
+	}
+}
+
+func TestCluster_UnloadingReleasesDocument(t *testing.T) {
+	bus := NewLoopbackBus()
+	defer bus.Close()
+	docsFolder, exportsFolder := t.TempDir(), t.TempDir()
+	appA := newClusterTestApp(t, bus, "a", docsFolder, exportsFolder)
+	docId, _ := appA.Docs.CreateDocument("Momo")
+	key := appA.Docs.RequestSession(docId, "alice", "Alice")
+	receive, _ := connectClusterTestPeer(t, appA, "alice", key)
+
+	// Alice's socket goes away, and she doesn't come back
+	receive(nil)
+	ld := appA.Orchestrator.lockDoc(docId)
+	ld.sessions[key].detachedUtc = time.Now().UTC().Add(-(orkSessionResumeGraceSeconds + 1) * time.Second)
+	ld.doc.lastAccessedUtc = time.Now().UTC().Add(-(orkUnloadAfterSeconds + 1) * time.Second)
+	ld.mu.Unlock()
+	appA.Orchestrator.cleanupSessions()
+	if len(appA.Docs.sessionSockets) != 0 {
+		t.Errorf("Socket of ended session still known: %v", appA.Docs.sessionSockets)
+	}
+
+	// Unloaded document is up for grabs
+	appA.Orchestrator.housekeepDocs()
+	if len(appA.Orchestrator.getLoadedDocs()) != 0 {
+		t.Fatalf("Document not unloaded")
+	}
+	if len(appA.Docs.ownedDocs) != 0 {
+		t.Errorf("Unloaded document still owned: %v", appA.Docs.ownedDocs)
+	}
+	if owner, _ := bus.ClaimDoc(docId, "b"); owner != "b" {
+		t.Errorf("Unloaded document still owned by %v", owner)
+	}
+}
+
+// Bus whose lease holder cannot be reached for renewals, like during a network partition.
+type unrenewableBus struct {
+	*LoopbackBus
+}
+
+func (unrenewableBus) RenewDocs(docIds []string, instanceId string) (lost []string, err error) {
+	return nil, errors.New("lease holder unreachable")
+}
+
+func TestCluster_UnrenewableLeaseSavesDocument(t *testing.T) {
+	bus := unrenewableBus{NewLoopbackBus()}
+	defer bus.Close()
+	docsFolder, exportsFolder := t.TempDir(), t.TempDir()
+	appA := newClusterTestApp(t, bus, "a", docsFolder, exportsFolder)
+	docId, _ := appA.Docs.CreateDocument("Momo")
+	key := appA.Docs.RequestSession(docId, "alice", "Alice")
+	receive, send := connectClusterTestPeer(t, appA, "alice", key)
+	receive([]byte(`{"type":"change","payload":{"revisionId":0,"selection":{"start":1,"end":1},` +
+		`"change":{"lengthBefore":0,"lengthAfter":1,"items":[{"hanzi":"狗","pinyin":"gou3"}]}}}`))
+	receiveTypeWithTimeout(t, send, "ackChange")
+
+	// Lease is still good for a while: keep the document
+	appA.Docs.renewLeases()
+	if len(appA.Orchestrator.getLoadedDocs()) != 1 {
+		t.Fatalf("Document dropped while lease is still valid")
+	}
+
+	// Lease is about to run out: save the document and stop editing it
+	appA.Docs.mu.Lock()
+	appA.Docs.ownedDocs[docId] = time.Now().UTC().Add(time.Second)
+	appA.Docs.mu.Unlock()
+	appA.Docs.renewLeases()
+	if len(appA.Orchestrator.getLoadedDocs()) != 0 {
+		t.Errorf("Document still loaded after lease expired")
+	}
+	if pl := receiveTypeWithTimeout(t, send, "error"); pl["code"] != errDocMoved {
+		t.Errorf("Expected doc moved error, got %v", pl)
+	}
+	if revs, _ := appA.Orchestrator.store.LoadRevisions(docId); len(revs) != 1 {
+		t.Errorf("Change not saved when giving up document: %+v", revs)
+	}
+}
@@ -6,8 +6,10 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"sort"
 	"strings"
 	"unicode"
+	"xiep/internal/common"
 )
 
 type charReading struct {
@@ -19,13 +21,32 @@ type composer struct {
 	pinyin       *pinyin
 	readingsSimp []charReading
 	readingsTrad []charReading
+	// Word and character frequencies, for ranking candidates
+	freqSimp *freqTable
+	freqTrad *freqTable
+	// Readings by pinyin, for looking up input
+	pinyinIndexSimp *pinyinIndex
+	pinyinIndexTrad *pinyinIndex
+	// Readings' pinyin by Hanzi, in the order they appear in the map files
+	hanziIndexSimp map[string][]string
+	hanziIndexTrad map[string][]string
+	// Most likely reading of each character on its own
+	charReadingsSimp map[string]string
+	charReadingsTrad map[string]string
+	// Longest word in the maps, in Hanzi
+	maxWordLength int
+	// Each user's recent picks, for boosting candidates
+	picks recentPicks
 }
 
-func loadComposerFromFiles(dataDir string) *composer {
+func loadComposerFromFiles(dataDir string, xlog common.XieLogger) *composer {
 	var res composer
 	res.pinyin = loadPinyin()
 	res.readingsSimp = loadCharReadings(path.Join(dataDir, "simp-map.json"))
 	res.readingsTrad = loadCharReadings(path.Join(dataDir, "trad-map.json"))
+	res.freqSimp = loadFreqTable(path.Join(dataDir, "simp-freq.txt"), xlog)
+	res.freqTrad = loadFreqTable(path.Join(dataDir, "trad-freq.txt"), xlog)
+	res.buildIndexes()
 	return &res
 }
 
@@ -38,9 +59,118 @@ func loadComposerFromString(simpJson, tradJson string) *composer {
 	if e := json.Unmarshal([]byte(tradJson), &res.readingsTrad); e != nil {
 		panic(fmt.Sprintf("Error parsing Json: %v", e))
 	}
+	res.freqSimp = newFreqTable(nil, 0)
+	res.freqTrad = newFreqTable(nil, 0)
+	res.buildIndexes()
 	return &res
 }
 
+// Positions of readings in a reading list, keyed by their normalized pinyin.
+// Positions are ordered by frequency once sortByFreq has been called, and by order in the list before that.
+type pinyinIndex struct {
+	exact    map[string][]int // Lower-case syllables with tones, separated by spaces
+	toneless map[string][]int // Same, with tone digits removed
+	initials map[string][]int // First letters of syllables, separated by spaces
+	sylls    [][]string       // Each reading's lower-case syllables, by position
+	scores   []float64        // Each reading's log frequency, by position
+}
+
+func newPinyinIndex(readings []charReading) *pinyinIndex {
+	res := pinyinIndex{
+		exact:    make(map[string][]int),
+		toneless: make(map[string][]int),
+		initials: make(map[string][]int),
+		sylls:    make([][]string, len(readings)),
+	}
+	for i, r := range readings {
+		res.sylls[i] = strings.Fields(strings.ToLower(r.Pinyin))
+		exact, toneless := pinyinKeys(res.sylls[i])
+		res.exact[exact] = append(res.exact[exact], i)
+		res.toneless[toneless] = append(res.toneless[toneless], i)
+		initials := initialsKey(res.sylls[i])
+		res.initials[initials] = append(res.initials[initials], i)
+	}
+	return &res
+}
+
+// Finds the positions of readings that match the lower-case input syllables. Input syllables without
+// a tone digit match any tone. Readings that match the input exactly come first, then the rest,
+// each in the index's order. Returns the number of exact matches too.
+func (idx *pinyinIndex) lookup(loSylls []string) (positions []int, exactCount int) {
+	exactKey, tonelessKey := pinyinKeys(loSylls)
+	exact := idx.exact[exactKey]
+	res := make([]int, len(exact), len(idx.toneless[tonelessKey]))
+	copy(res, exact)
+	for _, ix := range idx.toneless[tonelessKey] {
+		if len(exact) != 0 && exact[0] == ix {
+			exact = exact[1:]
+			continue
+		}
+		if tonesMatch(loSylls, idx.sylls[ix]) {
+			res = append(res, ix)
+		}
+	}
+	return res, len(idx.exact[exactKey])
+}
+
+// Checks if the stored syllables have the tones given in the input. Syllables must already be equal without tones.
+func tonesMatch(inputSylls, storedSylls []string) bool {
+	for i, in := range inputSylls {
+		if in == storedSylls[i] || !hasToneDigit(in) {
+			continue
+		}
+		// Neutral tone is written without a digit in the maps
+		if strings.HasSuffix(in, "5") && !hasToneDigit(storedSylls[i]) {
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+func hasToneDigit(syll string) bool {
+	return syll != "" && syll[len(syll)-1] >= '1' && syll[len(syll)-1] <= '5'
+}
+
+// Gets the index keys for a sequence of syllables: with and without tones.
+func pinyinKeys(sylls []string) (exact, toneless string) {
+	var sbExact, sbToneless strings.Builder
+	for i, syll := range sylls {
+		if i != 0 {
+			sbExact.WriteByte(' ')
+			sbToneless.WriteByte(' ')
+		}
+		syll = strings.ToLower(syll)
+		sbExact.WriteString(syll)
+		sbToneless.WriteString(strings.TrimRight(syll, "12345"))
+	}
+	return sbExact.String(), sbToneless.String()
+}
+
+// Builds lookup indexes once readings have been loaded.
+func (cp *composer) buildIndexes() {
+	cp.pinyinIndexSimp = newPinyinIndex(cp.readingsSimp)
+	cp.pinyinIndexSimp.sortByFreq(cp.readingsSimp, cp.freqSimp)
+	cp.pinyinIndexTrad = newPinyinIndex(cp.readingsTrad)
+	cp.pinyinIndexTrad.sortByFreq(cp.readingsTrad, cp.freqTrad)
+	cp.picks.init()
+	cp.hanziIndexSimp = cp.buildHanziIndex(cp.readingsSimp)
+	cp.hanziIndexTrad = cp.buildHanziIndex(cp.readingsTrad)
+	cp.charReadingsSimp = buildCharReadings(cp.readingsSimp, cp.pinyinIndexSimp, cp.hanziIndexSimp)
+	cp.charReadingsTrad = buildCharReadings(cp.readingsTrad, cp.pinyinIndexTrad, cp.hanziIndexTrad)
+}
+
+func (cp *composer) buildHanziIndex(readings []charReading) map[string][]string {
+	res := make(map[string][]string)
+	for _, r := range readings {
+		res[r.Hanzi] = append(res[r.Hanzi], r.Pinyin)
+		if n := len(strings.Fields(r.Hanzi)); n > cp.maxWordLength {
+			cp.maxWordLength = n
+		}
+	}
+	return res
+}
+
 func loadCharReadings(fnJson string) []charReading {
 	f, err := os.Open(fnJson)
 	if err != nil {
@@ -60,33 +190,106 @@ func loadCharReadings(fnJson string) []charReading {
 }
 
 // Splits input into pinyin syllables, and returns Hanzi words matching the whole input.
-func (cp *composer) Resolve(pinyinInput string, isSimp bool) (pinyinSylls []string, readings [][]string) {
+// Input may be written with v or u: for ü, with tone marks or in Zhuyin; the syllables are returned in numbered form.
+// Tone digits can be left out from any syllable; words whose tones match the input exactly are listed first.
+// Within that, words are ranked by frequency, boosted for characters that the user identified by userKey
+// picked recently. If userKey is empty, there is no boost.
+// If the input is best read as several words, segments holds the candidates for each word, and the sentence
+// made of each word's first candidate is the first item in readings.
+// Readings that complete abbreviated input, like "zg" or "zhongg" for 中国, come last. If there are any,
+// completions holds the pinyin of each reading: empty for readings of the input as typed.
+// If any reading's pinyin is not the input as typed, e.g. because the input left out tones or was abbreviated,
+// pinyins holds the pinyin of each reading from the maps: empty for readings that match the input exactly.
+func (cp *composer) Resolve(pinyinInput string, isSimp bool, userKey string) (pinyinSylls []string, readings [][]string, segments [][]string, pinyins []string, completions []string) {
 	readings = make([][]string, 0)
-	charReadings := cp.readingsTrad
-	if isSimp {
-		charReadings = cp.readingsSimp
-	}
+	pinyinInput = cp.pinyin.normalizeInput(pinyinInput)
 	pinyinInputLo := strings.ToLower(pinyinInput)
 	loSylls := cp.pinyin.splitSyllables(pinyinInputLo)
-	loSyllsConcat := ""
-	for i, syll := range loSylls {
-		if i != 0 {
-			loSyllsConcat += " "
+	words, wordPinyins := cp.lookupWords(loSylls, isSimp, userKey)
+	for _, hanzi := range words {
+		itm := make([]string, 0, 1)
+		itm = append(itm, hanzi)
+		readings = append(readings, itm)
+	}
+	if segs, segPinyins := cp.segment(loSylls, isSimp, userKey); len(segs) > 1 {
+		segments = segs
+		sentence := make([]string, len(segs))
+		for i, candidates := range segs {
+			sentence[i] = candidates[0]
 		}
-		loSyllsConcat += syll
+		readings = append([][]string{sentence}, readings...)
+		wordPinyins = append([]string{strings.Join(segPinyins, " ")}, wordPinyins...)
 	}
-	for _, r := range charReadings {
-		if r.Pinyin != loSyllsConcat {
+	if units, ok := cp.pinyin.splitAbbreviated(pinyinInputLo); ok {
+		words, completionPinyins := cp.lookupCompletions(units, isSimp, userKey)
+		if len(words) != 0 {
+			completions = make([]string, len(readings), len(readings)+len(words))
+			for i, word := range words {
+				readings = append(readings, []string{word})
+				completions = append(completions, completionPinyins[i])
+			}
+			wordPinyins = append(wordPinyins, completionPinyins...)
+		}
+	}
+	// Only readings with different syllables or tones need their own pinyin
+	inputKey, _ := pinyinKeys(loSylls)
+	for i, pinyin := range wordPinyins {
+		if key, _ := pinyinKeys(strings.Fields(pinyin)); key == inputKey {
 			continue
 		}
-		itm := make([]string, 0, 1)
-		itm = append(itm, r.Hanzi)
-		readings = append(readings, itm)
+		if pinyins == nil {
+			pinyins = make([]string, len(wordPinyins))
+		}
+		pinyins[i] = pinyin
 	}
 	pinyinSylls = getOrigSylls(pinyinInput, pinyinInputLo, loSylls)
 	return
 }
 
+// Returns Hanzi words matching the lower-case syllables, in the order described at Resolve, and their pinyin
+// from the maps.
+func (cp *composer) lookupWords(loSylls []string, isSimp bool, userKey string) (words []string, pinyins []string) {
+	charReadings, index := cp.readingsTrad, cp.pinyinIndexTrad
+	if isSimp {
+		charReadings, index = cp.readingsSimp, cp.pinyinIndexSimp
+	}
+	positions, exactCount := index.lookup(loSylls)
+	if userKey != "" {
+		cp.boostRecentPicks(userKey, positions[:exactCount], charReadings, index)
+		cp.boostRecentPicks(userKey, positions[exactCount:], charReadings, index)
+	}
+	words = make([]string, len(positions))
+	pinyins = make([]string, len(positions))
+	for i, ix := range positions {
+		words[i] = charReadings[ix].Hanzi
+		pinyins[i] = charReadings[ix].Pinyin
+	}
+	return
+}
+
+// Reorders positions of readings by frequency with the boost for the user's recent picks.
+func (cp *composer) boostRecentPicks(userKey string, positions []int, charReadings []charReading, index *pinyinIndex) {
+	words := make([]string, len(positions))
+	for i, ix := range positions {
+		words[i] = charReadings[ix].Hanzi
+	}
+	boosts := cp.picks.getBoosts(userKey, words)
+	scores := make(map[int]float64, len(positions))
+	for i, ix := range positions {
+		scores[ix] = index.scores[ix] + boosts[i]
+	}
+	sort.SliceStable(positions, func(i, j int) bool { return scores[positions[i]] > scores[positions[j]] })
+}
+
+// Records that the user identified by userKey picked a word, whose Hanzi are separated by spaces,
+// so that its characters rank higher in the user's next results.
+func (cp *composer) RecordPick(userKey string, hanzi string) {
+	if userKey == "" {
+		return
+	}
+	cp.picks.add(userKey, hanzi)
+}
+
 func getOrigSylls(orig string, lo string, loSylls []string) (origSylls []string) {
 	origSylls = make([]string, 0, len(loSylls))
 	ix := 0
@@ -0,0 +1,117 @@
+package logic
+
+import (
+	"math"
+	"strings"
+	"unicode"
+	"xiep/internal/biscript"
+)
+
+// Finds the most likely reading of each character on its own: the one it has in most words of the maps,
+// weighted by the words' frequency. Ties go to the reading listed first.
+func buildCharReadings(readings []charReading, index *pinyinIndex, hanziIndex map[string][]string) map[string]string {
+	// Weight of each character's readings, keyed by Hanzi, then by lower-case pinyin
+	weights := make(map[string]map[string]float64)
+	for i, r := range readings {
+		chars := strings.Fields(r.Hanzi)
+		if len(chars) != len(index.sylls[i]) {
+			continue
+		}
+		prob := math.Exp(index.scores[i])
+		for j, char := range chars {
+			if weights[char] == nil {
+				weights[char] = make(map[string]float64)
+			}
+			weights[char][index.sylls[i][j]] += prob
+		}
+	}
+	res := make(map[string]string)
+	for hanzi, pinyins := range hanziIndex {
+		if strings.Contains(hanzi, " ") {
+			continue
+		}
+		bestWeight := -1.0
+		for _, pinyin := range pinyins {
+			if w := weights[hanzi][strings.ToLower(pinyin)]; w > bestWeight {
+				res[hanzi], bestWeight = pinyin, w
+			}
+		}
+	}
+	return res
+}
+
+// Adds pinyin to plain text. Runs of Hanzi are split into the most likely sequence of words from the maps,
+// and each word gets its reading from the maps. Characters that make up a word on their own get their most
+// likely reading. Other characters, and Hanzi not found in the maps, get no pinyin.
+func (cp *composer) Annotate(text string, isSimp bool) []biscript.XieChar {
+	runes := []rune(strings.ReplaceAll(text, "\r\n", "\n"))
+	res := make([]biscript.XieChar, 0, len(runes))
+	for ix := 0; ix < len(runes); {
+		if !unicode.Is(unicode.Han, runes[ix]) {
+			res = append(res, biscript.XieChar{Hanzi: string(runes[ix])})
+			ix++
+			continue
+		}
+		end := ix
+		for end < len(runes) && unicode.Is(unicode.Han, runes[end]) {
+			end++
+		}
+		res = append(res, cp.annotateRun(runes[ix:end], isSimp)...)
+		ix = end
+	}
+	return res
+}
+
+// Adds pinyin to a run of Hanzi, as described at Annotate.
+func (cp *composer) annotateRun(run []rune, isSimp bool) []biscript.XieChar {
+	hanziIndex, charReadings, ft := cp.hanziIndexTrad, cp.charReadingsTrad, cp.freqTrad
+	if isSimp {
+		hanziIndex, charReadings, ft = cp.hanziIndexSimp, cp.charReadingsSimp, cp.freqSimp
+	}
+	chars := make([]string, len(run))
+	for i, r := range run {
+		chars[i] = string(r)
+	}
+	// Same as in segment: best[i] is the score of the best split of the first i characters,
+	// lengths[i] and pinyins[i] are the length and reading of its last word
+	n := len(chars)
+	best := make([]float64, n+1)
+	lengths := make([]int, n+1)
+	pinyins := make([]string, n+1)
+	for i := 1; i <= n; i++ {
+		best[i] = math.Inf(-1)
+		for length := 1; length <= cp.maxWordLength && length <= i; length++ {
+			word := strings.Join(chars[i-length:i], " ")
+			pinyin := ""
+			if length == 1 {
+				pinyin = charReadings[word]
+			} else {
+				for _, p := range hanziIndex[word] {
+					if len(strings.Fields(p)) == length {
+						pinyin = p
+						break
+					}
+				}
+			}
+			// Characters not in the maps make up a word on their own, without pinyin
+			if pinyin == "" && length != 1 {
+				continue
+			}
+			score := best[i-length] + ft.wordLogProb(word) - composerSegmentPenalty
+			if score > best[i] {
+				best[i], lengths[i], pinyins[i] = score, length, pinyin
+			}
+		}
+	}
+	res := make([]biscript.XieChar, n)
+	for i := n; i > 0; i -= lengths[i] {
+		sylls := strings.Fields(pinyins[i])
+		for j := 0; j < lengths[i]; j++ {
+			res[i-lengths[i]+j].Hanzi = chars[i-lengths[i]+j]
+			if len(sylls) != 0 {
+				res[i-lengths[i]+j].Pinyin = sylls[j]
+			}
+		}
+	}
+	return res
+}
@@ -0,0 +1,76 @@
+package logic
+
+import (
+	"strings"
+	"unicode"
+	"xiep/internal/biscript"
+)
+
+// A character whose pinyin is probably wrong.
+type ReadingSuggestion struct {
+	Pos       int    `json:"pos"`       // Position in text
+	Hanzi     string `json:"hanzi"`     // The character
+	Pinyin    string `json:"pinyin"`    // Its pinyin in the text
+	Suggested string `json:"suggested"` // Most likely pinyin in word context
+}
+
+// Suspected mis-readings in a document, with a change that fixes all of them.
+type ReadingsReport struct {
+	RevisionId  int                 `json:"revisionId"` // Revision of the document that was checked, and that Change applies to
+	Suggestions []ReadingSuggestion `json:"suggestions"`
+	Change      *biscript.ChangeSet `json:"change,omitempty"` // Replaces each suggested character's pinyin; nil if there are no suggestions
+}
+
+// Finds characters whose pinyin differs from their most likely reading in word context, as given by Annotate.
+// The text's script is decided for each run of Hanzi: the one whose maps know more of the run's characters.
+func (cp *composer) CheckReadings(text []biscript.XieChar) []ReadingSuggestion {
+	res := make([]ReadingSuggestion, 0)
+	isHan := func(xc biscript.XieChar) bool {
+		runes := []rune(xc.Hanzi)
+		return len(runes) == 1 && unicode.Is(unicode.Han, runes[0])
+	}
+	for ix := 0; ix < len(text); {
+		if !isHan(text[ix]) {
+			ix++
+			continue
+		}
+		end := ix
+		run := make([]rune, 0)
+		for end < len(text) && isHan(text[end]) {
+			run = append(run, []rune(text[end].Hanzi)[0])
+			end++
+		}
+		annotated := cp.annotateRun(run, true)
+		if trad := cp.annotateRun(run, false); countPinyin(trad) > countPinyin(annotated) {
+			annotated = trad
+		}
+		for i, xc := range annotated {
+			current := text[ix+i].Pinyin
+			if current != "" && xc.Pinyin != "" && !strings.EqualFold(current, xc.Pinyin) {
+				res = append(res, ReadingSuggestion{Pos: ix + i, Hanzi: xc.Hanzi, Pinyin: current, Suggested: xc.Pinyin})
+			}
+		}
+		ix = end
+	}
+	return res
+}
+
+func countPinyin(text []biscript.XieChar) int {
+	res := 0
+	for _, xc := range text {
+		if xc.Pinyin != "" {
+			res++
+		}
+	}
+	return res
+}
+
+// Makes a change set that gives each suggested character its suggested pinyin in a text of the provided length.
+func makeReadingsChange(length int, suggestions []ReadingSuggestion) *biscript.ChangeSet {
+	var cs biscript.ChangeSet
+	cs.InitIdent(uint(length))
+	for _, s := range suggestions {
+		cs.Items[s.Pos] = biscript.XieChar{Hanzi: s.Hanzi, Pinyin: s.Suggested}
+	}
+	return &cs
+}
@@ -0,0 +1,79 @@
+package logic
+
+import (
+	"strings"
+)
+
+// Most completions returned for one input
+const composerMaxCompletions = 20
+
+// Gets the key of the index by initials: the first letter of each syllable, separated by spaces.
+func initialsKey(sylls []string) string {
+	var sb strings.Builder
+	for i, syll := range sylls {
+		if i != 0 {
+			sb.WriteByte(' ')
+		}
+		if syll != "" {
+			sb.WriteByte(syll[0])
+		}
+	}
+	return sb.String()
+}
+
+// Finds words that the input syllables from splitAbbreviated are the beginning of: words whose syllables start
+// with abbreviated input syllables, or whose last syllable starts with the last input syllable if that has no tone.
+// Words matching the input exactly are not included, as they are found by lookupWords.
+// Returns the words' Hanzi and their pinyin, most likely first.
+func (cp *composer) lookupCompletions(units []string, isSimp bool, userKey string) (words []string, pinyins []string) {
+	abbreviated := false
+	for _, unit := range units {
+		if !cp.pinyin.isWholeSyllable(unit) {
+			abbreviated = true
+		}
+	}
+	// A single whole syllable would be completed to too many words to be useful
+	if len(units) == 0 || !abbreviated && (len(units) < 2 || hasToneDigit(units[len(units)-1])) {
+		return
+	}
+	charReadings, index := cp.readingsTrad, cp.pinyinIndexTrad
+	if isSimp {
+		charReadings, index = cp.readingsSimp, cp.pinyinIndexSimp
+	}
+	positions := make([]int, 0)
+	for _, ix := range index.initials[initialsKey(units)] {
+		if cp.completes(units, index.sylls[ix]) {
+			positions = append(positions, ix)
+			if len(positions) == composerMaxCompletions {
+				break
+			}
+		}
+	}
+	if userKey != "" {
+		cp.boostRecentPicks(userKey, positions, charReadings, index)
+	}
+	for _, ix := range positions {
+		words = append(words, charReadings[ix].Hanzi)
+		pinyins = append(pinyins, charReadings[ix].Pinyin)
+	}
+	return
+}
+
+// Checks if the stored syllables are a completion of the input syllables, as described at lookupCompletions.
+func (cp *composer) completes(units []string, storedSylls []string) bool {
+	completed := false
+	for i, unit := range units {
+		storedToneless := strings.TrimRight(storedSylls[i], "12345")
+		if !cp.pinyin.isWholeSyllable(unit) || i == len(units)-1 && !hasToneDigit(unit) {
+			if !strings.HasPrefix(storedToneless, unit) {
+				return false
+			}
+			completed = completed || storedToneless != unit
+			continue
+		}
+		if storedToneless != strings.TrimRight(unit, "12345") || !tonesMatch(units[i:i+1], storedSylls[i:i+1]) {
+			return false
+		}
+	}
+	return completed
+}
@@ -0,0 +1,182 @@
+package logic
+
+import (
+	"bufio"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"xiep/internal/common"
+)
+
+const (
+	composerRecentPicks   = 200  // Characters remembered per user for boosting candidates
+	composerMaxBoostUsers = 1000 // Users whose picks are remembered; least recently active ones are forgotten
+	composerPickBoost     = 5.0  // Added to log frequency of a candidate if all its characters were picked recently
+)
+
+// Frequencies of words and characters, as log probabilities.
+// Loaded from a tab-separated file with one word or character per line, followed by its count in the corpus.
+// Words are written without spaces between their characters.
+type freqTable struct {
+	logProbs map[string]float64
+	unknown  float64 // Log probability of characters not in the table
+}
+
+// Loads the frequency table from fnTxt. If the file cannot be opened, logs a warning and returns an empty table,
+// which ranks everything equally.
+func loadFreqTable(fnTxt string, xlog common.XieLogger) *freqTable {
+	counts := make(map[string]float64)
+	total := 0.0
+	if f, err := os.Open(fnTxt); err != nil {
+		xlog.Logf(common.LogSrcComposer, "Frequency list not loaded, candidates will not be ranked by frequency: %v", err)
+	} else {
+		//goland:noinspection GoUnhandledErrorResult
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			parts := strings.Split(scanner.Text(), "\t")
+			if len(parts) < 2 || strings.HasPrefix(parts[0], "#") {
+				continue
+			}
+			count, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+			if err != nil || count <= 0 {
+				continue
+			}
+			counts[parts[0]] += count
+			total += count
+		}
+	}
+	return newFreqTable(counts, total)
+}
+
+func newFreqTable(counts map[string]float64, total float64) *freqTable {
+	res := freqTable{
+		logProbs: make(map[string]float64, len(counts)),
+		unknown:  math.Log(0.5 / (total + 1)),
+	}
+	for word, count := range counts {
+		res.logProbs[word] = math.Log(count / total)
+	}
+	return &res
+}
+
+// Gets the log probability of a word, whose Hanzi are separated by spaces.
+// Words not in the table are scored by their characters.
+func (ft *freqTable) wordLogProb(hanzi string) float64 {
+	chars := strings.Fields(hanzi)
+	if lp, ok := ft.logProbs[strings.Join(chars, "")]; ok {
+		return lp
+	}
+	res := 0.0
+	for _, char := range chars {
+		if lp, ok := ft.logProbs[char]; ok {
+			res += lp
+		} else {
+			res += ft.unknown
+		}
+	}
+	return res
+}
+
+// Orders each list of reading positions in the index by frequency, most frequent first.
+// Readings that are equally frequent keep the order of the map file.
+func (idx *pinyinIndex) sortByFreq(readings []charReading, ft *freqTable) {
+	idx.scores = make([]float64, len(readings))
+	for i, r := range readings {
+		idx.scores[i] = ft.wordLogProb(r.Hanzi)
+	}
+	byScore := func(positions []int) {
+		sort.SliceStable(positions, func(i, j int) bool { return idx.scores[positions[i]] > idx.scores[positions[j]] })
+	}
+	for _, positions := range idx.exact {
+		byScore(positions)
+	}
+	for _, positions := range idx.toneless {
+		byScore(positions)
+	}
+	for _, positions := range idx.initials {
+		byScore(positions)
+	}
+}
+
+// Characters recently picked by users from the composer's candidates.
+type recentPicks struct {
+	mu    sync.Mutex
+	users map[string]*userPicks
+}
+
+type userPicks struct {
+	chars    []string       // Last picked characters, oldest first
+	counts   map[string]int // How many times each character occurs in chars
+	lastUsed time.Time
+}
+
+func (rp *recentPicks) init() {
+	rp.users = make(map[string]*userPicks)
+}
+
+// Records that a user picked a word, whose Hanzi are separated by spaces.
+func (rp *recentPicks) add(userKey string, hanzi string) {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	up, ok := rp.users[userKey]
+	if !ok {
+		if len(rp.users) >= composerMaxBoostUsers {
+			rp.forgetLeastRecentUser()
+		}
+		up = &userPicks{counts: make(map[string]int)}
+		rp.users[userKey] = up
+	}
+	up.lastUsed = time.Now()
+	for _, char := range strings.Fields(hanzi) {
+		up.chars = append(up.chars, char)
+		up.counts[char]++
+	}
+	for len(up.chars) > composerRecentPicks {
+		if up.counts[up.chars[0]]--; up.counts[up.chars[0]] == 0 {
+			delete(up.counts, up.chars[0])
+		}
+		up.chars = up.chars[1:]
+	}
+}
+
+// Must be called with the lock held.
+func (rp *recentPicks) forgetLeastRecentUser() {
+	var oldestKey string
+	var oldest time.Time
+	for key, up := range rp.users {
+		if oldestKey == "" || up.lastUsed.Before(oldest) {
+			oldestKey, oldest = key, up.lastUsed
+		}
+	}
+	delete(rp.users, oldestKey)
+}
+
+// Gets the boost for each of the words, whose Hanzi are separated by spaces: zero if none of a word's characters
+// were picked recently by the user, up to composerPickBoost if all of them were.
+func (rp *recentPicks) getBoosts(userKey string, words []string) []float64 {
+	res := make([]float64, len(words))
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	up, ok := rp.users[userKey]
+	if !ok {
+		return res
+	}
+	for i, word := range words {
+		chars := strings.Fields(word)
+		picked := 0
+		for _, char := range chars {
+			if up.counts[char] > 0 {
+				picked++
+			}
+		}
+		if len(chars) != 0 {
+			res[i] = composerPickBoost * float64(picked) / float64(len(chars))
+		}
+	}
+	return res
+}
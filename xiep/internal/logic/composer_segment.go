@@ -0,0 +1,54 @@
+package logic
+
+import (
+	"math"
+)
+
+// Subtracted from the log frequency of each word in a segmentation, so that fewer, longer words are preferred
+// when frequencies don't decide.
+const composerSegmentPenalty = 1.0
+
+// Splits lower-case input syllables into the most likely sequence of words from the maps.
+// Returns the candidates for each word, best first, and the pinyin of each word's first candidate;
+// nil if the syllables cannot be covered by words.
+func (cp *composer) segment(loSylls []string, isSimp bool, userKey string) (words [][]string, pinyins []string) {
+	index := cp.pinyinIndexTrad
+	if isSimp {
+		index = cp.pinyinIndexSimp
+	}
+	// best[i] is the score of the best segmentation of the first i syllables; lengths[i] is the length of its last word
+	n := len(loSylls)
+	best := make([]float64, n+1)
+	lengths := make([]int, n+1)
+	for i := 1; i <= n; i++ {
+		best[i] = math.Inf(-1)
+		for length := 1; length <= cp.maxWordLength && length <= i; length++ {
+			if math.IsInf(best[i-length], -1) {
+				continue
+			}
+			positions, _ := index.lookup(loSylls[i-length : i])
+			if len(positions) == 0 {
+				continue
+			}
+			score := best[i-length] + index.scores[positions[0]] - composerSegmentPenalty
+			if score > best[i] {
+				best[i] = score
+				lengths[i] = length
+			}
+		}
+	}
+	if n == 0 || math.IsInf(best[n], -1) {
+		return nil, nil
+	}
+	// Walk back from the end, then put words in order
+	for i := n; i > 0; i -= lengths[i] {
+		candidates, candidatePinyins := cp.lookupWords(loSylls[i-lengths[i]:i], isSimp, userKey)
+		words = append(words, candidates)
+		pinyins = append(pinyins, candidatePinyins[0])
+	}
+	for i, j := 0, len(words)-1; i < j; i, j = i+1, j-1 {
+		words[i], words[j] = words[j], words[i]
+		pinyins[i], pinyins[j] = pinyins[j], pinyins[i]
+	}
+	return
+}
@@ -1,11 +1,20 @@
 package logic
 
 import (
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"strconv"
+	"strings"
 	"testing"
+	"xiep/internal/biscript"
+	"xiep/internal/docx"
 )
 
 func TestComposerLoadFull(t *testing.T) {
-	loadComposerFromFiles("../../web/static/")
+	loadComposerFromFiles("../../web/static/", testLogger{})
 }
 
 func TestComposerPinyinNumsToSurf(t *testing.T) {
@@ -25,22 +34,73 @@ func TestComposerPinyinNumsToSurf(t *testing.T) {
 	}
 }
 
+func TestComposerPinyinNumsToRoman(t *testing.T) {
+	vals := []struct {
+		roman  string
+		pyNums string
+		res    string
+	}{
+		{docx.RomanPinyin, "Bei3jing1", "Běijīng"},
+		{docx.RomanZhuyin, "Bei3jing1", "ㄅㄟˇ ㄐㄧㄥ"},
+		{docx.RomanZhuyin, "shu1zi", "ㄕㄨ ˙ㄗ"},
+		{docx.RomanWadeGiles, "Bei3jing1", "Pei³-ching¹"},
+		{docx.RomanWadeGiles, "zhong1guo2", "chung¹-kuo²"},
+		{docx.RomanWadeGiles, "xue2xi2", "hsüeh²-hsi²"},
+		{docx.RomanWadeGiles, "zi4ji3", "tzŭ⁴-chi³"},
+		{docx.RomanWadeGiles, "duo1", "to¹"},
+		{docx.RomanGwoyeu, "Bei3jing1", "Beeijing"},
+		{docx.RomanGwoyeu, "zhong1guo2", "jonggwo"},
+		{docx.RomanGwoyeu, "ren2", "ren"},
+		{docx.RomanGwoyeu, "ma1", "mha"},
+		{docx.RomanGwoyeu, "wo3", "woo"},
+		{docx.RomanGwoyeu, "ye3", "yee"},
+		{docx.RomanGwoyeu, "yi4", "yih"},
+		{docx.RomanGwoyeu, "yue4", "yueh"},
+		{docx.RomanGwoyeu, "hao3", "hao"},
+		{docx.RomanGwoyeu, "xi1'an1", "shi'an"},
+		{docx.RomanIpa, "ni3hao3", "ni˨˩˦ xɑu̯˨˩˦"},
+		{docx.RomanIpa, "shi4", "ʂʐ̩˥˩"},
+		{docx.RomanIpa, "ma", "ma"},
+		{docx.RomanWadeGiles, "xyz", "xyz"},
+	}
+	c := loadComposerFromString(simpMapJson, tradMapJson)
+	for _, val := range vals {
+		if res := c.PinyinNumsToRoman(val.pyNums, val.roman); res != val.res {
+			t.Errorf("Wrong %v for %v: expected %v, got %v", val.roman, val.pyNums, val.res, res)
+		}
+	}
+}
+
 func TestComposerResolve(t *testing.T) {
 	type Itm struct {
 		Pinyin   string
 		IsSimp   bool
 		Sylls    []string
 		Readings []string
+		Pinyins  string // Pinyin of the readings that don't match the input exactly
 	}
 	vals := []Itm{
-		{"jing1", true, []string{"jing1"}, []string{"经", "精"}},
-		{"jing1", false, []string{"jing1"}, []string{"經", "精"}},
-		{"shu1zi", true, []string{"shu1", "zi"}, []string{"叔 子", "梳 子"}},
-		{"Shu1zi", true, []string{"Shu1", "zi"}, []string{"叔 子", "梳 子"}},
+		{"jing1", true, []string{"jing1"}, []string{"经", "精"}, ""},
+		{"jing1", false, []string{"jing1"}, []string{"經", "精"}, ""},
+		{"shu1zi", true, []string{"shu1", "zi"}, []string{"叔 子", "梳 子"}, ""},
+		{"Shu1zi", true, []string{"Shu1", "zi"}, []string{"叔 子", "梳 子"}, ""},
+		{"bei3jing1", true, []string{"bei3", "jing1"}, []string{"北 京"}, ""},
+		{"shu1", true, []string{"shu1"}, []string{}, ""},
+		{"nihao", true, []string{"ni", "hao"}, []string{"泥 蒿", "你 好"}, "ni2 hao1,ni3 hao3"},
+		{"ni3hao", true, []string{"ni3", "hao"}, []string{"你 好"}, "ni3 hao3"},
+		{"nihao3", true, []string{"ni", "hao3"}, []string{"你 好"}, "ni3 hao3"},
+		{"ni2hao3", true, []string{"ni2", "hao3"}, []string{}, ""},
+		{"zi", true, []string{"zi"}, []string{"子", "字"}, ",zi4"},
+		{"zi5", true, []string{"zi5"}, []string{"子"}, "zi"},
+		{"jing", false, []string{"jing"}, []string{"經", "精"}, "jing1,jing1"},
+		{"Nǐhǎo", true, []string{"Ni3", "hao3"}, []string{"你 好"}, ""},
+		{"nǐhao", true, []string{"ni3", "hao"}, []string{"你 好"}, "ni3 hao3"},
+		{"ㄋㄧˇㄏㄠˇ", true, []string{"ni3", "hao3"}, []string{"你 好"}, ""},
+		{"ㄐㄧㄥ", true, []string{"jing1"}, []string{"经", "精"}, ""},
 	}
 	c := loadComposerFromString(simpMapJson, tradMapJson)
 	for _, val := range vals {
-		sylls, readings := c.Resolve(val.Pinyin, val.IsSimp)
+		sylls, readings, _, pinyins, _ := c.Resolve(val.Pinyin, val.IsSimp, "")
 		if len(readings) != len(val.Readings) {
 			t.Errorf("Wrong number of readings for %v", val.Pinyin)
 			continue
@@ -67,9 +127,248 @@ func TestComposerResolve(t *testing.T) {
 		if !sameSylls {
 			t.Errorf("Syllables are different for %v", val.Pinyin)
 		}
+		if strings.Join(pinyins, ",") != val.Pinyins {
+			t.Errorf("Wrong pinyin of readings for %v: %v", val.Pinyin, pinyins)
+		}
 	}
 }
 
+func TestComposerFrequencyRanking(t *testing.T) {
+	fnFreq := path.Join(t.TempDir(), "simp-freq.txt")
+	_ = ioutil.WriteFile(fnFreq, []byte("# word\tcount\n精\t100\n经\t10\n字\t500\nbad line\n梳子\t50\n"), 0644)
+	c := loadComposerFromString(simpMapJson, tradMapJson)
+	c.freqSimp = loadFreqTable(fnFreq, testLogger{})
+	c.buildIndexes()
+	firstReadings := func(input, userKey string) string {
+		_, readings, _, _, _ := c.Resolve(input, true, userKey)
+		res := make([]string, len(readings))
+		for i := range readings {
+			res[i] = readings[i][0]
+		}
+		return strings.Join(res, ",")
+	}
+	// More frequent first; frequent word beats its characters; exact tones still first
+	if res := firstReadings("jing1", ""); res != "精,经" {
+		t.Errorf("Wrong order for jing1: %v", res)
+	}
+	if res := firstReadings("shu1zi", ""); res != "梳 子,叔 子" {
+		t.Errorf("Wrong order for shu1zi: %v", res)
+	}
+	if res := firstReadings("zi", ""); res != "子,字" {
+		t.Errorf("Wrong order for zi: %v", res)
+	}
+
+	// Recent picks boost a user's candidates, but not others'
+	c.RecordPick("alice", "经")
+	if res := firstReadings("jing1", "alice"); res != "经,精" {
+		t.Errorf("Pick not boosted: %v", res)
+	}
+	if res := firstReadings("jing1", "bob"); res != "精,经" {
+		t.Errorf("Other user's pick boosted: %v", res)
+	}
+	// Picks are forgotten after a while
+	for i := 0; i < composerRecentPicks; i++ {
+		c.RecordPick("alice", "精")
+	}
+	if res := firstReadings("jing1", "alice"); res != "精,经" {
+		t.Errorf("Old pick still boosted: %v", res)
+	}
+}
+
+// Logger that counts its entries.
+type countingLogger struct {
+	testLogger
+	count int
+}
+
+func (cl *countingLogger) Logf(prefix string, format string, v ...interface{}) {
+	cl.count++
+}
+
+func TestComposerMissingFreqTable(t *testing.T) {
+	var xlog countingLogger
+	ft := loadFreqTable(path.Join(t.TempDir(), "simp-freq.txt"), &xlog)
+	if xlog.count != 1 {
+		t.Errorf("Missing frequency list not logged")
+	}
+	if ft.wordLogProb("精") != ft.wordLogProb("经") {
+		t.Errorf("Empty frequency table does not rank everything equally")
+	}
+}
+
+func TestComposerSegment(t *testing.T) {
+	c := loadComposerFromString(simpMapJson, tradMapJson)
+	_, readings, segments, pinyins, _ := c.Resolve("Ni3hao3zi", true, "")
+	if len(segments) != 2 || strings.Join(segments[0], ",") != "你 好" || strings.Join(segments[1], ",") != "子,字" {
+		t.Errorf("Wrong segments: %v", segments)
+	}
+	if len(readings) == 0 || strings.Join(readings[0], "|") != "你 好|子" {
+		t.Errorf("Sentence not first among readings: %v", readings)
+	}
+	if pinyins != nil {
+		t.Errorf("Pinyin for readings that match the input: %v", pinyins)
+	}
+	// Sentence gets its words' pinyin from the maps if the input left out a tone
+	if _, readings, _, pinyins, _ = c.Resolve("Ni3haozi", true, ""); len(readings) == 0 || len(pinyins) == 0 ||
+		strings.Join(readings[0], "|") != "你 好|子" || pinyins[0] != "ni3 hao3 zi" {
+		t.Errorf("Wrong pinyin of sentence: %v, %v", readings, pinyins)
+	}
+	// One word covers the whole input
+	if _, _, segments, _, _ = c.Resolve("shu1zi", true, ""); segments != nil {
+		t.Errorf("Whole word segmented: %v", segments)
+	}
+	// Part of the input is not in the maps
+	if _, readings, segments, _, _ = c.Resolve("nihaoshu1", true, ""); segments != nil || len(readings) != 0 {
+		t.Errorf("Unknown syllable segmented: %v, %v", segments, readings)
+	}
+}
+
+func TestComposerCompletion(t *testing.T) {
+	vals := []struct {
+		input       string
+		readings    string
+		completions string
+	}{
+		{"zhongg", "中 国", "zhong1 guo2"},
+		{"zg", "中 国", "zhong1 guo2"},
+		{"zhong1gu", "中 国", "zhong1 guo2"},
+		{"sz", "叔 子,梳 子", "shu1 zi,shu1 zi"},
+		{"zhongguo", "中 国", ""}, // Exact match only
+		{"zhong4g", "", ""},     // Wrong tone
+		{"shu1z", "叔 子,梳 子", "shu1 zi,shu1 zi"},
+		{"shu", "", ""}, // Single whole syllable is not completed
+	}
+	c := loadComposerFromString(simpMapJson, tradMapJson)
+	for _, val := range vals {
+		_, readings, _, _, completions := c.Resolve(val.input, true, "")
+		words := make([]string, len(readings))
+		for i := range readings {
+			words[i] = strings.Join(readings[i], "|")
+		}
+		if strings.Join(words, ",") != val.readings || strings.Join(completions, ",") != val.completions {
+			t.Errorf("Wrong completions for %v: %v, %v", val.input, words, completions)
+		}
+	}
+}
+
+// Measures lookup time per request on the full maps, if they are present, and on a generated map of similar size.
+func BenchmarkComposerResolve(b *testing.B) {
+	inputs := []string{"jing1", "shu1zi", "Bei3jing1", "zhong1hua2ren2min2gong4he2guo2", "xyz", "nihao", "shi"}
+	composers := []struct {
+		name string
+		cp   func() *composer
+	}{
+		{"full", func() *composer {
+			if _, err := os.Stat("../../web/static/simp-map.json"); err != nil {
+				b.Skip("Full maps not present")
+			}
+			return loadComposerFromFiles("../../web/static/", testLogger{})
+		}},
+		{"generated", func() *composer {
+			data := generateReadingsJson(120000)
+			return loadComposerFromString(data, data)
+		}},
+	}
+	for _, c := range composers {
+		b.Run(c.name, func(b *testing.B) {
+			cp := c.cp()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				cp.Resolve(inputs[i%len(inputs)], i%2 == 0, "")
+			}
+		})
+	}
+}
+
+// Makes a map file's content with random words of one to four syllables.
+func generateReadingsJson(count int) string {
+	p := loadPinyin()
+	rnd := rand.New(rand.NewSource(1))
+	readings := make([]charReading, count)
+	for i := range readings {
+		n := 1 + rnd.Intn(4)
+		hanzi := make([]string, n)
+		sylls := make([]string, n)
+		for j := 0; j < n; j++ {
+			hanzi[j] = string(rune(0x4e00 + rnd.Intn(0x5000)))
+			sylls[j] = p.sylls[rnd.Intn(len(p.sylls))].text + strconv.Itoa(1+rnd.Intn(5))
+		}
+		readings[i] = charReading{Hanzi: strings.Join(hanzi, " "), Pinyin: strings.Join(sylls, " ")}
+	}
+	data, _ := json.Marshal(readings)
+	return string(data)
+}
+
+func TestComposerAnnotate(t *testing.T) {
+	c := loadComposerFromString(simpMapJson, tradMapJson)
+	text := c.Annotate("梳子\r\n精X叔", true)
+	expected := []biscript.XieChar{
+		{Hanzi: "梳", Pinyin: "shu1"}, {Hanzi: "子", Pinyin: "zi"}, {Hanzi: "\n"},
+		{Hanzi: "精", Pinyin: "jing1"}, {Hanzi: "X"}, {Hanzi: "叔"},
+	}
+	if len(text) != len(expected) {
+		t.Fatalf("Wrong annotated text: %v", text)
+	}
+	for i := range expected {
+		if text[i] != expected[i] {
+			t.Errorf("Wrong character at %v: expected %v, got %v", i, expected[i], text[i])
+		}
+	}
+}
+
+func TestComposerAnnotatePolyphones(t *testing.T) {
+	c := loadComposerFromString(polyMapJson, polyMapJson)
+	vals := []struct {
+		text   string
+		pinyin string
+	}{
+		{"行", "xing2"},       // More words have this reading
+		{"银行", "yin2 hang2"}, // Word context
+		{"银行行动", "yin2 hang2 xing2 dong4"},
+		{"进行X行", "jin4 xing2 _ xing2"},
+		{"动行", "_ xing2"}, // Character not in maps
+	}
+	for _, val := range vals {
+		text := c.Annotate(val.text, true)
+		pinyins := make([]string, len(text))
+		for i, xc := range text {
+			pinyins[i] = xc.Pinyin
+			if pinyins[i] == "" {
+				pinyins[i] = "_"
+			}
+		}
+		if strings.Join(pinyins, " ") != val.pinyin {
+			t.Errorf("Wrong pinyin for %v: %v", val.text, pinyins)
+		}
+	}
+}
+
+func TestComposerCheckReadings(t *testing.T) {
+	c := loadComposerFromString(polyMapJson, polyMapJson)
+	text := []biscript.XieChar{
+		{Hanzi: "银", Pinyin: "yin2"}, {Hanzi: "行", Pinyin: "xing2"}, // Wrong
+		{Hanzi: "。"},
+		{Hanzi: "行", Pinyin: "Xing2"}, {Hanzi: "动", Pinyin: "dong4"}, // Right, capitalized
+		{Hanzi: "行"}, // No pinyin: left alone
+	}
+	suggestions := c.CheckReadings(text)
+	if len(suggestions) != 1 || suggestions[0] != (ReadingSuggestion{Pos: 1, Hanzi: "行", Pinyin: "xing2", Suggested: "hang2"}) {
+		t.Fatalf("Wrong suggestions: %+v", suggestions)
+	}
+	fixed := makeReadingsChange(len(text), suggestions).Apply(text)
+	if len(fixed) != len(text) || fixed[1].Pinyin != "hang2" || fixed[3].Pinyin != "Xing2" {
+		t.Errorf("Wrong text after fix: %v", fixed)
+	}
+}
+
+var polyMapJson = `[
+	{"hanzi": "行", "pinyin": "hang2"},
+	{"hanzi": "行", "pinyin": "xing2"},
+	{"hanzi": "银 行", "pinyin": "yin2 hang2"},
+	{"hanzi": "行 动", "pinyin": "xing2 dong4"},
+	{"hanzi": "进 行", "pinyin": "jin4 xing2"}
+]`
+
 var simpMapJson = `
 [
   {
@@ -87,6 +386,30 @@ var simpMapJson = `
   {
     "hanzi": "梳 子",
     "pinyin": "shu1 zi"
+  },
+  {
+    "hanzi": "北 京",
+    "pinyin": "Bei3 jing1"
+  },
+  {
+    "hanzi": "泥 蒿",
+    "pinyin": "ni2 hao1"
+  },
+  {
+    "hanzi": "你 好",
+    "pinyin": "ni3 hao3"
+  },
+  {
+    "hanzi": "字",
+    "pinyin": "zi4"
+  },
+  {
+    "hanzi": "子",
+    "pinyin": "zi"
+  },
+  {
+    "hanzi": "中 国",
+    "pinyin": "zhong1 guo2"
   }
 ]
 `
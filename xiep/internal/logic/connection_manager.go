@@ -1,68 +1,128 @@
 package logic
 
 import (
-	"strconv"
-	"strings"
 	"sync"
-	"sync/atomic"
 	"time"
+	"xiep/internal/biscript"
 	"xiep/internal/common"
 )
 
 const (
-	cmDispatcherLoopMsec = 5 // Period of queue polling in dispatcher loop
+	cmPeerQueueLength     = 64 // Max number of outbound messages waiting for a peer's socket
+	cmMetricsLogPeriodSec = 60 // Frequency of logging dispatcher metrics, if there was any traffic
+)
+
+// What to do with a peer whose outbound queue is full.
+const (
+	// Drop the peer's queued messages and detach it from its session; the client can catch up by resuming.
+	// Legacy clients cannot be told to resync, so they get disconnected instead.
+	SlowPeerResync = "resync"
+	// Close the peer's socket.
+	SlowPeerDisconnect = "disconnect"
 )
 
 // Orchestrator functionality related to edit sessions and processing changes over sockets.
 // Interface allows us to decouple connectionManager from orchestrator
 type editSessionHandler interface {
-	startSession(sessionKey string) (startMsg string)
+	startSession(sessionKey, authSessionId string, cachedRevisionId int) (startMsg *sessionStartMessage)
+	resumeSession(sessionKey, authSessionId string, lastRevisionId int) (resumeMsg *sessionResumeMessage)
 	isSessionOpen(sessionKey string) bool
-	changeReceived(sessionKey string, clientRevisionId int, selStr, changeStr string) bool
-	sessionClosed(sessionKey string)
+	changeReceived(sessionKey string, clientRevisionId int, sel *sessionSelection, cs *biscript.ChangeSet) bool
+	sessionDetached(sessionKey string)
 }
 
 type connectedPeer struct {
 	// Client's IP address
 	clientIP string
+	// ID of the auth session that opened the socket; edit sessions must belong to the same one
+	authSessionId string
 	// Peer's session key, as soon as we've received and verified it
 	sessionKey string
+	// Session key the peer announced, while the session is being started or resumed
+	pendingSessionKey string
+	// Broadcasts to the pending session, held back until the peer has been sent the session's first message
+	held []interface{}
 	// Timestamp of last activity, so we can get rid of idle peers
 	lastActiveUtc time.Time
-	// Socket handler reads strings from this, and sends them to peer as messages
-	send chan string
+	// Wire format negotiated at connect time
+	codec peerCodec
+	// Socket handler reads messages from this, and sends them to peer in frames of the codec's type
+	// Buffered up to cmPeerQueueLength; see deliver for what happens when it's full
+	send chan []byte
+	// True once the peer has been told to go away; we don't queue anything else for it
+	closing bool
 	// Socket handler reads this, and if a string comes through, it closes the socket with that message
+	// Buffered, so a close request can be posted without waiting for the socket handler
 	closeConn chan string
 }
 
+// One item in the dispatcher's queue: a *changeToBroadcast, a *presenceToBroadcast, or a *sessionsToTerminate.
+type dispatchEvent struct {
+	queuedUtc time.Time
+	payload   interface{}
+}
+
+// Sessions to terminate, with the error to send their peers.
+type sessionsToTerminate struct {
+	sessionKeys map[string]bool
+	perr        *protocolError
+}
+
+// Counters describing the dispatcher's recent work. Maximums and latencies refer to the current
+// logging period; they are reset each time the metrics are logged.
+type DispatchMetrics struct {
+	EventsDispatched   uint64        // Events taken off the dispatcher queue
+	MaxEventQueueDepth int           // Longest the dispatcher queue has been when woken up
+	MessagesQueued     uint64        // Messages placed in peers' outbound queues
+	MessagesDropped    uint64        // Messages dropped because a peer's queue was full, or discarded in a resync
+	SlowPeers          uint64        // Peers whose queue overflowed
+	MaxPeerQueueDepth  int           // Longest any peer's outbound queue has been
+	TotalLatency       time.Duration // Sum of time from event queued to messages placed in peer queues
+	MaxLatency         time.Duration // Longest such time
+}
+
 type connectionManager struct {
 	xlog               common.XieLogger
 	wgShutdown         *sync.WaitGroup
-	exiting            int32
+	exit               chan interface{}
+	slowPeerPolicy     string
 	editSessionHandler editSessionHandler
 	mu                 sync.Mutex // For connected peers
 	peers              []*connectedPeer
+	detachedKeys       []string   // Sessions of slow peers, to detach once the lock is released
 	qmu                sync.Mutex // For message queue
-	queue              []interface{}
+	queue              []dispatchEvent
+	wake               chan struct{} // Signals the dispatcher that the queue is not empty
+	mmu                sync.Mutex    // For metrics
+	metrics            DispatchMetrics
 }
 
 func (cm *connectionManager) init(xlog common.XieLogger,
 	wgShutdown *sync.WaitGroup,
-	editSessionHandler editSessionHandler) {
+	editSessionHandler editSessionHandler,
+	slowPeerPolicy string) {
 	cm.xlog = xlog
 	cm.wgShutdown = wgShutdown
 	cm.editSessionHandler = editSessionHandler
+	cm.slowPeerPolicy = slowPeerPolicy
+	if cm.slowPeerPolicy == "" {
+		cm.slowPeerPolicy = SlowPeerResync
+	}
+	cm.exit = make(chan interface{})
+	cm.wake = make(chan struct{}, 1)
 	go cm.dispatch()
 }
 
 func (cm *connectionManager) shutdown() {
-	atomic.AddInt32(&cm.exiting, 1)
+	close(cm.exit)
 }
 
 // Registers a new socket connection when it comes in.
-func (cm *connectionManager) NewConnection(clientIP string) (
-	receive func(msg *string),
-	send <-chan string,
+// authSessionId identifies the logged-in user who opened the socket.
+// subprotocol is the websocket subprotocol negotiated at connect time; empty for legacy clients.
+func (cm *connectionManager) NewConnection(clientIP, authSessionId, subprotocol string) (
+	receive func(msg []byte),
+	send <-chan []byte,
 	closeConn chan string,
 ) {
 	cm.mu.Lock()
@@ -71,18 +131,20 @@ func (cm *connectionManager) NewConnection(clientIP string) (
 	// Keep track of peer; create channels for interaction for socket handler
 	peer := connectedPeer{
 		clientIP:      clientIP,
+		authSessionId: authSessionId,
+		codec:         getPeerCodec(subprotocol),
 		lastActiveUtc: time.Now().UTC(),
-		send:          make(chan string),
-		closeConn:     make(chan string),
+		send:          make(chan []byte, cmPeerQueueLength),
+		closeConn:     make(chan string, 1),
 	}
 	cm.peers = append(cm.peers, &peer)
 	send = peer.send
 	closeConn = peer.closeConn
-	receive = func(msg *string) {
+	receive = func(msg []byte) {
 		if msg == nil {
 			cm.peerGone(&peer)
 		} else {
-			cm.messageFromPeer(&peer, *msg)
+			cm.messageFromPeer(&peer, msg)
 		}
 	}
 	return
@@ -90,8 +152,6 @@ func (cm *connectionManager) NewConnection(clientIP string) (
 
 func (cm *connectionManager) peerGone(peer *connectedPeer) {
 	cm.mu.Lock()
-	defer cm.mu.Unlock()
-
 	// Remove peer from out list
 	i := 0
 	for _, p := range cm.peers {
@@ -101,204 +161,471 @@ func (cm *connectionManager) peerGone(peer *connectedPeer) {
 		}
 	}
 	cm.peers = cm.peers[:i]
+	sessionKey := peer.sessionKey
+	cm.mu.Unlock()
 
-	// Tell orchestrator that session is over
-	cm.editSessionHandler.sessionClosed(peer.sessionKey)
+	// Tell orchestrator that the session's socket is gone; session may still be resumed
+	// This may be a call to another instance, so we're not holding the lock for it
+	if sessionKey != "" {
+		cm.editSessionHandler.sessionDetached(sessionKey)
+	}
 }
 
-func (cm *connectionManager) messageFromPeer(peer *connectedPeer, msg string) {
+// Handles a message from a peer. Calls to the session handler may go to another instance and take a while,
+// so they are made without holding the lock; messages from one peer are still handled one at a time.
+// Thread-safe; invoked from the peer's socket handler.
+func (cm *connectionManager) messageFromPeer(peer *connectedPeer, msg []byte) {
 	cm.mu.Lock()
-	defer cm.mu.Unlock()
-
 	// Is this peer still on our list?
-	peerIx := -1
-	for ix, p := range cm.peers {
-		if p == peer {
-			peerIx = ix
-			break
-		}
-	}
-	if peerIx == -1 {
+	if !cm.isOnList(peer) {
 		// Not on our list? Weird. Let's close it.
-		peer.closeConn <- "This peer is no longer on our list"
+		cm.rejectPeer(peer, "", newProtocolError(errNotOnList, true, "This peer is no longer on our list"))
+		cm.unlock()
 		return
 	}
 	peer.lastActiveUtc = time.Now().UTC()
 	// Diagnostic: see what happens when message handling code panics
-	if msg == "BOO" {
+	if string(msg) == "BOO" {
+		cm.unlock()
 		panic("Panicking because of a diagnostic BOO")
 	}
-	// Client announcing their session key as the first message
-	if strings.HasPrefix(msg, "SESSIONKEY ") {
-		if peer.sessionKey != "" {
-			peer.closeConn <- "Protocol violation: this client already sent its session key"
+	req, perr := peer.codec.decode(msg)
+	if perr != nil {
+		cm.rejectPeer(peer, "", perr)
+		cm.unlock()
+		return
+	}
+	sessionKey := peer.sessionKey
+	if (req.kind == reqSessionKey || req.kind == reqResume) && sessionKey == "" {
+		// Hold back broadcasts to the session until the peer has its HELLO or RESUMED
+		peer.pendingSessionKey = req.sessionKey
+	}
+	cm.unlock()
+
+	switch req.kind {
+	case reqSessionKey:
+		// Client announcing their session key as the first message
+		if sessionKey != "" {
+			cm.rejectPeerSafe(peer, req.id, newProtocolError(errProtocolViolation, true, "Protocol violation: this client already sent its session key"))
 			return
 		}
-		sessionKey := msg[11:]
-		startMsg := cm.editSessionHandler.startSession(sessionKey)
-		if startMsg == "" {
-			peer.closeConn <- "We are not expecting a session with this key."
+		startMsg := cm.editSessionHandler.startSession(req.sessionKey, peer.authSessionId, req.revisionId)
+		if startMsg == nil {
+			cm.rejectPeerSafe(peer, req.id, newProtocolError(errSessionNotFound, true, "We are not expecting a session with this key."))
 			return
 		}
-		peer.sessionKey = sessionKey
-		peer.send <- "HELLO " + startMsg
-		return
-	}
-	// Anything else: client must be past sessionkey check
-	if peer.sessionKey == "" {
-		peer.closeConn <- "Don't talk until you've announced your session key"
-		return
+		cm.attachPeer(peer, req.sessionKey, startMsg.RevisionId, false, peer.codec.encodeHello(req.id, startMsg))
+	case reqResume:
+		// Client reconnecting after a network drop
+		if sessionKey != "" {
+			cm.rejectPeerSafe(peer, req.id, newProtocolError(errProtocolViolation, true, "Protocol violation: this client already sent its session key"))
+			return
+		}
+		resumeMsg := cm.editSessionHandler.resumeSession(req.sessionKey, peer.authSessionId, req.revisionId)
+		if resumeMsg == nil {
+			cm.rejectPeerSafe(peer, req.id, newProtocolError(errSessionNotResumable, true, "This session cannot be resumed."))
+			return
+		}
+		cm.attachPeer(peer, req.sessionKey, resumeMsg.RevisionId, true, peer.codec.encodeResumed(req.id, resumeMsg))
+	default:
+		// Anything else: client must be past sessionkey check
+		if sessionKey == "" {
+			cm.rejectPeerSafe(peer, req.id, newProtocolError(errSessionNotStarted, true, "Don't talk until you've announced your session key"))
+			return
+		}
+		cm.sessionMessageFromPeer(peer, sessionKey, req)
 	}
-	// Just a keepalive ping: see if session is still open?
-	if msg == "PING" {
-		if !cm.editSessionHandler.isSessionOpen(peer.sessionKey) {
-			peer.closeConn <- "This is not an open session"
+}
+
+// Handles messages that are only valid once the peer has announced its session.
+// Thread-safe.
+func (cm *connectionManager) sessionMessageFromPeer(peer *connectedPeer, sessionKey string, req *peerRequest) {
+	switch req.kind {
+	case reqPing:
+		// Just a keepalive ping: see if session is still open?
+		if !cm.editSessionHandler.isSessionOpen(sessionKey) {
+			cm.rejectPeerSafe(peer, req.id, newProtocolError(errSessionNotOpen, true, "This is not an open session"))
+			return
 		}
-		return
+		if pong := peer.codec.encodePong(req.id); pong != nil {
+			cm.mu.Lock()
+			cm.deliver(peer, pong)
+			cm.unlock()
+		}
+	case reqChange:
+		// Client announced a change
+		if !cm.editSessionHandler.changeReceived(sessionKey, req.revisionId, req.sel, req.cs) {
+			cm.rejectPeerSafe(peer, req.id, newProtocolError(errChangeRejected, true,
+				"We don't like this change; your session might have expired, the doc may be gone, or the change may be invalid"))
+		}
+	default:
+		// Anything else: No.
+		cm.rejectPeerSafe(peer, req.id, newProtocolError(errUnknownType, true, "You shouldn't have said that"))
 	}
-	// Client announced a change
-	if strings.HasPrefix(msg, "CHANGE ") {
-		ix1 := strings.Index(msg[7:], " ")
-		if ix1 != -1 {
-			ix1 += 7
+}
+
+// Attaches the peer to the session it has just started or resumed, and sends it the session's first message,
+// followed by the broadcasts that were held back in the meantime and are not already part of revisionId.
+// If the peer went away in the meantime, tells the session handler that the session is detached.
+// Thread-safe.
+func (cm *connectionManager) attachPeer(peer *connectedPeer, sessionKey string, revisionId int, replaceOthers bool, msg []byte) {
+	cm.mu.Lock()
+	held := peer.held
+	peer.held = nil
+	peer.pendingSessionKey = ""
+	attached := cm.isOnList(peer) && !peer.closing
+	if attached {
+		if replaceOthers {
+			cm.detachPeers(sessionKey)
 		}
-		ix2 := strings.Index(msg[ix1+1:], " ")
-		if ix2 != -1 {
-			ix2 += ix1 + 1
-		} else {
-			ix2 = len(msg)
+		peer.sessionKey = sessionKey
+		cm.deliver(peer, msg)
+		for _, payload := range held {
+			switch v := payload.(type) {
+			case *changeToBroadcast:
+				if v.newDocRevisionId > revisionId || v.change == nil && v.newDocRevisionId == revisionId {
+					cm.deliver(peer, peer.codec.encodeUpdate(v))
+				}
+			case *presenceToBroadcast:
+				if ptbMsg := peer.codec.encodePresence(v); ptbMsg != nil {
+					cm.deliver(peer, ptbMsg)
+				}
+			}
 		}
-		revId, err := strconv.Atoi(msg[7:ix1])
-		if err != nil {
-			peer.closeConn <- "Invalid message: failed to parse revision ID"
+	}
+	cm.unlock()
+
+	if !attached {
+		cm.editSessionHandler.sessionDetached(sessionKey)
+	}
+}
+
+// Checks if the peer is still on our list.
+// Must be called from within lock.
+func (cm *connectionManager) isOnList(peer *connectedPeer) bool {
+	for _, p := range cm.peers {
+		if p == peer {
+			return true
+		}
+	}
+	return false
+}
+
+// Like rejectPeer, for callers that don't hold the lock. Also drops anything held back for a session that didn't start.
+// Thread-safe.
+func (cm *connectionManager) rejectPeerSafe(peer *connectedPeer, replyTo string, perr *protocolError) {
+	cm.mu.Lock()
+	defer cm.unlock()
+
+	peer.pendingSessionKey = ""
+	peer.held = nil
+	cm.rejectPeer(peer, replyTo, perr)
+}
+
+// Reports an error to the peer. Fatal errors close the socket; so does any error in the legacy protocol,
+// which has no way of reporting them otherwise.
+// Must be called from within lock.
+func (cm *connectionManager) rejectPeer(peer *connectedPeer, replyTo string, perr *protocolError) {
+	if errMsg := peer.codec.encodeError(replyTo, perr); errMsg != nil {
+		cm.deliver(peer, errMsg)
+		if !perr.Fatal {
 			return
 		}
-		selStr := msg[ix1+1 : ix2]
-		changeStr := ""
-		if ix2 != len(msg) {
-			changeStr = msg[ix2+1:]
+	}
+	cm.closePeer(peer, perr.Message)
+}
+
+// Releases the lock, then tells the session handler about sessions whose slow peers were detached meanwhile.
+// Use instead of cm.mu.Unlock() wherever messages may have been delivered.
+func (cm *connectionManager) unlock() {
+	detachedKeys := cm.detachedKeys
+	cm.detachedKeys = nil
+	cm.mu.Unlock()
+	for _, sessionKey := range detachedKeys {
+		cm.editSessionHandler.sessionDetached(sessionKey)
+	}
+}
+
+// Asks the socket handler to close the peer's socket. Never blocks; only the first request counts.
+// Must be called from within lock.
+func (cm *connectionManager) closePeer(peer *connectedPeer, reason string) {
+	peer.closing = true
+	select {
+	case peer.closeConn <- reason:
+	default:
+	}
+}
+
+// Places a message in the peer's outbound queue without waiting for the socket handler.
+// If the queue is full, applies the slow peer policy.
+// Must be called from within lock.
+func (cm *connectionManager) deliver(peer *connectedPeer, msg []byte) {
+	if peer.closing {
+		return
+	}
+	select {
+	case peer.send <- msg:
+		cm.recordQueued(len(peer.send))
+	default:
+		cm.slowPeer(peer)
+	}
+}
+
+// Deals with a peer that cannot keep up with the messages we're sending it.
+// Must be called from within lock.
+func (cm *connectionManager) slowPeer(peer *connectedPeer) {
+	cm.xlog.Logf(common.LogSrcConnectionManager, "Outbound queue full for peer %v with session %v; policy: %v",
+		peer.clientIP, peer.sessionKey, cm.slowPeerPolicy)
+	dropped := 1
+	resync := cm.slowPeerPolicy == SlowPeerResync && peer.sessionKey != ""
+	var errMsg []byte
+	if resync {
+		errMsg = peer.codec.encodeError("", newProtocolError(errResyncRequired, false,
+			"You fell behind; messages were dropped. Resume your session to catch up."))
+	}
+	if errMsg == nil {
+		cm.recordSlowPeer(dropped)
+		cm.closePeer(peer, newProtocolError(errSlowPeer, true, "Terminating because the connection cannot keep up").Message)
+		return
+	}
+	// Discard whatever is still waiting: the client will get a composed delta when it resumes
+	for drained := false; !drained; {
+		select {
+		case <-peer.send:
+			dropped++
+		default:
+			drained = true
 		}
-		if !cm.editSessionHandler.changeReceived(peer.sessionKey, revId, selStr, changeStr) {
-			peer.closeConn <- "We don't like this change; your session might have expired, the doc may be gone, or the change may be invalid"
+	}
+	cm.recordSlowPeer(dropped)
+	// Session stays resumable, but this peer no longer receives its updates
+	// Session handler may call another instance, so it only hears about this once we release the lock
+	cm.detachedKeys = append(cm.detachedKeys, peer.sessionKey)
+	peer.sessionKey = ""
+	cm.deliver(peer, errMsg)
+}
+
+// Disowns peers still attached to a session that is being resumed over a new socket.
+// Their sockets get closed, but their demise no longer affects the session.
+// Must be called from within lock.
+func (cm *connectionManager) detachPeers(sessionKey string) {
+	i := 0
+	for _, p := range cm.peers {
+		if p.sessionKey != sessionKey {
+			cm.peers[i] = p
+			i++
+			continue
 		}
-		return
+		p.sessionKey = ""
+		// Old socket may well be dead already: closePeer doesn't wait for it
+		cm.closePeer(p, newProtocolError(errSessionReplaced, true, "Session has been resumed over a different connection").Message)
 	}
-	// Anything else: No.
-	peer.closeConn <- "You shouldn't have said that"
+	cm.peers = cm.peers[:i]
 }
 
 func (cm *connectionManager) broadcast(ctb *changeToBroadcast) {
-	cm.qmu.Lock()
-	defer cm.qmu.Unlock()
-	cm.queue = append(cm.queue, ctb)
+	cm.enqueue(ctb)
+}
+
+func (cm *connectionManager) terminateSessions(sessionKeys map[string]bool, perr *protocolError) {
+	cm.enqueue(&sessionsToTerminate{sessionKeys, perr})
+}
+
+func (cm *connectionManager) broadcastPresence(ptb *presenceToBroadcast) {
+	cm.enqueue(ptb)
 }
 
-func (cm *connectionManager) terminateSessions(sessionKeys map[string]bool) {
+// Appends an event to the dispatcher's queue and wakes up the dispatcher.
+// The queue itself is unbounded so that the orchestrator never waits here while holding its lock;
+// bounds apply to each peer's outbound queue instead.
+func (cm *connectionManager) enqueue(payload interface{}) {
 	cm.qmu.Lock()
-	defer cm.qmu.Unlock()
-	cm.queue = append(cm.queue, sessionKeys)
+	cm.queue = append(cm.queue, dispatchEvent{time.Now().UTC(), payload})
+	cm.qmu.Unlock()
+	select {
+	case cm.wake <- struct{}{}:
+	default:
+		// Dispatcher has already been woken up and will see this event too
+	}
 }
 
-// Running in separate goroutine, processes FIFO message queue.
+// Running in separate goroutine, processes FIFO message queue whenever it's woken up.
 func (cm *connectionManager) dispatch() {
-	ticker := time.NewTicker(cmDispatcherLoopMsec * time.Millisecond)
-	batch := make([]interface{}, 0)
+	ticker := time.NewTicker(cmMetricsLogPeriodSec * time.Second)
+	batch := make([]dispatchEvent, 0)
 	for {
-		<-ticker.C
-		// Shutting down? Stop delivering and just leave
-		if atomic.LoadInt32(&cm.exiting) != 0 {
+		select {
+		case <-cm.wake:
+		case <-ticker.C:
+			cm.logMetrics()
+			continue
+		case <-cm.exit:
+			// Shutting down? Stop delivering and just leave
 			ticker.Stop()
-			break
+			cm.wgShutdown.Done()
+			return
 		}
-		// Copy entire queue, deliver everything in one fell swoop
-		// Hold lock only for this copy
-		func() {
-			cm.qmu.Lock()
-			defer cm.qmu.Unlock()
-			for _, x := range cm.queue {
-				batch = append(batch, x)
-			}
-			cm.queue = cm.queue[:0]
-		}()
+		// Take entire queue, deliver everything in one fell swoop
+		// Hold lock only while swapping the slices
+		cm.qmu.Lock()
+		batch, cm.queue = cm.queue, batch[:0]
+		cm.qmu.Unlock()
+		cm.recordEvents(len(batch))
 		// Perform each item
-		for _, itm := range batch {
-			switch v := itm.(type) {
+		for _, evt := range batch {
+			switch v := evt.payload.(type) {
 			case *changeToBroadcast:
 				cm.doBroadcast(v)
-			case map[string]bool:
-				cm.doTerminateSessions(v)
+			case *presenceToBroadcast:
+				cm.doBroadcastPresence(v)
+			case *sessionsToTerminate:
+				cm.doTerminateSessions(v.sessionKeys, v.perr)
 			default:
 				panic("Unexpected type in message queue")
 			}
+			cm.recordLatency(time.Now().UTC().Sub(evt.queuedUtc))
+		}
+		// Clear batch slice; drop references to delivered events
+		for i := range batch {
+			batch[i] = dispatchEvent{}
 		}
-		// Clear batch slice
 		batch = batch[:0]
 	}
-	cm.wgShutdown.Done()
 }
 
 // Broadcasts message to the peers that need to hear it.
 // Thread-safe; invoked from dispatch goroutine.
 func (cm *connectionManager) doBroadcast(ctb *changeToBroadcast) {
+	cm.mu.Lock()
+	defer cm.unlock()
 
-	// Gather peers to update, and to ack
-	// Only hold lock while gathering; subsequent sending no longer needs it
-	peersToUpdate := make([]*connectedPeer, 0)
-	var peerToAck *connectedPeer
-	func() {
-		cm.mu.Lock()
-		defer cm.mu.Unlock()
-		for _, peer := range cm.peers {
-			// Propagate to all provided session keys, except sender herself
-			if _, ok := ctb.receiverSessionKeys[peer.sessionKey]; ok {
-				if peer.sessionKey != ctb.sourceSessionKey {
-					peersToUpdate = append(peersToUpdate, peer)
+	// Summon the pidgeons
+	// Peers may speak different protocols; build each message once per codec
+	// Delivery doesn't block, so we can hold the lock throughout
+	updMsgs := make(map[peerCodec][]byte)
+	for _, peer := range cm.peers {
+		if peer.pendingSessionKey != "" && ctb.receiverSessionKeys[peer.pendingSessionKey] {
+			peer.held = append(peer.held, ctb)
+			continue
+		}
+		// Propagate to all provided session keys, except sender herself
+		if _, ok := ctb.receiverSessionKeys[peer.sessionKey]; ok {
+			if peer.sessionKey != ctb.sourceSessionKey {
+				updMsg, ok := updMsgs[peer.codec]
+				if !ok {
+					updMsg = peer.codec.encodeUpdate(ctb)
+					updMsgs[peer.codec] = updMsg
 				}
-			}
-			// Acknowledge change to sender: but only for actual content changes!
-			// We're not acknowledging selection changes, as those don't change revision ID
-			if peer.sessionKey == ctb.sourceSessionKey && ctb.changeJson != "" {
-				peerToAck = peer
+				cm.deliver(peer, updMsg)
 			}
 		}
-	}()
-
-	// Build messages
-	updMsg := "UPDATE " + strconv.Itoa(ctb.newDocRevisionId) + " " + ctb.sourceSessionKey + " " + ctb.selJson
-	if ctb.changeJson != "" {
-		updMsg += " " + ctb.changeJson
+		// Acknowledge change to sender: but only for actual content changes!
+		// We're not acknowledging selection changes, as those don't change revision ID
+		if peer.sessionKey == ctb.sourceSessionKey && ctb.change != nil {
+			cm.deliver(peer, peer.codec.encodeAck(ctb))
+		}
 	}
-	ackMsg := "ACKCHANGE " + strconv.Itoa(ctb.sourceBaseDocRevisionId) + " " + strconv.Itoa(ctb.newDocRevisionId)
+}
 
-	// Summon the pidgeons
-	for _, peer := range peersToUpdate {
-		peer.send <- updMsg
-	}
-	if peerToAck != nil {
-		peerToAck.send <- ackMsg
+// Tells peers about another editor joining, leaving, or changing state.
+// Thread-safe; invoked from dispatch goroutine.
+func (cm *connectionManager) doBroadcastPresence(ptb *presenceToBroadcast) {
+	cm.mu.Lock()
+	defer cm.unlock()
+
+	msgs := make(map[peerCodec][]byte)
+	for _, peer := range cm.peers {
+		if peer.pendingSessionKey != "" && ptb.receiverSessionKeys[peer.pendingSessionKey] &&
+			peer.pendingSessionKey != ptb.presence.SessionKey {
+			peer.held = append(peer.held, ptb)
+			continue
+		}
+		if !ptb.receiverSessionKeys[peer.sessionKey] || peer.sessionKey == ptb.presence.SessionKey {
+			continue
+		}
+		msg, ok := msgs[peer.codec]
+		if !ok {
+			msg = peer.codec.encodePresence(ptb)
+			msgs[peer.codec] = msg
+		}
+		// Nil if protocol has no presence messages
+		if msg != nil {
+			cm.deliver(peer, msg)
+		}
 	}
 }
 
-// Terminates sessions identified by the provided keys.
+// Terminates sessions identified by the provided keys, telling peers why.
 // Thread-safe; invoked from dispatch goroutine.
-func (cm *connectionManager) doTerminateSessions(sessionKeys map[string]bool) {
+func (cm *connectionManager) doTerminateSessions(sessionKeys map[string]bool, perr *protocolError) {
+	cm.mu.Lock()
+	defer cm.unlock()
 
-	// Gather peers to close
 	// We only send signal to terminate, but don't remove from list of peers
 	// Socket handler will notify us of connection's closure via peerGone
-	// Only hold lock while gathering; subsequent sending no longer needs it
-	peersToClose := make([]*connectedPeer, 0)
-	func() {
-		cm.mu.Lock()
-		defer cm.mu.Unlock()
-		for _, peer := range cm.peers {
-			if _, ok := sessionKeys[peer.sessionKey]; ok {
-				peersToClose = append(peersToClose, peer)
-			}
+	for _, peer := range cm.peers {
+		if _, ok := sessionKeys[peer.sessionKey]; ok {
+			cm.rejectPeer(peer, "", perr)
 		}
-	}()
-	// Actually close
-	for _, peer := range peersToClose {
-		peer.closeConn <- "Terminating because session has been idle for too long"
 	}
 }
+
+// Returns a snapshot of the dispatcher's metrics.
+func (cm *connectionManager) Metrics() DispatchMetrics {
+	cm.mmu.Lock()
+	defer cm.mmu.Unlock()
+	return cm.metrics
+}
+
+func (cm *connectionManager) recordEvents(queueDepth int) {
+	cm.mmu.Lock()
+	defer cm.mmu.Unlock()
+	cm.metrics.EventsDispatched += uint64(queueDepth)
+	if queueDepth > cm.metrics.MaxEventQueueDepth {
+		cm.metrics.MaxEventQueueDepth = queueDepth
+	}
+}
+
+func (cm *connectionManager) recordQueued(peerQueueDepth int) {
+	cm.mmu.Lock()
+	defer cm.mmu.Unlock()
+	cm.metrics.MessagesQueued++
+	if peerQueueDepth > cm.metrics.MaxPeerQueueDepth {
+		cm.metrics.MaxPeerQueueDepth = peerQueueDepth
+	}
+}
+
+func (cm *connectionManager) recordSlowPeer(dropped int) {
+	cm.mmu.Lock()
+	defer cm.mmu.Unlock()
+	cm.metrics.MessagesDropped += uint64(dropped)
+	cm.metrics.SlowPeers++
+}
+
+func (cm *connectionManager) recordLatency(latency time.Duration) {
+	cm.mmu.Lock()
+	defer cm.mmu.Unlock()
+	cm.metrics.TotalLatency += latency
+	if latency > cm.metrics.MaxLatency {
+		cm.metrics.MaxLatency = latency
+	}
+}
+
+// Logs metrics for the period that just ended, then resets them.
+func (cm *connectionManager) logMetrics() {
+	cm.mmu.Lock()
+	m := cm.metrics
+	cm.metrics = DispatchMetrics{}
+	cm.mmu.Unlock()
+	if m.EventsDispatched == 0 && m.MessagesQueued == 0 {
+		return
+	}
+	var avgLatency time.Duration
+	if m.EventsDispatched != 0 {
+		avgLatency = m.TotalLatency / time.Duration(m.EventsDispatched)
+	}
+	cm.xlog.Logf(common.LogSrcConnectionManager,
+		"Dispatch: %v events, max queue %v; %v messages, max peer queue %v; %v dropped, %v slow peers; latency avg %v, max %v",
+		m.EventsDispatched, m.MaxEventQueueDepth, m.MessagesQueued, m.MaxPeerQueueDepth,
+		m.MessagesDropped, m.SlowPeers, avgLatency, m.MaxLatency)
+}
@@ -0,0 +1,232 @@
+package logic
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"xiep/internal/biscript"
+)
+
+// Session handler that accepts every session and remembers which ones got detached.
+// If cm is set, checks that the connection manager is not locked when a session is detached.
+type testSessionHandler struct {
+	mu       sync.Mutex
+	detached []string
+	cm       *connectionManager
+}
+
+func (tsh *testSessionHandler) startSession(sessionKey, authSessionId string, cachedRevisionId int) *sessionStartMessage {
+	return &sessionStartMessage{Name: "Momo", Text: []biscript.XieChar{}, PeerSelections: []sessionSelection{}}
+}
+
+func (tsh *testSessionHandler) resumeSession(sessionKey, authSessionId string, lastRevisionId int) *sessionResumeMessage {
+	return &sessionResumeMessage{RevisionId: lastRevisionId, LastOwnRevisionId: -1, PeerSelections: []sessionSelection{}}
+}
+
+func (tsh *testSessionHandler) isSessionOpen(sessionKey string) bool {
+	return true
+}
+
+func (tsh *testSessionHandler) changeReceived(sessionKey string, clientRevisionId int, sel *sessionSelection, cs *biscript.ChangeSet) bool {
+	return true
+}
+
+func (tsh *testSessionHandler) sessionDetached(sessionKey string) {
+	if tsh.cm != nil {
+		tsh.cm.mu.Lock()
+		tsh.cm.mu.Unlock()
+	}
+	tsh.mu.Lock()
+	defer tsh.mu.Unlock()
+	tsh.detached = append(tsh.detached, sessionKey)
+}
+
+func newTestConnectionManager(slowPeerPolicy string) (*connectionManager, *testSessionHandler, *sync.WaitGroup) {
+	var cm connectionManager
+	var wg sync.WaitGroup
+	tsh := &testSessionHandler{}
+	cm.init(testLogger{}, &wg, tsh, slowPeerPolicy)
+	return &cm, tsh, &wg
+}
+
+func stopTestConnectionManager(cm *connectionManager, wg *sync.WaitGroup) {
+	wg.Add(1)
+	cm.shutdown()
+	wg.Wait()
+}
+
+func receiveWithTimeout(t *testing.T, send <-chan []byte) string {
+	select {
+	case msg := <-send:
+		return string(msg)
+	case <-time.After(time.Second):
+		t.Fatalf("Timed out waiting for message")
+	}
+	return ""
+}
+
+func TestConnectionManager_BroadcastDelivered(t *testing.T) {
+	cm, _, wg := newTestConnectionManager(SlowPeerResync)
+	defer stopTestConnectionManager(cm, wg)
+
+	receive1, send1, _ := cm.NewConnection("1.1.1.1", "alice", "")
+	receive2, send2, _ := cm.NewConnection("2.2.2.2", "bob", "")
+	receive1([]byte("SESSIONKEY S-1"))
+	receive2([]byte("SESSIONKEY S-2"))
+	receiveWithTimeout(t, send1)
+	receiveWithTimeout(t, send2)
+
+	cm.broadcast(&changeToBroadcast{
+		sourceSessionKey:        "S-1",
+		sourceBaseDocRevisionId: 0,
+		newDocRevisionId:        1,
+		receiverSessionKeys:     map[string]bool{"S-1": true, "S-2": true},
+		selections:              []sessionSelection{},
+		change:                  makeChange("0>"),
+	})
+	if msg := receiveWithTimeout(t, send1); msg != "ACKCHANGE 0 1" {
+		t.Errorf("Wrong ack: %v", msg)
+	}
+	if msg := receiveWithTimeout(t, send2); !strings.HasPrefix(msg, "UPDATE 1 S-1 ") {
+		t.Errorf("Wrong update: %v", msg)
+	}
+	m := cm.Metrics()
+	if m.EventsDispatched != 1 || m.MessagesQueued != 4 || m.MessagesDropped != 0 {
+		t.Errorf("Wrong metrics: %+v", m)
+	}
+}
+
+// Fills a peer's queue by broadcasting to it while nobody reads from its socket.
+func overflowPeer(cm *connectionManager, sessionKey string) {
+	for i := 0; i <= cmPeerQueueLength; i++ {
+		cm.doBroadcast(&changeToBroadcast{
+			sourceSessionKey:    "S-other",
+			newDocRevisionId:    i + 1,
+			receiverSessionKeys: map[string]bool{sessionKey: true},
+			selections:          []sessionSelection{},
+			change:              makeChange("0>"),
+		})
+	}
+}
+
+func TestConnectionManager_SlowPeerResync(t *testing.T) {
+	cm, tsh, wg := newTestConnectionManager(SlowPeerResync)
+	defer stopTestConnectionManager(cm, wg)
+
+	receive, send, closeConn := cm.NewConnection("1.1.1.1", "alice", SubprotocolJSONv1)
+	receive([]byte(`{"type":"sessionKey","payload":{"sessionKey":"S-1"}}`))
+	// Session gets detached after the connection manager releases its lock
+	tsh.cm = cm
+	overflowed := make(chan struct{})
+	go func() {
+		overflowPeer(cm, "S-1")
+		close(overflowed)
+	}()
+	select {
+	case <-overflowed:
+	case <-time.After(time.Second):
+		t.Fatalf("Session detached while connection manager was locked")
+	}
+
+	// Queue was emptied and holds only the request to resync; socket stays open
+	if len(send) != 1 {
+		t.Fatalf("Expected 1 message in queue, got %v", len(send))
+	}
+	if msg := string(<-send); !strings.Contains(msg, errResyncRequired) {
+		t.Errorf("Expected resync error, got %v", msg)
+	}
+	if len(closeConn) != 0 {
+		t.Errorf("Socket closed in resync")
+	}
+	if len(tsh.detached) != 1 || tsh.detached[0] != "S-1" {
+		t.Errorf("Session not detached: %v", tsh.detached)
+	}
+	if m := cm.Metrics(); m.SlowPeers != 1 || m.MessagesDropped != cmPeerQueueLength+1 {
+		t.Errorf("Wrong metrics: %+v", m)
+	}
+	// Client can resume on the same socket
+	receive([]byte(`{"type":"resume","payload":{"sessionKey":"S-1","lastRevisionId":1}}`))
+	if msg := string(<-send); !strings.HasPrefix(msg, `{"type":"resumed"`) {
+		t.Errorf("Expected resumed, got %v", msg)
+	}
+}
+
+func TestConnectionManager_SlowPeerDisconnect(t *testing.T) {
+	vals := []struct {
+		policy      string
+		subprotocol string
+	}{
+		{SlowPeerDisconnect, SubprotocolJSONv1},
+		// Legacy protocol cannot ask for a resync
+		{SlowPeerResync, ""},
+	}
+	for _, val := range vals {
+		cm, _, wg := newTestConnectionManager(val.policy)
+		receive, send, closeConn := cm.NewConnection("1.1.1.1", "alice", val.subprotocol)
+		if val.subprotocol == "" {
+			receive([]byte("SESSIONKEY S-1"))
+		} else {
+			receive([]byte(`{"type":"sessionKey","payload":{"sessionKey":"S-1"}}`))
+		}
+		overflowPeer(cm, "S-1")
+		if len(closeConn) != 1 {
+			t.Errorf("Slow peer not disconnected with policy %v, subprotocol '%v'", val.policy, val.subprotocol)
+		}
+		if len(send) != cmPeerQueueLength {
+			t.Errorf("Messages queued after disconnect: %v", len(send))
+		}
+		stopTestConnectionManager(cm, wg)
+	}
+}
+
+// Session handler whose startSession takes a while, like a call to another instance.
+type slowStartSessionHandler struct {
+	testSessionHandler
+	started chan struct{}
+	proceed chan struct{}
+}
+
+func (ssh *slowStartSessionHandler) startSession(sessionKey, authSessionId string, cachedRevisionId int) *sessionStartMessage {
+	close(ssh.started)
+	<-ssh.proceed
+	return &sessionStartMessage{Name: "Momo", RevisionId: 1, Text: []biscript.XieChar{}, PeerSelections: []sessionSelection{}}
+}
+
+func TestConnectionManager_BroadcastHeldUntilHello(t *testing.T) {
+	var cm connectionManager
+	var wg sync.WaitGroup
+	ssh := &slowStartSessionHandler{started: make(chan struct{}), proceed: make(chan struct{})}
+	cm.init(testLogger{}, &wg, ssh, SlowPeerResync)
+	defer stopTestConnectionManager(&cm, &wg)
+
+	receive, send, _ := cm.NewConnection("1.1.1.1", "alice", "")
+	go receive([]byte("SESSIONKEY S-1"))
+	<-ssh.started
+
+	// Session is starting; connection manager must not be locked, and broadcasts wait
+	for rev := 1; rev <= 2; rev++ {
+		cm.doBroadcast(&changeToBroadcast{
+			sourceSessionKey:    "S-2",
+			newDocRevisionId:    rev,
+			receiverSessionKeys: map[string]bool{"S-1": true, "S-2": true},
+			selections:          []sessionSelection{},
+			change:              makeChange("0>"),
+		})
+	}
+	if len(send) != 0 {
+		t.Fatalf("Broadcast delivered before HELLO")
+	}
+	close(ssh.proceed)
+
+	// Revision 1 is already in HELLO; only revision 2 follows
+	if msg := receiveWithTimeout(t, send); !strings.HasPrefix(msg, "HELLO ") {
+		t.Errorf("Expected HELLO, got %v", msg)
+	}
+	if msg := receiveWithTimeout(t, send); !strings.HasPrefix(msg, "UPDATE 2 S-2 ") {
+		t.Errorf("Expected update to revision 2, got %v", msg)
+	}
+	if len(send) != 0 {
+		t.Errorf("Unexpected messages after update: %v", len(send))
+	}
+}
@@ -2,7 +2,6 @@ package logic
 
 import (
 	"encoding/json"
-	"os"
 	"time"
 	"xiep/internal/biscript"
 )
@@ -25,7 +24,11 @@ type document struct {
 	// Document's starting text. Revisions Start from this state.
 	StartText []biscript.XieChar `json:"startText"`
 
-	// Sequence of revisions.
+	// ID of the revision that StartText represents. Revision IDs keep growing across saves and reloads,
+	// so a client's cached revision ID remains meaningful after the document has been unloaded.
+	BaseRevisionId int `json:"baseRevisionId,omitempty"`
+
+	// Sequence of revisions. The first one is StartText's identity revision, with ID BaseRevisionId.
 	revisions []*revision
 
 	// Document's current content, after applying all revisions to Start text.
@@ -34,6 +37,9 @@ type document struct {
 	// If true, document has been changed in memory and needs to be saved soon.
 	dirty bool
 
+	// ID of the last revision written to the store's revision log.
+	storedRevisionId int
+
 	// Last time the document was accessed. Documents that are not changed for a while get unloaded.
 	lastAccessedUtc time.Time
 }
@@ -45,27 +51,26 @@ func (doc *document) init(docId string, name string, startText []biscript.XieCha
 	if doc.StartText == nil {
 		doc.StartText = make([]biscript.XieChar, 0)
 	}
-	doc.headText = make([]biscript.XieChar, 0)
+	doc.headText = make([]biscript.XieChar, len(doc.StartText))
+	copy(doc.headText, doc.StartText)
 	doc.lastAccessedUtc = time.Now().UTC()
 	// Add initial revision with identity change
 	initialRev := revision{}
-	initialRev.changeSet.InitIdent(uint(len(startText)))
+	initialRev.changeSet.InitIdent(uint(len(doc.StartText)))
 	doc.revisions = append(doc.revisions, &initialRev)
 }
 
-func (doc *document) loadFromFile(fileName string) error {
-	if data, err := os.ReadFile(fileName); err != nil {
+// Initializes the document from its serialized form, as kept in the document store.
+func (doc *document) deserialize(data []byte) error {
+	if err := json.Unmarshal(data, doc); err != nil {
 		return err
-	} else {
-		if err = json.Unmarshal(data, doc); err != nil {
-			return err
-		}
 	}
 	doc.lastAccessedUtc = time.Now().UTC()
 	doc.headText = make([]biscript.XieChar, len(doc.StartText))
 	for i, xc := range doc.StartText {
 		doc.headText[i] = xc
 	}
+	doc.storedRevisionId = doc.BaseRevisionId
 	// Add initial revision with identity change
 	initialRev := revision{}
 	initialRev.changeSet.InitIdent(uint(len(doc.StartText)))
@@ -74,17 +79,10 @@ func (doc *document) loadFromFile(fileName string) error {
 	return nil
 }
 
-func (doc *document) saveToFile(fileName string) error {
-	toSave := document{DocId: doc.DocId, Name: doc.Name, StartText: doc.headText}
-	data, err := json.Marshal(&toSave)
-	if err != nil {
-		return err
-	}
-	if err = os.WriteFile(fileName, data, 0644); err != nil {
-		return err
-	}
-	doc.dirty = false
-	return nil
+// Serializes the document's head text, to be kept in the document store.
+func (doc *document) serialize() ([]byte, error) {
+	toSave := document{DocId: doc.DocId, Name: doc.Name, StartText: doc.headText, BaseRevisionId: doc.headRevisionId()}
+	return json.Marshal(&toSave)
 }
 
 func (doc *document) touch(makeDirty bool) {
@@ -92,12 +90,44 @@ func (doc *document) touch(makeDirty bool) {
 	doc.dirty = doc.dirty || makeDirty
 }
 
+// Gets the ID of the latest revision, which the head text represents.
+func (doc *document) headRevisionId() int {
+	return doc.BaseRevisionId + len(doc.revisions) - 1
+}
+
+// Checks if the revision with the provided ID is held in memory.
+// Revisions from before the document was last loaded are not known.
+func (doc *document) isKnownRevision(revId int) bool {
+	return revId >= doc.BaseRevisionId && revId <= doc.headRevisionId()
+}
+
+// Composes all revisions after baseRevId into a single change set that takes the text
+// at baseRevId to the current head text.
+// Returns false if baseRevId is not a known revision.
+func (doc *document) composeSince(baseRevId int) (cs *biscript.ChangeSet, ok bool) {
+	if !doc.isKnownRevision(baseRevId) {
+		return nil, false
+	}
+	doc.touch(false)
+	if baseRevId == doc.headRevisionId() {
+		cs = &biscript.ChangeSet{}
+		cs.InitIdent(uint(len(doc.headText)))
+		return cs, true
+	}
+	baseIx := baseRevId - doc.BaseRevisionId
+	cs = &doc.revisions[baseIx+1].changeSet
+	for i := baseIx + 2; i < len(doc.revisions); i++ {
+		cs = cs.Compose(&doc.revisions[i].changeSet)
+	}
+	return cs, true
+}
+
 // Calculates forward of selection from a client, so it applies to current head text.
-// baseRevId is client's head revision ID, to which the selection applies.
+// baseRevId is client's head revision ID, to which the selection applies. It must be a known revision.
 func (doc *document) forwardSelection(start, end uint, baseRevId int) (uint, uint) {
 	doc.touch(false)
 	poss := []uint{start, end}
-	for i := baseRevId + 1; i < len(doc.revisions); i++ {
+	for i := baseRevId - doc.BaseRevisionId + 1; i < len(doc.revisions); i++ {
 		doc.revisions[i].changeSet.ForwardPositions(poss)
 	}
 	return poss[0], poss[1]
@@ -106,6 +136,7 @@ func (doc *document) forwardSelection(start, end uint, baseRevId int) (uint, uin
 // Applies a changeset received from a client to the document.
 // selStart and selEnd represent the selection in the client's head revision
 // baseRevId is client's head revision ID (latest revision they are aware of; this is what the change is based on)
+// It must be a known revision.
 // csToProp is the computed new changeset added to the end of document's master revision list.
 // selInHeadStart and selInHeadEnd are the selection forwarded to the new head text.
 func (doc *document) applyChange(cs *biscript.ChangeSet, selStart, selEnd uint, baseRevId int) (
@@ -115,7 +146,7 @@ func (doc *document) applyChange(cs *biscript.ChangeSet, selStart, selEnd uint,
 	// Server's head might be ahead of the revision known to the client, which is what this CS is based on.
 	csToProp = cs
 	poss := []uint{selStart, selEnd}
-	for i := baseRevId + 1; i < len(doc.revisions); i++ {
+	for i := baseRevId - doc.BaseRevisionId + 1; i < len(doc.revisions); i++ {
 		revCS := &doc.revisions[i].changeSet
 		csToProp = revCS.Follow(csToProp)
 		revCS.ForwardPositions(poss)
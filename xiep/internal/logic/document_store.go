@@ -0,0 +1,561 @@
+package logic
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+	"xiep/internal/common"
+)
+
+// Kinds of document store that can be selected in the config.
+const (
+	DocStoreFiles = "files" // One JSON file per document in DocsFolder; the default
+	DocStoreBolt  = "bolt"  // Single bbolt database file in DocsFolder
+)
+
+const (
+	fsDocExt       = ".json"          // Extension of a document's file in the filesystem store
+	fsHistoryExt   = ".history.jsonl" // Extension of a document's revision log in the filesystem store
+	fsBackupExt    = ".bak"           // Added to document's file name, followed by number, for backups; 1 is the newest
+	fsTempExt      = ".tmp"           // Added to document's file name while new version is being written
+	fsDamagedExt   = ".damaged"       // Added to name of document file that failed validation
+	fsChecksumTag  = "#sha256:"       // Starts line at end of document file with hex checksum of what comes before
+	fsTrashFolder  = "trash"          // Subfolder where deleted documents' files are moved
+	fsTrashInfoExt = ".trash.json"    // Extension of file in trash folder that says when and by whom document was deleted
+	boltDbFileName = "docs.bolt"      // Name of database file in the bolt store
+)
+
+const fsDefaultBackups = 3 // Previous versions of each document kept by the filesystem store, unless configured
+
+// Returned by a document store if the requested document does not exist.
+var errDocNotFound = errors.New("document not found")
+
+// Returned if stored data does not match its checksum.
+var errChecksumMismatch = errors.New("checksum mismatch")
+
+// Returned when restoring a document whose ID is in use by a live document.
+var errDocExists = errors.New("document already exists")
+
+// Persistent storage for documents. Stores keep opaque serialized data: the orchestrator decides what goes in it.
+// Implementations must be safe for concurrent use.
+type DocumentStore interface {
+	// Retrieves a document's data. Returns errDocNotFound if document does not exist.
+	Load(docId string) ([]byte, error)
+
+	// Stores a document's data, replacing what's there.
+	Save(docId string, data []byte) error
+
+	// Removes a document and its revision log. Returns errDocNotFound if document does not exist.
+	Delete(docId string) error
+
+	// Moves a document, with its revision log, to the trash. Returns errDocNotFound if document does not exist.
+	Trash(info *TrashedDoc) error
+
+	// Moves a document back from the trash. Returns errDocNotFound if it is not in the trash,
+	// and errDocExists if a live document has the same ID.
+	Restore(docId string) error
+
+	// Permanently removes a document from the trash. Returns errDocNotFound if it is not in the trash.
+	Purge(docId string) error
+
+	// Gets the documents in the trash.
+	ListTrash() ([]TrashedDoc, error)
+
+	// Gets the IDs of all stored documents.
+	List() ([]string, error)
+
+	// Adds a revision to the end of a document's revision log.
+	AppendRevision(docId string, revisionId int, data []byte) error
+
+	// Replaces a document's revision log with the provided revisions in one step.
+	ReplaceRevisions(docId string, revs []StoredRevision) error
+
+	// Retrieves a document's revision log, oldest first. Empty if there is no log.
+	LoadRevisions(docId string) ([]StoredRevision, error)
+
+	// Releases the store's resources.
+	Close() error
+}
+
+// Describes a document in the trash.
+type TrashedDoc struct {
+	DocId      string    `json:"docId"`
+	Name       string    `json:"name"`
+	DeletedUtc time.Time `json:"deletedUtc"`
+	DeletedBy  string    `json:"deletedBy"`
+}
+
+// One entry in a document's revision log.
+type StoredRevision struct {
+	RevisionId int             `json:"revisionId"`
+	Data       json.RawMessage `json:"data"`
+}
+
+// Opens the store of the requested kind in the configured DocsFolder. Empty kind means the filesystem store.
+func NewDocumentStore(kind string, config *common.Config, xlog common.XieLogger) (DocumentStore, error) {
+	switch kind {
+	case "", DocStoreFiles:
+		backups := config.DocBackups
+		if backups == 0 {
+			backups = fsDefaultBackups
+		}
+		return &fsDocumentStore{xlog: xlog, folder: config.DocsFolder, backups: backups}, nil
+	case DocStoreBolt:
+		return openBoltDocumentStore(path.Join(config.DocsFolder, boltDbFileName))
+	default:
+		return nil, fmt.Errorf("unknown document store: %v", kind)
+	}
+}
+
+// Copies all documents, with their revision logs, from one store to another. The trash is not copied.
+// Documents already in the target store are overwritten. Returns the number of documents copied.
+func MigrateDocuments(from, to DocumentStore) (count int, err error) {
+	docIds, err := from.List()
+	if err != nil {
+		return 0, err
+	}
+	for _, docId := range docIds {
+		data, err := from.Load(docId)
+		if err != nil {
+			return count, fmt.Errorf("loading %v: %v", docId, err)
+		}
+		revs, err := from.LoadRevisions(docId)
+		if err != nil {
+			return count, fmt.Errorf("loading revisions of %v: %v", docId, err)
+		}
+		// Start from a clean slate so we don't append to an earlier migration's log
+		if err = to.Delete(docId); err != nil && !errors.Is(err, errDocNotFound) {
+			return count, fmt.Errorf("replacing %v: %v", docId, err)
+		}
+		for _, rev := range revs {
+			if err = to.AppendRevision(docId, rev.RevisionId, rev.Data); err != nil {
+				return count, fmt.Errorf("saving revisions of %v: %v", docId, err)
+			}
+		}
+		if err = to.Save(docId, data); err != nil {
+			return count, fmt.Errorf("saving %v: %v", docId, err)
+		}
+		count++
+	}
+	return count, nil
+}
+
+// Keeps each document in a JSON file in a folder, with its revision log in a second file of JSON lines.
+// Saves are atomic: new content is written to a temp file, flushed to disk, and renamed over the old file.
+// The file ends in a checksum line; the last few versions are kept as backups, and loading falls back
+// to the newest valid backup if the file is damaged.
+type fsDocumentStore struct {
+	xlog    common.XieLogger
+	folder  string
+	backups int
+}
+
+func (fs *fsDocumentStore) getDocFileName(docId string) string {
+	return path.Join(fs.folder, docId+fsDocExt)
+}
+
+func (fs *fsDocumentStore) getHistoryFileName(docId string) string {
+	return path.Join(fs.folder, docId+fsHistoryExt)
+}
+
+func (fs *fsDocumentStore) getBackupFileName(docId string, ix int) string {
+	return fs.getDocFileName(docId) + fsBackupExt + strconv.Itoa(ix)
+}
+
+func (fs *fsDocumentStore) Load(docId string) ([]byte, error) {
+	fileName := fs.getDocFileName(docId)
+	data, err := readCheckedFile(fileName)
+	if err == nil {
+		return data, nil
+	} else if errors.Is(err, os.ErrNotExist) {
+		return nil, errDocNotFound
+	}
+	for i := 1; i <= fs.backups; i++ {
+		bakData, bakErr := readCheckedFile(fs.getBackupFileName(docId, i))
+		if bakErr != nil {
+			continue
+		}
+		if bakData, bakErr = fs.renumberRecovered(docId, bakData); bakErr != nil {
+			fs.xlog.Logf(common.LogSrcDocStore, "Cannot use backup #%v of document %v: %v", i, docId, bakErr)
+			continue
+		}
+		fs.xlog.Logf(common.LogSrcDocStore, "Document %v is damaged (%v); falling back to backup #%v", docId, err, i)
+		// Set damaged file aside, so it's kept for inspection but doesn't end up among the backups
+		if renErr := os.Rename(fileName, fileName+fsDamagedExt); renErr != nil {
+			fs.xlog.Logf(common.LogSrcDocStore, "Failed to set aside damaged document %v: %v", docId, renErr)
+			return bakData, nil
+		}
+		// Recovered version takes the damaged file's place, so its new revision ID sticks
+		tempFileName := fileName + fsTempExt
+		if wrErr := writeFileSynced(tempFileName, appendChecksum(bakData)); wrErr != nil {
+			os.Remove(tempFileName)
+			fs.xlog.Logf(common.LogSrcDocStore, "Failed to write recovered document %v: %v", docId, wrErr)
+		} else if renErr := os.Rename(tempFileName, fileName); renErr != nil {
+			fs.xlog.Logf(common.LogSrcDocStore, "Failed to write recovered document %v: %v", docId, renErr)
+		}
+		return bakData, nil
+	}
+	return nil, err
+}
+
+// Moves the revision ID of a document recovered from a backup past the last entry in its revision log:
+// the revisions after the backup's were lost with the damaged file, and clients may have cached them.
+func (fs *fsDocumentStore) renumberRecovered(docId string, data []byte) ([]byte, error) {
+	revs, err := fs.LoadRevisions(docId)
+	if err != nil || len(revs) == 0 {
+		return data, err
+	}
+	var doc document
+	if err = doc.deserialize(data); err != nil {
+		return nil, err
+	}
+	lastRevId := revs[len(revs)-1].RevisionId
+	if doc.BaseRevisionId > lastRevId {
+		return data, nil
+	}
+	doc.BaseRevisionId = lastRevId + 1
+	return doc.serialize()
+}
+
+func (fs *fsDocumentStore) Save(docId string, data []byte) error {
+	fileName := fs.getDocFileName(docId)
+	tempFileName := fileName + fsTempExt
+	if err := writeFileSynced(tempFileName, appendChecksum(data)); err != nil {
+		os.Remove(tempFileName)
+		return err
+	}
+	fs.rotateBackups(docId)
+	if err := os.Rename(tempFileName, fileName); err != nil {
+		return err
+	}
+	return syncFolder(fs.folder)
+}
+
+// Shifts backups of a document by one, dropping the oldest, and makes the current file the newest backup.
+// Current file stays in place, so the document is never missing. Failures are logged, not returned:
+// a save should not fail because a backup could not be kept.
+func (fs *fsDocumentStore) rotateBackups(docId string) {
+	if fs.backups <= 0 {
+		return
+	}
+	for i := fs.backups; i > 1; i-- {
+		err := os.Rename(fs.getBackupFileName(docId, i-1), fs.getBackupFileName(docId, i))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			fs.xlog.Logf(common.LogSrcDocStore, "Failed to rotate backup of document %v: %v", docId, err)
+		}
+	}
+	newest := fs.getBackupFileName(docId, 1)
+	if err := os.Remove(newest); err != nil && !errors.Is(err, os.ErrNotExist) {
+		fs.xlog.Logf(common.LogSrcDocStore, "Failed to remove backup of document %v: %v", docId, err)
+	}
+	if err := os.Link(fs.getDocFileName(docId), newest); err != nil && !errors.Is(err, os.ErrNotExist) {
+		fs.xlog.Logf(common.LogSrcDocStore, "Failed to back up document %v: %v", docId, err)
+	}
+}
+
+func (fs *fsDocumentStore) Delete(docId string) error {
+	if err := os.Remove(fs.getHistoryFileName(docId)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	for i := 1; i <= fs.backups; i++ {
+		if err := os.Remove(fs.getBackupFileName(docId, i)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	err := os.Remove(fs.getDocFileName(docId))
+	if errors.Is(err, os.ErrNotExist) {
+		return errDocNotFound
+	}
+	return err
+}
+
+func (fs *fsDocumentStore) getTrashFolder() string {
+	return path.Join(fs.folder, fsTrashFolder)
+}
+
+// Gets the names of all files that belong to a document in a folder: the document, its backups, its revision log.
+func getDocFileNames(folder, docId string) ([]string, error) {
+	files, err := ioutil.ReadDir(folder)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]string, 0)
+	for _, f := range files {
+		if !f.IsDir() && strings.HasPrefix(f.Name(), docId+".") {
+			res = append(res, f.Name())
+		}
+	}
+	return res, nil
+}
+
+func (fs *fsDocumentStore) Trash(info *TrashedDoc) error {
+	trashFolder := fs.getTrashFolder()
+	if err := os.MkdirAll(trashFolder, 0755); err != nil {
+		return err
+	}
+	// Moving the document itself first makes it disappear for good; the rest is cleanup
+	docFileName := info.DocId + fsDocExt
+	if err := os.Rename(path.Join(fs.folder, docFileName), path.Join(trashFolder, docFileName)); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return errDocNotFound
+		}
+		return err
+	}
+	names, err := getDocFileNames(fs.folder, info.DocId)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err = os.Rename(path.Join(fs.folder, name), path.Join(trashFolder, name)); err != nil {
+			return err
+		}
+	}
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	if err = writeFileSynced(path.Join(trashFolder, info.DocId+fsTrashInfoExt), data); err != nil {
+		return err
+	}
+	return syncFolder(trashFolder)
+}
+
+func (fs *fsDocumentStore) Restore(docId string) error {
+	trashFolder := fs.getTrashFolder()
+	docFileName := docId + fsDocExt
+	if _, err := os.Stat(path.Join(trashFolder, docFileName)); errors.Is(err, os.ErrNotExist) {
+		return errDocNotFound
+	}
+	if _, err := os.Stat(path.Join(fs.folder, docFileName)); err == nil {
+		return errDocExists
+	}
+	names, err := getDocFileNames(trashFolder, docId)
+	if err != nil {
+		return err
+	}
+	// Moving the document itself last makes it reappear only once it's complete
+	for _, name := range names {
+		if name == docFileName || name == docId+fsTrashInfoExt {
+			continue
+		}
+		if err = os.Rename(path.Join(trashFolder, name), path.Join(fs.folder, name)); err != nil {
+			return err
+		}
+	}
+	if err = os.Rename(path.Join(trashFolder, docFileName), path.Join(fs.folder, docFileName)); err != nil {
+		return err
+	}
+	if err = os.Remove(path.Join(trashFolder, docId+fsTrashInfoExt)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return syncFolder(fs.folder)
+}
+
+func (fs *fsDocumentStore) Purge(docId string) error {
+	trashFolder := fs.getTrashFolder()
+	names, err := getDocFileNames(trashFolder, docId)
+	if errors.Is(err, os.ErrNotExist) || err == nil && len(names) == 0 {
+		return errDocNotFound
+	} else if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err = os.Remove(path.Join(trashFolder, name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (fs *fsDocumentStore) ListTrash() ([]TrashedDoc, error) {
+	trashFolder := fs.getTrashFolder()
+	files, err := ioutil.ReadDir(trashFolder)
+	if errors.Is(err, os.ErrNotExist) {
+		return []TrashedDoc{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	res := make([]TrashedDoc, 0)
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), fsDocExt) || strings.HasSuffix(f.Name(), fsTrashInfoExt) {
+			continue
+		}
+		info := TrashedDoc{DocId: strings.TrimSuffix(f.Name(), fsDocExt)}
+		data, err := ioutil.ReadFile(path.Join(trashFolder, info.DocId+fsTrashInfoExt))
+		if err == nil {
+			err = json.Unmarshal(data, &info)
+		}
+		// Info file is written last; if we crashed before that, time of the move is a good guess
+		if err != nil {
+			info.DeletedUtc = f.ModTime().UTC()
+		}
+		res = append(res, info)
+	}
+	return res, nil
+}
+
+func (fs *fsDocumentStore) List() ([]string, error) {
+	files, err := ioutil.ReadDir(fs.folder)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]string, 0, len(files))
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() || !strings.HasSuffix(name, fsDocExt) {
+			continue
+		}
+		res = append(res, strings.TrimSuffix(name, fsDocExt))
+	}
+	return res, nil
+}
+
+// Serializes revisions into lines of the revision log.
+func encodeRevisionLines(revs []StoredRevision) ([]byte, error) {
+	// Keep revision data byte for byte; the encoder ends the line for us
+	var lines bytes.Buffer
+	enc := json.NewEncoder(&lines)
+	enc.SetEscapeHTML(false)
+	for i := range revs {
+		if err := enc.Encode(&revs[i]); err != nil {
+			return nil, err
+		}
+	}
+	return lines.Bytes(), nil
+}
+
+func (fs *fsDocumentStore) AppendRevision(docId string, revisionId int, data []byte) error {
+	line, err := encodeRevisionLines([]StoredRevision{{RevisionId: revisionId, Data: data}})
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(fs.getHistoryFileName(docId), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(line); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (fs *fsDocumentStore) ReplaceRevisions(docId string, revs []StoredRevision) error {
+	lines, err := encodeRevisionLines(revs)
+	if err != nil {
+		return err
+	}
+	fileName := fs.getHistoryFileName(docId)
+	tempFileName := fileName + fsTempExt
+	if err = writeFileSynced(tempFileName, lines); err != nil {
+		os.Remove(tempFileName)
+		return err
+	}
+	if err = os.Rename(tempFileName, fileName); err != nil {
+		return err
+	}
+	return syncFolder(fs.folder)
+}
+
+func (fs *fsDocumentStore) LoadRevisions(docId string) ([]StoredRevision, error) {
+	data, err := ioutil.ReadFile(fs.getHistoryFileName(docId))
+	if errors.Is(err, os.ErrNotExist) {
+		return []StoredRevision{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	res := make([]StoredRevision, 0)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), len(data)+1)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var rev StoredRevision
+		if err = json.Unmarshal(scanner.Bytes(), &rev); err != nil {
+			// Append was cut short by a crash: everything before it is still good
+			if len(data) == 0 || data[len(data)-1] != '\n' {
+				fs.xlog.Logf(common.LogSrcDocStore, "Ignoring incomplete last entry in revision log of %v", docId)
+				break
+			}
+			return nil, err
+		}
+		res = append(res, rev)
+	}
+	return res, scanner.Err()
+}
+
+func (fs *fsDocumentStore) Close() error {
+	return nil
+}
+
+// Adds a line with the data's checksum to its end.
+func appendChecksum(data []byte) []byte {
+	sum := sha256.Sum256(data)
+	res := make([]byte, 0, len(data)+len(fsChecksumTag)+2*len(sum)+2)
+	res = append(res, data...)
+	res = append(res, '\n')
+	res = append(res, fsChecksumTag...)
+	res = append(res, hex.EncodeToString(sum[:])...)
+	return append(res, '\n')
+}
+
+// Reads file written with a checksum at the end, and returns its content without the checksum.
+// Files from before checksums were introduced are accepted if they contain valid JSON.
+func readCheckedFile(fileName string) ([]byte, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	trimmed := bytes.TrimRight(data, "\n")
+	ix := bytes.LastIndexByte(trimmed, '\n')
+	if ix == -1 || !bytes.HasPrefix(trimmed[ix+1:], []byte(fsChecksumTag)) {
+		if !json.Valid(data) {
+			return nil, errChecksumMismatch
+		}
+		return data, nil
+	}
+	content := trimmed[:ix]
+	sum := sha256.Sum256(content)
+	if string(trimmed[ix+1+len(fsChecksumTag):]) != hex.EncodeToString(sum[:]) {
+		return nil, errChecksumMismatch
+	}
+	return content, nil
+}
+
+// Writes file and flushes it to disk before returning.
+func writeFileSynced(fileName string, data []byte) error {
+	f, err := os.OpenFile(fileName, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Flushes folder to disk, so a rename within it survives a crash.
+func syncFolder(folder string) error {
+	f, err := os.Open(folder)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
@@ -0,0 +1,252 @@
+package logic
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	boltBucketDocs         = []byte("docs")         // Document data by document ID
+	boltBucketHistory      = []byte("history")      // One nested bucket per document, with revisions by big-endian revision ID
+	boltBucketTrash        = []byte("trash")        // Deleted documents' data by document ID
+	boltBucketTrashed      = []byte("trashed")      // JSON TrashedDoc of deleted documents by document ID
+	boltBucketTrashHistory = []byte("trashHistory") // Deleted documents' revision logs, laid out like history
+)
+
+// Keeps all documents and their revision logs in a single bbolt database file.
+// The file is locked while open, so only one process can use it at a time.
+// bbolt commits are atomic and flushed to disk, so a crash cannot leave a document half-written.
+type boltDocumentStore struct {
+	db *bolt.DB
+}
+
+func openBoltDocumentStore(fileName string) (*boltDocumentStore, error) {
+	db, err := bolt.Open(fileName, 0644, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltBucketDocs, boltBucketHistory, boltBucketTrash, boltBucketTrashed, boltBucketTrashHistory} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltDocumentStore{db: db}, nil
+}
+
+func (bs *boltDocumentStore) Load(docId string) ([]byte, error) {
+	var data []byte
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		val := tx.Bucket(boltBucketDocs).Get([]byte(docId))
+		if val == nil {
+			return errDocNotFound
+		}
+		// Value is only valid within the transaction
+		data = append([]byte{}, val...)
+		return nil
+	})
+	return data, err
+}
+
+func (bs *boltDocumentStore) Save(docId string, data []byte) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucketDocs).Put([]byte(docId), data)
+	})
+}
+
+func (bs *boltDocumentStore) Delete(docId string) error {
+	found := false
+	err := bs.db.Update(func(tx *bolt.Tx) error {
+		history := tx.Bucket(boltBucketHistory)
+		if history.Bucket([]byte(docId)) != nil {
+			if err := history.DeleteBucket([]byte(docId)); err != nil {
+				return err
+			}
+		}
+		docs := tx.Bucket(boltBucketDocs)
+		found = docs.Get([]byte(docId)) != nil
+		return docs.Delete([]byte(docId))
+	})
+	// Returning the error from within the transaction would roll back the removal of an orphaned log
+	if err == nil && !found {
+		err = errDocNotFound
+	}
+	return err
+}
+
+// Moves a document's data between the live and the trash bucket within a transaction.
+func moveBoltDoc(from, to *bolt.Bucket, docId string) error {
+	data := from.Get([]byte(docId))
+	if data == nil {
+		return errDocNotFound
+	}
+	if err := to.Put([]byte(docId), data); err != nil {
+		return err
+	}
+	return from.Delete([]byte(docId))
+}
+
+// Moves a document's revision log between the live and the trash history within a transaction.
+// Buckets cannot be renamed, so this copies the revisions.
+func moveBoltHistory(from, to *bolt.Bucket, docId string) error {
+	revs := from.Bucket([]byte(docId))
+	if revs == nil {
+		return nil
+	}
+	if to.Bucket([]byte(docId)) != nil {
+		if err := to.DeleteBucket([]byte(docId)); err != nil {
+			return err
+		}
+	}
+	target, err := to.CreateBucket([]byte(docId))
+	if err != nil {
+		return err
+	}
+	if err = revs.ForEach(func(k, v []byte) error { return target.Put(k, v) }); err != nil {
+		return err
+	}
+	return from.DeleteBucket([]byte(docId))
+}
+
+func (bs *boltDocumentStore) Trash(info *TrashedDoc) error {
+	infoData, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		if err := moveBoltDoc(tx.Bucket(boltBucketDocs), tx.Bucket(boltBucketTrash), info.DocId); err != nil {
+			return err
+		}
+		if err := moveBoltHistory(tx.Bucket(boltBucketHistory), tx.Bucket(boltBucketTrashHistory), info.DocId); err != nil {
+			return err
+		}
+		return tx.Bucket(boltBucketTrashed).Put([]byte(info.DocId), infoData)
+	})
+}
+
+func (bs *boltDocumentStore) Restore(docId string) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(boltBucketDocs).Get([]byte(docId)) != nil {
+			return errDocExists
+		}
+		if err := moveBoltDoc(tx.Bucket(boltBucketTrash), tx.Bucket(boltBucketDocs), docId); err != nil {
+			return err
+		}
+		if err := moveBoltHistory(tx.Bucket(boltBucketTrashHistory), tx.Bucket(boltBucketHistory), docId); err != nil {
+			return err
+		}
+		return tx.Bucket(boltBucketTrashed).Delete([]byte(docId))
+	})
+}
+
+func (bs *boltDocumentStore) Purge(docId string) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		trash := tx.Bucket(boltBucketTrash)
+		if trash.Get([]byte(docId)) == nil {
+			return errDocNotFound
+		}
+		history := tx.Bucket(boltBucketTrashHistory)
+		if history.Bucket([]byte(docId)) != nil {
+			if err := history.DeleteBucket([]byte(docId)); err != nil {
+				return err
+			}
+		}
+		if err := tx.Bucket(boltBucketTrashed).Delete([]byte(docId)); err != nil {
+			return err
+		}
+		return trash.Delete([]byte(docId))
+	})
+}
+
+func (bs *boltDocumentStore) ListTrash() ([]TrashedDoc, error) {
+	res := make([]TrashedDoc, 0)
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucketTrashed).ForEach(func(k, v []byte) error {
+			var info TrashedDoc
+			if err := json.Unmarshal(v, &info); err != nil {
+				return err
+			}
+			res = append(res, info)
+			return nil
+		})
+	})
+	return res, err
+}
+
+func (bs *boltDocumentStore) List() ([]string, error) {
+	res := make([]string, 0)
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucketDocs).ForEach(func(k, v []byte) error {
+			res = append(res, string(k))
+			return nil
+		})
+	})
+	return res, err
+}
+
+func (bs *boltDocumentStore) AppendRevision(docId string, revisionId int, data []byte) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		revs, err := tx.Bucket(boltBucketHistory).CreateBucketIfNotExists([]byte(docId))
+		if err != nil {
+			return err
+		}
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, uint64(revisionId))
+		return revs.Put(key, data)
+	})
+}
+
+func (bs *boltDocumentStore) ReplaceRevisions(docId string, revs []StoredRevision) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		history := tx.Bucket(boltBucketHistory)
+		if history.Bucket([]byte(docId)) != nil {
+			if err := history.DeleteBucket([]byte(docId)); err != nil {
+				return err
+			}
+		}
+		target, err := history.CreateBucket([]byte(docId))
+		if err != nil {
+			return err
+		}
+		for _, rev := range revs {
+			key := make([]byte, 8)
+			binary.BigEndian.PutUint64(key, uint64(rev.RevisionId))
+			if err = target.Put(key, rev.Data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (bs *boltDocumentStore) LoadRevisions(docId string) ([]StoredRevision, error) {
+	res := make([]StoredRevision, 0)
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		revs := tx.Bucket(boltBucketHistory).Bucket([]byte(docId))
+		if revs == nil {
+			return nil
+		}
+		// Keys are big-endian, so iteration is in revision order
+		return revs.ForEach(func(k, v []byte) error {
+			res = append(res, StoredRevision{
+				RevisionId: int(binary.BigEndian.Uint64(k)),
+				Data:       append([]byte{}, v...),
+			})
+			return nil
+		})
+	})
+	return res, err
+}
+
+func (bs *boltDocumentStore) Close() error {
+	return bs.db.Close()
+}
@@ -0,0 +1,320 @@
+package logic
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+	"xiep/internal/common"
+)
+
+func openTestStores(t *testing.T) map[string]DocumentStore {
+	res := make(map[string]DocumentStore)
+	for _, kind := range []string{DocStoreFiles, DocStoreBolt} {
+		store, err := NewDocumentStore(kind, &common.Config{DocsFolder: t.TempDir()}, testLogger{})
+		if err != nil {
+			t.Fatalf("Failed to open %v store: %v", kind, err)
+		}
+		t.Cleanup(func() { store.Close() })
+		res[kind] = store
+	}
+	return res
+}
+
+func TestDocumentStore_Roundtrip(t *testing.T) {
+	for kind, store := range openTestStores(t) {
+		if _, err := store.Load("x"); !errors.Is(err, errDocNotFound) {
+			t.Errorf("%v: expected not found, got %v", kind, err)
+		}
+		_ = store.Save("x", []byte(`{"docId":"x"}`))
+		_ = store.Save("y", []byte(`{"docId":"y"}`))
+		_ = store.Save("x", []byte(`{"docId":"x","name":"Momo"}`))
+		if data, err := store.Load("x"); err != nil || string(data) != `{"docId":"x","name":"Momo"}` {
+			t.Errorf("%v: wrong data loaded: %s, %v", kind, data, err)
+		}
+		_ = store.AppendRevision("x", 1, []byte(`"1>A"`))
+		_ = store.AppendRevision("x", 2, []byte(`"1>0,B"`))
+		revs, err := store.LoadRevisions("x")
+		if err != nil || len(revs) != 2 || revs[1].RevisionId != 2 || string(revs[1].Data) != `"1>0,B"` {
+			t.Errorf("%v: wrong revisions: %+v, %v", kind, revs, err)
+		}
+		docIds, _ := store.List()
+		sort.Strings(docIds)
+		if len(docIds) != 2 || docIds[0] != "x" || docIds[1] != "y" {
+			t.Errorf("%v: wrong list: %v", kind, docIds)
+		}
+		if err = store.Delete("x"); err != nil {
+			t.Errorf("%v: failed to delete: %v", kind, err)
+		}
+		if revs, _ = store.LoadRevisions("x"); len(revs) != 0 {
+			t.Errorf("%v: revisions survived delete", kind)
+		}
+		if err = store.Delete("x"); !errors.Is(err, errDocNotFound) {
+			t.Errorf("%v: expected not found on second delete, got %v", kind, err)
+		}
+	}
+}
+
+func TestDocumentStore_Migrate(t *testing.T) {
+	stores := openTestStores(t)
+	from, to := stores[DocStoreFiles], stores[DocStoreBolt]
+	_ = from.Save("x", []byte(`{"docId":"x"}`))
+	_ = from.AppendRevision("x", 1, []byte(`"0>A"`))
+	// Leftover from an earlier migration gets replaced
+	_ = to.AppendRevision("x", 7, []byte(`"0>B"`))
+
+	count, err := MigrateDocuments(from, to)
+	if err != nil || count != 1 {
+		t.Fatalf("Migration failed: %v, %v", count, err)
+	}
+	if data, _ := to.Load("x"); string(data) != `{"docId":"x"}` {
+		t.Errorf("Wrong data after migration: %s", data)
+	}
+	if revs, _ := to.LoadRevisions("x"); len(revs) != 1 || revs[0].RevisionId != 1 {
+		t.Errorf("Wrong revisions after migration: %+v", revs)
+	}
+}
+
+func TestOrchestrator_SaveAppendsRevisions(t *testing.T) {
+	for kind, store := range openTestStores(t) {
+		var ork orchestrator
+		var wg sync.WaitGroup
+		ork.init(testLogger{}, &wg, nil, store, t.TempDir(), 0)
+		ork.peerMessenger = &testMessenger{}
+		docId, _ := ork.CreateDocument("Momo")
+		sessionKey := ork.RequestSession(docId, "alice", "")
+		ork.startSession(sessionKey, "alice", -1)
+		typeChar(&ork, sessionKey, 0)
+		typeChar(&ork, sessionKey, 1)
+		ork.housekeepDocs()
+		typeChar(&ork, sessionKey, 2)
+		ork.housekeepDocs()
+
+		revs, _ := store.LoadRevisions(docId)
+		if len(revs) != 3 || revs[0].RevisionId != 1 || revs[2].RevisionId != 3 {
+			t.Errorf("%v: wrong revisions: %+v", kind, revs)
+		}
+		var doc document
+		data, _ := store.Load(docId)
+		if err := doc.deserialize(data); err != nil || doc.BaseRevisionId != 3 || len(doc.StartText) != 3 {
+			t.Errorf("%v: wrong document saved: %s", kind, data)
+		}
+	}
+}
+
+func TestFsDocumentStore_FallbackToBackup(t *testing.T) {
+	folder := t.TempDir()
+	store := &fsDocumentStore{xlog: testLogger{}, folder: folder, backups: 2}
+	for _, name := range []string{"a", "b", "c"} {
+		if err := store.Save("x", []byte(`{"name":"`+name+`"}`)); err != nil {
+			t.Fatalf("Failed to save: %v", err)
+		}
+	}
+	// Oldest version rotated out
+	if _, err := os.Stat(store.getBackupFileName("x", 3)); err == nil {
+		t.Errorf("Too many backups kept")
+	}
+	if data, _ := readCheckedFile(store.getBackupFileName("x", 2)); string(data) != `{"name":"a"}` {
+		t.Errorf("Wrong oldest backup: %s", data)
+	}
+
+	// Damage current version: newest backup is loaded instead, and damaged file is set aside
+	fileName := store.getDocFileName("x")
+	data, _ := ioutil.ReadFile(fileName)
+	_ = ioutil.WriteFile(fileName, data[:len(data)-10], 0644)
+	if data, err := store.Load("x"); err != nil || string(data) != `{"name":"b"}` {
+		t.Errorf("Wrong fallback: %s, %v", data, err)
+	}
+	if _, err := os.Stat(fileName + fsDamagedExt); err != nil {
+		t.Errorf("Damaged file not set aside: %v", err)
+	}
+
+	// Nothing valid left
+	_ = ioutil.WriteFile(fileName, []byte(`{"name":`), 0644)
+	_ = os.Remove(store.getBackupFileName("x", 1))
+	_ = ioutil.WriteFile(store.getBackupFileName("x", 2), []byte("{}\n#sha256:00\n"), 0644)
+	if _, err := store.Load("x"); !errors.Is(err, errChecksumMismatch) {
+		t.Errorf("Expected checksum mismatch, got %v", err)
+	}
+}
+
+func TestFsDocumentStore_FallbackMovesRevisionId(t *testing.T) {
+	store := &fsDocumentStore{xlog: testLogger{}, folder: t.TempDir(), backups: 2}
+	_ = store.Save("x", []byte(`{"docId":"x","name":"Momo","startText":[],"baseRevisionId":2}`))
+	_ = store.AppendRevision("x", 3, []byte(makeChange("0>A").SerializeJSON()))
+	_ = store.AppendRevision("x", 4, []byte(makeChange("1>B").SerializeJSON()))
+	_ = store.Save("x", []byte(`{"docId":"x","name":"Momo","startText":[{"hanzi":"A"},{"hanzi":"B"}],"baseRevisionId":4}`))
+
+	// Backup from revision 2 continues after the last logged revision, and replaces the damaged file
+	fileName := store.getDocFileName("x")
+	_ = ioutil.WriteFile(fileName, []byte(`{"docId":`), 0644)
+	expected := `{"docId":"x","name":"Momo","startText":[],"baseRevisionId":5}`
+	if data, err := store.Load("x"); err != nil || string(data) != expected {
+		t.Errorf("Wrong fallback: %s, %v", data, err)
+	}
+	if data, err := readCheckedFile(fileName); err != nil || string(data) != expected {
+		t.Errorf("Recovered document not written: %s, %v", data, err)
+	}
+}
+
+func TestFsDocumentStore_LegacyFiles(t *testing.T) {
+	folder := t.TempDir()
+	store := &fsDocumentStore{xlog: testLogger{}, folder: folder}
+	// Document saved before checksums; revision log whose last append was cut short
+	_ = ioutil.WriteFile(store.getDocFileName("x"), []byte(`{"docId":"x"}`), 0644)
+	_ = ioutil.WriteFile(store.getHistoryFileName("x"), []byte("{\"revisionId\":1,\"data\":\"0>A\"}\n{\"revisionId\":2,\"da"), 0644)
+	if data, err := store.Load("x"); err != nil || string(data) != `{"docId":"x"}` {
+		t.Errorf("Legacy document not loaded: %s, %v", data, err)
+	}
+	if revs, err := store.LoadRevisions("x"); err != nil || len(revs) != 1 {
+		t.Errorf("Wrong revisions: %+v, %v", revs, err)
+	}
+}
+
+func TestDocumentStore_Trash(t *testing.T) {
+	for kind, store := range openTestStores(t) {
+		_ = store.Save("x", []byte(`{"docId":"x"}`))
+		_ = store.AppendRevision("x", 1, []byte(`"0>A"`))
+		deletedUtc := time.Date(2021, 8, 1, 12, 0, 0, 0, time.UTC)
+		if err := store.Trash(&TrashedDoc{DocId: "x", Name: "Momo", DeletedUtc: deletedUtc, DeletedBy: "Alice"}); err != nil {
+			t.Fatalf("%v: failed to trash: %v", kind, err)
+		}
+		if _, err := store.Load("x"); !errors.Is(err, errDocNotFound) {
+			t.Errorf("%v: trashed document still loads", kind)
+		}
+		if docIds, _ := store.List(); len(docIds) != 0 {
+			t.Errorf("%v: trashed document still listed: %v", kind, docIds)
+		}
+		trashed, err := store.ListTrash()
+		if err != nil || len(trashed) != 1 || trashed[0].Name != "Momo" || trashed[0].DeletedBy != "Alice" ||
+			!trashed[0].DeletedUtc.Equal(deletedUtc) {
+			t.Errorf("%v: wrong trash: %+v, %v", kind, trashed, err)
+		}
+
+		// Restore brings back document with its log, but not over a live document
+		_ = store.Save("x", []byte(`{}`))
+		if err = store.Restore("x"); !errors.Is(err, errDocExists) {
+			t.Errorf("%v: expected conflict, got %v", kind, err)
+		}
+		_ = store.Delete("x")
+		if err = store.Restore("x"); err != nil {
+			t.Errorf("%v: failed to restore: %v", kind, err)
+		}
+		if data, _ := store.Load("x"); string(data) != `{"docId":"x"}` {
+			t.Errorf("%v: wrong data after restore: %s", kind, data)
+		}
+		if revs, _ := store.LoadRevisions("x"); len(revs) != 1 {
+			t.Errorf("%v: revisions lost in trash: %+v", kind, revs)
+		}
+		if trashed, _ = store.ListTrash(); len(trashed) != 0 {
+			t.Errorf("%v: restored document still in trash", kind)
+		}
+
+		// Purge removes for good
+		_ = store.Trash(&TrashedDoc{DocId: "x"})
+		if err = store.Purge("x"); err != nil {
+			t.Errorf("%v: failed to purge: %v", kind, err)
+		}
+		if err = store.Restore("x"); !errors.Is(err, errDocNotFound) {
+			t.Errorf("%v: purged document restored", kind)
+		}
+		if err = store.Purge("x"); !errors.Is(err, errDocNotFound) {
+			t.Errorf("%v: expected not found on second purge, got %v", kind, err)
+		}
+	}
+}
+
+func TestOrchestrator_DeleteToTrash(t *testing.T) {
+	ork := newTestOrchestrator(t)
+	tm := ork.peerMessenger.(*testMessenger)
+	docId, _ := ork.CreateDocument("Momo")
+	sessionKey := ork.RequestSession(docId, "alice", "Alice")
+	ork.startSession(sessionKey, "alice", -1)
+	typeChar(ork, sessionKey, 0)
+
+	ork.DeleteDocument(docId, "Alice")
+	if len(tm.terminated) != 1 || !tm.terminated[0].sessionKeys[sessionKey] || tm.terminated[0].perr.Code != errDocDeleted {
+		t.Errorf("Editors not told about delete: %+v", tm.terminated)
+	}
+	if ork.RequestSession(docId, "alice", "") != "" {
+		t.Errorf("Deleted document can still be opened")
+	}
+	trashed := ork.ListTrash()
+	if len(trashed) != 1 || trashed[0].Name != "Momo" || trashed[0].DeletedBy != "Alice" {
+		t.Errorf("Wrong trash: %+v", trashed)
+	}
+
+	// Restored document has the change that was not saved yet at the time of the delete
+	if !ork.RestoreDocument(docId) {
+		t.Fatalf("Failed to restore")
+	}
+	if ork.RestoreDocument(docId) {
+		t.Errorf("Restored document twice")
+	}
+	sessionKey = ork.RequestSession(docId, "alice", "")
+	if ssm := ork.startSession(sessionKey, "alice", -1); ssm == nil || len(ssm.Text) != 1 {
+		t.Errorf("Wrong document after restore: %+v", ssm)
+	}
+}
+
+// Store whose Trash waits until the test lets it proceed, like a slow disk.
+type slowTrashStore struct {
+	DocumentStore
+	trashing chan struct{}
+	proceed  chan struct{}
+}
+
+func (sts *slowTrashStore) Trash(info *TrashedDoc) error {
+	close(sts.trashing)
+	<-sts.proceed
+	return sts.DocumentStore.Trash(info)
+}
+
+func TestOrchestrator_DeleteDoesNotBlockOtherDocs(t *testing.T) {
+	ork := newTestOrchestrator(t)
+	sts := &slowTrashStore{DocumentStore: ork.store, trashing: make(chan struct{}), proceed: make(chan struct{})}
+	ork.store = sts
+	docIds, _ := makeLoadTestDocs(t, ork, 2)
+
+	deleted := make(chan struct{})
+	go func() {
+		ork.DeleteDocument(docIds[0], "Alice")
+		close(deleted)
+	}()
+	<-sts.trashing
+
+	// While the first document is moved to the trash, sessions can be requested on the second
+	done := make(chan string)
+	go func() { done <- ork.RequestSession(docIds[1], "bob", "Bob") }()
+	select {
+	case sessionKey := <-done:
+		if sessionKey == "" {
+			t.Errorf("Failed to request session")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Request for second document blocked by delete of first document")
+	}
+
+	// Deleted document is not loaded again before it's in the trash
+	go func() { done <- ork.GetDocumentName(docIds[0]) }()
+	close(sts.proceed)
+	<-deleted
+	if name := <-done; name != "" {
+		t.Errorf("Deleted document loaded again: %v", name)
+	}
+}
+
+func TestOrchestrator_PurgeTrash(t *testing.T) {
+	ork := newTestOrchestrator(t)
+	oldId, _ := ork.CreateDocument("Old")
+	newId, _ := ork.CreateDocument("New")
+	_ = ork.store.Trash(&TrashedDoc{DocId: oldId, DeletedUtc: time.Now().UTC().AddDate(0, 0, -orkDefaultTrashRetentionDays-1)})
+	_ = ork.store.Trash(&TrashedDoc{DocId: newId, DeletedUtc: time.Now().UTC().AddDate(0, 0, -1)})
+	ork.purgeTrash()
+	if trashed := ork.ListTrash(); len(trashed) != 1 || trashed[0].DocId != newId {
+		t.Errorf("Wrong trash after purge: %+v", trashed)
+	}
+}
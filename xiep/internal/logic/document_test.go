@@ -21,3 +21,39 @@ func TestDocument_JSON(t *testing.T) {
 		t.Errorf("Incorrect JSON for document")
 	}
 }
+
+func TestDocument_ComposeSince(t *testing.T) {
+	var doc document
+	doc.init("X", "Y", nil)
+	texts := []string{"", "A", "AB", "XAB"}
+	changes := []string{"0>A", "1>0,B", "2>X,0,1"}
+	for i, diag := range changes {
+		var cs biscript.ChangeSet
+		cs.FromDiagStr(diag)
+		doc.applyChange(&cs, 0, 0, i)
+	}
+	for baseRevId, baseText := range texts {
+		cs, ok := doc.composeSince(baseRevId)
+		if !ok {
+			t.Errorf("Failed to compose since revision %v", baseRevId)
+			continue
+		}
+		var text []biscript.XieChar
+		for _, r := range baseText {
+			text = append(text, biscript.XieChar{Hanzi: string(r)})
+		}
+		res := ""
+		for _, xc := range cs.Apply(text) {
+			res += xc.Hanzi
+		}
+		if res != "XAB" {
+			t.Errorf("Composed change since revision %v yields %v instead of head text", baseRevId, res)
+		}
+	}
+	if _, ok := doc.composeSince(len(texts)); ok {
+		t.Errorf("Composed change from unknown revision")
+	}
+	if _, ok := doc.composeSince(-1); ok {
+		t.Errorf("Composed change from negative revision")
+	}
+}
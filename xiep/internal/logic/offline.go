@@ -0,0 +1,164 @@
+package logic
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"unicode"
+	"xiep/internal/biscript"
+	"xiep/internal/common"
+)
+
+// Operations on stored documents for command-line tools, which work with the store directly, without the server.
+// The server should not be running while they modify documents.
+
+// A stored document's content.
+type DocContent struct {
+	DocId      string
+	Name       string
+	RevisionId int
+	Text       []biscript.XieChar
+}
+
+// Summary of a stored document.
+type DocStats struct {
+	DocId      string
+	Name       string
+	RevisionId int
+	Chars      int // Characters in the text, including line breaks
+	Hanzi      int // Characters that have pinyin
+	Paragraphs int
+	Revisions  int // Entries in the document's revision log
+}
+
+// Loads a document from the store, or, if source names an existing file, from a document JSON file.
+func LoadDocContent(store DocumentStore, source string) (*DocContent, error) {
+	var data []byte
+	var err error
+	if st, statErr := os.Stat(source); statErr == nil && !st.IsDir() {
+		data, err = readCheckedFile(source)
+	} else {
+		data, err = store.Load(source)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var doc document
+	if err = doc.deserialize(data); err != nil {
+		return nil, err
+	}
+	return &DocContent{DocId: doc.DocId, Name: doc.Name, RevisionId: doc.BaseRevisionId, Text: doc.headText}, nil
+}
+
+// Creates a new document in the store. Returns the new document's ID.
+func ImportDocument(store DocumentStore, name string, text []biscript.XieChar) (docId string, err error) {
+	for {
+		docId = getShortId()
+		if _, err = store.Load(docId); errors.Is(err, errDocNotFound) {
+			break
+		} else if err != nil {
+			return "", err
+		}
+	}
+	var doc document
+	doc.init(docId, name, text)
+	data, err := doc.serialize()
+	if err != nil {
+		return "", err
+	}
+	if err = store.Save(docId, data); err != nil {
+		return "", err
+	}
+	return docId, nil
+}
+
+// Summarizes a stored document.
+func GetDocStats(store DocumentStore, docId string) (*DocStats, error) {
+	content, err := LoadDocContent(store, docId)
+	if err != nil {
+		return nil, err
+	}
+	revs, err := store.LoadRevisions(docId)
+	if err != nil {
+		return nil, err
+	}
+	res := DocStats{
+		DocId:      docId,
+		Name:       content.Name,
+		RevisionId: content.RevisionId,
+		Chars:      len(content.Text),
+		Revisions:  len(revs),
+	}
+	// Paragraphs are ended by line breaks, except for the last one
+	for _, xc := range content.Text {
+		if xc.Hanzi == "\n" {
+			res.Paragraphs++
+		} else if xc.Pinyin != "" {
+			res.Hanzi++
+		}
+	}
+	if len(content.Text) != 0 && content.Text[len(content.Text)-1].Hanzi != "\n" {
+		res.Paragraphs++
+	}
+	return &res, nil
+}
+
+// Checks that a stored document loads, and that its revision log holds valid change sets that lead up
+// to the saved text. Returns the problems found; empty if the document is fine.
+func ValidateDocument(store DocumentStore, docId string) []string {
+	res := make([]string, 0)
+	data, err := store.Load(docId)
+	if err != nil {
+		return append(res, fmt.Sprintf("cannot be loaded: %v", err))
+	}
+	var doc document
+	if err = doc.deserialize(data); err != nil {
+		return append(res, fmt.Sprintf("cannot be parsed: %v", err))
+	}
+	if doc.DocId != docId {
+		res = append(res, fmt.Sprintf("has wrong ID inside: %v", doc.DocId))
+	}
+	for i, xc := range doc.StartText {
+		if xc.Hanzi == "" {
+			res = append(res, fmt.Sprintf("character %v is empty", i))
+			continue
+		}
+		if xc.Pinyin != "" && !unicode.Is(unicode.Han, []rune(xc.Hanzi)[0]) {
+			res = append(res, fmt.Sprintf("character %v has pinyin but is not Hanzi: %v", i, xc.Hanzi))
+		}
+	}
+	revs, err := store.LoadRevisions(docId)
+	if err != nil {
+		return append(res, fmt.Sprintf("revision log cannot be loaded: %v", err))
+	}
+	var prev *biscript.ChangeSet
+	prevId := 0
+	for _, rev := range revs {
+		var cs biscript.ChangeSet
+		if err = json.Unmarshal(rev.Data, &cs); err != nil {
+			res = append(res, fmt.Sprintf("revision %v cannot be parsed: %v", rev.RevisionId, err))
+			prev = nil
+			continue
+		}
+		if !cs.IsValid() {
+			res = append(res, fmt.Sprintf("revision %v is not a valid change set", rev.RevisionId))
+		}
+		if prev != nil && rev.RevisionId == prevId+1 && cs.LengthBefore != prev.LengthAfter {
+			res = append(res, fmt.Sprintf("revision %v does not apply to revision %v", rev.RevisionId, prevId))
+		}
+		if rev.RevisionId == doc.BaseRevisionId && cs.LengthAfter != uint(len(doc.StartText)) {
+			res = append(res, fmt.Sprintf("revision %v does not lead to the saved text", rev.RevisionId))
+		}
+		if rev.RevisionId > doc.BaseRevisionId {
+			res = append(res, fmt.Sprintf("revision %v is newer than the saved text", rev.RevisionId))
+		}
+		prev, prevId = &cs, rev.RevisionId
+	}
+	return res
+}
+
+// Loads the composer for command-line tools; panics if the map files are missing, like the server does.
+func LoadComposer(dataDir string, xlog common.XieLogger) *composer {
+	return loadComposerFromFiles(dataDir, xlog)
+}
@@ -0,0 +1,57 @@
+package logic
+
+import (
+	"strings"
+	"testing"
+	"xiep/internal/biscript"
+)
+
+func TestOffline_ImportAndLoad(t *testing.T) {
+	store := &fsDocumentStore{xlog: testLogger{}, folder: t.TempDir()}
+	text := []biscript.XieChar{{Hanzi: "狗", Pinyin: "gou3"}, {Hanzi: "\n"}, {Hanzi: "A"}}
+	docId, err := ImportDocument(store, "Momo", text)
+	if err != nil {
+		t.Fatalf("Failed to import: %v", err)
+	}
+	content, err := LoadDocContent(store, docId)
+	if err != nil || content.Name != "Momo" || len(content.Text) != 3 || content.Text[0] != text[0] {
+		t.Errorf("Wrong content: %+v, %v", content, err)
+	}
+	// Same document, loaded from its file
+	if content, err = LoadDocContent(nil, store.getDocFileName(docId)); err != nil || content.DocId != docId {
+		t.Errorf("Failed to load from file: %+v, %v", content, err)
+	}
+	stats, err := GetDocStats(store, docId)
+	if err != nil || stats.Chars != 3 || stats.Hanzi != 1 || stats.Paragraphs != 2 {
+		t.Errorf("Wrong stats: %+v, %v", stats, err)
+	}
+}
+
+func TestOffline_Validate(t *testing.T) {
+	ork := newTestOrchestrator(t)
+	docId, _ := ork.CreateDocument("Momo")
+	sessionKey := ork.RequestSession(docId, "alice", "")
+	ork.startSession(sessionKey, "alice", -1)
+	typeChar(ork, sessionKey, 0)
+	typeChar(ork, sessionKey, 1)
+	ork.housekeepDocs()
+	if problems := ValidateDocument(ork.store, docId); len(problems) != 0 {
+		t.Errorf("Problems in good document: %v", problems)
+	}
+
+	// Revision that doesn't follow from the previous one
+	_ = ork.store.AppendRevision(docId, 3, []byte(makeChange("5>A").SerializeJSON()))
+	problems := ValidateDocument(ork.store, docId)
+	if len(problems) != 2 || !strings.Contains(problems[0], "does not apply") || !strings.Contains(problems[1], "newer") {
+		t.Errorf("Wrong problems: %v", problems)
+	}
+	if problems = ValidateDocument(ork.store, "nonesuch"); len(problems) != 1 {
+		t.Errorf("Missing document not reported: %v", problems)
+	}
+
+	// Empty character in the saved text: reported, not a panic
+	docId, _ = ImportDocument(ork.store, "Momo", []biscript.XieChar{{Hanzi: "狗", Pinyin: "gou3"}, {Hanzi: "", Pinyin: "ma"}})
+	if problems = ValidateDocument(ork.store, docId); len(problems) != 1 {
+		t.Errorf("Empty character not reported: %v", problems)
+	}
+}
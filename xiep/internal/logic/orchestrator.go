@@ -1,11 +1,11 @@
 package logic
 
 import (
-	"encoding/json"
-	"fmt"
+	"errors"
 	"io/ioutil"
 	"os"
 	"path"
+	"sort"
 	"sync"
 	"time"
 	"xiep/internal/biscript"
@@ -17,9 +17,13 @@ const (
 	orkUnloadAfterSeconds          = 7800 // 2:10h; MUST BE GREATER THAN SessionIdleEndSeconds
 	orkSessionRequestExpirySeconds = 10   // If requested session is not started in this time, we purge it
 	orkSessionIdleEndSeconds       = 7200 // 2h; session is purged if idle for this long
+	orkSessionResumeGraceSeconds   = 60   // Session whose socket dropped can be resumed for this long
+	orkCatchUpMaxRevisions         = 2000 // Clients further behind than this get the full text, not a composed delta
 	orkHousekeepPeriodSec          = 2    // Frequency of housekeeping loop
 	orkExportCleanupLoopSec        = 600  // Frequency of cleanup of exported files waiting for download
 	orkExportFileMaxAgeMinutes     = 60   // How long exported DOCX files are kept
+	orkTrashPurgeLoopSec           = 3600 // Frequency of purging expired documents from the trash
+	orkDefaultTrashRetentionDays   = 30   // How long deleted documents are kept in the trash, unless configured
 )
 
 // Connection manager functionality related to sending messagest to connected peers.
@@ -28,8 +32,17 @@ type peerMessenger interface {
 	// Broadcasts message to the peers that need to hear it.
 	broadcast(ctb *changeToBroadcast)
 
-	// Terminates sessions identified by the provided keys.
-	terminateSessions(sessionKeys map[string]bool)
+	// Terminates sessions identified by the provided keys, sending peers the provided error.
+	terminateSessions(sessionKeys map[string]bool, perr *protocolError)
+
+	// Tells the other editors of a document that someone joined, left, or went idle.
+	broadcastPresence(ptb *presenceToBroadcast)
+
+	// Tells the messenger that sessions have ended, so it can forget about their peers.
+	sessionsEnded(sessionKeys []string)
+
+	// Tells the messenger that a document has been unloaded from memory.
+	docUnloaded(docId string)
 }
 
 // Represents the current selection in one active session.
@@ -48,50 +61,111 @@ type editSession struct {
 	// ID of document the session is editing
 	docId string
 
+	// ID of the auth session (logged-in user) that requested the edit session
+	authSessionId string
+
+	// Name shown to other editors
+	displayName string
+
+	// Time the session was started, i.e., the editor joined the document
+	joinedUtc time.Time
+
+	// True if other editors were last told that this session is idle
+	idle bool
+
 	// Last communication from the session (either change or ping)
 	lastActiveUtc time.Time
 
 	// Time the session was requested. Changes to zero time once session has started.
 	requestedUtc time.Time
 
+	// Time the session's socket went away. Zero while a socket is attached.
+	// A detached session can be resumed by a new socket within the grace period.
+	detachedUtc time.Time
+
+	// Revision ID created by the last change this session submitted, or -1.
+	lastOwnRevisionId int
+
 	// This editor's selection, as it applies to the current head text.
 	selection *sessionSelection
 }
 
+// Sent in HELLO. Carries either the full head text, or, for clients that have a cached copy,
+// a change set from their cached revision to the head; in the latter case, Text is nil.
 type sessionStartMessage struct {
-	Name           string             `json:"name"`
-	RevisionId     int                `json:"revisionId"`
-	Text           []biscript.XieChar `json:"text"`
-	PeerSelections []sessionSelection `json:"peerSelections"`
+	Name           string              `json:"name"`
+	RevisionId     int                 `json:"revisionId"`
+	Text           []biscript.XieChar  `json:"text"`
+	Change         *biscript.ChangeSet `json:"change,omitempty"`
+	PeerSelections []sessionSelection  `json:"peerSelections"`
+	Editors        []sessionPresence   `json:"editors,omitempty"`
+}
+
+type sessionResumeMessage struct {
+	RevisionId        int                 `json:"revisionId"`
+	LastOwnRevisionId int                 `json:"lastOwnRevisionId"`
+	Change            *biscript.ChangeSet `json:"change"`
+	PeerSelections    []sessionSelection  `json:"peerSelections"`
+	Editors           []sessionPresence   `json:"editors,omitempty"`
+}
+
+// A document in memory, with its own lock and the sessions editing it.
+// Activity on one document only ever holds that document's lock, so it never blocks another document.
+// Lock order: orchestrator.mu before loadedDoc.mu; never acquire orchestrator.mu while holding a document's lock.
+type loadedDoc struct {
+	mu sync.Mutex
+
+	// Nil until the document has been loaded from the store.
+	doc *document
+
+	// True once the document has been removed from the orchestrator's index (unloaded, deleted, or failed to load).
+	// Whoever finds this after acquiring the lock must look up the document again.
+	gone bool
+
+	// Sessions editing this document, by session key.
+	sessions map[string]*editSession
 }
 
 type orchestrator struct {
-	xlog              common.XieLogger
-	wgShutdown        *sync.WaitGroup
-	composer          *composer
-	docsFolder        string
-	exportsFolder     string
-	exit              chan interface{}
-	peerMessenger     peerMessenger
-	lastExportCleanup time.Time
+	xlog               common.XieLogger
+	wgShutdown         *sync.WaitGroup
+	composer           *composer
+	store              DocumentStore
+	exportsFolder      string
+	exit               chan interface{}
+	peerMessenger      peerMessenger
+	lastExportCleanup  time.Time
+	lastTrashPurge     time.Time
+	trashRetentionDays int              // Deleted documents are purged from the trash after this many days
+	backups            *backupScheduler // Nil if scheduled backups are not configured
+	sessionKeyPrefix   string           // Prepended to new session keys; identifies the instance in a cluster
 
-	mu       sync.Mutex
-	docs     []*document
-	sessions []*editSession
+	// Guards the indexes below only; held briefly for lookups, never while doing IO or processing changes.
+	mu       sync.RWMutex
+	docs     map[string]*loadedDoc
+	sessions map[string]*editSession
 }
 
 func (ork *orchestrator) init(xlog common.XieLogger,
 	wgShutdown *sync.WaitGroup,
 	composer *composer,
-	docsFolder string,
+	store DocumentStore,
 	exportsFolder string,
+	trashRetentionDays int,
 ) {
 	ork.xlog = xlog
 	ork.wgShutdown = wgShutdown
 	ork.composer = composer
-	ork.docsFolder = docsFolder
+	ork.store = store
+	ork.trashRetentionDays = trashRetentionDays
+	if ork.trashRetentionDays <= 0 {
+		ork.trashRetentionDays = orkDefaultTrashRetentionDays
+	}
 	ork.exportsFolder = exportsFolder
 	ork.exit = make(chan interface{})
+	ork.sessionKeyPrefix = "S-"
+	ork.docs = make(map[string]*loadedDoc)
+	ork.sessions = make(map[string]*editSession)
 }
 
 func (ork *orchestrator) startup(pm peerMessenger) {
@@ -122,6 +196,10 @@ func (ork *orchestrator) housekeep() {
 			safeExec(ork.housekeepDocs)
 			safeExec(ork.cleanupSessions)
 			safeExec(ork.cleanupExports)
+			safeExec(ork.purgeTrash)
+			if ork.backups != nil {
+				safeExec(ork.backups.run)
+			}
 		case <-ork.exit:
 			ork.xlog.Logf(common.LogSrcOrchestrator, "Housekeeping thread exiting")
 			ticker.Stop()
@@ -156,96 +234,245 @@ func (ork *orchestrator) cleanupExports() {
 // Saves dirty docs and unloads inactive docs.
 // Thread-safe; invoked from housekeep goroutine.
 func (ork *orchestrator) housekeepDocs() {
-	// We break out of closure within loop after each document save
-	// This way we release and re-acquire lock, so that other requests can be served between long-ish blocking IO writes
-	for finished := false; !finished; {
-		func() {
-			ork.mu.Lock()
-			defer ork.mu.Unlock()
-
-			// Remove docs that have been inactive for long
-			// Also remember a dirty document if we see one
-			i := 0
-			var dirtyDoc *document
-			for _, doc := range ork.docs {
-				hasExpired := time.Now().UTC().Sub(doc.lastAccessedUtc).Seconds() > orkUnloadAfterSeconds
-				if !hasExpired {
-					ork.docs[i] = doc
-					i++
-				}
-				if doc.dirty {
-					dirtyDoc = doc
-				}
-			}
-			ork.docs = ork.docs[:i]
-			// Save the last dirty document that we found
-			if dirtyDoc != nil {
-				if err := dirtyDoc.saveToFile(ork.getDocFileName(dirtyDoc.DocId)); err != nil {
-					ork.xlog.Logf(common.LogSrcOrchestrator, "Error saving dirty document %v: %v", dirtyDoc.DocId, err)
-				}
-			}
-			// If we removed a single dirty doc, we continue looping: there may be more
-			finished = dirtyDoc == nil
-		}()
+	// Each document is saved while holding only its own lock, so others can be edited in the meantime
+	for _, ld := range ork.getLoadedDocs() {
+		if ork.saveDoc(ld) && ork.unloadDoc(ld) {
+			ork.peerMessenger.docUnloaded(ld.doc.DocId)
+		}
 	}
 }
 
-// Unloads inactive and unclaimed sessions; terminates what must be closed.
-// Thread-safe; invoked from housekeep goroutine.
-func (ork *orchestrator) cleanupSessions() {
+// Gets a snapshot of the currently loaded documents.
+// Thread-safe.
+func (ork *orchestrator) getLoadedDocs() []*loadedDoc {
+	ork.mu.RLock()
+	defer ork.mu.RUnlock()
+
+	res := make([]*loadedDoc, 0, len(ork.docs))
+	for _, ld := range ork.docs {
+		res = append(res, ld)
+	}
+	return res
+}
+
+// Saves document if it is dirty. Returns true if the document has been inactive long enough to be unloaded.
+// Thread-safe.
+func (ork *orchestrator) saveDoc(ld *loadedDoc) (canUnload bool) {
+	ld.mu.Lock()
+	defer ld.mu.Unlock()
+
+	if ld.gone {
+		return false
+	}
+	if ld.doc.dirty {
+		if err := ork.storeDoc(ld.doc); err != nil {
+			ork.xlog.Logf(common.LogSrcOrchestrator, "Error saving dirty document %v: %v", ld.doc.DocId, err)
+		}
+	}
+	return ld.canUnload()
+}
+
+// Removes document from memory, unless it has been used since we decided to unload it.
+// Returns true if the document was unloaded.
+// Thread-safe.
+func (ork *orchestrator) unloadDoc(ld *loadedDoc) bool {
 	ork.mu.Lock()
 	defer ork.mu.Unlock()
+	ld.mu.Lock()
+	defer ld.mu.Unlock()
 
+	if ld.gone || !ld.canUnload() {
+		return false
+	}
+	ld.gone = true
+	delete(ork.docs, ld.doc.DocId)
+	return true
+}
+
+// Checks if the document is currently loaded.
+// Thread-safe.
+func (ork *orchestrator) isDocLoaded(docId string) bool {
+	ork.mu.RLock()
+	defer ork.mu.RUnlock()
+
+	_, ok := ork.docs[docId]
+	return ok
+}
+
+// Checks if document is saved, has no sessions, and has been inactive for long.
+// Must be called from within document's lock.
+func (ld *loadedDoc) canUnload() bool {
+	return !ld.doc.dirty && len(ld.sessions) == 0 &&
+		time.Now().UTC().Sub(ld.doc.lastAccessedUtc).Seconds() > orkUnloadAfterSeconds
+}
+
+// Unloads inactive and unclaimed sessions; terminates what must be closed.
+// Thread-safe; invoked from housekeep goroutine.
+func (ork *orchestrator) cleanupSessions() {
 	// Keys of sessions to terminate
 	toTerminate := make(map[string]bool)
-	i := 0
-	for _, sess := range ork.sessions {
-		unload := false
-		// Requested too long ago, and not claimed yet
-		if !sess.requestedUtc.IsZero() &&
-			time.Now().UTC().Sub(sess.requestedUtc).Seconds() > orkSessionRequestExpirySeconds {
-			unload = true
+	// Keys of sessions to remove from index
+	toRemove := make([]string, 0)
+	utcNow := time.Now().UTC()
+	for _, ld := range ork.getLoadedDocs() {
+		ld.mu.Lock()
+		for _, sess := range ld.sessions {
+			attached := sess.requestedUtc.IsZero() && sess.detachedUtc.IsZero()
+			unload := false
+			// Requested too long ago, and not claimed yet
+			if !sess.requestedUtc.IsZero() &&
+				time.Now().UTC().Sub(sess.requestedUtc).Seconds() > orkSessionRequestExpirySeconds {
+				unload = true
+			}
+			// Socket went away, and session was not resumed in time
+			if !sess.detachedUtc.IsZero() &&
+				time.Now().UTC().Sub(sess.detachedUtc).Seconds() > orkSessionResumeGraceSeconds {
+				unload = true
+			}
+			// Inactive for too long
+			if time.Now().UTC().Sub(sess.lastActiveUtc).Seconds() > orkSessionIdleEndSeconds {
+				unload = true
+				toTerminate[sess.sessionKey] = true
+			}
+			if unload {
+				delete(ld.sessions, sess.sessionKey)
+				toRemove = append(toRemove, sess.sessionKey)
+				if attached {
+					ork.broadcastPresence(ld, sess, presenceEventLeave)
+				}
+			} else if attached && !sess.idle && sess.isIdle(utcNow) {
+				sess.idle = true
+				ork.broadcastPresence(ld, sess, presenceEventStateChange)
+			}
 		}
-		// Inactive for too long
-		if time.Now().UTC().Sub(sess.lastActiveUtc).Seconds() > orkSessionIdleEndSeconds {
-			unload = true
-			toTerminate[sess.sessionKey] = true
+		ld.mu.Unlock()
+	}
+	if len(toRemove) != 0 {
+		ork.mu.Lock()
+		for _, sessionKey := range toRemove {
+			delete(ork.sessions, sessionKey)
 		}
-		if !unload {
-			ork.sessions[i] = sess
-			i++
+		ork.mu.Unlock()
+	}
+	ork.peerMessenger.terminateSessions(toTerminate,
+		newProtocolError(errSessionIdle, true, "Terminating because session has been idle for too long"))
+	if len(toRemove) != 0 {
+		ork.peerMessenger.sessionsEnded(toRemove)
+	}
+}
+
+// Writes revisions created since the last save to the document's revision log, then saves the document.
+// Must be called from within document's lock.
+func (ork *orchestrator) storeDoc(doc *document) error {
+	for revId := doc.storedRevisionId + 1; revId <= doc.headRevisionId(); revId++ {
+		cs := &doc.revisions[revId-doc.BaseRevisionId].changeSet
+		if err := ork.store.AppendRevision(doc.DocId, revId, []byte(cs.SerializeJSON())); err != nil {
+			return err
 		}
+		doc.storedRevisionId = revId
+	}
+	data, err := doc.serialize()
+	if err != nil {
+		return err
 	}
-	ork.sessions = ork.sessions[:i]
-	ork.peerMessenger.terminateSessions(toTerminate)
+	if err = ork.store.Save(doc.DocId, data); err != nil {
+		return err
+	}
+	doc.dirty = false
+	return nil
 }
 
-// Assembles full file system path of saved document.
+// Finds document, loading it from the store if it is not in memory yet, and acquires its lock.
+// Returns nil if document does not exist or cannot be loaded.
+// Caller must release the document's lock.
 // Thread-safe.
-func (ork *orchestrator) getDocFileName(docId string) string {
-	return path.Join(ork.docsFolder, docId+".json")
+func (ork *orchestrator) lockDoc(docId string) *loadedDoc {
+	for {
+		ork.mu.RLock()
+		ld, ok := ork.docs[docId]
+		ork.mu.RUnlock()
+		if !ok {
+			return ork.loadDoc(docId)
+		}
+		ld.mu.Lock()
+		if !ld.gone {
+			return ld
+		}
+		// Unloaded or deleted since we looked it up: try again
+		ld.mu.Unlock()
+	}
 }
 
-// Gets index of document in loaded array. Returns -1 if not currently loaded.
-// Must be called from within lock.
-func (ork *orchestrator) getDocIx(docId string) int {
-	for ix, doc := range ork.docs {
-		if doc.DocId == docId {
-			return ix
+// Loads a doc from the store. Claims the document's place in the index first, so that concurrent
+// requests wait for this load on the document's lock instead of loading it again.
+// If document does not exist, or cannot be parsed, logs incident and returns nil.
+// On success, returns the document with its lock held.
+// Thread-safe.
+func (ork *orchestrator) loadDoc(docId string) *loadedDoc {
+	ork.mu.Lock()
+	if ld, ok := ork.docs[docId]; ok {
+		// Someone else got here first
+		ork.mu.Unlock()
+		ld.mu.Lock()
+		if !ld.gone {
+			return ld
 		}
+		ld.mu.Unlock()
+		return ork.lockDoc(docId)
+	}
+	ld := &loadedDoc{sessions: make(map[string]*editSession)}
+	ld.mu.Lock()
+	ork.docs[docId] = ld
+	ork.mu.Unlock()
+
+	var doc document
+	data, err := ork.store.Load(docId)
+	if err == nil {
+		err = doc.deserialize(data)
 	}
-	return -1
+	if err != nil {
+		ork.xlog.Logf(common.LogSrcOrchestrator, "Failed to load document %v: %v", docId, err)
+		ld.gone = true
+		ld.mu.Unlock()
+		ork.dropDoc(docId, ld)
+		return nil
+	}
+	ld.doc = &doc
+	return ld
 }
 
-// Gets index of a session by key. Returns -1 if no such session.
-// Must be called from within lock.
-func (ork *orchestrator) getSessionIx(sessionKey string) int {
-	for ix, sess := range ork.sessions {
-		if sess.sessionKey == sessionKey {
-			return ix
-		}
+// Removes a document that has been marked as gone from the index.
+// Must be called without holding the document's lock.
+func (ork *orchestrator) dropDoc(docId string, ld *loadedDoc) {
+	ork.mu.Lock()
+	defer ork.mu.Unlock()
+
+	if ork.docs[docId] == ld {
+		delete(ork.docs, docId)
+	}
+}
+
+// Finds session, and acquires the lock of the document it is editing.
+// Returns nils if there is no such session.
+// Caller must release the document's lock.
+// Thread-safe.
+func (ork *orchestrator) lockSession(sessionKey string) (*editSession, *loadedDoc) {
+	ork.mu.RLock()
+	sess, ok := ork.sessions[sessionKey]
+	ork.mu.RUnlock()
+	if !ok {
+		return nil, nil
+	}
+	ld := ork.lockDoc(sess.docId)
+	if ld == nil {
+		return nil, nil
+	}
+	// Session may have been removed since we looked it up
+	if ld.sessions[sessionKey] != sess {
+		ld.mu.Unlock()
+		return nil, nil
 	}
-	return -1
+	return sess, ld
 }
 
 // Creates new document.
@@ -253,121 +480,280 @@ func (ork *orchestrator) getSessionIx(sessionKey string) int {
 // Thread-safe.
 func (ork *orchestrator) CreateDocument(name string) (docId string, err error) {
 	ork.mu.Lock()
-	defer ork.mu.Unlock()
-
-	err = nil
-	var docFileName string
 	for {
 		docId = getShortId()
-		if ix := ork.getDocIx(docId); ix != -1 {
+		if _, ok := ork.docs[docId]; ok {
 			continue
 		}
-		docFileName = ork.getDocFileName(docId)
-		if _, err := os.Stat(docFileName); err == nil {
+		if _, err := ork.store.Load(docId); err == nil {
 			continue
 		}
 		break
 	}
+	ld := &loadedDoc{sessions: make(map[string]*editSession)}
+	ld.mu.Lock()
+	ork.docs[docId] = ld
+	ork.mu.Unlock()
+
 	var doc document
 	doc.init(docId, name, nil)
-	if err = doc.saveToFile(docFileName); err != nil {
+	if err = ork.storeDoc(&doc); err != nil {
+		ld.gone = true
+		ld.mu.Unlock()
+		ork.dropDoc(docId, ld)
 		return
 	}
-	ork.docs = append(ork.docs, &doc)
+	ld.doc = &doc
+	ld.mu.Unlock()
 	return
 }
 
-// Unload document and deletes from disk; destroys existing sessions.
+// Unloads document and moves it to the trash; tells editors in existing sessions that it's gone.
+// deletedBy is the display name of the user deleting the document; it may be empty.
 // If document does not exist, or if it cannot be deleted, logs incident, but returns normally.
 // Thread-safe.
-func (ork *orchestrator) DeleteDocument(docId string) {
-	ork.mu.Lock()
-	defer ork.mu.Unlock()
+func (ork *orchestrator) DeleteDocument(docId, deletedBy string) {
+	var ld *loadedDoc
+	for {
+		// Make sure document is in memory, so the trash gets its latest content and its name
+		if ld = ork.lockDoc(docId); ld == nil {
+			// Document does not exist: log it, but life can go on
+			ork.xlog.Logf(common.LogSrcOrchestrator, "document %v does not seem to exist (no big deal)", docId)
+			return
+		}
+		ld.mu.Unlock()
+		// Lock order requires index lock first
+		ork.mu.Lock()
+		ld.mu.Lock()
+		if !ld.gone {
+			break
+		}
+		// Unloaded or deleted in the meantime: try again
+		ld.mu.Unlock()
+		ork.mu.Unlock()
+	}
 
-	// Find index of document in docs array (might not be present if not loaded)
-	docIx := ork.getDocIx(docId)
-	// Remove doc from array, if loaded
-	if docIx != -1 {
-		ork.docs[docIx] = ork.docs[len(ork.docs)-1]
-		ork.docs[len(ork.docs)-1] = nil
-		ork.docs = ork.docs[:len(ork.docs)-1]
-	}
-	// Remove any related sessions
-	i := 0
-	for _, sess := range ork.sessions {
-		if sess.docId != docId {
-			ork.sessions[i] = sess
-			i++
+	// Remove related sessions from index; doc stays in the index, marked as gone, until it is in the trash,
+	// so that nobody loads it from the store again in the meantime
+	ld.gone = true
+	sessionKeys := make(map[string]bool)
+	for sessionKey := range ld.sessions {
+		delete(ork.sessions, sessionKey)
+		sessionKeys[sessionKey] = true
+	}
+	ld.sessions = make(map[string]*editSession)
+	ork.mu.Unlock()
+
+	// Save and move to trash holding only the document's lock
+	if ld.doc.dirty {
+		if err := ork.storeDoc(ld.doc); err != nil {
+			ork.xlog.Logf(common.LogSrcOrchestrator, "Error saving dirty document before delete %v: %v", docId, err)
 		}
 	}
-	ork.sessions = ork.sessions[:i]
-	// Delete file
-	docFileName := ork.getDocFileName(docId)
-	// Try to delete if file seems to exist
-	if _, err := os.Stat(docFileName); err != nil {
-		// File does not exist: log it, but life can go on
-		ork.xlog.Logf(common.LogSrcOrchestrator, "document on disk does not seem to exist (no big deal): %v", err)
-	} else {
-		// File exists: get rid of it
-		if err := os.Remove(docFileName); err != nil {
-			// If physical delete fails, log error, but otherwise life can go on
-			ork.xlog.Logf(common.LogSrcOrchestrator, "Failed to delete document from disk (no big deal): %v", err)
+	info := TrashedDoc{
+		DocId:      docId,
+		Name:       ld.doc.Name,
+		DeletedUtc: time.Now().UTC(),
+		DeletedBy:  sanitizeDisplayName(deletedBy),
+	}
+	if err := ork.store.Trash(&info); err != nil {
+		// If move fails, log error, but otherwise life can go on
+		ork.xlog.Logf(common.LogSrcOrchestrator, "Failed to move document %v to trash (no big deal): %v", docId, err)
+	}
+	ld.mu.Unlock()
+	ork.dropDoc(docId, ld)
+
+	ork.peerMessenger.terminateSessions(sessionKeys, newProtocolError(errDocDeleted, true, "Document has been deleted"))
+}
+
+// Drops a document from memory, and ends its sessions.
+// Called when this instance is no longer the document's owner, or soon won't be. If another instance owns it
+// already, it has loaded the document from the store, so saving now could overwrite its changes: then save
+// is false, and changes that have not been saved yet are lost. If the lease is about to run out, save is true,
+// and the document is saved while it still belongs to this instance.
+// Thread-safe.
+func (ork *orchestrator) abandonDocument(docId string, save bool) {
+	ork.mu.Lock()
+	ld, ok := ork.docs[docId]
+	if !ok {
+		ork.mu.Unlock()
+		return
+	}
+	ld.mu.Lock()
+	if ld.gone {
+		ld.mu.Unlock()
+		ork.mu.Unlock()
+		return
+	}
+	ld.gone = true
+	sessionKeys := make(map[string]bool)
+	for sessionKey := range ld.sessions {
+		delete(ork.sessions, sessionKey)
+		sessionKeys[sessionKey] = true
+	}
+	ld.sessions = make(map[string]*editSession)
+	delete(ork.docs, docId)
+	ork.mu.Unlock()
+
+	// Nobody finds the document anymore, so its own lock is enough while saving
+	if ld.doc.dirty && save {
+		if err := ork.storeDoc(ld.doc); err != nil {
+			ork.xlog.Logf(common.LogSrcOrchestrator, "Error saving abandoned document %v: %v", docId, err)
 		}
+	} else if ld.doc.dirty {
+		ork.xlog.Logf(common.LogSrcOrchestrator, "Unsaved changes to abandoned document %v are lost", docId)
+	}
+	ld.mu.Unlock()
+
+	ork.peerMessenger.terminateSessions(sessionKeys, newProtocolError(errDocMoved, true, "Document has moved to a different server; reload it"))
+}
+
+// Moves a document back from the trash.
+// Returns false if document is not in the trash, or cannot be restored; logs the reason.
+// Thread-safe.
+func (ork *orchestrator) RestoreDocument(docId string) bool {
+	if err := ork.store.Restore(docId); err != nil {
+		ork.xlog.Logf(common.LogSrcOrchestrator, "Failed to restore document %v: %v", docId, err)
+		return false
 	}
+	return true
 }
 
-// Loads a doc from disk if it exists but no currently in memory.
-// If document does not exist, or cannot be parsed, logs incident and returns normally.
-// Must be called from within lock.
-func (ork *orchestrator) ensureLoaded(docId string) {
-	docIx := ork.getDocIx(docId)
-	if docIx != -1 {
+// Gets the documents in the trash. If the trash cannot be read, logs the incident and returns an empty list.
+// Thread-safe.
+func (ork *orchestrator) ListTrash() []TrashedDoc {
+	res, err := ork.store.ListTrash()
+	if err != nil {
+		ork.xlog.Logf(common.LogSrcOrchestrator, "Failed to list trash: %v", err)
+		return []TrashedDoc{}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].DeletedUtc.After(res[j].DeletedUtc) })
+	return res
+}
+
+// Permanently removes documents that have been in the trash for longer than the retention period.
+// Invoked from housekeep goroutine.
+func (ork *orchestrator) purgeTrash() {
+	if !ork.lastTrashPurge.IsZero() && time.Since(ork.lastTrashPurge).Seconds() < orkTrashPurgeLoopSec {
 		return
 	}
-	docFileName := ork.getDocFileName(docId)
-	var doc document
-	if err := doc.loadFromFile(docFileName); err != nil {
-		ork.xlog.Logf(common.LogSrcOrchestrator, "Failed to load document from file: %v", err)
+	ork.lastTrashPurge = time.Now()
+	trashed, err := ork.store.ListTrash()
+	if err != nil {
+		ork.xlog.Logf(common.LogSrcOrchestrator, "Not purging trash because got error listing it: %v", err)
 		return
 	}
-	ork.docs = append(ork.docs, &doc)
+	for _, info := range trashed {
+		if time.Since(info.DeletedUtc).Hours() <= float64(24*ork.trashRetentionDays) {
+			continue
+		}
+		// Another instance sharing the store may have been faster
+		if err := ork.store.Purge(info.DocId); err != nil && !errors.Is(err, errDocNotFound) {
+			ork.xlog.Logf(common.LogSrcOrchestrator, "Error purging document %v from trash: %v", info.DocId, err)
+		}
+	}
 }
 
-// Requests a new editing session.
+// Requests a new editing session on behalf of the logged-in user identified by authSessionId.
+// Only a socket opened by the same user can start the session.
+// displayName is what other editors see; it may be empty.
 // Returns new session ID, or zero string if document does not exist.
 // Thread-safe.
-func (ork *orchestrator) RequestSession(docId string) (sessionKey string) {
+func (ork *orchestrator) RequestSession(docId, authSessionId, displayName string) (sessionKey string) {
 
-	ork.mu.Lock()
-	defer ork.mu.Unlock()
-
-	ork.ensureLoaded(docId)
-	if docIx := ork.getDocIx(docId); docIx == -1 {
-		return ""
+	sess := editSession{
+		docId:             docId,
+		authSessionId:     authSessionId,
+		displayName:       sanitizeDisplayName(displayName),
+		lastActiveUtc:     time.Now().UTC(),
+		requestedUtc:      time.Now().UTC(),
+		lastOwnRevisionId: -1,
 	}
+	// Reserve key in index first: we must not acquire the index lock while holding the document's
+	ork.mu.Lock()
 	for {
-		sessionKey = "S-" + getShortId()
-		if ix := ork.getSessionIx(sessionKey); ix == -1 {
+		sessionKey = ork.sessionKeyPrefix + getShortId()
+		if _, ok := ork.sessions[sessionKey]; !ok {
 			break
 		}
 	}
-	sess := editSession{
-		docId:         docId,
-		sessionKey:    sessionKey,
-		lastActiveUtc: time.Now().UTC(),
-		requestedUtc:  time.Now().UTC(),
+	sess.sessionKey = sessionKey
+	ork.sessions[sessionKey] = &sess
+	ork.mu.Unlock()
+
+	ld := ork.lockDoc(docId)
+	if ld == nil {
+		ork.mu.Lock()
+		delete(ork.sessions, sessionKey)
+		ork.mu.Unlock()
+		return ""
 	}
-	ork.sessions = append(ork.sessions, &sess)
+	ld.sessions[sessionKey] = &sess
+	ld.mu.Unlock()
 
 	return sessionKey
 }
 
-// Retrieves currently known selections in all active sessions.
-// Must be called from within lock.
-func (ork *orchestrator) getDocSelections(docId string) []sessionSelection {
-	res := make([]sessionSelection, 0, 1)
-	for _, sess := range ork.sessions {
-		if sess.docId != docId || sess.selection == nil {
+// Gets the keys of sessions that have a socket attached and should hear about changes.
+// Must be called from within document's lock.
+func (ld *loadedDoc) getReceivers() map[string]bool {
+	receivers := make(map[string]bool)
+	for _, x := range ld.sessions {
+		if x.requestedUtc.IsZero() && x.detachedUtc.IsZero() {
+			receivers[x.sessionKey] = true
+		}
+	}
+	return receivers
+}
+
+// Gets presence info of sessions that have a socket attached, in the order they joined.
+// Must be called from within document's lock.
+func (ld *loadedDoc) getPresences() []sessionPresence {
+	utcNow := time.Now().UTC()
+	sessions := make([]*editSession, 0, len(ld.sessions))
+	for _, sess := range ld.sessions {
+		if sess.requestedUtc.IsZero() && sess.detachedUtc.IsZero() {
+			sessions = append(sessions, sess)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		if sessions[i].joinedUtc.Equal(sessions[j].joinedUtc) {
+			return sessions[i].sessionKey < sessions[j].sessionKey
+		}
+		return sessions[i].joinedUtc.Before(sessions[j].joinedUtc)
+	})
+	res := make([]sessionPresence, 0, len(sessions))
+	for _, sess := range sessions {
+		res = append(res, sess.getPresence(utcNow))
+	}
+	return res
+}
+
+// Gets presence info of everyone currently editing the document.
+// Does not load the document: if it's not in memory, nobody is editing it.
+// Thread-safe.
+func (ork *orchestrator) getEditors(docId string) []sessionPresence {
+	ork.mu.RLock()
+	ld, ok := ork.docs[docId]
+	ork.mu.RUnlock()
+	if !ok {
+		return []sessionPresence{}
+	}
+	ld.mu.Lock()
+	defer ld.mu.Unlock()
+
+	if ld.gone {
+		return []sessionPresence{}
+	}
+	return ld.getPresences()
+}
+
+// Retrieves currently known selections in all active sessions, ordered by session key.
+// Must be called from within document's lock.
+func (ld *loadedDoc) getSelections() []sessionSelection {
+	res := make([]sessionSelection, 0, len(ld.sessions))
+	for _, sess := range ld.sessions {
+		if sess.selection == nil || !sess.detachedUtc.IsZero() {
 			continue
 		}
 		res = append(res, sessionSelection{
@@ -377,111 +763,187 @@ func (ork *orchestrator) getDocSelections(docId string) []sessionSelection {
 			CaretAtStart: sess.selection.CaretAtStart,
 		})
 	}
+	sort.Slice(res, func(i, j int) bool { return res[i].SessionKey < res[j].SessionKey })
 	return res
 }
 
-// Retrieves currently known selections in all active sessions and returns result serialized into JSON.
-// Must be called from within lock.
-func (ork *orchestrator) getDocSelectionsJSON(docId string) string {
-	sessionSelections := ork.getDocSelections(docId)
-	selJson, err := json.Marshal(&sessionSelections)
-	if err != nil {
-		panic(fmt.Sprintf("Failed to serialize session selections to JSON: %v", err))
-	}
-	return string(selJson)
-}
-
 // Starts a new session in response to SESSIONKEY message from socket client
+// authSessionId identifies the user behind the socket; it must match the user who requested the session.
+// cachedRevisionId is the revision of the client's locally cached copy, or -1 if it has none.
+// If that revision is known and recent enough, the start message carries a delta instead of the full text.
+// Returns nil if the session cannot be started.
 // Thread-safe.
-func (ork *orchestrator) startSession(sessionKey string) (startMsg string) {
-	ork.mu.Lock()
-	defer ork.mu.Unlock()
-
-	startMsg = ""
-	sessionIx := ork.getSessionIx(sessionKey)
-	if sessionIx == -1 {
+func (ork *orchestrator) startSession(sessionKey, authSessionId string, cachedRevisionId int) (startMsg *sessionStartMessage) {
+	startMsg = nil
+	sess, ld := ork.lockSession(sessionKey)
+	if sess == nil {
 		return
 	}
-	sess := ork.sessions[sessionIx]
+	defer ld.mu.Unlock()
+
 	if sess.requestedUtc.IsZero() {
 		return
 	}
-	docIx := ork.getDocIx(sess.docId)
-	if docIx == -1 {
+	if sess.authSessionId != authSessionId {
+		ork.xlog.Logf(common.LogSrcOrchestrator, "Session %v presented by a different user than the one who requested it", sessionKey)
 		return
 	}
-	doc := ork.docs[docIx]
+	doc := ld.doc
+	sess.requestedUtc = time.Time{}
+	sess.joinedUtc = time.Now().UTC()
+	sess.lastActiveUtc = sess.joinedUtc
+	sess.selection = &sessionSelection{}
 	ssm := sessionStartMessage{
 		Name:           doc.Name,
-		RevisionId:     len(doc.revisions) - 1,
-		Text:           doc.headText,
-		PeerSelections: ork.getDocSelections(doc.DocId),
+		RevisionId:     doc.headRevisionId(),
+		PeerSelections: ld.getSelections(),
+		Editors:        ld.getPresences(),
 	}
-	sess.requestedUtc = time.Time{}
-	sess.selection = &sessionSelection{}
-	if startStrBytes, err := json.Marshal(&ssm); err == nil {
-		startMsg = string(startStrBytes)
+	if cachedRevisionId >= 0 && doc.headRevisionId()-cachedRevisionId <= orkCatchUpMaxRevisions {
+		ssm.Change, _ = doc.composeSince(cachedRevisionId)
+	}
+	if ssm.Change == nil {
+		ssm.Text = doc.headText
 	}
+	ork.broadcastPresence(ld, sess, presenceEventJoin)
+	startMsg = &ssm
 	return
 }
 
 // Checks whether session with provided key is currently active (exists and has been started).
 // Thread-safe.
 func (ork *orchestrator) isSessionOpen(sessionKey string) bool {
-	ork.mu.Lock()
-	defer ork.mu.Unlock()
+	sess, ld := ork.lockSession(sessionKey)
+	if sess == nil {
+		return false
+	}
+	defer ld.mu.Unlock()
 
-	sessionIx := ork.getSessionIx(sessionKey)
-	return sessionIx != -1 && ork.sessions[sessionIx].requestedUtc.IsZero()
+	return sess.requestedUtc.IsZero() && sess.detachedUtc.IsZero()
 }
 
-// Removes session with the provided key from list of known sessions, if there.
+// Marks session with the provided key as detached when its socket goes away.
+// The session is kept around for a grace period so a new socket can resume it; after that, housekeeping removes it.
 // Thread-safe.
-func (ork *orchestrator) sessionClosed(sessionKey string) {
-	ork.mu.Lock()
-	defer ork.mu.Unlock()
+func (ork *orchestrator) sessionDetached(sessionKey string) {
+	sess, ld := ork.lockSession(sessionKey)
+	if sess == nil {
+		return
+	}
+	defer ld.mu.Unlock()
 
-	i := 0
-	for _, sess := range ork.sessions {
-		if sess.sessionKey != sessionKey {
-			ork.sessions[i] = sess
-			i++
-		}
+	if !sess.requestedUtc.IsZero() || !sess.detachedUtc.IsZero() {
+		return
 	}
-	ork.sessions = ork.sessions[:i]
+	sess.detachedUtc = time.Now().UTC()
+	// Make the session's cursor disappear for everyone else
+	ork.broadcastSelections(ld, sessionKey)
+	ork.broadcastPresence(ld, sess, presenceEventLeave)
 }
 
-// Handles a message from a session announced through a CHANGE message.
+// Tells the document's other editors about a change in a session's presence.
+// Must be called from within document's lock.
+func (ork *orchestrator) broadcastPresence(ld *loadedDoc, sess *editSession, event string) {
+	ptb := presenceToBroadcast{
+		event:               event,
+		presence:            sess.getPresence(time.Now().UTC()),
+		receiverSessionKeys: ld.getReceivers(),
+	}
+	ork.peerMessenger.broadcastPresence(&ptb)
+}
+
+// Tells everyone editing the document about the current selections, after a session came or went.
+// Must be called from within document's lock.
+func (ork *orchestrator) broadcastSelections(ld *loadedDoc, sourceSessionKey string) {
+	ctb := changeToBroadcast{
+		sourceSessionKey:        sourceSessionKey,
+		sourceBaseDocRevisionId: ld.doc.headRevisionId(),
+		newDocRevisionId:        ld.doc.headRevisionId(),
+		receiverSessionKeys:     ld.getReceivers(),
+		selections:              ld.getSelections(),
+	}
+	ork.peerMessenger.broadcast(&ctb)
+}
+
+// Reattaches a new socket to an existing session in response to a RESUME message.
+// lastRevisionId is the latest revision the client has seen. The returned message carries
+// a single change set that takes the client from that revision to the current head.
+// Returns nil if the session cannot be resumed.
 // Thread-safe.
-func (ork *orchestrator) changeReceived(sessionKey string, clientRevisionId int, selStr, changeStr string) bool {
-	ork.mu.Lock()
-	defer ork.mu.Unlock()
+func (ork *orchestrator) resumeSession(sessionKey, authSessionId string, lastRevisionId int) (resumeMsg *sessionResumeMessage) {
+	resumeMsg = nil
+	sess, ld := ork.lockSession(sessionKey)
+	if sess == nil {
+		return
+	}
+	defer ld.mu.Unlock()
 
-	// What's the change?
-	ok, sess, doc, sel, cs := ork.parseChange(sessionKey, selStr, changeStr)
+	if !sess.requestedUtc.IsZero() || sess.authSessionId != authSessionId {
+		return
+	}
+	if !sess.detachedUtc.IsZero() && time.Now().UTC().Sub(sess.detachedUtc).Seconds() > orkSessionResumeGraceSeconds {
+		return
+	}
+	doc := ld.doc
+	cs, ok := doc.composeSince(lastRevisionId)
 	if !ok {
+		ork.xlog.Logf(common.LogSrcOrchestrator, "Cannot resume session %v from unknown revision %v", sessionKey, lastRevisionId)
+		return
+	}
+	wasDetached := !sess.detachedUtc.IsZero()
+	sess.detachedUtc = time.Time{}
+	sess.lastActiveUtc = time.Now().UTC()
+	resumeMsg = &sessionResumeMessage{
+		RevisionId:        doc.headRevisionId(),
+		LastOwnRevisionId: sess.lastOwnRevisionId,
+		Change:            cs,
+		PeerSelections:    ld.getSelections(),
+		Editors:           ld.getPresences(),
+	}
+	// Session's cursor is back
+	if wasDetached {
+		ork.broadcastSelections(ld, sessionKey)
+		ork.broadcastPresence(ld, sess, presenceEventJoin)
+	}
+	return
+}
+
+// Handles a message from a session announced through a CHANGE message.
+// sel is the client's selection in its head revision; cs is nil if only the selection changed.
+// Holds only the lock of the session's document, so changes to different documents are processed in parallel.
+// Thread-safe.
+func (ork *orchestrator) changeReceived(sessionKey string, clientRevisionId int, sel *sessionSelection, cs *biscript.ChangeSet) bool {
+	// Whose change is it?
+	sess, ld := ork.lockSession(sessionKey)
+	if sess == nil {
 		return false
 	}
-	// Who are we broadcasting to?
-	receivers := make(map[string]bool)
-	for _, x := range ork.sessions {
-		if x.requestedUtc.IsZero() && x.docId == sess.docId {
-			receivers[x.sessionKey] = true
-		}
+	defer ld.mu.Unlock()
+
+	sess.lastActiveUtc = time.Now().UTC()
+	if sess.idle {
+		sess.idle = false
+		ork.broadcastPresence(ld, sess, presenceEventStateChange)
+	}
+	doc := ld.doc
+	ork.xlog.Logf(common.LogSrcOrchestrator, "Received change from session %v: Sel %v", sessionKey, *sel)
+	if !doc.isKnownRevision(clientRevisionId) {
+		ork.xlog.Logf(common.LogSrcOrchestrator, "Received change based on unknown revision %v. Ending session.", clientRevisionId)
+		return false
 	}
-	// What are we broadcasting?
+	// What are we broadcasting, and to whom?
 	ctb := changeToBroadcast{
 		sourceSessionKey:        sessionKey,
 		sourceBaseDocRevisionId: clientRevisionId,
-		newDocRevisionId:        len(doc.revisions) - 1,
-		receiverSessionKeys:     receivers,
+		newDocRevisionId:        doc.headRevisionId(),
+		receiverSessionKeys:     ld.getReceivers(),
 	}
 	// What is this change?
 	if cs == nil {
 		// This is only about a changed selection
 		sess.selection.Start, sess.selection.End = doc.forwardSelection(sel.Start, sel.End, clientRevisionId)
 		sess.selection.CaretAtStart = sel.CaretAtStart
-		ctb.selJson = ork.getDocSelectionsJSON(sess.docId)
+		ctb.selections = ld.getSelections()
 		ork.xlog.Logf(common.LogSrcOrchestrator, "Propagating selection update")
 	} else {
 		// We got us a real change set
@@ -492,81 +954,35 @@ func (ork *orchestrator) changeReceived(sessionKey string, clientRevisionId int,
 		var csToProp *biscript.ChangeSet
 		csToProp, sess.selection.Start, sess.selection.End = doc.applyChange(cs, sel.Start, sel.End, clientRevisionId)
 		sess.selection.CaretAtStart = sel.CaretAtStart
-		ctb.newDocRevisionId = len(doc.revisions) - 1
-		ctb.selJson = ork.getDocSelectionsJSON(sess.docId)
-		ctb.changeJson = csToProp.SerializeJSON()
+		ctb.newDocRevisionId = doc.headRevisionId()
+		sess.lastOwnRevisionId = ctb.newDocRevisionId
+		ctb.selections = ld.getSelections()
+		ctb.change = csToProp
 		ork.xlog.Logf(common.LogSrcOrchestrator, "Propagating change set and selection update")
 	}
 	// Showtime!
+	// Still within document's lock, so broadcasts about the same document are queued in order
 	ork.peerMessenger.broadcast(&ctb)
 	return true
 }
 
-// Parses data in received change.
-// Must be called from within lock.
-func (ork *orchestrator) parseChange(sessionKey string, selStr, changeStr string) (
-	ok bool, sess *editSession, doc *document, sel sessionSelection, cs *biscript.ChangeSet) {
-
-	ok = false
-	sess = nil
-	doc = nil
-	sel = sessionSelection{SessionKey: sessionKey}
-	cs = nil
-
-	for _, x := range ork.sessions {
-		if x.sessionKey == sessionKey {
-			sess = x
-			break
-		}
-	}
-	if sess == nil {
-		return
-	}
-	sess.lastActiveUtc = time.Now().UTC()
-	ork.ensureLoaded(sess.docId)
-	for _, x := range ork.docs {
-		if x.DocId == sess.docId {
-			doc = x
-			break
-		}
-	}
-	if doc == nil {
-		return
-	}
-	if err := json.Unmarshal([]byte(selStr), &sel); err != nil {
-		return
-	}
-	if changeStr != "" {
-		cs = &biscript.ChangeSet{}
-		if err := cs.DeserializeJSON(changeStr); err != nil {
-			ork.xlog.Logf(common.LogSrcOrchestrator, "Failed to deserialize change set from JSON: %v", err)
-			return
-		}
-	}
-	ork.xlog.Logf(common.LogSrcOrchestrator, "Parsed change from session %v: Sel %v", sessionKey, sel)
-	ok = true
-	return
-}
-
 // Gets the display name of the document. Returns empty string if document is not found.
 // Thread-safe.
 func (ork *orchestrator) GetDocumentName(docId string) string {
-	ork.mu.Lock()
-	defer ork.mu.Unlock()
-
-	ork.ensureLoaded(docId)
-	ix := ork.getDocIx(docId)
-	if ix == -1 {
+	ld := ork.lockDoc(docId)
+	if ld == nil {
 		return ""
 	}
-	return ork.docs[ix].Name
+	defer ld.mu.Unlock()
+
+	return ld.doc.Name
 }
 
-// Exports a document into DOCX and stores it in the filesystem for later download.
+// Exports a document into DOCX with the provided options, and stores it in the filesystem for later download.
 // Returns ID that can be used for download in a subsequent call.
 // If doc is not found or the export fails, returns empty string.
 // Thread-safe.
-func (ork *orchestrator) ExportDocx(docId string) (downloadId string) {
+func (ork *orchestrator) ExportDocx(docId string, opts docx.Options) (downloadId string) {
 
 	var text []biscript.XieChar
 	downloadId = ""
@@ -574,19 +990,16 @@ func (ork *orchestrator) ExportDocx(docId string) (downloadId string) {
 
 	// Closure so we only lock as long as we're loading the document and coming up with the output file name
 	func() {
-		ork.mu.Lock()
-		defer ork.mu.Unlock()
-
 		// Grab doc and verify it exists
-		ork.ensureLoaded(docId)
-		ix := ork.getDocIx(docId)
-		if ix == -1 {
+		ld := ork.lockDoc(docId)
+		if ld == nil {
 			return
 		}
-		doc := ork.docs[ix]
+		defer ld.mu.Unlock()
+		doc := ld.doc
 		// If dirty, save before exiting so user gets the actual latest content
 		if doc.dirty {
-			if err := doc.saveToFile(ork.getDocFileName(doc.DocId)); err != nil {
+			if err := ork.storeDoc(doc); err != nil {
 				ork.xlog.Logf(common.LogSrcOrchestrator, "Error saving dirty document before export %v: %v", doc.DocId, err)
 			}
 		}
@@ -610,9 +1023,30 @@ func (ork *orchestrator) ExportDocx(docId string) (downloadId string) {
 		return
 	}
 	// Perform export; indicate error with empty download ID
-	if err := docx.Export(text, exportFilePath, ork.composer); err != nil {
+	if err := docx.Export(text, exportFilePath, ork.composer, opts); err != nil {
 		downloadId = ""
 		ork.xlog.Logf(common.LogSrcOrchestrator, "Error exporting document to DOCX: %v", err)
 	}
 	return
 }
+
+// Looks for characters in the document whose pinyin is probably wrong, given their word context.
+// Returns nil if doc is not found.
+// Thread-safe.
+func (ork *orchestrator) CheckReadings(docId string) *ReadingsReport {
+	ld := ork.lockDoc(docId)
+	if ld == nil {
+		return nil
+	}
+	// Check a copy, so we don't hold up editing
+	text := make([]biscript.XieChar, len(ld.doc.headText))
+	copy(text, ld.doc.headText)
+	res := ReadingsReport{RevisionId: ld.doc.headRevisionId()}
+	ld.mu.Unlock()
+
+	res.Suggestions = ork.composer.CheckReadings(text)
+	if len(res.Suggestions) != 0 {
+		res.Change = makeReadingsChange(len(text), res.Suggestions)
+	}
+	return &res
+}
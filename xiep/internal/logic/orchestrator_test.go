@@ -2,7 +2,11 @@ package logic
 
 import (
 	"encoding/json"
+	"fmt"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 	"xiep/internal/biscript"
 )
 
@@ -39,3 +43,308 @@ func TestSessionStartMessage_JSON(t *testing.T) {
 		t.Errorf("Incorrect JSON for sessionSelection")
 	}
 }
+
+type testLogger struct{}
+
+func (testLogger) Logf(prefix string, format string, v ...interface{}) {}
+
+func (testLogger) LogFatal(prefix string, msg string) { panic(msg) }
+
+type testMessenger struct {
+	mu         sync.Mutex
+	broadcasts []*changeToBroadcast
+	presences  []*presenceToBroadcast
+	terminated []*sessionsToTerminate
+}
+
+func (tm *testMessenger) broadcast(ctb *changeToBroadcast) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	tm.broadcasts = append(tm.broadcasts, ctb)
+}
+
+func (tm *testMessenger) terminateSessions(sessionKeys map[string]bool, perr *protocolError) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	tm.terminated = append(tm.terminated, &sessionsToTerminate{sessionKeys, perr})
+}
+
+func (tm *testMessenger) broadcastPresence(ptb *presenceToBroadcast) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	tm.presences = append(tm.presences, ptb)
+}
+
+func (tm *testMessenger) sessionsEnded(sessionKeys []string) {
+}
+
+func (tm *testMessenger) docUnloaded(docId string) {
+}
+
+// Creates an orchestrator over a temporary docs folder, without background goroutines.
+func newTestOrchestrator(t testing.TB) *orchestrator {
+	var ork orchestrator
+	var wg sync.WaitGroup
+	ork.init(testLogger{}, &wg, nil, &fsDocumentStore{xlog: testLogger{}, folder: t.TempDir()}, t.TempDir(), 0)
+	ork.peerMessenger = &testMessenger{}
+	return &ork
+}
+
+func TestOrchestrator_SessionBoundToUser(t *testing.T) {
+	ork := newTestOrchestrator(t)
+	docId, err := ork.CreateDocument("Momo")
+	if err != nil {
+		t.Fatalf("Failed to create document: %v", err)
+	}
+	sessionKey := ork.RequestSession(docId, "alice", "")
+	if sessionKey == "" {
+		t.Fatalf("Failed to request session")
+	}
+	if ork.startSession(sessionKey, "mallory", -1) != nil {
+		t.Errorf("Session started by a different user than the one who requested it")
+	}
+	if ork.startSession(sessionKey, "alice", -1) == nil {
+		t.Errorf("Session not started by the user who requested it")
+	}
+}
+
+// Parses a change set from its diagnostic string.
+func makeChange(diag string) *biscript.ChangeSet {
+	var cs biscript.ChangeSet
+	cs.FromDiagStr(diag)
+	return &cs
+}
+
+func TestOrchestrator_ResumeSession(t *testing.T) {
+	ork := newTestOrchestrator(t)
+	docId, _ := ork.CreateDocument("Momo")
+	keyA := ork.RequestSession(docId, "alice", "")
+	keyB := ork.RequestSession(docId, "bob", "")
+	ork.startSession(keyA, "alice", -1)
+	ork.startSession(keyB, "bob", -1)
+	sel := &sessionSelection{}
+	if !ork.changeReceived(keyA, 0, sel, makeChange("0>A")) {
+		t.Fatalf("Change rejected")
+	}
+	ork.sessionDetached(keyA)
+	if ork.isSessionOpen(keyA) {
+		t.Errorf("Detached session reported as open")
+	}
+	if !ork.changeReceived(keyB, 1, sel, makeChange("1>0,B")) {
+		t.Fatalf("Change rejected")
+	}
+	if ork.resumeSession(keyA, "mallory", 1) != nil {
+		t.Errorf("Session resumed by a different user")
+	}
+	if ork.resumeSession(keyA, "alice", 5) != nil {
+		t.Errorf("Session resumed from unknown revision")
+	}
+	srm := ork.resumeSession(keyA, "alice", 1)
+	if srm == nil {
+		t.Fatalf("Failed to resume session")
+	}
+	if !ork.isSessionOpen(keyA) {
+		t.Errorf("Resumed session not reported as open")
+	}
+	if srm.RevisionId != 2 || srm.LastOwnRevisionId != 1 || srm.Change.ToDiagStr() != "1>0,B" {
+		t.Errorf("Wrong resume message: %+v", srm)
+	}
+}
+
+func TestOrchestrator_StartSessionWithCachedRevision(t *testing.T) {
+	ork := newTestOrchestrator(t)
+	docId, _ := ork.CreateDocument("Momo")
+	keyA := ork.RequestSession(docId, "alice", "")
+	ork.startSession(keyA, "alice", -1)
+	sel := &sessionSelection{}
+	ork.changeReceived(keyA, 0, sel, makeChange("0>A"))
+	ork.changeReceived(keyA, 1, sel, makeChange("1>0,B"))
+
+	// Client with cached copy at revision 1 gets a delta
+	ssm := ork.startSession(ork.RequestSession(docId, "bob", ""), "bob", 1)
+	if ssm.RevisionId != 2 || ssm.Text != nil || ssm.Change == nil || ssm.Change.ToDiagStr() != "1>0,B" {
+		t.Errorf("Expected delta from cached revision; got %+v", ssm)
+	}
+	// Revision IDs survive saving and reloading; revisions from before the reload are unknown
+	ork.housekeepDocs()
+	ork.docs = make(map[string]*loadedDoc)
+	ork.sessions = make(map[string]*editSession)
+	ssm = ork.startSession(ork.RequestSession(docId, "bob", ""), "bob", 1)
+	if ssm.RevisionId != 2 || len(ssm.Text) != 2 || ssm.Change != nil {
+		t.Errorf("Expected full text for revision before reload; got %+v", ssm)
+	}
+	ssm = ork.startSession(ork.RequestSession(docId, "bob", ""), "bob", 2)
+	if ssm.RevisionId != 2 || ssm.Text != nil || ssm.Change == nil || ssm.Change.ToDiagStr() != "2>0,1" {
+		t.Errorf("Expected identity delta for head revision; got %+v", ssm)
+	}
+}
+
+// Creates documents, each with one started session.
+func makeLoadTestDocs(t testing.TB, ork *orchestrator, count int) (docIds, sessionKeys []string) {
+	for i := 0; i < count; i++ {
+		docId, err := ork.CreateDocument("Momo")
+		if err != nil {
+			t.Fatalf("Failed to create document: %v", err)
+		}
+		sessionKey := ork.RequestSession(docId, "alice", "")
+		if ork.startSession(sessionKey, "alice", -1) == nil {
+			t.Fatalf("Failed to start session")
+		}
+		docIds = append(docIds, docId)
+		sessionKeys = append(sessionKeys, sessionKey)
+	}
+	return
+}
+
+// Appends a character to a session's document; revId is the current head.
+func typeChar(ork *orchestrator, sessionKey string, revId int) bool {
+	var cs biscript.ChangeSet
+	cs.LengthBefore = uint(revId)
+	for i := uint(0); i < uint(revId); i++ {
+		cs.Items = append(cs.Items, i)
+	}
+	cs.Items = append(cs.Items, biscript.XieChar{Hanzi: "A"})
+	cs.LengthAfter = uint(len(cs.Items))
+	sel := &sessionSelection{Start: uint(revId + 1), End: uint(revId + 1)}
+	return ork.changeReceived(sessionKey, revId, sel, &cs)
+}
+
+func TestOrchestrator_DocLockDoesNotBlockOtherDocs(t *testing.T) {
+	ork := newTestOrchestrator(t)
+	docIds, sessionKeys := makeLoadTestDocs(t, ork, 2)
+
+	// Hold first document's lock, as if a long change or save were in progress
+	ld := ork.lockDoc(docIds[0])
+	defer ld.mu.Unlock()
+	done := make(chan bool)
+	go func() {
+		done <- typeChar(ork, sessionKeys[1], 0) && ork.GetDocumentName(docIds[1]) == "Momo"
+	}()
+	select {
+	case ok := <-done:
+		if !ok {
+			t.Errorf("Change to second document failed")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Change to second document blocked by lock on first document")
+	}
+}
+
+// Load test: hundreds of documents edited concurrently, each by its own client.
+func TestOrchestrator_ConcurrentDocs(t *testing.T) {
+	const docCount = 300
+	const changesPerDoc = 50
+	ork := newTestOrchestrator(t)
+	_, sessionKeys := makeLoadTestDocs(t, ork, docCount)
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	var failed int32
+	for _, sessionKey := range sessionKeys {
+		wg.Add(1)
+		go func(sessionKey string) {
+			defer wg.Done()
+			for revId := 0; revId < changesPerDoc; revId++ {
+				if !typeChar(ork, sessionKey, revId) {
+					atomic.AddInt32(&failed, 1)
+					return
+				}
+			}
+		}(sessionKey)
+	}
+	// Housekeeping runs in parallel, as it would in the server
+	ork.housekeepDocs()
+	ork.cleanupSessions()
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	if failed != 0 {
+		t.Fatalf("%v clients had a change rejected", failed)
+	}
+	if len(ork.peerMessenger.(*testMessenger).broadcasts) != docCount*changesPerDoc {
+		t.Errorf("Wrong number of broadcasts")
+	}
+	for _, ld := range ork.getLoadedDocs() {
+		if len(ld.doc.headText) != changesPerDoc {
+			t.Errorf("Document %v has %v characters instead of %v", ld.doc.DocId, len(ld.doc.headText), changesPerDoc)
+		}
+	}
+	t.Logf("%v changes across %v documents in %v: %.0f changes/sec",
+		docCount*changesPerDoc, docCount, elapsed, float64(docCount*changesPerDoc)/elapsed.Seconds())
+}
+
+// Compares throughput of parallel clients editing a single document vs. each editing their own.
+func BenchmarkOrchestrator_ParallelChanges(b *testing.B) {
+	for _, docCount := range []int{1, 300} {
+		b.Run(fmt.Sprintf("docs=%v", docCount), func(b *testing.B) {
+			ork := newTestOrchestrator(b)
+			docIds, _ := makeLoadTestDocs(b, ork, docCount)
+			var next int32
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				// Each goroutine gets a session of its own, on one of the documents
+				docId := docIds[int(atomic.AddInt32(&next, 1))%docCount]
+				sessionKey := ork.RequestSession(docId, "alice", "")
+				ork.startSession(sessionKey, "alice", -1)
+				sel := &sessionSelection{}
+				for pb.Next() {
+					// Selection change on the head revision: takes the document's lock like a real edit
+					ld := ork.lockDoc(docId)
+					revId := ld.doc.headRevisionId()
+					ld.mu.Unlock()
+					ork.changeReceived(sessionKey, revId, sel, nil)
+				}
+			})
+		})
+	}
+}
+
+func TestOrchestrator_DetachBroadcastsSelections(t *testing.T) {
+	ork := newTestOrchestrator(t)
+	tm := ork.peerMessenger.(*testMessenger)
+	docId, _ := ork.CreateDocument("Momo")
+	keyA := ork.RequestSession(docId, "alice", "")
+	keyB := ork.RequestSession(docId, "bob", "")
+	ork.startSession(keyA, "alice", -1)
+	ork.startSession(keyB, "bob", -1)
+
+	ork.sessionDetached(keyA)
+	if len(tm.broadcasts) != 1 {
+		t.Fatalf("Expected 1 broadcast after detach, got %v", len(tm.broadcasts))
+	}
+	ctb := tm.broadcasts[0]
+	if ctb.change != nil || len(ctb.selections) != 1 || ctb.selections[0].SessionKey != keyB {
+		t.Errorf("Detached session's selection not removed: %+v", ctb.selections)
+	}
+	if ctb.receiverSessionKeys[keyA] || !ctb.receiverSessionKeys[keyB] {
+		t.Errorf("Wrong receivers: %v", ctb.receiverSessionKeys)
+	}
+	// Socket reported gone twice: no news the second time
+	ork.sessionDetached(keyA)
+	if len(tm.broadcasts) != 1 {
+		t.Errorf("Repeated detach broadcast again")
+	}
+	if ork.resumeSession(keyA, "alice", 0) == nil {
+		t.Fatalf("Failed to resume session")
+	}
+	if len(tm.broadcasts) != 2 || len(tm.broadcasts[1].selections) != 2 {
+		t.Errorf("Resumed session's selection not broadcast")
+	}
+}
+
+func TestOrchestrator_CheckReadings(t *testing.T) {
+	ork := newTestOrchestrator(t)
+	ork.composer = loadComposerFromString(polyMapJson, polyMapJson)
+	text := []biscript.XieChar{{Hanzi: "银", Pinyin: "yin2"}, {Hanzi: "行", Pinyin: "xing2"}}
+	docId, _ := ImportDocument(ork.store, "Momo", text)
+	report := ork.CheckReadings(docId)
+	if report == nil || report.RevisionId != 0 || len(report.Suggestions) != 1 || report.Change == nil {
+		t.Fatalf("Wrong report: %+v", report)
+	}
+	if fixed := report.Change.Apply(text); report.Change.ToDiagStr() != "2>0,行" || fixed[1].Pinyin != "hang2" {
+		t.Errorf("Wrong change: %v", report.Change.SerializeJSON())
+	}
+	if ork.CheckReadings("nonesuch") != nil {
+		t.Errorf("Report for missing document")
+	}
+}
@@ -0,0 +1,380 @@
+package logic
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"xiep/internal/biscript"
+)
+
+const (
+	// Websocket subprotocol for version 1 of the JSON envelope protocol.
+	// Clients that don't ask for any subprotocol speak the legacy space-delimited protocol.
+	SubprotocolJSONv1 = "xiep.json.v1"
+	// Websocket subprotocol for version 1 of the CBOR envelope protocol, sent in binary frames.
+	SubprotocolCBORv1 = "xiep.cbor.v1"
+)
+
+// Subprotocols the server can negotiate at connect time, in order of preference.
+var SupportedSubprotocols = []string{SubprotocolCBORv1, SubprotocolJSONv1}
+
+// Kinds of requests a peer can send.
+const (
+	reqSessionKey = "sessionKey"
+	reqResume     = "resume"
+	reqPing       = "ping"
+	reqChange     = "change"
+)
+
+// Error codes sent to peers.
+const (
+	errBadMessage          = "bad_message"
+	errUnknownType         = "unknown_type"
+	errProtocolViolation   = "protocol_violation"
+	errNotOnList           = "peer_unknown"
+	errSessionNotFound     = "session_not_found"
+	errSessionNotResumable = "session_not_resumable"
+	errSessionNotStarted   = "session_not_started"
+	errSessionNotOpen      = "session_not_open"
+	errChangeRejected      = "change_rejected"
+	errSessionIdle         = "session_idle"
+	errSessionReplaced     = "session_replaced"
+	errResyncRequired      = "resync_required"
+	errSlowPeer            = "slow_peer"
+	errDocDeleted          = "doc_deleted"
+	errDocMoved            = "doc_moved"
+)
+
+// Describes what went wrong with a peer's request.
+// Fatal errors end the connection; with the JSON protocol, others are reported and the socket stays open.
+type protocolError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Fatal   bool   `json:"fatal"`
+}
+
+func newProtocolError(code string, fatal bool, message string) *protocolError {
+	return &protocolError{Code: code, Message: message, Fatal: fatal}
+}
+
+// A request received from a peer, independent of the wire format.
+type peerRequest struct {
+	// One of the reqXxx constants
+	kind string
+	// Request ID chosen by the client, echoed in direct replies; empty in legacy protocol
+	id string
+	// Session key in sessionKey and resume requests
+	sessionKey string
+	// Cached revision (sessionKey), last seen revision (resume), or base revision (change); -1 if absent
+	revisionId int
+	// Client's selection in change requests
+	sel *sessionSelection
+	// Change set in change requests; nil if only the selection changed
+	cs *biscript.ChangeSet
+}
+
+// Translates between peer requests/server messages and one wire format.
+type peerCodec interface {
+	// True if messages travel in binary websocket frames; false for text frames.
+	isBinary() bool
+	// Parses an incoming message.
+	decode(msg []byte) (req *peerRequest, perr *protocolError)
+	// Reply to sessionKey request.
+	encodeHello(replyTo string, ssm *sessionStartMessage) []byte
+	// Reply to resume request.
+	encodeResumed(replyTo string, srm *sessionResumeMessage) []byte
+	// Reply to ping request, or nil if protocol has no such reply.
+	encodePong(replyTo string) []byte
+	// Change or selection update from a different session.
+	encodeUpdate(ctb *changeToBroadcast) []byte
+	// Acknowledgement of a change to the session that sent it.
+	encodeAck(ctb *changeToBroadcast) []byte
+	// Another editor joined, left, or changed state; nil if protocol has no presence messages.
+	encodePresence(ptb *presenceToBroadcast) []byte
+	// Error report, or nil if the protocol cannot report errors without closing the socket.
+	encodeError(replyTo string, perr *protocolError) []byte
+}
+
+// Returns the codec for the subprotocol negotiated at connect time.
+func getPeerCodec(subprotocol string) peerCodec {
+	switch subprotocol {
+	case SubprotocolJSONv1:
+		return jsonCodec{}
+	case SubprotocolCBORv1:
+		return cborCodec{}
+	default:
+		return legacyCodec{}
+	}
+}
+
+// Tells if messages in the negotiated subprotocol travel in binary websocket frames.
+func IsBinarySubprotocol(subprotocol string) bool {
+	return getPeerCodec(subprotocol).isBinary()
+}
+
+// Payloads shared by the envelope protocols. Field tags also apply in CBOR.
+
+type envSessionKeyPayload struct {
+	SessionKey       string `json:"sessionKey"`
+	CachedRevisionId *int   `json:"cachedRevisionId"`
+}
+
+type envResumePayload struct {
+	SessionKey     string `json:"sessionKey"`
+	LastRevisionId *int   `json:"lastRevisionId"`
+}
+
+type envUpdatePayload struct {
+	RevisionId       int                 `json:"revisionId"`
+	SourceSessionKey string              `json:"sourceSessionKey"`
+	PeerSelections   []sessionSelection  `json:"peerSelections"`
+	Change           *biscript.ChangeSet `json:"change,omitempty"`
+}
+
+type envAckPayload struct {
+	BaseRevisionId int `json:"baseRevisionId"`
+	RevisionId     int `json:"revisionId"`
+}
+
+type envPresencePayload struct {
+	Event    string          `json:"event"`
+	Presence sessionPresence `json:"presence"`
+}
+
+func makePresencePayload(ptb *presenceToBroadcast) *envPresencePayload {
+	return &envPresencePayload{Event: ptb.event, Presence: ptb.presence}
+}
+
+func makeUpdatePayload(ctb *changeToBroadcast) *envUpdatePayload {
+	return &envUpdatePayload{
+		RevisionId:       ctb.newDocRevisionId,
+		SourceSessionKey: ctb.sourceSessionKey,
+		PeerSelections:   ctb.selections,
+		Change:           ctb.change,
+	}
+}
+
+func makeAckPayload(ctb *changeToBroadcast) *envAckPayload {
+	return &envAckPayload{
+		BaseRevisionId: ctb.sourceBaseDocRevisionId,
+		RevisionId:     ctb.newDocRevisionId,
+	}
+}
+
+// Serializes a value into JSON; panics on failure, which would mean a bug in our types.
+func mustMarshalJSON(what string, val interface{}) []byte {
+	res, err := json.Marshal(val)
+	if err != nil {
+		panic(fmt.Sprintf("Failed to serialize %v to JSON: %v", what, err))
+	}
+	return res
+}
+
+// Original space-delimited text protocol: SESSIONKEY, RESUME, PING, CHANGE in; HELLO, RESUMED, UPDATE, ACKCHANGE out.
+type legacyCodec struct{}
+
+func (legacyCodec) isBinary() bool {
+	return false
+}
+
+func (legacyCodec) decode(msgBytes []byte) (*peerRequest, *protocolError) {
+	msg := string(msgBytes)
+	req := peerRequest{revisionId: -1}
+	parseRevId := func(str string) *protocolError {
+		var err error
+		if req.revisionId, err = strconv.Atoi(str); err != nil {
+			return newProtocolError(errBadMessage, true, "Invalid message: failed to parse revision ID")
+		}
+		return nil
+	}
+	// SESSIONKEY <sessionKey> [<cachedRevisionId>]
+	if strings.HasPrefix(msg, "SESSIONKEY ") {
+		req.kind = reqSessionKey
+		parts := strings.Split(msg[11:], " ")
+		req.sessionKey = parts[0]
+		if len(parts) > 1 {
+			if perr := parseRevId(parts[1]); perr != nil {
+				return nil, perr
+			}
+		}
+		return &req, nil
+	}
+	// RESUME <sessionKey> <lastRevisionId>
+	if strings.HasPrefix(msg, "RESUME ") {
+		req.kind = reqResume
+		parts := strings.Split(msg[7:], " ")
+		if len(parts) != 2 {
+			return nil, newProtocolError(errBadMessage, true, "Invalid message: RESUME expects session key and revision ID")
+		}
+		req.sessionKey = parts[0]
+		if perr := parseRevId(parts[1]); perr != nil {
+			return nil, perr
+		}
+		return &req, nil
+	}
+	if msg == "PING" {
+		req.kind = reqPing
+		return &req, nil
+	}
+	// CHANGE <revisionId> <selection> [<changeSet>]
+	if strings.HasPrefix(msg, "CHANGE ") {
+		req.kind = reqChange
+		parts := strings.SplitN(msg[7:], " ", 3)
+		if perr := parseRevId(parts[0]); perr != nil {
+			return nil, perr
+		}
+		req.sel = &sessionSelection{}
+		if len(parts) < 2 || json.Unmarshal([]byte(parts[1]), req.sel) != nil {
+			return nil, newProtocolError(errBadMessage, true, "Invalid message: failed to parse selection")
+		}
+		if len(parts) > 2 {
+			req.cs = &biscript.ChangeSet{}
+			if err := req.cs.DeserializeJSON(parts[2]); err != nil {
+				return nil, newProtocolError(errBadMessage, true, "Invalid message: failed to parse change set")
+			}
+		}
+		return &req, nil
+	}
+	return nil, newProtocolError(errUnknownType, true, "You shouldn't have said that")
+}
+
+func (legacyCodec) encodeHello(_ string, ssm *sessionStartMessage) []byte {
+	return append([]byte("HELLO "), mustMarshalJSON("start message", ssm)...)
+}
+
+func (legacyCodec) encodeResumed(_ string, srm *sessionResumeMessage) []byte {
+	return append([]byte("RESUMED "), mustMarshalJSON("resume message", srm)...)
+}
+
+func (legacyCodec) encodePong(_ string) []byte {
+	return nil
+}
+
+func (legacyCodec) encodeUpdate(ctb *changeToBroadcast) []byte {
+	updMsg := "UPDATE " + strconv.Itoa(ctb.newDocRevisionId) + " " + ctb.sourceSessionKey + " "
+	updMsg += string(mustMarshalJSON("session selections", &ctb.selections))
+	if ctb.change != nil {
+		updMsg += " " + ctb.change.SerializeJSON()
+	}
+	return []byte(updMsg)
+}
+
+func (legacyCodec) encodeAck(ctb *changeToBroadcast) []byte {
+	return []byte("ACKCHANGE " + strconv.Itoa(ctb.sourceBaseDocRevisionId) + " " + strconv.Itoa(ctb.newDocRevisionId))
+}
+
+func (legacyCodec) encodePresence(_ *presenceToBroadcast) []byte {
+	return nil
+}
+
+func (legacyCodec) encodeError(_ string, _ *protocolError) []byte {
+	return nil
+}
+
+// JSON envelope protocol: every message is {"type": ..., "id": ..., "payload": ...}.
+type jsonCodec struct{}
+
+type jsonEnvelope struct {
+	Type    string          `json:"type"`
+	Id      string          `json:"id,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+type jsonChangePayload struct {
+	RevisionId *int              `json:"revisionId"`
+	Selection  *sessionSelection `json:"selection"`
+	Change     json.RawMessage   `json:"change"`
+}
+
+func (jsonCodec) isBinary() bool {
+	return false
+}
+
+func (jsonCodec) decode(msg []byte) (*peerRequest, *protocolError) {
+	var env jsonEnvelope
+	if err := json.Unmarshal(msg, &env); err != nil {
+		return nil, newProtocolError(errBadMessage, false, fmt.Sprintf("Message is not a valid JSON envelope: %v", err))
+	}
+	req := peerRequest{kind: env.Type, id: env.Id, revisionId: -1}
+	badPayload := func(err error) *protocolError {
+		return newProtocolError(errBadMessage, false, fmt.Sprintf("Invalid payload for %v: %v", env.Type, err))
+	}
+	switch env.Type {
+	case reqSessionKey:
+		var pl envSessionKeyPayload
+		if err := json.Unmarshal(env.Payload, &pl); err != nil {
+			return nil, badPayload(err)
+		}
+		req.sessionKey = pl.SessionKey
+		if pl.CachedRevisionId != nil {
+			req.revisionId = *pl.CachedRevisionId
+		}
+	case reqResume:
+		var pl envResumePayload
+		if err := json.Unmarshal(env.Payload, &pl); err != nil {
+			return nil, badPayload(err)
+		}
+		if pl.LastRevisionId == nil {
+			return nil, badPayload(fmt.Errorf("missing lastRevisionId"))
+		}
+		req.sessionKey = pl.SessionKey
+		req.revisionId = *pl.LastRevisionId
+	case reqPing:
+	case reqChange:
+		var pl jsonChangePayload
+		if err := json.Unmarshal(env.Payload, &pl); err != nil {
+			return nil, badPayload(err)
+		}
+		if pl.RevisionId == nil || pl.Selection == nil {
+			return nil, badPayload(fmt.Errorf("missing revisionId or selection"))
+		}
+		req.revisionId = *pl.RevisionId
+		req.sel = pl.Selection
+		if pl.Change != nil && string(pl.Change) != "null" {
+			req.cs = &biscript.ChangeSet{}
+			if err := req.cs.DeserializeJSON(string(pl.Change)); err != nil {
+				return nil, badPayload(err)
+			}
+		}
+	default:
+		return nil, newProtocolError(errUnknownType, false, fmt.Sprintf("Unknown message type: %v", env.Type))
+	}
+	return &req, nil
+}
+
+func (jsonCodec) encode(msgType, id string, payload interface{}) []byte {
+	env := jsonEnvelope{Type: msgType, Id: id}
+	if payload != nil {
+		env.Payload = mustMarshalJSON(msgType+" payload", payload)
+	}
+	return mustMarshalJSON(msgType+" envelope", &env)
+}
+
+func (c jsonCodec) encodeHello(replyTo string, ssm *sessionStartMessage) []byte {
+	return c.encode("hello", replyTo, ssm)
+}
+
+func (c jsonCodec) encodeResumed(replyTo string, srm *sessionResumeMessage) []byte {
+	return c.encode("resumed", replyTo, srm)
+}
+
+func (c jsonCodec) encodePong(replyTo string) []byte {
+	return c.encode("pong", replyTo, nil)
+}
+
+func (c jsonCodec) encodeUpdate(ctb *changeToBroadcast) []byte {
+	return c.encode("update", "", makeUpdatePayload(ctb))
+}
+
+func (c jsonCodec) encodeAck(ctb *changeToBroadcast) []byte {
+	return c.encode("ackChange", "", makeAckPayload(ctb))
+}
+
+func (c jsonCodec) encodePresence(ptb *presenceToBroadcast) []byte {
+	return c.encode("presence", "", makePresencePayload(ptb))
+}
+
+func (c jsonCodec) encodeError(replyTo string, perr *protocolError) []byte {
+	return c.encode("error", replyTo, perr)
+}
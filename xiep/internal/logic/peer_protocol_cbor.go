@@ -0,0 +1,157 @@
+package logic
+
+import (
+	"fmt"
+	"github.com/fxamacker/cbor/v2"
+	"unicode/utf8"
+	"xiep/internal/biscript"
+)
+
+// CBOR envelope protocol: same messages and payloads as the JSON envelope protocol, encoded as CBOR in binary frames.
+// Kept positions in change sets become 1 to 3 bytes instead of up to 6 characters, which matters for large documents.
+type cborCodec struct{}
+
+type cborEnvelopeIn struct {
+	Type    string          `json:"type"`
+	Id      string          `json:"id,omitempty"`
+	Payload cbor.RawMessage `json:"payload,omitempty"`
+}
+
+type cborEnvelopeOut struct {
+	Type    string      `json:"type"`
+	Id      string      `json:"id,omitempty"`
+	Payload interface{} `json:"payload,omitempty"`
+}
+
+type cborChangeSet struct {
+	LengthBefore uint              `json:"lengthBefore"`
+	LengthAfter  uint              `json:"lengthAfter"`
+	Items        []cbor.RawMessage `json:"items"`
+}
+
+type cborChangePayload struct {
+	RevisionId *int              `json:"revisionId"`
+	Selection  *sessionSelection `json:"selection"`
+	Change     *cborChangeSet    `json:"change"`
+}
+
+func (cborCodec) isBinary() bool {
+	return true
+}
+
+func (cborCodec) decode(msg []byte) (*peerRequest, *protocolError) {
+	var env cborEnvelopeIn
+	if err := cbor.Unmarshal(msg, &env); err != nil {
+		return nil, newProtocolError(errBadMessage, false, fmt.Sprintf("Message is not a valid CBOR envelope: %v", err))
+	}
+	req := peerRequest{kind: env.Type, id: env.Id, revisionId: -1}
+	badPayload := func(err error) *protocolError {
+		return newProtocolError(errBadMessage, false, fmt.Sprintf("Invalid payload for %v: %v", env.Type, err))
+	}
+	switch env.Type {
+	case reqSessionKey:
+		var pl envSessionKeyPayload
+		if err := cbor.Unmarshal(env.Payload, &pl); err != nil {
+			return nil, badPayload(err)
+		}
+		req.sessionKey = pl.SessionKey
+		if pl.CachedRevisionId != nil {
+			req.revisionId = *pl.CachedRevisionId
+		}
+	case reqResume:
+		var pl envResumePayload
+		if err := cbor.Unmarshal(env.Payload, &pl); err != nil {
+			return nil, badPayload(err)
+		}
+		if pl.LastRevisionId == nil {
+			return nil, badPayload(fmt.Errorf("missing lastRevisionId"))
+		}
+		req.sessionKey = pl.SessionKey
+		req.revisionId = *pl.LastRevisionId
+	case reqPing:
+	case reqChange:
+		var pl cborChangePayload
+		if err := cbor.Unmarshal(env.Payload, &pl); err != nil {
+			return nil, badPayload(err)
+		}
+		if pl.RevisionId == nil || pl.Selection == nil {
+			return nil, badPayload(fmt.Errorf("missing revisionId or selection"))
+		}
+		req.revisionId = *pl.RevisionId
+		req.sel = pl.Selection
+		if pl.Change != nil {
+			var err error
+			if req.cs, err = pl.Change.toChangeSet(); err != nil {
+				return nil, badPayload(err)
+			}
+		}
+	default:
+		return nil, newProtocolError(errUnknownType, false, fmt.Sprintf("Unknown message type: %v", env.Type))
+	}
+	return &req, nil
+}
+
+// Builds a change set from the CBOR representation, with the same checks as ChangeSet.DeserializeJSON.
+func (ccs *cborChangeSet) toChangeSet() (*biscript.ChangeSet, error) {
+	cs := biscript.ChangeSet{
+		LengthBefore: ccs.LengthBefore,
+		Items:        make([]interface{}, 0, len(ccs.Items)),
+	}
+	for _, itm := range ccs.Items {
+		var pos uint
+		if err := cbor.Unmarshal(itm, &pos); err == nil {
+			if pos+1 > cs.LengthBefore {
+				return nil, fmt.Errorf("invalid data: kept position beyond LengthBefore")
+			}
+			cs.Items = append(cs.Items, pos)
+			continue
+		}
+		var xc biscript.XieChar
+		if err := cbor.Unmarshal(itm, &xc); err != nil {
+			return nil, err
+		}
+		if utf8.RuneCountInString(xc.Hanzi) != 1 {
+			return nil, fmt.Errorf("invalid XieChar: hanzi must be exactly 1 rune: %v", xc)
+		}
+		cs.Items = append(cs.Items, xc)
+	}
+	cs.LengthAfter = uint(len(cs.Items))
+	return &cs, nil
+}
+
+func (cborCodec) encode(msgType, id string, payload interface{}) []byte {
+	env := cborEnvelopeOut{Type: msgType, Id: id, Payload: payload}
+	res, err := cbor.Marshal(&env)
+	if err != nil {
+		panic(fmt.Sprintf("Failed to serialize %v to CBOR: %v", msgType, err))
+	}
+	return res
+}
+
+func (c cborCodec) encodeHello(replyTo string, ssm *sessionStartMessage) []byte {
+	return c.encode("hello", replyTo, ssm)
+}
+
+func (c cborCodec) encodeResumed(replyTo string, srm *sessionResumeMessage) []byte {
+	return c.encode("resumed", replyTo, srm)
+}
+
+func (c cborCodec) encodePong(replyTo string) []byte {
+	return c.encode("pong", replyTo, nil)
+}
+
+func (c cborCodec) encodeUpdate(ctb *changeToBroadcast) []byte {
+	return c.encode("update", "", makeUpdatePayload(ctb))
+}
+
+func (c cborCodec) encodeAck(ctb *changeToBroadcast) []byte {
+	return c.encode("ackChange", "", makeAckPayload(ctb))
+}
+
+func (c cborCodec) encodePresence(ptb *presenceToBroadcast) []byte {
+	return c.encode("presence", "", makePresencePayload(ptb))
+}
+
+func (c cborCodec) encodeError(replyTo string, perr *protocolError) []byte {
+	return c.encode("error", replyTo, perr)
+}
@@ -0,0 +1,231 @@
+package logic
+
+import (
+	"bytes"
+	"compress/flate"
+	"strconv"
+	"testing"
+	"xiep/internal/biscript"
+)
+
+func TestLegacyCodec_Decode(t *testing.T) {
+	vals := []struct {
+		msg        string
+		kind       string
+		sessionKey string
+		revisionId int
+		selStart   uint
+		changeDiag string
+	}{
+		{"SESSIONKEY S-a12bc3d", reqSessionKey, "S-a12bc3d", -1, 0, ""},
+		{"SESSIONKEY S-a12bc3d 42", reqSessionKey, "S-a12bc3d", 42, 0, ""},
+		{"RESUME S-a12bc3d 7", reqResume, "S-a12bc3d", 7, 0, ""},
+		{"PING", reqPing, "", -1, 0, ""},
+		{`CHANGE 3 {"start":1}`, reqChange, "", 3, 1, ""},
+		{`CHANGE 3 {"start":1} {"lengthBefore":1,"items":[0,{"hanzi":" "}]}`, reqChange, "", 3, 1, "1>0, "},
+	}
+	var codec legacyCodec
+	for _, val := range vals {
+		req, perr := codec.decode([]byte(val.msg))
+		if perr != nil {
+			t.Errorf("Failed to decode %v: %v", val.msg, perr.Message)
+			continue
+		}
+		if req.kind != val.kind || req.sessionKey != val.sessionKey || req.revisionId != val.revisionId {
+			t.Errorf("Wrong result for %v: %+v", val.msg, req)
+		}
+		if req.kind == reqChange && req.sel.Start != val.selStart {
+			t.Errorf("Wrong selection for %v: %+v", val.msg, req.sel)
+		}
+		if (req.cs == nil) != (val.changeDiag == "") || req.cs != nil && req.cs.ToDiagStr() != val.changeDiag {
+			t.Errorf("Wrong change set for %v: %+v", val.msg, req.cs)
+		}
+	}
+	for _, msg := range []string{"HELLO", "RESUME S-a12bc3d", "CHANGE x {}", "CHANGE 1 x", "SESSIONKEY S-a12bc3d x"} {
+		if _, perr := codec.decode([]byte(msg)); perr == nil || !perr.Fatal {
+			t.Errorf("Expected fatal error for %v", msg)
+		}
+	}
+}
+
+func TestJsonCodec_Decode(t *testing.T) {
+	var codec jsonCodec
+	req, perr := codec.decode([]byte(`{"type":"change","id":"5","payload":{"revisionId":3,"selection":{"start":1},"change":null}}`))
+	if perr != nil {
+		t.Fatalf("Failed to decode change: %v", perr.Message)
+	}
+	if req.kind != reqChange || req.id != "5" || req.revisionId != 3 || req.sel.Start != 1 || req.cs != nil {
+		t.Errorf("Wrong result for change: %+v", req)
+	}
+	req, perr = codec.decode([]byte(`{"type":"sessionKey","id":"1","payload":{"sessionKey":"S-a12bc3d"}}`))
+	if perr != nil || req.kind != reqSessionKey || req.sessionKey != "S-a12bc3d" || req.revisionId != -1 {
+		t.Errorf("Wrong result for sessionKey: %+v", req)
+	}
+	for _, msg := range []string{`CHANGE 3 {}`, `{"type":"boo"}`, `{"type":"resume","payload":{"sessionKey":"S-a12bc3d"}}`} {
+		if _, perr := codec.decode([]byte(msg)); perr == nil || perr.Fatal {
+			t.Errorf("Expected non-fatal error for %v", msg)
+		}
+	}
+}
+
+func TestCborCodec_Decode(t *testing.T) {
+	var codec cborCodec
+	msg := codec.encode(reqChange, "5", map[string]interface{}{
+		"revisionId": 3,
+		"selection":  map[string]interface{}{"start": 2, "end": 2},
+		"change": map[string]interface{}{
+			"lengthBefore": 2,
+			"items":        []interface{}{0, map[string]string{"hanzi": "狗", "pinyin": "gou3"}, 1},
+		},
+	})
+	req, perr := codec.decode(msg)
+	if perr != nil {
+		t.Fatalf("Failed to decode change: %v", perr.Message)
+	}
+	if req.kind != reqChange || req.id != "5" || req.revisionId != 3 || req.sel.End != 2 {
+		t.Errorf("Wrong result for change: %+v", req)
+	}
+	if req.cs == nil || req.cs.ToDiagStr() != "2>0,狗,1" || req.cs.Items[1].(biscript.XieChar).Pinyin != "gou3" {
+		t.Errorf("Wrong change set: %+v", req.cs)
+	}
+	bad := codec.encode(reqChange, "", map[string]interface{}{
+		"revisionId": 3,
+		"selection":  map[string]interface{}{},
+		"change":     map[string]interface{}{"lengthBefore": 1, "items": []interface{}{1}},
+	})
+	if _, perr := codec.decode(bad); perr == nil || perr.Fatal {
+		t.Errorf("Expected non-fatal error for kept position beyond length")
+	}
+	if _, perr := codec.decode([]byte("PING")); perr == nil || perr.Fatal {
+		t.Errorf("Expected non-fatal error for text in binary protocol")
+	}
+}
+
+func TestPeerCodecs_Encode(t *testing.T) {
+	ctb := changeToBroadcast{
+		sourceSessionKey:        "S-a12bc3d",
+		sourceBaseDocRevisionId: 3,
+		newDocRevisionId:        4,
+		selections:              []sessionSelection{},
+		change:                  makeChange("0>"),
+	}
+	vals := []struct {
+		codec  peerCodec
+		update string
+		ack    string
+		err    string
+	}{
+		{
+			legacyCodec{},
+			`UPDATE 4 S-a12bc3d [] {"lengthBefore":0,"lengthAfter":0,"items":[]}`,
+			`ACKCHANGE 3 4`,
+			``,
+		},
+		{
+			jsonCodec{},
+			`{"type":"update","payload":{"revisionId":4,"sourceSessionKey":"S-a12bc3d","peerSelections":[],"change":{"lengthBefore":0,"lengthAfter":0,"items":[]}}}`,
+			`{"type":"ackChange","payload":{"baseRevisionId":3,"revisionId":4}}`,
+			`{"type":"error","id":"9","payload":{"code":"bad_message","message":"Nope","fatal":false}}`,
+		},
+	}
+	for _, val := range vals {
+		if msg := string(val.codec.encodeUpdate(&ctb)); msg != val.update {
+			t.Errorf("Wrong update message: %v", msg)
+		}
+		if msg := string(val.codec.encodeAck(&ctb)); msg != val.ack {
+			t.Errorf("Wrong ack message: %v", msg)
+		}
+		if msg := string(val.codec.encodeError("9", newProtocolError(errBadMessage, false, "Nope"))); msg != val.err {
+			t.Errorf("Wrong error message: %v", msg)
+		}
+	}
+}
+
+// Encodes a client's CHANGE request the way a client speaking the codec's protocol would.
+func encodeClientChange(codec peerCodec, revId int, sel *sessionSelection, cs *biscript.ChangeSet) []byte {
+	switch c := codec.(type) {
+	case legacyCodec:
+		return []byte("CHANGE " + strconv.Itoa(revId) + " " + string(mustMarshalJSON("selection", sel)) + " " + cs.SerializeJSON())
+	case jsonCodec:
+		return c.encode(reqChange, "1", &struct {
+			RevisionId int                 `json:"revisionId"`
+			Selection  *sessionSelection   `json:"selection"`
+			Change     *biscript.ChangeSet `json:"change"`
+		}{revId, sel, cs})
+	case cborCodec:
+		return c.encode(reqChange, "1", &struct {
+			RevisionId int                 `json:"revisionId"`
+			Selection  *sessionSelection   `json:"selection"`
+			Change     *biscript.ChangeSet `json:"change"`
+		}{revId, sel, cs})
+	}
+	panic("unknown codec")
+}
+
+// Size of a message after permessage-deflate compression without context takeover.
+func deflatedSize(msg []byte) int {
+	var buf bytes.Buffer
+	fw, _ := flate.NewWriter(&buf, flate.DefaultCompression)
+	_, _ = fw.Write(msg)
+	_ = fw.Flush()
+	// Sync flush appends 0x00 0x00 0xff 0xff, which permessage-deflate strips
+	return buf.Len() - 4
+}
+
+// Measures traffic caused by a single keystroke in a document of 2000 characters:
+// the sender's CHANGE, the ACKCHANGE it gets back, and the UPDATE sent to one other peer.
+func BenchmarkPeerCodecs_BytesPerKeystroke(b *testing.B) {
+	const docLength = 2000
+	var cs biscript.ChangeSet
+	cs.LengthBefore = docLength
+	for i := uint(0); i < docLength; i++ {
+		if i == docLength/2 {
+			cs.Items = append(cs.Items, biscript.XieChar{Hanzi: "狗", Pinyin: "gou3"})
+		}
+		cs.Items = append(cs.Items, i)
+	}
+	cs.LengthAfter = uint(len(cs.Items))
+	sel := &sessionSelection{Start: docLength/2 + 1, End: docLength/2 + 1}
+	ctb := changeToBroadcast{
+		sourceSessionKey:        "S-a12bc3d",
+		sourceBaseDocRevisionId: 1234,
+		newDocRevisionId:        1235,
+		selections:              []sessionSelection{{"S-a12bc3d", sel.Start, sel.End, false}, {"S-b34cd5e", 17, 17, false}},
+		change:                  &cs,
+	}
+	codecs := []struct {
+		name  string
+		codec peerCodec
+	}{
+		{"legacy", legacyCodec{}},
+		{"json", jsonCodec{}},
+		{"cbor", cborCodec{}},
+	}
+	for _, c := range codecs {
+		for _, compress := range []bool{false, true} {
+			name := c.name
+			if compress {
+				name += "+deflate"
+			}
+			b.Run(name, func(b *testing.B) {
+				total := 0
+				for i := 0; i < b.N; i++ {
+					msgs := [][]byte{
+						encodeClientChange(c.codec, 1234, sel, &cs),
+						c.codec.encodeAck(&ctb),
+						c.codec.encodeUpdate(&ctb),
+					}
+					total = 0
+					for _, msg := range msgs {
+						if compress {
+							total += deflatedSize(msg)
+						} else {
+							total += len(msg)
+						}
+					}
+				}
+				b.ReportMetric(float64(total), "bytes/keystroke")
+			})
+		}
+	}
+}
@@ -23,6 +23,31 @@ type pinyin struct {
 	sylls       []syllable
 	surf2NumMap map[string]string
 	num2SurfMap map[string]string
+	// Every prefix of every syllable, without tone; true if the prefix is a whole syllable itself
+	prefixes map[string]bool
+	// Zhuyin of every syllable, without tone, to the syllable in pinyin
+	zhuyin2Num map[string]string
+}
+
+// A vowel with a tone mark, or ü, in pinyin input
+type markedVowel struct {
+	base byte // The vowel without tone mark, v for ü
+	tone byte // Tone digit, or 0 for no tone mark
+}
+
+var markedVowels = make(map[rune]markedVowel)
+
+func init() {
+	for _, vowels := range []string{"aāáǎà", "eēéěè", "iīíǐì", "oōóǒò", "uūúǔù", "vǖǘǚǜ"} {
+		for _, vowels := range []string{vowels, strings.ToUpper(vowels)} {
+			runes := []rune(vowels)
+			for i := 1; i < len(runes); i++ {
+				markedVowels[runes[i]] = markedVowel{byte(runes[0]), byte('0' + i)}
+			}
+		}
+	}
+	markedVowels['ü'] = markedVowel{'v', 0}
+	markedVowels['Ü'] = markedVowel{'V', 0}
 }
 
 func loadPinyin() *pinyin {
@@ -48,6 +73,19 @@ func loadPinyin() *pinyin {
 	sort.Slice(p.sylls, func(i, j int) bool {
 		return utf8.RuneCountInString(p.sylls[i].text) > utf8.RuneCountInString(p.sylls[j].text)
 	})
+	for _, ps := range p.sylls {
+		for i := 1; i < len(ps.text); i++ {
+			if _, ok := p.prefixes[ps.text[:i]]; !ok {
+				p.prefixes[ps.text[:i]] = false
+			}
+		}
+		p.prefixes[ps.text] = true
+		if zhuyin := tonelessToZhuyin(ps.text); zhuyin != "" {
+			if _, ok := p.zhuyin2Num[zhuyin]; !ok {
+				p.zhuyin2Num[zhuyin] = ps.text
+			}
+		}
+	}
 
 	return &p
 }
@@ -55,6 +93,8 @@ func loadPinyin() *pinyin {
 func (p *pinyin) init() {
 	p.num2SurfMap = make(map[string]string)
 	p.surf2NumMap = make(map[string]string)
+	p.prefixes = make(map[string]bool)
+	p.zhuyin2Num = make(map[string]string)
 }
 
 func (p *pinyin) parseInputLine(line string) {
@@ -159,3 +199,150 @@ func (p *pinyin) splitSyllables(text string) (res []string) {
 	}
 	return
 }
+
+// Splits text into syllables, where any syllable may be abbreviated to its beginning, like "zhongg" or "zg"
+// for "zhong guo". Whole syllables are preferred over abbreviations, and may have a tone digit.
+// Returns false if text cannot be split this way.
+func (p *pinyin) splitAbbreviated(text string) (res []string, ok bool) {
+	if len(text) == 0 {
+		return
+	}
+	ends := make([]int, 0)
+	// Positions from which the rest of the text is known not to split
+	failed := make(map[int]bool)
+	if !p.matchAbbreviated(text, 0, &ends, failed) {
+		return
+	}
+	i := 0
+	for _, j := range ends {
+		res = append(res, text[i:j])
+		i = j
+	}
+	return res, true
+}
+
+func (p *pinyin) matchAbbreviated(str string, pos int, ends *[]int, failed map[int]bool) bool {
+	if pos == len(str) {
+		return true
+	}
+	if failed[pos] {
+		return false
+	}
+	rest := str[pos:]
+	tryEnd := func(endPos int) bool {
+		*ends = append(*ends, endPos)
+		if p.matchAbbreviated(str, endPos, ends, failed) {
+			return true
+		}
+		*ends = (*ends)[:len(*ends)-1]
+		return false
+	}
+	// Whole syllables first, longest first, like in matchSylls
+	for _, ps := range p.sylls {
+		if pos != 0 && ps.vowelStart || !strings.HasPrefix(rest, ps.text) {
+			continue
+		}
+		endPos := pos + len(ps.text)
+		if len(rest) > len(ps.text) && rest[len(ps.text)] >= '1' && rest[len(ps.text)] <= '5' {
+			endPos++
+		}
+		if tryEnd(endPos) {
+			return true
+		}
+	}
+	// Then beginnings of syllables, longest first
+	for length := len(rest); length > 0; length-- {
+		prefix := rest[:length]
+		if isWhole, ok := p.prefixes[prefix]; !ok || isWhole {
+			continue
+		}
+		if tryEnd(pos + length) {
+			return true
+		}
+	}
+	failed[pos] = true
+	return false
+}
+
+// Checks if a syllable from splitAbbreviated is a whole syllable, with or without tone.
+func (p *pinyin) isWholeSyllable(syll string) bool {
+	return p.prefixes[strings.TrimRight(syll, "12345")]
+}
+
+// Rewrites pinyin input into the numbered form used in XieChar.Pinyin. Understands Zhuyin, u: for ü,
+// and tone marks; ü becomes v. Syllables keep the case of their first letter.
+func (p *pinyin) normalizeInput(input string) string {
+	if strings.IndexFunc(input, isZhuyin) != -1 {
+		input = p.zhuyinToNum(input)
+	}
+	input = strings.NewReplacer("u:", "v", "U:", "V").Replace(input)
+	if strings.IndexFunc(input, func(r rune) bool { _, ok := markedVowels[r]; return ok }) == -1 {
+		return input
+	}
+	// Syllables don't span spaces and apostrophes, so the text between them is converted piece by piece
+	var sb strings.Builder
+	start := 0
+	for pos, r := range input {
+		if unicode.IsSpace(r) || r == '\'' || r == '’' {
+			sb.WriteString(p.markedToNum(input[start:pos]))
+			sb.WriteRune(r)
+			start = pos + utf8.RuneLen(r)
+		}
+	}
+	sb.WriteString(p.markedToNum(input[start:]))
+	return sb.String()
+}
+
+// Rewrites pinyin with tone marks into the numbered form, for normalizeInput.
+func (p *pinyin) markedToNum(input string) string {
+	// Input with plain letters for marked vowels, in lower case; for each byte, its tone digit
+	// and the position of its rune in input
+	var lo, tones []byte
+	var inputPos []int
+	for pos := 0; pos < len(input); {
+		r, size := utf8.DecodeRuneInString(input[pos:])
+		mv, ok := markedVowels[r]
+		if !ok {
+			// Anything else is kept byte by byte
+			for i := 0; i < size; i++ {
+				lo = append(lo, toLowerASCII(input[pos+i]))
+				tones = append(tones, 0)
+				inputPos = append(inputPos, pos+i)
+			}
+		} else {
+			lo = append(lo, toLowerASCII(mv.base))
+			tones = append(tones, mv.tone)
+			inputPos = append(inputPos, pos)
+		}
+		pos += size
+	}
+	inputPos = append(inputPos, len(input))
+	var sb strings.Builder
+	start := 0
+	for _, syll := range p.splitSyllables(string(lo)) {
+		end := start + len(syll)
+		orig := input[inputPos[start]:inputPos[end]]
+		num, ok := p.surf2NumMap[strings.ToLower(orig)]
+		if !ok {
+			num = syll
+			for _, tone := range tones[start:end] {
+				if tone != 0 && !hasToneDigit(num) {
+					num += string(tone)
+				}
+			}
+		}
+		if first, _ := utf8.DecodeRuneInString(orig); unicode.IsUpper(first) {
+			num = strings.ToUpper(num[:1]) + num[1:]
+		}
+		sb.WriteString(num)
+		start = end
+	}
+	return sb.String()
+}
+
+func toLowerASCII(b byte) byte {
+	if b >= 'A' && b <= 'Z' {
+		return b + 'a' - 'A'
+	}
+	return b
+}
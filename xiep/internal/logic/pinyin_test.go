@@ -81,3 +81,86 @@ func TestPinyinSplitBySyllables(t *testing.T) {
 		}
 	}
 }
+
+func TestPinyinSplitAbbreviated(t *testing.T) {
+	vals := []struct {
+		text  string
+		sylls []string
+	}{
+		{"zhongg", []string{"zhong", "g"}},
+		{"zg", []string{"z", "g"}},
+		{"zhong1guo", []string{"zhong1", "guo"}},
+		{"zhgu", []string{"zh", "gu"}},
+		{"zh1", nil},
+		{"zgzgzgzgzgzgzgzgzgzgzgzgzgzgzgzgzgzgzgzgzgzg1", nil},
+	}
+	p := loadPinyin()
+	for _, val := range vals {
+		sylls, ok := p.splitAbbreviated(val.text)
+		if ok != (val.sylls != nil) || !checkSlicesEqual(sylls, val.sylls) {
+			t.Errorf("Wrong split for %v: %v", val.text, sylls)
+		}
+	}
+}
+
+func TestPinyinZhuyin(t *testing.T) {
+	vals := []struct {
+		num    string
+		zhuyin string
+	}{
+		{"ni3", "ㄋㄧˇ"},
+		{"hao3", "ㄏㄠˇ"},
+		{"zhi1", "ㄓ"},
+		{"yu2", "ㄩˊ"},
+		{"xue2", "ㄒㄩㄝˊ"},
+		{"lv4", "ㄌㄩˋ"},
+		{"wo3", "ㄨㄛˇ"},
+		{"you3", "ㄧㄡˇ"},
+		{"gui4", "ㄍㄨㄟˋ"},
+		{"er2", "ㄦˊ"},
+		{"ma", "˙ㄇㄚ"},
+		{"xyz1", ""},
+	}
+	p := loadPinyin()
+	for _, val := range vals {
+		if zhuyin := numToZhuyin(val.num); zhuyin != val.zhuyin {
+			t.Errorf("Wrong Zhuyin for %v: expected %v, got %v", val.num, val.zhuyin, zhuyin)
+		}
+		if val.zhuyin == "" {
+			continue
+		}
+		if num := p.zhuyinToNum(val.zhuyin); num != val.num {
+			t.Errorf("Wrong pinyin for %v: expected %v, got %v", val.zhuyin, val.num, num)
+		}
+	}
+}
+
+func TestPinyinNormalizeInput(t *testing.T) {
+	vals := []struct {
+		input string
+		num   string
+	}{
+		{"ni3hao3", "ni3hao3"},
+		{"Nǐhǎo", "Ni3hao3"},
+		{"NǏHǍO", "Ni3Hao3"},
+		{"nǐhao", "ni3hao"},
+		{"nu:3", "nv3"},
+		{"Lu:", "Lv"},
+		{"lǚ", "lv3"},
+		{"lü4", "lv4"},
+		{"Xī'ān", "Xi1'an1"},
+		{"nǐ hǎo", "ni3 hao3"},
+		{"Nǐhǎo  ma", "Ni3hao3  ma"},
+		{"lǜ sè", "lv4 se4"},
+		{"xī’ān", "xi1’an1"},
+		{"ㄋㄧˇㄏㄠˇ", "ni3hao3"},
+		{"ㄓㄨㄥㄍㄨㄛˊ", "zhong1guo2"},
+		{"˙ㄇㄚ", "ma"},
+	}
+	p := loadPinyin()
+	for _, val := range vals {
+		if num := p.normalizeInput(val.input); num != val.num {
+			t.Errorf("Wrong normalized input for %v: expected %v, got %v", val.input, val.num, num)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package logic
+
+import (
+	"hash/fnv"
+	"strings"
+	"time"
+	"unicode/utf8"
+	"xiep/internal/common"
+)
+
+const (
+	presenceIdleSeconds      = 120         // Session that hasn't changed text or selection for this long is shown as idle
+	presenceMaxNameLength    = 40          // Longer display names are truncated
+	presenceDefaultName      = "Anonymous" // Display name of editors who didn't provide one
+	presenceStateActive      = "active"
+	presenceStateIdle        = "idle"
+	presenceEventJoin        = "join"
+	presenceEventLeave       = "leave"
+	presenceEventStateChange = "state"
+)
+
+// Cursor colors assigned to editors; picked by hashing the session key, so a session keeps its color when it resumes.
+var presenceColors = []string{
+	"#e6194b", "#3cb44b", "#4363d8", "#f58231", "#911eb4", "#42d4f4",
+	"#f032e6", "#9a6324", "#469990", "#800000", "#808000", "#000075",
+}
+
+// Describes who is behind an edit session, for other editors of the same document.
+type sessionPresence struct {
+	SessionKey  string `json:"sessionKey"`
+	DisplayName string `json:"displayName"`
+	Color       string `json:"color"`
+	State       string `json:"state"`
+	JoinedUtc   string `json:"joinedUtc"`
+}
+
+// A change in an editor's presence that other editors of the document need to hear about.
+type presenceToBroadcast struct {
+	event               string
+	presence            sessionPresence
+	receiverSessionKeys map[string]bool
+}
+
+// Cleans up a display name provided by the client.
+func sanitizeDisplayName(name string) string {
+	name = strings.Join(strings.Fields(name), " ")
+	if utf8.RuneCountInString(name) > presenceMaxNameLength {
+		name = string([]rune(name)[:presenceMaxNameLength])
+	}
+	if name == "" {
+		name = presenceDefaultName
+	}
+	return name
+}
+
+func getPresenceColor(sessionKey string) string {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(sessionKey))
+	return presenceColors[h.Sum32()%uint32(len(presenceColors))]
+}
+
+// Tells if session counts as idle at the provided time.
+func (sess *editSession) isIdle(utcNow time.Time) bool {
+	return utcNow.Sub(sess.lastActiveUtc).Seconds() > presenceIdleSeconds
+}
+
+// Gets the session's current presence info.
+func (sess *editSession) getPresence(utcNow time.Time) sessionPresence {
+	state := presenceStateActive
+	if sess.isIdle(utcNow) {
+		state = presenceStateIdle
+	}
+	return sessionPresence{
+		SessionKey:  sess.sessionKey,
+		DisplayName: sess.displayName,
+		Color:       getPresenceColor(sess.sessionKey),
+		State:       state,
+		JoinedUtc:   sess.joinedUtc.Format(common.Iso8601Layout),
+	}
+}
@@ -0,0 +1,102 @@
+package logic
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSanitizeDisplayName(t *testing.T) {
+	vals := []struct {
+		name string
+		res  string
+	}{
+		{"", presenceDefaultName},
+		{"  \t ", presenceDefaultName},
+		{" Momo  the\tdog ", "Momo the dog"},
+		{"李小龍", "李小龍"},
+		{strings.Repeat("龍", presenceMaxNameLength+5), strings.Repeat("龍", presenceMaxNameLength)},
+	}
+	for _, val := range vals {
+		if res := sanitizeDisplayName(val.name); res != val.res {
+			t.Errorf("Expected '%v' for '%v', got '%v'", val.res, val.name, res)
+		}
+	}
+}
+
+func TestOrchestrator_Presence(t *testing.T) {
+	ork := newTestOrchestrator(t)
+	tm := ork.peerMessenger.(*testMessenger)
+	docId, _ := ork.CreateDocument("Momo")
+	keyA := ork.RequestSession(docId, "alice", "Alice")
+	keyB := ork.RequestSession(docId, "bob", "")
+	ork.startSession(keyA, "alice", -1)
+	ssm := ork.startSession(keyB, "bob", -1)
+
+	// Newcomer learns who's there, in order of joining
+	if len(ssm.Editors) != 2 || ssm.Editors[0].DisplayName != "Alice" || ssm.Editors[1].DisplayName != presenceDefaultName {
+		t.Errorf("Wrong editors in start message: %+v", ssm.Editors)
+	}
+	if ssm.Editors[0].State != presenceStateActive || ssm.Editors[0].Color != getPresenceColor(keyA) {
+		t.Errorf("Wrong presence: %+v", ssm.Editors[0])
+	}
+	// Others learn about newcomer
+	if len(tm.presences) != 2 || tm.presences[1].event != presenceEventJoin || tm.presences[1].presence.SessionKey != keyB {
+		t.Fatalf("Join not broadcast")
+	}
+	if !tm.presences[1].receiverSessionKeys[keyA] {
+		t.Errorf("Join not sent to other editor")
+	}
+
+	// Alice goes idle, then comes back
+	ld := ork.lockDoc(docId)
+	ld.sessions[keyA].lastActiveUtc = time.Now().UTC().Add(-(presenceIdleSeconds + 1) * time.Second)
+	ld.mu.Unlock()
+	ork.cleanupSessions()
+	ork.cleanupSessions()
+	if len(tm.presences) != 3 || tm.presences[2].event != presenceEventStateChange || tm.presences[2].presence.State != presenceStateIdle {
+		t.Fatalf("Idle state not broadcast exactly once")
+	}
+	if editors := ork.getEditors(docId); editors[0].State != presenceStateIdle {
+		t.Errorf("Idle state not listed: %+v", editors)
+	}
+	ork.changeReceived(keyA, 0, &sessionSelection{}, nil)
+	if len(tm.presences) != 4 || tm.presences[3].presence.State != presenceStateActive {
+		t.Fatalf("Active state not broadcast")
+	}
+
+	// Bob leaves
+	ork.sessionDetached(keyB)
+	if len(tm.presences) != 5 || tm.presences[4].event != presenceEventLeave || tm.presences[4].presence.SessionKey != keyB {
+		t.Fatalf("Leave not broadcast")
+	}
+	if editors := ork.getEditors(docId); len(editors) != 1 || editors[0].SessionKey != keyA {
+		t.Errorf("Wrong editors after leave: %+v", editors)
+	}
+}
+
+func TestConnectionManager_BroadcastPresence(t *testing.T) {
+	cm, _, wg := newTestConnectionManager(SlowPeerResync)
+	defer stopTestConnectionManager(cm, wg)
+
+	receive1, send1, _ := cm.NewConnection("1.1.1.1", "alice", SubprotocolJSONv1)
+	receive2, send2, _ := cm.NewConnection("2.2.2.2", "bob", "")
+	receive1([]byte(`{"type":"sessionKey","payload":{"sessionKey":"S-1"}}`))
+	receive2([]byte("SESSIONKEY S-2"))
+	receiveWithTimeout(t, send1)
+	receiveWithTimeout(t, send2)
+
+	cm.doBroadcastPresence(&presenceToBroadcast{
+		event:               presenceEventJoin,
+		presence:            sessionPresence{SessionKey: "S-3", DisplayName: "Momo"},
+		receiverSessionKeys: map[string]bool{"S-1": true, "S-2": true, "S-3": true},
+	})
+	msg := receiveWithTimeout(t, send1)
+	if !strings.HasPrefix(msg, `{"type":"presence","payload":{"event":"join","presence":{"sessionKey":"S-3","displayName":"Momo"`) {
+		t.Errorf("Wrong presence message: %v", msg)
+	}
+	// Legacy protocol has no presence messages
+	if len(send2) != 0 {
+		t.Errorf("Presence sent to legacy peer")
+	}
+}
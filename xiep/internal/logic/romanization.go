@@ -0,0 +1,296 @@
+package logic
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+	"xiep/internal/docx"
+)
+
+// Splits a lower-case pinyin syllable without tone into its initial and its final. The final is written in full,
+// the way it would be after an initial, and with v for ü: "you" gives "iou", "gui" gives "uei", "jun" gives "vn".
+// Returns false if the syllable is not made up of a known initial and final.
+func splitPinyinSyllable(syll string) (initial, final string, ok bool) {
+	if len(syll) >= 2 && zhuyinInitials[syll[:2]] != "" {
+		initial = syll[:2]
+	} else if len(syll) >= 1 && zhuyinInitials[syll[:1]] != "" {
+		initial = syll[:1]
+	}
+	final = syll[len(initial):]
+	// Syllables without initial are spelled with y and w
+	if initial == "" {
+		switch {
+		case strings.HasPrefix(final, "yu"):
+			final = "v" + final[2:]
+		case strings.HasPrefix(final, "yi"), strings.HasPrefix(final, "wu"):
+			final = final[1:]
+		case strings.HasPrefix(final, "y"):
+			final = "i" + final[1:]
+		case strings.HasPrefix(final, "w"):
+			final = "u" + final[1:]
+		}
+	}
+	// ü is written u after j, q and x
+	if (initial == "j" || initial == "q" || initial == "x") && strings.HasPrefix(final, "u") {
+		final = "v" + final[1:]
+	}
+	switch final {
+	case "iu":
+		final = "iou"
+	case "ui":
+		final = "uei"
+	case "un":
+		final = "uen"
+	}
+	_, ok = zhuyinFinals[final]
+	ok = ok && (initial != "" || final != "")
+	return
+}
+
+// Checks if an initial is one after which i stands for a syllabic consonant, like in zhi or si.
+func isRetroflexOrSibilant(initial string) bool {
+	switch initial {
+	case "zh", "ch", "sh", "r", "z", "c", "s":
+		return true
+	}
+	return false
+}
+
+var wadeGilesInitials = map[string]string{
+	"b": "p", "p": "p'", "m": "m", "f": "f", "d": "t", "t": "t'", "n": "n", "l": "l",
+	"g": "k", "k": "k'", "h": "h", "j": "ch", "q": "ch'", "x": "hs",
+	"zh": "ch", "ch": "ch'", "sh": "sh", "r": "j", "z": "ts", "c": "ts'", "s": "s",
+}
+
+// Wade-Giles finals after an initial, and without initial, for the finals from splitPinyinSyllable
+var wadeGilesFinals = map[string][2]string{
+	"": {"", ""}, "a": {"a", "a"}, "o": {"o", "o"}, "e": {"ê", "o"}, "ai": {"ai", "ai"}, "ei": {"ei", "ei"},
+	"ao": {"ao", "ao"}, "ou": {"ou", "ou"}, "an": {"an", "an"}, "en": {"ên", "ên"}, "ang": {"ang", "ang"},
+	"eng": {"êng", "êng"}, "ong": {"ung", "ung"}, "er": {"êrh", "êrh"},
+	"i": {"i", "i"}, "ia": {"ia", "ya"}, "io": {"io", "yo"}, "ie": {"ieh", "yeh"}, "iao": {"iao", "yao"},
+	"iou": {"iu", "yu"}, "ian": {"ien", "yen"}, "in": {"in", "yin"}, "iang": {"iang", "yang"},
+	"ing": {"ing", "ying"}, "iong": {"iung", "yung"},
+	"u": {"u", "wu"}, "ua": {"ua", "wa"}, "uo": {"uo", "wo"}, "uai": {"uai", "wai"}, "uei": {"ui", "wei"},
+	"uan": {"uan", "wan"}, "uen": {"un", "wên"}, "uang": {"uang", "wang"}, "ueng": {"ung", "wêng"},
+	"v": {"ü", "yü"}, "ve": {"üeh", "yüeh"}, "van": {"üan", "yüan"}, "vn": {"ün", "yün"},
+}
+
+var wadeGilesTones = map[byte]string{'1': "¹", '2': "²", '3': "³", '4': "⁴"}
+
+// Gets the Wade-Giles for a lower-case pinyin syllable without tone. Returns empty string if syllable is unknown.
+func tonelessToWadeGiles(syll string) string {
+	initial, final, ok := splitPinyinSyllable(syll)
+	if !ok {
+		return ""
+	}
+	if final == "i" && isRetroflexOrSibilant(initial) {
+		switch initial {
+		case "z":
+			return "tzŭ"
+		case "c":
+			return "tz'ŭ"
+		case "s":
+			return "ssŭ"
+		}
+		return wadeGilesInitials[initial] + "ih"
+	}
+	if initial == "" {
+		return wadeGilesFinals[final][1]
+	}
+	res := wadeGilesFinals[final][0]
+	switch {
+	case final == "e" && (initial == "g" || initial == "k" || initial == "h"):
+		res = "o"
+	case final == "uo" && initial != "g" && initial != "k" && initial != "h" && initial != "sh":
+		res = "o"
+	case final == "uei" && (initial == "g" || initial == "k"):
+		res = "uei"
+	}
+	return wadeGilesInitials[initial] + res
+}
+
+var gwoyeuInitials = map[string]string{
+	"b": "b", "p": "p", "m": "m", "f": "f", "d": "d", "t": "t", "n": "n", "l": "l",
+	"g": "g", "k": "k", "h": "h", "j": "j", "q": "ch", "x": "sh",
+	"zh": "j", "ch": "ch", "sh": "sh", "r": "r", "z": "tz", "c": "ts", "s": "s",
+}
+
+// Gwoyeu Romatzyh spells tones with letters: the finals from splitPinyinSyllable in the first, second, third
+// and fourth tone, after an initial
+var gwoyeuFinals = map[string][4]string{
+	"": {"", "", "", ""}, "a": {"a", "ar", "aa", "ah"}, "o": {"o", "or", "oo", "oh"}, "e": {"e", "er", "ee", "eh"},
+	"ai": {"ai", "air", "ae", "ay"}, "ei": {"ei", "eir", "eei", "ey"}, "ao": {"au", "aur", "ao", "aw"},
+	"ou": {"ou", "our", "oou", "ow"}, "an": {"an", "arn", "aan", "ann"}, "en": {"en", "ern", "een", "enn"},
+	"ang": {"ang", "arng", "aang", "anq"}, "eng": {"eng", "erng", "eeng", "enq"},
+	"ong": {"ong", "orng", "oong", "onq"}, "er": {"el", "erl", "eel", "ell"},
+	"i": {"i", "yi", "ii", "ih"}, "ia": {"ia", "ya", "ea", "iah"}, "io": {"io", "yo", "eo", "ioh"},
+	"ie": {"ie", "ye", "iee", "ieh"}, "iao": {"iau", "yau", "eau", "iaw"}, "iou": {"iou", "you", "eou", "iow"},
+	"ian": {"ian", "yan", "ean", "iann"}, "in": {"in", "yn", "iin", "inn"}, "iang": {"iang", "yang", "eang", "ianq"},
+	"ing": {"ing", "yng", "iing", "inq"}, "iong": {"iong", "yong", "eong", "ionq"},
+	"u": {"u", "wu", "uu", "uh"}, "ua": {"ua", "wa", "oa", "uah"}, "uo": {"uo", "wo", "uoo", "uoh"},
+	"uai": {"uai", "wai", "oai", "uay"}, "uei": {"uei", "wei", "oei", "uey"}, "uan": {"uan", "wan", "oan", "uann"},
+	"uen": {"uen", "wen", "oen", "uenn"}, "uang": {"uang", "wang", "oang", "uanq"}, "ueng": {"ueng", "weng", "oeng", "uenq"},
+	"v": {"iu", "yu", "eu", "iuh"}, "ve": {"iue", "yue", "eue", "iueh"}, "van": {"iuan", "yuan", "euan", "iuann"},
+	"vn": {"iun", "yun", "eun", "iunn"},
+}
+
+// Gets the Gwoyeu Romatzyh for a lower-case numbered pinyin syllable. Returns empty string if syllable is unknown.
+func numToGwoyeu(num string) string {
+	toneless := strings.TrimRight(num, "12345")
+	initial, final, ok := splitPinyinSyllable(toneless)
+	if !ok {
+		return ""
+	}
+	// Index into gwoyeuFinals; the neutral tone is spelled like the first
+	tone := 0
+	if toneless != num && num[len(num)-1] != '5' {
+		tone = int(num[len(num)-1] - '1')
+	}
+	forms := gwoyeuFinals[final]
+	if final == "i" && isRetroflexOrSibilant(initial) {
+		forms = [4]string{"y", "yr", "yy", "yh"}
+	}
+	res := forms[tone]
+	// Without initial, i, u and ü are written y and w in the third and fourth tone too
+	if initial == "" && tone >= 2 && strings.IndexAny(final[:1], "iuv") == 0 {
+		semi := "y"
+		if final[0] == 'u' {
+			semi = "w"
+		}
+		prefix := tone == 2 && (strings.HasPrefix(res, "ii") || strings.HasPrefix(res, "uu") || res[0] == 'e' || res[0] == 'o')
+		prefix = prefix || tone == 3 && (final == "i" || final == "in" || final == "ing" || final == "u")
+		if prefix {
+			res = semi + res
+		} else {
+			res = semi + res[1:]
+		}
+	}
+	// After m, n, l and r, the first tone is marked with h, and the second tone is spelled like the first
+	if initial == "m" || initial == "n" || initial == "l" || initial == "r" {
+		switch {
+		case tone == 0 && toneless != num && num[len(num)-1] != '5':
+			res = "h" + res
+		case tone == 1:
+			res = forms[0]
+		}
+	}
+	return gwoyeuInitials[initial] + res
+}
+
+var ipaInitials = map[string]string{
+	"b": "p", "p": "pʰ", "m": "m", "f": "f", "d": "t", "t": "tʰ", "n": "n", "l": "l",
+	"g": "k", "k": "kʰ", "h": "x", "j": "tɕ", "q": "tɕʰ", "x": "ɕ",
+	"zh": "ʈʂ", "ch": "ʈʂʰ", "sh": "ʂ", "r": "ʐ", "z": "ts", "c": "tsʰ", "s": "s",
+}
+
+var ipaFinals = map[string]string{
+	"": "", "a": "a", "o": "o", "e": "ɤ", "ai": "ai̯", "ei": "ei̯", "ao": "ɑu̯", "ou": "ou̯",
+	"an": "an", "en": "ən", "ang": "ɑŋ", "eng": "əŋ", "ong": "ʊŋ", "er": "aɚ",
+	"i": "i", "ia": "ja", "io": "jo", "ie": "jɛ", "iao": "jɑu̯", "iou": "jou̯",
+	"ian": "jɛn", "in": "in", "iang": "jɑŋ", "ing": "iŋ", "iong": "jʊŋ",
+	"u": "u", "ua": "wa", "uo": "wo", "uai": "wai̯", "uei": "wei̯",
+	"uan": "wan", "uen": "wən", "uang": "wɑŋ", "ueng": "wəŋ",
+	"v": "y", "ve": "ɥɛ", "van": "ɥɛn", "vn": "yn",
+}
+
+// Chao tone letters
+var ipaTones = map[byte]string{'1': "˥", '2': "˧˥", '3': "˨˩˦", '4': "˥˩"}
+
+// Gets the IPA for a lower-case pinyin syllable without tone. Returns empty string if syllable is unknown.
+func tonelessToIpa(syll string) string {
+	initial, final, ok := splitPinyinSyllable(syll)
+	if !ok {
+		return ""
+	}
+	if final == "i" && isRetroflexOrSibilant(initial) {
+		if initial == "z" || initial == "c" || initial == "s" {
+			return ipaInitials[initial] + "ɹ̩"
+		}
+		return ipaInitials[initial] + "ʐ̩"
+	}
+	return ipaInitials[initial] + ipaFinals[final]
+}
+
+// Gets a lower-case numbered pinyin syllable in the romanization, which is one of docx.Roman*, other than pinyin.
+// Returns empty string if syllable is unknown.
+func numToRoman(num string, roman string) string {
+	toneless := strings.TrimRight(num, "12345")
+	tone := byte('5')
+	if toneless != num {
+		tone = num[len(num)-1]
+	}
+	res := ""
+	// The r of erhua
+	if toneless == "r" && roman != docx.RomanZhuyin {
+		return map[string]string{docx.RomanWadeGiles: "rh", docx.RomanGwoyeu: "l", docx.RomanIpa: "ɻ"}[roman]
+	}
+	switch roman {
+	case docx.RomanZhuyin:
+		return numToZhuyin(num)
+	case docx.RomanGwoyeu:
+		return numToGwoyeu(num)
+	case docx.RomanWadeGiles:
+		if res = tonelessToWadeGiles(toneless); res != "" {
+			res += wadeGilesTones[tone]
+		}
+	case docx.RomanIpa:
+		if res = tonelessToIpa(toneless); res != "" {
+			res += ipaTones[tone]
+		}
+	}
+	return res
+}
+
+// Parses input string with numbers, and returns it in the romanization, which is one of docx.Roman*.
+// Syllables are separated the way the romanization writes words. Anything that is not a syllable is kept as it is.
+func (cp *composer) PinyinNumsToRoman(pyNums string, roman string) string {
+	if roman == docx.RomanPinyin || roman == "" {
+		return cp.PinyinNumsToSurf(pyNums)
+	}
+	pyNumsLo := strings.ToLower(pyNums)
+	loSylls := cp.pinyin.splitSyllables(pyNumsLo)
+	return strings.Join(cp.PinyinSyllsToRoman(getOrigSylls(pyNums, pyNumsLo, loSylls), roman), "")
+}
+
+// Converts numbered pinyin syllables of a word into the romanization, which is one of docx.Roman*.
+// Each result starts with the separator that the romanization writes before the syllable, so that they can be
+// joined into the word. Anything that is not a syllable is kept as it is.
+func (cp *composer) PinyinSyllsToRoman(sylls []string, roman string) []string {
+	res := make([]string, len(sylls))
+	afterSyll := false
+	for i, syll := range sylls {
+		if roman == docx.RomanPinyin || roman == "" {
+			res[i] = cp.PinyinNumsToSurf(syll)
+			continue
+		}
+		loSyll := strings.ToLower(syll)
+		romanSyll := numToRoman(loSyll, roman)
+		if romanSyll == "" {
+			res[i] = syll
+			afterSyll = false
+			continue
+		}
+		separator := ""
+		if afterSyll {
+			switch roman {
+			case docx.RomanWadeGiles:
+				separator = "-"
+			case docx.RomanGwoyeu:
+				// Like in pinyin, an apostrophe marks where a syllable starting with a vowel begins
+				if strings.IndexAny(romanSyll[:1], "aeo") == 0 {
+					separator = "'"
+				}
+			default:
+				separator = " "
+			}
+		}
+		// Keep upper case in romanizations that have it
+		if loSyll != syll && (roman == docx.RomanWadeGiles || roman == docx.RomanGwoyeu) {
+			first, size := utf8.DecodeRuneInString(romanSyll)
+			romanSyll = string(unicode.ToUpper(first)) + romanSyll[size:]
+		}
+		res[i] = separator + romanSyll
+		afterSyll = true
+	}
+	return res
+}
@@ -1,6 +1,8 @@
 package logic
 
 import (
+	"fmt"
+	"net/http"
 	"sync"
 	"time"
 	"xiep/internal/common"
@@ -14,22 +16,52 @@ type xieApp struct {
 	Composer          *composer
 	Orchestrator      orchestrator
 	ConnectionManager connectionManager
+	Docs              docRouter
 	wgShutdown        sync.WaitGroup
 	xlog              common.XieLogger
 }
 
 // Initializes the the application logic at startup.
 func InitTheApp(config *common.Config, xlog common.XieLogger) {
+	var bus ClusterBus
+	if len(config.ClusterPeers) != 0 {
+		hb, err := NewHTTPBus(config, xlog)
+		if err != nil {
+			xlog.LogFatal(common.LogSrcApp, fmt.Sprintf("Failed to set up cluster bus: %v", err))
+		}
+		bus = hb
+	}
+	TheApp.init(config, xlog, loadComposerFromFiles("./static", xlog), bus)
+}
+
+// Gets the handler for requests from other instances, or nil if this instance runs alone.
+func (app *xieApp) ClusterHandler() http.Handler {
+	if hb, ok := app.Docs.bus.(*HTTPBus); ok {
+		return hb
+	}
+	return nil
+}
+
+// Initializes one instance of the application logic.
+// bus connects the instance to others that share the same documents; nil if the instance runs alone.
+func (app *xieApp) init(config *common.Config, xlog common.XieLogger, composer *composer, bus ClusterBus) {
 
-	TheApp.xlog = xlog
+	app.xlog = xlog
 
-	TheApp.ASM.init(config.SecretsFile, xlog)
-	TheApp.Composer = loadComposerFromFiles("./static")
-	TheApp.Orchestrator.init(xlog, &TheApp.wgShutdown, TheApp.Composer, config.DocsFolder, config.ExportsFolder)
-	TheApp.ConnectionManager.init(xlog, &TheApp.wgShutdown, &TheApp.Orchestrator)
+	app.ASM.init(config.SecretsFile, xlog)
+	app.Composer = composer
+	store, err := NewDocumentStore(config.DocStore, config, xlog)
+	if err != nil {
+		xlog.LogFatal(common.LogSrcApp, fmt.Sprintf("Failed to open document store: %v", err))
+	}
+	app.Orchestrator.init(xlog, &app.wgShutdown, app.Composer, store, config.ExportsFolder, config.TrashRetentionDays)
+	app.Orchestrator.backups = newBackupScheduler(config, store, xlog)
+	app.ConnectionManager.init(xlog, &app.wgShutdown, &app.Docs, config.SlowPeerPolicy)
+	// Router needs connection manager up and running before it starts receiving from other instances
+	app.Docs.init(xlog, config.InstanceId, bus, &app.Orchestrator, &app.ConnectionManager)
 
-	// Hook up orchestrator to connection manager
-	TheApp.Orchestrator.startup(&TheApp.ConnectionManager)
+	// Hook up orchestrator to connection manager, through the router
+	app.Orchestrator.startup(&app.Docs)
 }
 
 // Tells background processes to finish at graceful shutdown.
@@ -51,4 +83,9 @@ func (app *xieApp) Shutdown() {
 	case <-done:
 		app.xlog.Logf(common.LogSrcApp, "Background threads finished gracefully")
 	}
+	// Dirty docs have been saved: other instances can take over
+	app.Docs.shutdown()
+	if err := app.Orchestrator.store.Close(); err != nil {
+		app.xlog.Logf(common.LogSrcApp, "Failed to close document store: %v", err)
+	}
 }
@@ -0,0 +1,121 @@
+package logic
+
+import (
+	"strings"
+)
+
+// Zhuyin (Bopomofo) for pinyin initials
+var zhuyinInitials = map[string]string{
+	"b": "ㄅ", "p": "ㄆ", "m": "ㄇ", "f": "ㄈ", "d": "ㄉ", "t": "ㄊ", "n": "ㄋ", "l": "ㄌ",
+	"g": "ㄍ", "k": "ㄎ", "h": "ㄏ", "j": "ㄐ", "q": "ㄑ", "x": "ㄒ",
+	"zh": "ㄓ", "ch": "ㄔ", "sh": "ㄕ", "r": "ㄖ", "z": "ㄗ", "c": "ㄘ", "s": "ㄙ",
+}
+
+// Zhuyin for pinyin finals, in the form returned by splitPinyinSyllable
+var zhuyinFinals = map[string]string{
+	"": "", "a": "ㄚ", "o": "ㄛ", "e": "ㄜ", "ai": "ㄞ", "ei": "ㄟ", "ao": "ㄠ", "ou": "ㄡ",
+	"an": "ㄢ", "en": "ㄣ", "ang": "ㄤ", "eng": "ㄥ", "ong": "ㄨㄥ", "er": "ㄦ",
+	"i": "ㄧ", "ia": "ㄧㄚ", "io": "ㄧㄛ", "ie": "ㄧㄝ", "iao": "ㄧㄠ", "iou": "ㄧㄡ",
+	"ian": "ㄧㄢ", "in": "ㄧㄣ", "iang": "ㄧㄤ", "ing": "ㄧㄥ", "iong": "ㄩㄥ",
+	"u": "ㄨ", "ua": "ㄨㄚ", "uo": "ㄨㄛ", "uai": "ㄨㄞ", "uei": "ㄨㄟ",
+	"uan": "ㄨㄢ", "uen": "ㄨㄣ", "uang": "ㄨㄤ", "ueng": "ㄨㄥ",
+	"v": "ㄩ", "ve": "ㄩㄝ", "van": "ㄩㄢ", "vn": "ㄩㄣ",
+}
+
+// Zhuyin tone marks by tone digit. First tone is unmarked; the neutral tone's mark goes before the syllable.
+var zhuyinToneMarks = map[byte]string{'2': "ˊ", '3': "ˇ", '4': "ˋ"}
+
+const (
+	zhuyinNeutralMark = "˙"
+	zhuyinFirstMark   = "ˉ" // Optional in input
+)
+
+// Gets the Zhuyin for a lower-case pinyin syllable without tone. Returns empty string if syllable has no Zhuyin.
+func tonelessToZhuyin(syll string) string {
+	switch syll {
+	case "ng":
+		return "ㄫ"
+	case "r":
+		return "ㄦ"
+	}
+	initial, final, ok := splitPinyinSyllable(syll)
+	if !ok {
+		return ""
+	}
+	// The i in zhi, chi, shi, ri, zi, ci, si is not written
+	if final == "i" && isRetroflexOrSibilant(initial) {
+		return zhuyinInitials[initial]
+	}
+	return zhuyinInitials[initial] + zhuyinFinals[final]
+}
+
+// Gets the Zhuyin for a lower-case numbered pinyin syllable, with tone mark. Returns empty string if syllable has no Zhuyin.
+func numToZhuyin(num string) string {
+	toneless := strings.TrimRight(num, "12345")
+	res := tonelessToZhuyin(toneless)
+	if res == "" {
+		return ""
+	}
+	if toneless == num || strings.HasSuffix(num, "5") {
+		return zhuyinNeutralMark + res
+	}
+	return res + zhuyinToneMarks[num[len(num)-1]]
+}
+
+// Checks if a rune is a Zhuyin letter or tone mark.
+func isZhuyin(r rune) bool {
+	return r >= 0x3105 && r <= 0x312f || r >= 0x31a0 && r <= 0x31bf ||
+		strings.ContainsRune(zhuyinNeutralMark+zhuyinFirstMark+"ˊˇˋ", r)
+}
+
+// Converts the Zhuyin in text into numbered pinyin; leaves everything else as it is.
+// Syllables without tone mark are in the first tone.
+func (p *pinyin) zhuyinToNum(text string) string {
+	runes := []rune(text)
+	var sb strings.Builder
+	for ix := 0; ix < len(runes); {
+		neutral := false
+		start := ix
+		if string(runes[ix]) == zhuyinNeutralMark {
+			neutral = true
+			ix++
+		}
+		// Longest Zhuyin syllable
+		syll := ""
+		for length := 4; length > 0 && syll == ""; length-- {
+			if ix+length <= len(runes) {
+				if num, ok := p.zhuyin2Num[string(runes[ix:ix+length])]; ok {
+					syll = num
+					ix += length
+				}
+			}
+		}
+		if syll == "" {
+			sb.WriteRune(runes[start])
+			ix = start + 1
+			continue
+		}
+		tone := "1"
+		if ix < len(runes) {
+			switch string(runes[ix]) {
+			case "ˊ":
+				tone = "2"
+			case "ˇ":
+				tone = "3"
+			case "ˋ":
+				tone = "4"
+			case zhuyinNeutralMark:
+				neutral = true
+			case zhuyinFirstMark:
+			default:
+				ix--
+			}
+			ix++
+		}
+		if neutral {
+			tone = ""
+		}
+		sb.WriteString(syll + tone)
+	}
+	return sb.String()
+}
@@ -100,3 +100,8 @@ func handleAuthLogout(c *gin.Context) {
 	c.String(http.StatusOK, "bye")
 }
 
+
+// Issues a single-use ticket for opening the socket; see checkSockAuth.
+func handleAuthSockTicket(c *gin.Context) {
+	c.String(http.StatusOK, logic.TheApp.ASM.IssueSocketTicket(getCheckedSessionId(c)))
+}
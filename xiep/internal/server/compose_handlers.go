@@ -5,12 +5,22 @@ import (
 	"net/http"
 	"strings"
 	"time"
+	"unicode/utf8"
 	"xiep/internal/logic"
 )
 
 type composeResult struct {
 	PinyinSylls []string `json:"pinyinSylls"`
 	Words [][]string `json:"words"`
+	// Candidates for each word if the prompt is best read as several words; the first item in Words is made of
+	// each segment's first candidate
+	Segments [][]string `json:"segments,omitempty"`
+	// If any item in Words has pinyin other than the prompt as typed, like a word whose tones were left out,
+	// the pinyin of each item in Words; empty for items that match the prompt exactly
+	Pinyins []string `json:"pinyins,omitempty"`
+	// If there are completions of the prompt among Words, the pinyin of each item in Words; empty for items
+	// that match the prompt as typed
+	Completions []string `json:"completions,omitempty"`
 }
 
 func handleCompose(c *gin.Context) {
@@ -36,7 +46,39 @@ func handleCompose(c *gin.Context) {
 		}
 	}
 
+	// Candidates are boosted for the user's recent picks if they are logged in; auth is not required here
+	userKey := getCheckedSessionId(c)
+
 	var cr composeResult
-	cr.PinyinSylls, cr.Words = logic.TheApp.Composer.Resolve(prompt, isSimp)
+	cr.PinyinSylls, cr.Words, cr.Segments, cr.Pinyins, cr.Completions = logic.TheApp.Composer.Resolve(prompt, isSimp, userKey)
 	c.JSON(http.StatusOK, cr)
 }
+
+func handleComposePick(c *gin.Context) {
+	word, ok := requireParam(c, "word", true)
+	if !ok {
+		return
+	}
+	logic.TheApp.Composer.RecordPick(getCheckedSessionId(c), word)
+	c.String(http.StatusOK, "OK")
+}
+
+// Longest text, in characters, that is annotated in one request
+const maxAnnotateLength = 100000
+
+func handleComposeAnnotate(c *gin.Context) {
+	text, ok1 := requireParam(c, "text", true)
+	isSimpStr, ok2 := requireParam(c, "isSimp", true)
+	if !ok1 || !ok2 {
+		return
+	}
+	if isSimpStr != "true" && isSimpStr != "false" {
+		c.String(http.StatusBadRequest, "Wrong value for isSimp parameter; true or false is expected.")
+		return
+	}
+	if utf8.RuneCountInString(text) > maxAnnotateLength {
+		c.String(http.StatusBadRequest, "Text is too long.")
+		return
+	}
+	c.JSON(http.StatusOK, logic.TheApp.Composer.Annotate(text, isSimpStr == "true"))
+}
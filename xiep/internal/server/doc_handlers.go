@@ -7,6 +7,7 @@ import (
 	"os"
 	"path"
 	"regexp"
+	"xiep/internal/docx"
 	"xiep/internal/logic"
 )
 
@@ -16,12 +17,13 @@ type resultWrapper struct {
 }
 
 func handleDocOpen(c *gin.Context) {
-	//sessionId := c.Value("sessionId").(string)
 	docId, ok := requireParam(c, "docId", false)
 	if !ok {
 		return
 	}
-	sessionKey := logic.TheApp.Orchestrator.RequestSession(docId)
+	// Optional: name to show to other editors of the document
+	displayName := c.Query("displayName")
+	sessionKey := logic.TheApp.Docs.RequestSession(docId, getCheckedSessionId(c), displayName)
 	if sessionKey == "" {
 		c.String(http.StatusNotFound, "Document not found.")
 		return
@@ -29,12 +31,24 @@ func handleDocOpen(c *gin.Context) {
 	sendDocSuccess(c, sessionKey)
 }
 
+func handleDocEditors(c *gin.Context) {
+	docId, ok := requireParam(c, "docId", false)
+	if !ok {
+		return
+	}
+	result := resultWrapper{
+		Result: "OK",
+		Data:   logic.TheApp.Docs.GetDocEditors(docId),
+	}
+	c.JSON(http.StatusOK, result)
+}
+
 func handleDocCreate(c *gin.Context) {
 	name, ok := requireParam(c, "name", true)
 	if !ok {
 		return
 	}
-	if docId, err := logic.TheApp.Orchestrator.CreateDocument(name); err != nil {
+	if docId, err := logic.TheApp.Docs.CreateDocument(name); err != nil {
 		panic(fmt.Sprintf("Failed to create document: %v", err))
 	} else {
 		sendDocSuccess(c, docId)
@@ -46,16 +60,50 @@ func handleDocDelete(c *gin.Context) {
 	if !ok {
 		return
 	}
-	logic.TheApp.Orchestrator.DeleteDocument(docId)
+	// Optional: name of the user deleting the document, recorded in the trash
+	deletedBy := c.PostForm("displayName")
+	logic.TheApp.Docs.DeleteDocument(docId, deletedBy)
 	sendDocSuccess(c, docId)
 }
 
+func handleDocRestore(c *gin.Context) {
+	docId, ok := requireParam(c, "docId", true)
+	if !ok {
+		return
+	}
+	if !logic.TheApp.Docs.RestoreDocument(docId) {
+		c.String(http.StatusNotFound, "Document not found in trash.")
+		return
+	}
+	sendDocSuccess(c, docId)
+}
+
+func handleDocTrash(c *gin.Context) {
+	result := resultWrapper{
+		Result: "OK",
+		Data:   logic.TheApp.Docs.ListTrash(),
+	}
+	c.JSON(http.StatusOK, result)
+}
+
 func handleDocExportDocx(c *gin.Context) {
 	docId, ok := requireParam(c, "docId", true)
 	if !ok {
 		return
 	}
-	downloadId := logic.TheApp.Orchestrator.ExportDocx(docId)
+	// Optional; pinyin with citation tones if missing
+	var opts docx.Options
+	opts.Romanization = c.PostForm("romanization")
+	if opts.Romanization != "" && !docx.IsRomanization(opts.Romanization) {
+		c.String(http.StatusBadRequest, "Wrong value for romanization parameter.")
+		return
+	}
+	opts.Sandhi = c.PostForm("sandhi")
+	if !docx.IsSandhiMode(opts.Sandhi) {
+		c.String(http.StatusBadRequest, "Wrong value for sandhi parameter.")
+		return
+	}
+	downloadId := logic.TheApp.Docs.ExportDocx(docId, opts)
 	if downloadId == "" {
 		c.String(http.StatusNotFound, "Document not found.")
 		return
@@ -63,6 +111,23 @@ func handleDocExportDocx(c *gin.Context) {
 	sendDocSuccess(c, downloadId)
 }
 
+func handleDocReadings(c *gin.Context) {
+	docId, ok := requireParam(c, "docId", false)
+	if !ok {
+		return
+	}
+	report := logic.TheApp.Docs.CheckReadings(docId)
+	if report == nil {
+		c.String(http.StatusNotFound, "Document not found.")
+		return
+	}
+	result := resultWrapper{
+		Result: "OK",
+		Data:   report,
+	}
+	c.JSON(http.StatusOK, result)
+}
+
 func handleDocDownload(c *gin.Context) {
 	name, ok := requireParam(c, "name", false)
 	if !ok {
@@ -84,7 +149,7 @@ func handleDocDownload(c *gin.Context) {
 		c.String(http.StatusNotFound, "File does not exist.")
 		return
 	}
-	fileName := logic.TheApp.Orchestrator.GetDocumentName(docId)
+	fileName := logic.TheApp.Docs.GetDocumentName(docId)
 	if fileName == "" {
 		fileName = docId
 	}
@@ -35,18 +35,29 @@ func initHandlers(r *gin.Engine) {
 	rAuth := r.Group("/api/auth")
 	rAuth.Use(checkAuth)
 	rAuth.POST("/logout/", handleAuthLogout)
+	rAuth.POST("/sockticket/", handleAuthSockTicket)
 	// api/doc enpoints
 	rDoc := r.Group("/api/doc/")
 	rDoc.Use(checkAuth)
 	rDoc.GET("/open/", handleDocOpen)
+	rDoc.GET("/editors/", handleDocEditors)
 	rDoc.POST("/create/", handleDocCreate)
 	rDoc.POST("/delete/", handleDocDelete)
+	rDoc.POST("/restore/", handleDocRestore)
+	rDoc.GET("/trash/", handleDocTrash)
 	rDoc.POST("/exportdocx/", handleDocExportDocx)
+	rDoc.GET("/readings/", handleDocReadings)
 	rDoc.GET("/download/", handleDocDownload)
-	// api/compose endpoint
-	r.GET("/api/compose/", handleCompose)
+	// api/compose endpoints; recording picks requires authentication, so we know whose they are
+	r.GET("/api/compose/", checkOptionalAuth, handleCompose)
+	r.POST("/api/compose/pick/", checkAuth, handleComposePick)
+	r.POST("/api/compose/annotate/", checkAuth, handleComposeAnnotate)
 	// Websocket at /sock
-	r.GET("/sock/", handleSock).Use(checkAuth)
+	r.GET("/sock/", checkSockAuth, handleSock)
+	// Other instances in the cluster authenticate with the cluster key, not with users' sessions
+	if h := logic.TheApp.ClusterHandler(); h != nil {
+		r.POST(logic.ClusterPathPrefix+"*op", gin.WrapH(h))
+	}
 }
 
 func initContent(r *gin.Engine) {
@@ -65,6 +76,7 @@ func initContent(r *gin.Engine) {
 func initInfra(r *gin.Engine, logger common.XieLogger) {
 
 	xlog = logger
+	initAllowedOrigins()
 
 	r.Use(gin.LoggerWithFormatter(func(param gin.LogFormatterParams) string {
 		msg := fmt.Sprintf("%d %s %s %s %s",
@@ -122,35 +134,87 @@ func addCacheHeaders(c *gin.Context) {
 
 func checkAuth(c *gin.Context) {
 
+	sessionId, fromCookie, errMsg := getAuthSessionId(c)
 	fail := func(msg string) {
 		//c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
-		deleteAuthCookie(c.Writer)
+		// A bad bearer token says nothing about the cookie, which may still hold a valid session
+		if fromCookie {
+			deleteAuthCookie(c.Writer)
+		}
 		c.String(http.StatusUnauthorized, msg)
 		c.Abort()
 	}
 
+	if errMsg != "" {
+		fail(errMsg)
+		return
+	}
+	expiry := logic.TheApp.ASM.Check(sessionId)
+	if expiry.IsZero() {
+		fail("session expired")
+		return
+	}
+	c.Set(common.SessionIdKey, sessionId)
+	c.Next()
+}
+
+// Authenticates the websocket upgrade. Browsers cannot set headers on websocket requests,
+// so besides what checkAuth accepts, a ticket from /api/auth/sockticket/ is accepted in the query string.
+func checkSockAuth(c *gin.Context) {
+	ticket := c.Query(common.SocketTicketParam)
+	if ticket == "" {
+		checkAuth(c)
+		return
+	}
+	sessionId := logic.TheApp.ASM.RedeemSocketTicket(ticket)
+	if sessionId == "" || logic.TheApp.ASM.Check(sessionId).IsZero() {
+		c.String(http.StatusUnauthorized, "invalid socket ticket")
+		c.Abort()
+		return
+	}
+	c.Set(common.SessionIdKey, sessionId)
+	c.Next()
+}
+
+// Identifies the user if the request carries a valid auth session, but lets the request through either way.
+func checkOptionalAuth(c *gin.Context) {
+	sessionId, _, errMsg := getAuthSessionId(c)
+	if errMsg == "" && !logic.TheApp.ASM.Check(sessionId).IsZero() {
+		c.Set(common.SessionIdKey, sessionId)
+	}
+	c.Next()
+}
+
+// Retrieves the auth session ID from the request, without checking if the session is valid.
+// A bearer header takes precedence over the cookie; fromCookie tells which one the ID came from.
+// If no ID can be retrieved, returns a non-empty error message.
+func getAuthSessionId(c *gin.Context) (sessionId string, fromCookie bool, errMsg string) {
+	if hdr := c.GetHeader("Authorization"); strings.HasPrefix(hdr, "Bearer ") {
+		if token := strings.TrimSpace(hdr[7:]); token != "" {
+			return token, false, ""
+		}
+	}
 	cookie, err := c.Request.Cookie(common.AuthCookieName)
 	if err != nil {
-		fail("missing cookie")
-		return
+		return "", false, "missing cookie"
 	}
 	cookieVal, err := url.QueryUnescape(cookie.Value)
 	if err != nil {
-		fail("cannot query-unescape cookie value")
-		return
+		return "", true, "cannot query-unescape cookie value"
 	}
 	var asc authSessionCookie
 	if err := asc.UnmarshalJSON([]byte(cookieVal)); err != nil {
-		fail("cannot parse json in cookie")
-		return
+		return "", true, "cannot parse json in cookie"
 	}
-	expiry := logic.TheApp.ASM.Check(asc.ID)
-	if expiry.IsZero() {
-		fail("session expired")
-		return
+	return asc.ID, true, ""
+}
+
+// Retrieves the auth session ID that checkAuth stored in the context, or empty string.
+func getCheckedSessionId(c *gin.Context) string {
+	if sessionId, ok := c.Get(common.SessionIdKey); ok {
+		return sessionId.(string)
 	}
-	c.Set(common.SessionIdKey, asc.ID)
-	c.Next()
+	return ""
 }
 
 // Retrieves a POST or GET param. If param is not present, sets BadRequest and returns false.
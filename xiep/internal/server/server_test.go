@@ -0,0 +1,68 @@
+package server
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"xiep/internal/common"
+)
+
+func TestCheckAuth_CookieDeletion(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	cookieVal := url.QueryEscape(`{"id":"stale","expiry":"2030-01-01T00:00:00Z"}`)
+	vals := []struct {
+		bearer        string
+		deletesCookie bool
+	}{
+		// Bad cookie: client should forget it
+		{"", true},
+		// Bad bearer token: the cookie was not checked, so it stays
+		{"badtoken", false},
+	}
+	for _, val := range vals {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodGet, "/api/doc/open/", nil)
+		c.Request.AddCookie(&http.Cookie{Name: common.AuthCookieName, Value: cookieVal})
+		if val.bearer != "" {
+			c.Request.Header.Set("Authorization", "Bearer "+val.bearer)
+		}
+		checkAuth(c)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("Expected 401 with bearer %q, got %v", val.bearer, w.Code)
+		}
+		deleted := strings.Contains(w.Header().Get("Set-Cookie"), common.AuthCookieName+"=;")
+		if deleted != val.deletesCookie {
+			t.Errorf("With bearer %q, expected cookie deletion %v, got %v", val.bearer, val.deletesCookie, deleted)
+		}
+	}
+}
+
+func TestCheckSockAuth_RejectsBadTicket(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodGet, "/sock/?"+common.SocketTicketParam+"=nonexistent", nil)
+	checkSockAuth(c)
+	if w.Code != http.StatusUnauthorized || !c.IsAborted() {
+		t.Errorf("Expected socket upgrade with unknown ticket to be rejected")
+	}
+}
+
+func TestCheckOptionalAuth_IgnoresUnknownSession(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodGet, "/api/compose/?prompt=ni&isSimp=true", nil)
+	c.Request.Header.Set("Authorization", "Bearer madeup")
+	checkOptionalAuth(c)
+	if c.IsAborted() {
+		t.Errorf("Request without valid session rejected")
+	}
+	if sessionId := getCheckedSessionId(c); sessionId != "" {
+		t.Errorf("Unknown session taken for user: %v", sessionId)
+	}
+}
@@ -3,7 +3,12 @@ package server
 import (
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
+	"net"
 	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
 	"xiep/internal/common"
 	"xiep/internal/logic"
 )
@@ -11,19 +16,59 @@ import (
 // http://arlimus.github.io/articles/gin.and.gorilla/
 // https://developpaper.com/golang-gin-framework-with-websocket/
 
+// Origins allowed to open a websocket; filled from config at startup.
+// Values are lower-case hosts (with port if any), or full origins with scheme.
+var allowedOrigins map[string]bool
+
+const (
+	sockPongWaitSec   = 60 // Peer must show a sign of life (pong or any message) this often, or it's considered dead
+	sockPingPeriodSec = 25 // Frequency of pings sent to peer; must be less than sockPongWaitSec
+	sockWriteWaitSec  = 10 // Time allowed to write a message to the peer
+)
+
 var wsupgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
+	ReadBufferSize:    1024,
+	WriteBufferSize:   1024,
+	Subprotocols:      logic.SupportedSubprotocols,
+	EnableCompression: true, // permessage-deflate, if the client offers it
 	CheckOrigin: func(r *http.Request) bool {
-		allowed := false
-		if r.Host == config.WebSocketAllowedOrigin {
-			allowed= true
-		}
-		xlog.Logf(common.LogSrcSocketHandler, "Websocket request from %v; allowed: %v", r.Host, allowed)
+		origin := r.Header.Get("Origin")
+		allowed := isOriginAllowed(origin)
+		xlog.Logf(common.LogSrcSocketHandler, "Websocket request from origin %v; allowed: %v", origin, allowed)
 		return allowed
 	},
 }
 
+// Collects allowed websocket origins from the config.
+func initAllowedOrigins() {
+	allowedOrigins = make(map[string]bool)
+	origins := config.WebSocketAllowedOrigins
+	if config.WebSocketAllowedOrigin != "" {
+		origins = append(origins, config.WebSocketAllowedOrigin)
+	}
+	for _, o := range origins {
+		o = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(o), "/"))
+		if o != "" {
+			allowedOrigins[o] = true
+		}
+	}
+}
+
+// Checks the value of a request's Origin header against the configured list.
+// An entry without a scheme matches the origin's host with any scheme.
+func isOriginAllowed(origin string) bool {
+	if origin == "" {
+		return false
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	host := strings.ToLower(u.Host)
+	full := strings.ToLower(u.Scheme) + "://" + host
+	return allowedOrigins[host] || allowedOrigins[full]
+}
+
 func handleSock(c *gin.Context) {
 
 	xlog.Logf(common.LogSrcSocketHandler, "Incoming request at socket endpoint; upgrading to websocket")
@@ -40,10 +85,27 @@ func handleSock(c *gin.Context) {
 		}
 	}()
 
-	receive, send, closeConn := logic.TheApp.ConnectionManager.NewConnection(c.ClientIP())
+	xlog.Logf(common.LogSrcSocketHandler, "Negotiated subprotocol: '%v'", conn.Subprotocol())
+
+	receive, send, closeConn := logic.TheApp.ConnectionManager.NewConnection(c.ClientIP(), getCheckedSessionId(c), conn.Subprotocol())
+	frameType := websocket.TextMessage
+	if logic.IsBinarySubprotocol(conn.Subprotocol()) {
+		frameType = websocket.BinaryMessage
+	}
+
+	// Peer must answer our pings in time; otherwise the read below fails and we learn the connection is dead
+	// Any message from the peer also counts as a sign of life
+	_ = conn.SetReadDeadline(time.Now().Add(sockPongWaitSec * time.Second))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(sockPongWaitSec * time.Second))
+	})
+
+	// Closed by the listening goroutine when the socket can no longer be read
+	readerDone := make(chan struct{})
 
 	// Spawn separate goroutine for listening
 	go func() {
+		defer close(readerDone)
 		defer func() {
 			if r := recover(); r != nil {
 				xlog.Logf(common.LogSrcSocketHandler, "Panic while processing message: %v", r)
@@ -51,6 +113,8 @@ func handleSock(c *gin.Context) {
 				if err != nil {
 					xlog.Logf(common.LogSrcSocketHandler, "Error closing socket after panic: %v", err)
 				}
+				// Let connection manager know this peer is gone
+				receive(nil)
 			}
 		}()
 		for {
@@ -58,6 +122,8 @@ func handleSock(c *gin.Context) {
 			if err != nil {
 				if websocket.IsCloseError(err, 1000, 1001, 1005) {
 					xlog.Logf(common.LogSrcSocketHandler, "Socket closing with expected code: %v", err)
+				} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					xlog.Logf(common.LogSrcSocketHandler, "Peer missed heartbeat; dropping connection")
 				} else {
 					xlog.Logf(common.LogSrcSocketHandler, "Error reading from socket: %v", err)
 				}
@@ -65,27 +131,96 @@ func handleSock(c *gin.Context) {
 				receive(nil)
 				break
 			}
-			if t != websocket.TextMessage {
-				xlog.Logf(common.LogSrcSocketHandler, "Received message type %v on socket; only text messages expected", t)
-				closeConn<- "Protocol violation: only text messages allowed"
+			_ = conn.SetReadDeadline(time.Now().Add(sockPongWaitSec * time.Second))
+			if t != frameType {
+				xlog.Logf(common.LogSrcSocketHandler, "Received message type %v on socket; only type %v expected", t, frameType)
+				select {
+				case closeConn <- "Protocol violation: wrong websocket message type for negotiated subprotocol":
+				default:
+					// Connection manager has already asked for the socket to be closed
+				}
+				receive(nil)
 				break
 			}
-			msgStr := string(msg)
-			receive(&msgStr)
+			if msg == nil {
+				msg = []byte{}
+			}
+			receive(msg)
 		}
 	}()
+
+	writeToSocket(conn, frameType, send, closeConn, readerDone)
+}
+
+// Writes messages, and pings the peer periodically, until either side is done with the socket.
+// readerDone must be closed once the socket can no longer be read.
+func writeToSocket(conn *websocket.Conn, frameType int, send <-chan []byte, closeConn <-chan string, readerDone <-chan struct{}) {
+	writeMessage := func(msg []byte) bool {
+		_ = conn.SetWriteDeadline(time.Now().Add(sockWriteWaitSec * time.Second))
+		if err := conn.WriteMessage(frameType, msg); err != nil {
+			xlog.Logf(common.LogSrcSocketHandler, "Error writing to socket: %v", err)
+			// Closing the socket makes the listener fail and report the peer gone
+			_ = conn.Close()
+			<-readerDone
+			return false
+		}
+		return true
+	}
+	pingTicker := time.NewTicker(sockPingPeriodSec * time.Second)
+	defer pingTicker.Stop()
 	for {
 		select {
 		case msg := <-send:
-			if err := conn.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
-				xlog.Logf(common.LogSrcSocketHandler, "Error writing to socket: %v", err)
-				break
+			if !writeMessage(msg) {
+				return
+			}
+		case <-pingTicker.C:
+			deadline := time.Now().Add(sockWriteWaitSec * time.Second)
+			if err := conn.WriteControl(websocket.PingMessage, nil, deadline); err != nil {
+				xlog.Logf(common.LogSrcSocketHandler, "Error sending ping to socket: %v", err)
+				_ = conn.Close()
+				<-readerDone
+				return
 			}
 		case msg := <-closeConn:
-			if err := conn.WriteMessage(websocket.CloseMessage, []byte(msg)); err != nil {
+			// Messages queued before the close request, like the error that caused it, go out first
+			for flushed := false; !flushed; {
+				select {
+				case queued := <-send:
+					if !writeMessage(queued) {
+						return
+					}
+				default:
+					flushed = true
+				}
+			}
+			deadline := time.Now().Add(sockWriteWaitSec * time.Second)
+			if err := conn.WriteControl(websocket.CloseMessage, formatCloseMessage(msg), deadline); err != nil {
 				xlog.Logf(common.LogSrcSocketHandler, "Error sending close message to socket: %v", err)
+				_ = conn.Close()
+			}
+			// Give peer a chance to answer the close frame; the listener reports the peer gone either way
+			select {
+			case <-readerDone:
+			case <-time.After(sockWriteWaitSec * time.Second):
+				_ = conn.Close()
+				<-readerDone
 			}
-			break
+			return
+		case <-readerDone:
+			return
+		}
+	}
+}
+
+// Builds the payload of a close frame: policy violation code, followed by reason truncated to what fits in a control frame.
+func formatCloseMessage(reason string) []byte {
+	const maxReasonLen = 123
+	if len(reason) > maxReasonLen {
+		reason = reason[:maxReasonLen]
+		for !utf8.ValidString(reason) {
+			reason = reason[:len(reason)-1]
 		}
 	}
+	return websocket.FormatCloseMessage(websocket.ClosePolicyViolation, reason)
 }
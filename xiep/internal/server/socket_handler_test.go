@@ -0,0 +1,96 @@
+package server
+
+import (
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"xiep/internal/common"
+	"xiep/internal/logic"
+)
+
+func TestIsOriginAllowed(t *testing.T) {
+	config = &common.Config{
+		WebSocketAllowedOrigin:  "localhost:1313",
+		WebSocketAllowedOrigins: []string{"Xie.example.com", "https://other.example.com/"},
+	}
+	initAllowedOrigins()
+	vals := []struct {
+		origin  string
+		allowed bool
+	}{
+		{"http://localhost:1313", true},
+		{"https://xie.example.com", true},
+		{"http://xie.example.com", true},
+		{"https://other.example.com", true},
+		{"http://other.example.com", false},
+		{"http://localhost:1314", false},
+		{"http://evil.com", false},
+		{"localhost:1313", false},
+		{"", false},
+	}
+	for _, val := range vals {
+		if isOriginAllowed(val.origin) != val.allowed {
+			t.Errorf("Wrong result for origin %v: expected %v", val.origin, val.allowed)
+		}
+	}
+}
+
+func TestWriteToSocket_ErrorBeforeClose(t *testing.T) {
+	upgrader := websocket.Upgrader{Subprotocols: logic.SupportedSubprotocols}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		receive, send, closeConn := logic.TheApp.ConnectionManager.NewConnection("127.0.0.1", "", conn.Subprotocol())
+		// Handle the first message before writing starts, so the error and the close request are both waiting
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			receive(nil)
+			return
+		}
+		receive(msg)
+		readerDone := make(chan struct{})
+		go func() {
+			defer close(readerDone)
+			for {
+				_, msg, err := conn.ReadMessage()
+				if err != nil {
+					receive(nil)
+					return
+				}
+				receive(msg)
+			}
+		}()
+		writeToSocket(conn, websocket.TextMessage, send, closeConn, readerDone)
+	}))
+	defer srv.Close()
+
+	dialer := websocket.Dialer{Subprotocols: []string{logic.SubprotocolJSONv1}}
+	sockUrl := "ws" + strings.TrimPrefix(srv.URL, "http")
+	// The writer picks between the queued error and the close request at random; try a few times
+	for i := 0; i < 16; i++ {
+		conn, _, err := dialer.Dial(sockUrl, nil)
+		if err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		// Talking before announcing a session key is a fatal error
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"ping","id":"1"}`)); err != nil {
+			t.Fatalf("Failed to send message: %v", err)
+		}
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("Expected error envelope before close frame, got %v", err)
+		}
+		if !strings.Contains(string(msg), `"type":"error"`) || !strings.Contains(string(msg), `"fatal":true`) {
+			t.Errorf("Expected fatal error envelope, got %v", string(msg))
+		}
+		if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+			t.Errorf("Expected close frame after error envelope, got %v", err)
+		}
+		_ = conn.Close()
+	}
+}
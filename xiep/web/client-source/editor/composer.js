@@ -117,6 +117,10 @@ module.exports = (function (elmHost) {
       for (var i = 0; i < data.words.length; ++i) {
         var elm = $("<span></span>");
         elm.text(data.words[i].join(" "));
+        // Words whose tones or syllables are not the input as typed come with their own pinyin
+        if (data.pinyins && data.pinyins[i]) elm.data("pinyin", data.pinyins[i]);
+        // Completion of abbreviated input
+        if (data.completions && data.completions[i]) elm.addClass("completion");
         if (i == 0) elm.addClass("focus");
         _elmSuggestions.append(elm);
       }
@@ -135,9 +139,9 @@ module.exports = (function (elmHost) {
     });
   }
 
-  function constructSuggestion(convertedText) {
-    var hanzi = convertedText;
-    var pinyin = _elmSuggestions.data("pinyinSylls");
+  function constructSuggestion(elmSuggestion) {
+    var hanzi = elmSuggestion.text();
+    var pinyin = elmSuggestion.data("pinyin") || _elmSuggestions.data("pinyinSylls");
     hanzi = hanzi.split(/(\s+)/).filter((e) => e.trim().length > 0);
     pinyin = pinyin.split(/(\s+)/).filter((e) => e.trim().length > 0);
     var result = [];
@@ -146,12 +150,19 @@ module.exports = (function (elmHost) {
     return result;
   }
 
-  function fire(convertedText) {
+  function fire(elmSuggestion) {
 
     var evt = new Event('insert');
     evt.result = null;
     evt.prompt = _prompt;
-    evt.result = constructSuggestion(convertedText);
+    evt.result = constructSuggestion(elmSuggestion);
+
+    // Tell server what we picked so it ranks these characters higher next time; no harm if this fails
+    $.ajax({
+      url: "/api/compose/pick/",
+      type: "POST",
+      data: { word: elmSuggestion.text() },
+    });
 
     close(true);
 
@@ -177,7 +188,7 @@ module.exports = (function (elmHost) {
     if (_elmSuggestions.find("span.sel").length == 0) return null;
     return {
       prompt: _prompt,
-      result: constructSuggestion(_elmSuggestions.find("span.sel").text()),
+      result: constructSuggestion(_elmSuggestions.find("span.sel")),
     };
   }
 
@@ -188,14 +199,14 @@ module.exports = (function (elmHost) {
   function onSuggestionClick(e) {
     e.preventDefault();
     e.stopPropagation();
-    fire($(this).text());
+    fire($(this));
   }
 
   function onKeyDown(e) {
     var handled = false;
     switch (e.code) {
       case "Enter":
-        fire(_elmSuggestions.find("span.sel").text());
+        fire(_elmSuggestions.find("span.sel"));
         handled = true;
         break;
       case "Escape":
@@ -9,6 +9,8 @@ const htmlHanziCaret = '<div class="caret hanzi hidden">&nbsp;</div>';
 const htmlPinyinCaret = '<div class="caret pinyin hidden">&nbsp;</div>';
 const htmlHiddenInput = '<input type="text" id="hiddenInput" autofocus="autofocus"/>';
 const htmlComposer = '<div class="composer"></div>';
+// Longest wait for the server to add pinyin to pasted text; after that, it's inserted without pinyin
+const annotateTimeoutMsec = 10000;
 
 module.exports = (function (elmHost, shortcutHandler, wordcountChangeHandler) {
   var _elmHost = elmHost;
@@ -32,6 +34,9 @@ module.exports = (function (elmHost, shortcutHandler, wordcountChangeHandler) {
   };
   var _caretInterval = null;
   var _composer = null;
+  // True while pasted text is with the server for pinyin: input and selection changes are ignored until then,
+  // so the text goes where it was pasted
+  var _pasting = false;
 
   init();
   setContent([]);
@@ -132,14 +137,29 @@ module.exports = (function (elmHost, shortcutHandler, wordcountChangeHandler) {
     _suppressHiddenInfputChange = true;
     _elmHiddenInput.val("");
     _suppressHiddenInfputChange = false;
+    if (_pasting) return;
     // When typing a single punctuation mark, or a space:
     // Insert current suggestion, if any
+    // Except for a colon after u, which is how ü can be typed
     var sugg = _composer.getSuggestion();
-    if (sugg && _sel.end == _sel.start && /^[\s\p{Punctuation}]$/u.test(val)) {
+    if (sugg && _sel.end == _sel.start && /^[\s\p{Punctuation}]$/u.test(val) && !isUmlautColon(val, sugg.prompt)) {
       onComposerInsert(sugg);
       _composer.close();
     }
+    // Pasted Chinese text: let server add pinyin
+    if (val.length > 1 && /\p{Script=Han}/u.test(val)) {
+      insertAnnotated(val);
+      return;
+    }
     // Insert characters into text. This also gracefully handles pasting into hidden input field.
+    insertPlain(val);
+  }
+
+  function isUmlautColon(val, prompt) {
+    return val == ":" && prompt.length > 0 && /^[uU]$/.test(prompt[prompt.length - 1].hanzi);
+  }
+
+  function insertPlain(val) {
     let text = [];
     for (const c of val) text.push({ hanzi: c });
     const prompt = replaceSel(text);
@@ -147,6 +167,30 @@ module.exports = (function (elmHost, shortcutHandler, wordcountChangeHandler) {
     updateComposer(prompt);
   }
 
+  function insertAnnotated(val) {
+    _pasting = true;
+    _composer.close();
+    var req = $.ajax({
+      url: "/api/compose/annotate/",
+      type: "POST",
+      timeout: annotateTimeoutMsec,
+      data: {
+        text: val,
+        isSimp: _inputType != "trad",
+      }
+    });
+    req.done(function (data) {
+      _pasting = false;
+      replaceSel(data);
+      _composer.close();
+    });
+    // Better without pinyin than not at all
+    req.fail(function () {
+      _pasting = false;
+      insertPlain(val);
+    });
+  }
+
   function updateComposer(prompt) {
     if (prompt.length == 0) {
       _composer.close();
@@ -179,7 +223,7 @@ module.exports = (function (elmHost, shortcutHandler, wordcountChangeHandler) {
 
   function onMouseDown(e) {
     // We only care about left button.
-    if (e.originalEvent.buttons != 1) return;
+    if (e.originalEvent.buttons != 1 || _pasting) return;
     const pos = getContentIxFromCoords(e.originalEvent.x, e.originalEvent.y);
     if (pos.ix == -1) return;
     const ix = pos.before ? pos.ix : pos.ix + 1;
@@ -206,6 +250,10 @@ module.exports = (function (elmHost, shortcutHandler, wordcountChangeHandler) {
   }
 
   function onKeyDown(e) {
+    if (_pasting) {
+      e.preventDefault();
+      return;
+    }
     if (_composer.isVisible()) {
       if (_composer.onKeyDown(e))
         return;
@@ -301,7 +349,8 @@ module.exports = (function (elmHost, shortcutHandler, wordcountChangeHandler) {
         const char = sPara.text[i];
         if (!char) continue;
         if (char.pinyin && char.pinyin != "") break;
-        if (/\p{Punctuation}/u.test(char.hanzi)) break;
+        const prev = i > 0 ? sPara.text[i - 1] : null;
+        if (/\p{Punctuation}/u.test(char.hanzi) && !(prev && isUmlautColon(char.hanzi, [prev]))) break;
         if (/\s/.test(char.hanzi)) break;
         prompt.unshift(char);
       }
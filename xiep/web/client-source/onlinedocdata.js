@@ -4,6 +4,10 @@ var CS = require('./editor/changeset');
 
 const pingInterval = 15000;
 const sendChangeInterval = 500;
+// Delays before successive attempts to resume the session after the socket drops; server keeps it for 60 seconds
+const resumeDelays = [1000, 2000, 5000, 10000, 20000];
+// Local storage key prefix for the last known server text of each document
+const cacheKeyPrefix = "online-doc-cache-";
 
 module.exports = (function (sessionKey, docId) {
 
@@ -26,8 +30,22 @@ module.exports = (function (sessionKey, docId) {
   var _displaySel = null;
   var _displaySelChangedLocally = false;
   var _sendChangeInterval = null;
+  var _cachedRevisionId = -1;
+  var _cachedText = null;
+  var _closing = false;
+  var _resuming = false;
+  var _resumeAttempts = 0;
+  var _resumeTimeout = null;
 
   function startSession(cbStart, cbTragedy, cbUpdate) {
+    _startCB = cbStart;
+    _tragedyCB = cbTragedy;
+    _updateCB = cbUpdate;
+    openSocket();
+  }
+
+  function openSocket() {
+    _resumeTimeout = null;
     let sockUrl = window.location.protocol.startsWith("https") ? "wss://" : "ws://";
     sockUrl += window.location.host;
     sockUrl += "/sock/";
@@ -36,25 +54,45 @@ module.exports = (function (sessionKey, docId) {
     _ws.onclose = onSocketClose;
     _ws.onerror = onSocketError;
     _ws.onmessage = onSocketMessage;
-    _startCB = cbStart;
-    _tragedyCB = cbTragedy;
-    _updateCB = cbUpdate;
   }
 
   function closeSession() {
+    stopTimers();
+    clearTimeout(_resumeTimeout);
+    _resumeTimeout = null;
+    _closing = true;
+    _tragedyCB = null;
+    if (_baseText != null) saveCachedText();
+    if (_ws) _ws.close();
+    _wsOpen = false;
+    _ws = null;
+  }
+
+  function stopTimers() {
     clearInterval(_pingInterval);
     clearInterval(_sendChangeInterval);
     _pingInterval = null;
     _sendChangeInterval = null;
-    _tragedyCB = null;
-    _ws.close();
-    _wsOpen = false;
-    _ws = null;
+  }
+
+  function startTimers() {
+    stopTimers();
+    _pingInterval = setInterval(doPing, pingInterval);
+    _sendChangeInterval = setInterval(doSendChange, sendChangeInterval);
   }
 
   function onSocketOpen() {
     _wsOpen = true;
-    _ws.send("SESSIONKEY " + _sessionKey);
+    // Socket dropped while we were editing: pick up the session where we left off
+    if (_baseText != null) {
+      _resuming = true;
+      _ws.send("RESUME " + _sessionKey + " " + _revisionId);
+      return;
+    }
+    // Opening the document: if we have a copy from earlier, we only need the changes since then
+    loadCachedText();
+    if (_cachedText != null) _ws.send("SESSIONKEY " + _sessionKey + " " + _cachedRevisionId);
+    else _ws.send("SESSIONKEY " + _sessionKey);
   };
 
   function onSocketClose(e) {
@@ -62,12 +100,15 @@ module.exports = (function (sessionKey, docId) {
     if (e.reason) closeReason = "Server said: " + e.reason;
     else closeReason = "Server said nothing.";
     _wsOpen = false;
+    if (_closing) return;
     if (_startCB != null) {
       let cb = _startCB;
       _startCB = null;
       cb(closeReason);
     }
-    else shoutTragedy(closeReason);
+    // Server refused to resume our session: no point in trying again
+    else if (_resuming && e.reason) shoutTragedy(closeReason);
+    else tryResume(closeReason);
   }
 
   function onSocketError() {
@@ -78,7 +119,47 @@ module.exports = (function (sessionKey, docId) {
       _startCB = null;
       cb(closeReason);
     }
-    else shoutTragedy(closeReason);
+    // Otherwise, the socket is closing too, and we try to resume from there
+  }
+
+  function tryResume(closeReason) {
+    stopTimers();
+    _ws = null;
+    if (_resumeAttempts == resumeDelays.length) {
+      shoutTragedy(closeReason);
+      return;
+    }
+    _resumeTimeout = setTimeout(openSocket, resumeDelays[_resumeAttempts]);
+    ++_resumeAttempts;
+  }
+
+  function loadCachedText() {
+    _cachedRevisionId = -1;
+    _cachedText = null;
+    try {
+      const cacheJson = localStorage.getItem(cacheKeyPrefix + _docId);
+      if (!cacheJson) return;
+      const cache = JSON.parse(cacheJson);
+      _cachedRevisionId = cache.revisionId;
+      _cachedText = cache.text;
+    }
+    catch (e) {
+      _cachedRevisionId = -1;
+      _cachedText = null;
+    }
+  }
+
+  // Remembers the latest revision we got from the server, without our own unacknowledged changes
+  function saveCachedText() {
+    if (_revisionId == _cachedRevisionId) return;
+    const text = _receivedChanges == null ? _baseText : CS.apply(_baseText, _receivedChanges);
+    try {
+      localStorage.setItem(cacheKeyPrefix + _docId, JSON.stringify({ revisionId: _revisionId, text: text }));
+      _cachedRevisionId = _revisionId;
+    }
+    catch (e) {
+      // Out of storage: we will simply get the full text next time
+    }
   }
 
   function updateDocInfoLocally() {
@@ -103,7 +184,19 @@ module.exports = (function (sessionKey, docId) {
   function processHello(detail) {
     const data = JSON.parse(detail);
     _name = data.name;
-    _baseText = data.text;
+    // Server only sent what changed since our cached copy
+    if (data.text == null) {
+      try {
+        _baseText = CS.apply(_cachedText, data.change);
+      }
+      catch (e) {
+        // Our copy was not what we thought it was; forget it so reloading gets the full text
+        localStorage.removeItem(cacheKeyPrefix + _docId);
+        throw e;
+      }
+    }
+    else _baseText = data.text;
+    _cachedText = null;
     _revisionId = data.revisionId;
     _peerSelections = data.peerSelections;
     if (_startCB != null) {
@@ -119,8 +212,47 @@ module.exports = (function (sessionKey, docId) {
       });
       updateDocInfoLocally();
     }
-    _pingInterval = setInterval(doPing, pingInterval);
-    _sendChangeInterval = setInterval(doSendChange, sendChangeInterval);
+    saveCachedText();
+    startTimers();
+  }
+
+  function processResumed(detail) {
+    const data = JSON.parse(detail);
+    _resuming = false;
+    _resumeAttempts = 0;
+    const serverText = _receivedChanges == null ? _baseText : CS.apply(_baseText, _receivedChanges);
+    let cs = data.change == null ? CS.makeIdent(serverText.length) : data.change;
+    if (_sentChanges != null) {
+      if (data.lastOwnRevisionId > _revisionId) {
+        // Our last change made it before the socket dropped, and it is part of the change set we got.
+        // Treat it as acknowledged, and only take what the others did on top of it.
+        const sentText = CS.apply(serverText, _sentChanges);
+        cs = makeDiff(sentText, CS.apply(serverText, cs));
+        _receivedChanges = _receivedChanges == null ? _sentChanges : CS.compose(_receivedChanges, _sentChanges);
+      }
+      else {
+        // Our last change was lost: it goes out again with our other local changes
+        _localChanges = _localChanges == null ? _sentChanges : CS.compose(_sentChanges, _localChanges);
+      }
+      _sentChanges = null;
+      _sentChangesFromId = -1;
+    }
+    _peerSelections = data.peerSelections;
+    const editorChanges = receiveChanges(cs, data.revisionId);
+    updateEditor(editorChanges);
+    startTimers();
+  }
+
+  // Returns a change set that replaces the part where two texts differ.
+  function makeDiff(textA, textB) {
+    let prefixLen = 0;
+    while (prefixLen < textA.length && prefixLen < textB.length &&
+      CS.chrCmp(textA[prefixLen], textB[prefixLen]) == 0) ++prefixLen;
+    let suffixLen = 0;
+    while (suffixLen < textA.length - prefixLen && suffixLen < textB.length - prefixLen &&
+      CS.chrCmp(textA[textA.length - suffixLen - 1], textB[textB.length - suffixLen - 1]) == 0) ++suffixLen;
+    const newText = textB.slice(prefixLen, textB.length - suffixLen);
+    return CS.addReplace(CS.makeIdent(textA.length), prefixLen, textA.length - suffixLen, newText);
   }
 
   function forwardPeerSelections() {
@@ -167,7 +299,13 @@ module.exports = (function (sessionKey, docId) {
       shoutTragedy("Received changeset to next revision " + newRevisionId + " but our current revision is " + _revisionId);
       return;
     }
-    // Process change set
+    const editorChanges = receiveChanges(cs, newRevisionId);
+    updateEditor(editorChanges);
+  }
+
+  // Takes in a change set from the server that moves our head text to newRevisionId.
+  // Returns the change set that updates the editor's content, which also has our sent and local changes.
+  function receiveChanges(cs, newRevisionId) {
     let newReceivedChanges = _receivedChanges == null ? cs : CS.compose(_receivedChanges, cs);
     let newSentChanges = null;
     if (_sentChanges != null) newSentChanges = CS.follow(cs, _sentChanges);
@@ -194,7 +332,10 @@ module.exports = (function (sessionKey, docId) {
     _sentChanges = newSentChanges;
     _localChanges = newLocalChanges;
     _revisionId = newRevisionId;
+    return editorChanges;
+  }
 
+  function updateEditor(editorChanges) {
     _updateCB(function (currText, selStart, selEnd) {
       let poss = [selStart, selEnd];
       let newText = CS.apply(currText, editorChanges, poss);
@@ -234,6 +375,7 @@ module.exports = (function (sessionKey, docId) {
       if (ixSpace != -1) verb = msg.substring(0, ixSpace);
       if (msg.startsWith("HELLO ")) processHello(msg.substring(6));
       else if (msg.startsWith("UPDATE ")) processUpdate(msg.substring(7));
+      else if (msg.startsWith("RESUMED ")) processResumed(msg.substring(8));
       else if (msg.startsWith("ACKCHANGE ")) processAckChange(msg.substring(10));
     }
     catch (e) {
@@ -244,6 +386,7 @@ module.exports = (function (sessionKey, docId) {
   function doPing() {
     if (_ws && _wsOpen)
       _ws.send("PING");
+    saveCachedText();
   }
 
   function doSendChange() {
@@ -205,13 +205,15 @@ module.exports = (function (elmHost, path, navigateTo) {
     _header = null;
   }
 
-  function onExportDoc() {
+  function onExportDoc(e) {
     _header.$set({ docxEnabled: false });
     var req = $.ajax({
       url: "/api/doc/exportdocx/",
       type: "POST",
       data: {
         docId: _id,
+        romanization: e.detail.romanization,
+        sandhi: e.detail.sandhi,
       }
     });
     req.done(function (data) {